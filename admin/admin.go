@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// autoPauseReason prefixes the reason of consumers paused by AutoPause, so
+// that it only resumes consumers which it paused
+const autoPauseReason = "auto-pause: "
+
+// Consumer is the part of a kafka.ConsumerGroup which can be paused
+type Consumer interface {
+	Pause(reason string)
+	Resume()
+	PauseState() kafka.PauseState
+}
+
+// NewHandler returns a handler reporting (on GET) the PauseState of each of
+// consumers, and which, on a POST with action=pause (and an optional reason)
+// or action=resume, pauses or resumes them all before reporting. A POST must
+// be authorized by token, as "Authorization: Bearer <token>", and is refused
+// if token is empty.
+func NewHandler(token string, consumers ...Consumer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if token == "" {
+				http.Error(w, "Pausing consumers is disabled, as there is no ADMIN_API_TOKEN", http.StatusForbidden)
+				return
+			} else if !authorized(r, token) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "A bearer token is needed to pause or resume consumers", http.StatusUnauthorized)
+				return
+			}
+			switch action := r.FormValue("action"); action {
+			case "pause":
+				reason := r.FormValue("reason")
+				if reason == "" {
+					reason = "paused by operator"
+				}
+				for _, consumer := range consumers {
+					consumer.Pause(reason)
+				}
+			case "resume":
+				for _, consumer := range consumers {
+					consumer.Resume()
+				}
+			default:
+				http.Error(w, fmt.Sprintf("Unknown action %q, expected pause or resume", action), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		states := make([]kafka.PauseState, len(consumers))
+		for i, consumer := range consumers {
+			states[i] = consumer.PauseState()
+		}
+		body, err := json.Marshal(states)
+		if err != nil {
+			log.Error(err, nil)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(body)
+	}
+}
+
+// authorized reports whether r has token, as "Authorization: Bearer <token>"
+func authorized(r *http.Request, token string) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) == 1
+}
+
+// AutoPause, when AUTO_PAUSE_INTERVAL_MS is set, calls check (e.g. of a
+// downstream database) at that interval, pausing consumers while it fails and
+// resuming them once it passes. Consumers paused by an operator are left
+// paused. The returned func stops the checks.
+func AutoPause(check func() error, consumers ...Consumer) (func() error, error) {
+	intervalMs, err := utils.GetEnvironmentVariableInt("AUTO_PAUSE_INTERVAL_MS", 0)
+	if err != nil {
+		return nil, fmt.Errorf("Bad value for AUTO_PAUSE_INTERVAL_MS: %s", err)
+	}
+	if intervalMs <= 0 {
+		return func() error { return nil }, nil
+	}
+	log.Info(fmt.Sprintf("Checking dependencies every %dms, to pause consumers while failing", intervalMs), nil)
+	quit := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		paused := make([]bool, len(consumers))
+		for {
+			select {
+			case <-ticker.C:
+				autoPause(check(), consumers, paused)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() error {
+		quit <- true
+		return nil
+	}, nil
+}
+
+// autoPause pauses, after a failed check, those consumers not already paused
+// and, after a passing check, resumes those it paused. paused records which
+// consumers it has paused. A consumer resumed by an operator is not paused
+// again until the check has passed.
+func autoPause(checkErr error, consumers []Consumer, paused []bool) {
+	for i, consumer := range consumers {
+		if checkErr != nil {
+			if !paused[i] && !consumer.PauseState().Paused {
+				consumer.Pause(autoPauseReason + checkErr.Error())
+				paused[i] = true
+			}
+			continue
+		}
+		if paused[i] {
+			if strings.HasPrefix(consumer.PauseState().Reason, autoPauseReason) {
+				consumer.Resume()
+			}
+			paused[i] = false
+		}
+	}
+}
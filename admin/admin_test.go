@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+)
+
+type testConsumer struct {
+	state kafka.PauseState
+}
+
+func (c *testConsumer) Pause(reason string) {
+	c.state = kafka.PauseState{Paused: true, Reason: reason}
+}
+
+func (c *testConsumer) Resume() {
+	c.state = kafka.PauseState{}
+}
+
+func (c *testConsumer) PauseState() kafka.PauseState {
+	return c.state
+}
+
+func TestHandlerPausesAndResumes(t *testing.T) {
+	consumer := &testConsumer{}
+	handler := NewHandler("secret", consumer)
+	post := func(target string) *http.Request {
+		r := httptest.NewRequest("POST", target, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, post("/admin/consumers?action=pause&reason=rds+failover"))
+	if !consumer.state.Paused || consumer.state.Reason != "rds failover" || !strings.Contains(w.Body.String(), `"paused":true`) {
+		t.Errorf("Test failed, got %+v, response %s", consumer.state, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, post("/admin/consumers?action=resume"))
+	if consumer.state.Paused {
+		t.Errorf("Test failed, still paused, response %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, post("/admin/consumers?action=stop"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Test failed, got status %d for an unknown action", w.Code)
+	}
+}
+
+func TestHandlerNeedsToken(t *testing.T) {
+	consumer := &testConsumer{}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/admin/consumers?action=pause", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	NewHandler("secret", consumer)(w, r)
+	if w.Code != http.StatusUnauthorized || consumer.state.Paused {
+		t.Errorf("Test failed, got status %d with the wrong token, paused %v", w.Code, consumer.state.Paused)
+	}
+
+	w = httptest.NewRecorder()
+	NewHandler("", consumer)(w, httptest.NewRequest("POST", "/admin/consumers?action=pause", nil))
+	if w.Code != http.StatusForbidden || consumer.state.Paused {
+		t.Errorf("Test failed, got status %d without a token, paused %v", w.Code, consumer.state.Paused)
+	}
+
+	w = httptest.NewRecorder()
+	NewHandler("", consumer)(w, httptest.NewRequest("GET", "/admin/consumers", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Test failed, got status %d for a GET", w.Code)
+	}
+}
+
+func TestAutoPauseLeavesOperatorPauses(t *testing.T) {
+	auto, operator := &testConsumer{}, &testConsumer{}
+	consumers := []Consumer{auto, operator}
+	paused := make([]bool, len(consumers))
+	operator.Pause("paused by operator")
+
+	autoPause(errors.New("connection refused"), consumers, paused)
+	if auto.state.Reason != autoPauseReason+"connection refused" || operator.state.Reason != "paused by operator" {
+		t.Errorf("Test failed, got %+v and %+v", auto.state, operator.state)
+	}
+
+	autoPause(nil, consumers, paused)
+	if auto.state.Paused || !operator.state.Paused {
+		t.Errorf("Test failed, got %+v and %+v", auto.state, operator.state)
+	}
+}
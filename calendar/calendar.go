@@ -0,0 +1,245 @@
+package calendar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Entry is a release read from a calendar. It names its collection by id
+// and/or path, and may list the uris it publishes.
+type Entry struct {
+	Uid            string    `json:"uid,omitempty"`
+	Title          string    `json:"title,omitempty"`
+	CollectionId   string    `json:"collectionId,omitempty"`
+	CollectionPath string    `json:"collectionPath,omitempty"`
+	ReleaseTime    time.Time `json:"releaseTime"`
+	Uris           []string  `json:"uris,omitempty"`
+}
+
+// the calendar formats
+const (
+	ICalendar = "ical"
+	CSV       = "csv"
+)
+
+// releaseZone is the zone of release times given without one
+const releaseZone = "Europe/London"
+
+// FormatOf returns the format of a calendar file, from its extension
+func FormatOf(filename string) (string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".ics", ".ical", ".ifb":
+		return ICalendar, nil
+	case ".csv":
+		return CSV, nil
+	}
+	return "", fmt.Errorf("Cannot tell the calendar format of %q, expected .ics or .csv", filename)
+}
+
+// Parse reads the entries of a calendar in format (ICalendar or CSV)
+func Parse(r io.Reader, format string) ([]Entry, error) {
+	switch format {
+	case ICalendar:
+		return ParseICalendar(r)
+	case CSV:
+		return ParseCSV(r)
+	}
+	return nil, fmt.Errorf("Unknown calendar format %q, expected %s or %s", format, ICalendar, CSV)
+}
+
+// ParseICalendar reads the VEVENTs of an iCalendar (RFC 5545) file. An event's
+// DTSTART is its release time, and its collection is given by the properties
+// X-ONS-COLLECTION-ID and/or X-ONS-COLLECTION-PATH. Its uris are given by
+// X-ONS-URI, which may be repeated or hold a comma-separated list.
+func ParseICalendar(r io.Reader) ([]Entry, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	var entry *Entry
+	for i, line := range lines {
+		name, params, value, err := parseProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", i+1, err)
+		}
+		if name == "BEGIN" && strings.EqualFold(value, "VEVENT") {
+			entry = &Entry{}
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		switch name {
+		case "END":
+			if strings.EqualFold(value, "VEVENT") {
+				if entry.ReleaseTime.IsZero() {
+					return nil, fmt.Errorf("Line %d: event %q has no DTSTART", i+1, entry.Uid)
+				}
+				entries = append(entries, *entry)
+				entry = nil
+			}
+		case "UID":
+			entry.Uid = unescape(value)
+		case "SUMMARY":
+			entry.Title = unescape(value)
+		case "X-ONS-COLLECTION-ID":
+			entry.CollectionId = unescape(value)
+		case "X-ONS-COLLECTION-PATH":
+			entry.CollectionPath = unescape(value)
+		case "X-ONS-URI":
+			entry.Uris = append(entry.Uris, splitText(value)...)
+		case "DTSTART":
+			if entry.ReleaseTime, err = parseDateTime(value, params["TZID"]); err != nil {
+				return nil, fmt.Errorf("Line %d: %s", i+1, err)
+			}
+		}
+	}
+	if entry != nil {
+		return nil, fmt.Errorf("Event %q is not ended", entry.Uid)
+	}
+	return entries, nil
+}
+
+// unfold joins the continuation lines (starting with a space or tab) of an iCalendar file
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// parseProperty splits a content line, NAME;PARAM=VALUE;...:value
+func parseProperty(line string) (string, map[string]string, string, error) {
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, "", fmt.Errorf("No ':' in %q", line)
+	}
+	parts := strings.Split(line[:colon], ";")
+	params := make(map[string]string)
+	for _, param := range parts[1:] {
+		if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, line[colon+1:], nil
+}
+
+// parseDateTime reads an iCalendar DATE-TIME, in UTC ("Z"), in zone tzid, or
+// else (a floating time) in releaseZone
+func parseDateTime(value, tzid string) (time.Time, error) {
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	if len(value) == len("20060102") {
+		return time.Time{}, fmt.Errorf("DTSTART %q has no time of day", value)
+	}
+	if tzid == "" {
+		tzid = releaseZone
+	}
+	zone, err := time.LoadLocation(tzid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation("20060102T150405", value, zone)
+}
+
+// splitText splits an iCalendar TEXT list at its unescaped commas
+func splitText(value string) []string {
+	var items []string
+	var item bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			item.WriteByte(value[i])
+			item.WriteByte(value[i+1])
+			i++
+		} else if value[i] == ',' {
+			items = append(items, unescape(item.String()))
+			item.Reset()
+		} else {
+			item.WriteByte(value[i])
+		}
+	}
+	return append(items, unescape(item.String()))
+}
+
+func unescape(value string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, `;`, `\,`, `,`, `\n`, "\n", `\N`, "\n").Replace(value)
+}
+
+// ParseCSV reads a CSV file with a header row naming its columns:
+// release_time (required), collection_id, collection_path, title, uid and uris
+// (separated by spaces). A release time is RFC3339, or "2006-01-02 15:04" in
+// UK time.
+func ParseCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the header row: %s", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["release_time"]; !ok {
+		return nil, fmt.Errorf("No release_time column in %v", header)
+	}
+	zone, err := time.LoadLocation(releaseZone)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		entry := Entry{
+			Uid:            field("uid"),
+			Title:          field("title"),
+			CollectionId:   field("collection_id"),
+			CollectionPath: field("collection_path"),
+			Uris:           strings.Fields(field("uris")),
+		}
+		releaseTime := field("release_time")
+		if entry.ReleaseTime, err = time.Parse(time.RFC3339, releaseTime); err != nil {
+			if entry.ReleaseTime, err = time.ParseInLocation("2006-01-02 15:04", releaseTime, zone); err != nil {
+				return nil, fmt.Errorf("Row %d: bad release_time %q, expected e.g. 2017-03-01T09:30:00Z or 2017-03-01 09:30", row, releaseTime)
+			}
+		}
+		entries = append(entries, entry)
+	}
+}
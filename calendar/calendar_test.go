@@ -0,0 +1,67 @@
+package calendar
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseICalendar(t *testing.T) {
+	ics := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:release-1\r\n" +
+		"SUMMARY:Labour market\\, March\r\n" +
+		"DTSTART;TZID=Europe/London:20170301T093000\r\n" +
+		"X-ONS-COLLECTION-ID:labourmarket-0001\r\n" +
+		"X-ONS-URI:/employment/bulletin,/employment/\r\n" +
+		" dataset\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:release-2\r\n" +
+		"DTSTART:20170701T083000Z\r\n" +
+		"X-ONS-COLLECTION-PATH:gdp\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	entries, err := ParseICalendar(strings.NewReader(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{
+		{Uid: "release-1", Title: "Labour market, March", CollectionId: "labourmarket-0001", ReleaseTime: time.Date(2017, 3, 1, 9, 30, 0, 0, time.UTC), Uris: []string{"/employment/bulletin", "/employment/dataset"}},
+		{Uid: "release-2", CollectionPath: "gdp", ReleaseTime: time.Date(2017, 7, 1, 8, 30, 0, 0, time.UTC)},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Test failed, got %+v", entries)
+	}
+	for i := range want {
+		if !entries[i].ReleaseTime.Equal(want[i].ReleaseTime) {
+			t.Errorf("Test failed, entry %d released at %s, expected %s", i, entries[i].ReleaseTime, want[i].ReleaseTime)
+		}
+		entries[i].ReleaseTime = want[i].ReleaseTime
+		if !reflect.DeepEqual(entries[i], want[i]) {
+			t.Errorf("Test failed, got %+v, expected %+v", entries[i], want[i])
+		}
+	}
+
+	if _, err = ParseICalendar(strings.NewReader("BEGIN:VEVENT\nUID:x\nDTSTART;VALUE=DATE:20170301\nEND:VEVENT\n")); err == nil {
+		t.Error("Test failed, expected an error for a release with no time of day")
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	entries, err := ParseCSV(strings.NewReader("collection_id,release_time,uris\n" +
+		"labourmarket-0001,2017-07-01 09:30,/employment/bulletin /employment/dataset\n" +
+		"gdp-0001,2017-03-01T09:30:00Z,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].CollectionId != "labourmarket-0001" || len(entries[0].Uris) != 2 ||
+		!entries[0].ReleaseTime.Equal(time.Date(2017, 7, 1, 8, 30, 0, 0, time.UTC)) || !entries[1].ReleaseTime.Equal(time.Date(2017, 3, 1, 9, 30, 0, 0, time.UTC)) {
+		t.Errorf("Test failed, got %+v", entries)
+	}
+
+	if _, err = ParseCSV(strings.NewReader("collection_id,release_time\ngdp-0001,tomorrow\n")); err == nil {
+		t.Error("Test failed, expected an error for a bad release_time")
+	}
+}
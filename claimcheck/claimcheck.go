@@ -0,0 +1,106 @@
+package claimcheck
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/s3"
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+// objectStore is the part of s3.S3Client used to stage content
+type objectStore interface {
+	PutObject(location string, content []byte) error
+	GetObject(location string) ([]byte, error)
+}
+
+// Store moves the FileContent of large FileCompleteMessages into a staging
+// bucket, leaving the message with a reference (ContentLocation) and checksum
+// (ContentSha256) of the content, so that messages stay small
+type Store struct {
+	objects   objectStore
+	bucket    string
+	threshold int
+}
+
+// NewStore returns a Store for the staging bucket set by CLAIM_CHECK_S3_*.
+// Content over CLAIM_CHECK_THRESHOLD bytes is staged by Check (0, the default,
+// stages nothing), while Resolve reads any staged content.
+func NewStore() (*Store, error) {
+	threshold, err := utils.GetEnvironmentVariableInt("CLAIM_CHECK_THRESHOLD", 0)
+	if err != nil {
+		return nil, fmt.Errorf("Bad value for CLAIM_CHECK_THRESHOLD: %s", err)
+	}
+	bucketName := utils.GetEnvironmentVariable("CLAIM_CHECK_S3_BUCKET", "publish-staging")
+	regionName := utils.GetEnvironmentVariable("CLAIM_CHECK_S3_REGION", "eu-west-1")
+	endpoint := utils.GetEnvironmentVariable("CLAIM_CHECK_S3_URL", "localhost:4000")
+	s3Secure := (utils.GetEnvironmentVariable("CLAIM_CHECK_S3_SECURE", "1") == "1")
+	IAM := (utils.GetEnvironmentVariable("CLAIM_CHECK_S3_IAM", "1") == "1")
+	s3Client, err := s3.CreateClient(regionName, bucketName, endpoint, IAM, s3Secure)
+	if err != nil {
+		return nil, err
+	}
+	if threshold > 0 {
+		if err = s3Client.CreateBucket(regionName); err != nil {
+			return nil, err
+		}
+		log.Info(fmt.Sprintf("Staging content over %d bytes in s3:%s", threshold, bucketName), nil)
+	}
+	return &Store{&s3Client, bucketName, threshold}, nil
+}
+
+// Check stages the FileContent of message, if over the threshold. A nil Store stages nothing.
+func (s *Store) Check(message *kafka.FileCompleteMessage) error {
+	if s == nil || s.threshold <= 0 || len(message.FileContent) <= s.threshold {
+		return nil
+	}
+	content := []byte(message.FileContent)
+	location := path.Join(message.CollectionId, strconv.FormatInt(message.ScheduleId, 10), uuid.NewV1().String())
+	if err := s.objects.PutObject(location, content); err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to stage file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+	message.ContentLocation = "s3://" + s.bucket + "/" + location
+	message.ContentSha256 = checksum(content)
+	message.FileContent = ""
+	log.Trace(fmt.Sprintf("Job %d Collection %q staged %q to %s", message.ScheduleId, message.CollectionId, message.Uri, message.ContentLocation), nil)
+	return nil
+}
+
+// Resolve replaces the ContentLocation of message with the FileContent staged
+// there, after verifying its checksum. A message without a ContentLocation is
+// left as is.
+func (s *Store) Resolve(message *kafka.FileCompleteMessage) error {
+	if message.ContentLocation == "" {
+		return nil
+	}
+	if s == nil {
+		return fmt.Errorf("Job %d Collection %q - File %d is staged, but there is no staging store", message.ScheduleId, message.CollectionId, message.FileId)
+	}
+	bucketPrefix := "s3://" + s.bucket + "/"
+	if !strings.HasPrefix(message.ContentLocation, bucketPrefix) {
+		return fmt.Errorf("Unexpected bucket: wanted %s, for %s", bucketPrefix, message.ContentLocation)
+	}
+	content, err := s.objects.GetObject(message.ContentLocation[len(bucketPrefix):])
+	if err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to read staged file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+	if sum := checksum(content); sum != message.ContentSha256 {
+		return fmt.Errorf("Job %d Collection %q - Checksum mismatch for staged file %d at %s: got %s", message.ScheduleId, message.CollectionId, message.FileId, message.ContentLocation, sum)
+	}
+	message.FileContent = string(content)
+	message.ContentLocation = ""
+	message.ContentSha256 = ""
+	return nil
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,65 @@
+package claimcheck
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+)
+
+type memoryObjects map[string][]byte
+
+func (m memoryObjects) PutObject(location string, content []byte) error {
+	m[location] = content
+	return nil
+}
+
+func (m memoryObjects) GetObject(location string) ([]byte, error) {
+	content, ok := m[location]
+	if !ok {
+		return nil, fmt.Errorf("No such object %s", location)
+	}
+	return content, nil
+}
+
+func TestCheckAndResolve(t *testing.T) {
+	objects := memoryObjects{}
+	store := &Store{objects, "staging", 10}
+	content := `{"type":"bulletin","description":{"title":"Inflation"}}`
+	message := kafka.FileCompleteMessage{ScheduleId: 1, FileId: 2, CollectionId: "test0001", Uri: "/a/data.json", FileContent: content}
+	if err := store.Check(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.FileContent != "" || !strings.HasPrefix(message.ContentLocation, "s3://staging/test0001/1/") || len(message.ContentSha256) != 64 || len(objects) != 1 {
+		t.Fatalf("Test failed, content not staged: %+v", message)
+	}
+
+	if err := store.Resolve(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.FileContent != content || message.ContentLocation != "" {
+		t.Errorf("Test failed, content not resolved: %+v", message)
+	}
+}
+
+func TestSmallContentIsNotStaged(t *testing.T) {
+	store := &Store{memoryObjects{}, "staging", 100}
+	message := kafka.FileCompleteMessage{FileContent: `{"type":"bulletin"}`}
+	if err := store.Check(&message); err != nil || message.FileContent != `{"type":"bulletin"}` || message.ContentLocation != "" {
+		t.Errorf("Test failed, got: %+v %v", message, err)
+	}
+}
+
+func TestResolveRejectsBadChecksum(t *testing.T) {
+	objects := memoryObjects{}
+	store := &Store{objects, "staging", 1}
+	message := kafka.FileCompleteMessage{FileContent: `{"type":"bulletin"}`}
+	store.Check(&message)
+	for location := range objects {
+		objects[location] = []byte(`{"type":"tampered"}`)
+	}
+	if err := store.Resolve(&message); err == nil || !strings.Contains(err.Error(), "Checksum") {
+		t.Errorf("Test failed, expected a checksum error, got: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package clock
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// Clock tells the time, or why it cannot
+type Clock interface {
+	Now() (time.Time, error)
+	Close() error
+}
+
+// Local is the host's clock, trusted to be kept right (e.g. by NTP)
+type Local struct{}
+
+func (Local) Now() (time.Time, error) { return time.Now(), nil }
+
+func (Local) Close() error { return nil }
+
+// Trusted tells the time of a reference server, from the Date of its HTTP
+// responses. The time is read every refresh, and advanced in between on the
+// host's monotonic clock, so that changing the host's wall clock has no
+// effect. Date is to the second, so the time told is up to a second behind.
+type Trusted struct {
+	url     string
+	client  *http.Client
+	maxAge  time.Duration
+	mutex   sync.Mutex
+	date    time.Time // the reference time, as last read
+	readAt  time.Time // when it was read, on the host's (monotonic) clock
+	readErr error
+	quit    chan bool
+	done    chan bool
+}
+
+// New returns the Trusted clock of TRUSTED_CLOCK_URL, read every
+// TRUSTED_CLOCK_REFRESH_SECONDS and no longer trusted once it has not been read
+// for TRUSTED_CLOCK_MAX_AGE_SECONDS. With no TRUSTED_CLOCK_URL, it is the Local clock.
+func New() (Clock, error) {
+	url := utils.GetEnvironmentVariable("TRUSTED_CLOCK_URL", "")
+	if url == "" {
+		log.Info("No TRUSTED_CLOCK_URL, trusting the local clock", nil)
+		return Local{}, nil
+	}
+	refresh, err := utils.GetEnvironmentVariableInt("TRUSTED_CLOCK_REFRESH_SECONDS", 60)
+	if err != nil || refresh <= 0 {
+		return nil, fmt.Errorf("Bad value for TRUSTED_CLOCK_REFRESH_SECONDS: %v", err)
+	}
+	maxAge, err := utils.GetEnvironmentVariableInt("TRUSTED_CLOCK_MAX_AGE_SECONDS", 300)
+	if err != nil || maxAge < refresh {
+		return nil, fmt.Errorf("Bad value for TRUSTED_CLOCK_MAX_AGE_SECONDS, it must be at least TRUSTED_CLOCK_REFRESH_SECONDS: %v", err)
+	}
+	return NewTrusted(url, time.Duration(refresh)*time.Second, time.Duration(maxAge)*time.Second)
+}
+
+// NewTrusted reads the time of url, then keeps reading it every refresh
+func NewTrusted(url string, refresh, maxAge time.Duration) (*Trusted, error) {
+	c := &Trusted{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		maxAge: maxAge,
+		quit:   make(chan bool),
+		done:   make(chan bool),
+	}
+	if err := c.read(); err != nil {
+		return nil, fmt.Errorf("Could not read the trusted clock at %s: %s", url, err)
+	}
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.read(); err != nil {
+					log.ErrorC("Could not read the trusted clock", err, log.Data{"url": url})
+				}
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+	log.Info("Reading the time from the trusted clock", log.Data{"url": url, "offset": c.date.Sub(c.readAt).String()})
+	return c, nil
+}
+
+func (c *Trusted) read() error {
+	resp, err := c.client.Head(c.url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	readAt := time.Now()
+	var date time.Time
+	if err == nil {
+		date, err = http.ParseTime(resp.Header.Get("Date"))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readErr = err
+	if err == nil {
+		c.date, c.readAt = date, readAt
+	}
+	return err
+}
+
+// Now is the reference time, unless it has not been read for too long
+func (c *Trusted) Now() (time.Time, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	age := time.Since(c.readAt)
+	if age > c.maxAge {
+		return time.Time{}, fmt.Errorf("trusted clock not read for %s: %v", age, c.readErr)
+	}
+	return c.date.Add(age), nil
+}
+
+// Close stops reading the time
+func (c *Trusted) Close() error {
+	close(c.quit)
+	<-c.done
+	return nil
+}
@@ -0,0 +1,44 @@
+package clock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrustedClockFollowsReference(t *testing.T) {
+	// the reference is a day ahead of the host
+	reference := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", reference.Format(http.TimeFormat))
+	}))
+
+	c, err := NewTrusted(server.URL, time.Hour, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	now, err := c.Now()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now.Before(reference) || now.After(reference.Add(time.Second)) {
+		t.Errorf("Test failed, expected about %s, got %s", reference, now)
+	}
+
+	// not read again, so no longer trusted
+	server.Close()
+	time.Sleep(150 * time.Millisecond)
+	if _, err = c.Now(); err == nil {
+		t.Error("Test failed, expected an error once the clock was too old")
+	}
+}
+
+func TestTrustedClockNeedsReference(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	if _, err := NewTrusted(server.URL, time.Hour, time.Hour); err == nil {
+		t.Error("Test failed, expected an error without a reference")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/calendar"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// report is the response of the scheduler's import API
+type report struct {
+	DryRun  bool
+	Applied bool
+	Entries []struct {
+		Uid                  string
+		Title                string
+		CollectionId         string
+		ReleaseTime          time.Time
+		Action               string
+		ScheduleId           int64
+		PreviousScheduleTime string
+		Reason               string
+	}
+	Conflicts []struct {
+		ScheduleTime string
+		Collections  []string
+		Uris         []string
+	}
+	Error string
+}
+
+// printDiff writes a line for each entry (prefixed + for a job created, ~ for
+// one moved, ! for one which cannot be imported) and each conflict
+func (r report) printDiff() {
+	for _, entry := range r.Entries {
+		mark := " "
+		switch entry.Action {
+		case "create":
+			mark = "+"
+		case "reschedule":
+			mark = "~"
+		case "unmatched", "ambiguous", "started":
+			mark = "!"
+		}
+		line := fmt.Sprintf("%s %-10s %s %q", mark, entry.Action, entry.ReleaseTime.UTC().Format(time.RFC3339), entry.CollectionId)
+		if entry.ScheduleId != 0 {
+			line += fmt.Sprintf(" job %d", entry.ScheduleId)
+		}
+		if entry.PreviousScheduleTime != "" {
+			line += " from " + entry.PreviousScheduleTime
+		}
+		if entry.Title != "" {
+			line += fmt.Sprintf(" (%s)", entry.Title)
+		}
+		if entry.Reason != "" {
+			line += ": " + entry.Reason
+		}
+		fmt.Println(line)
+	}
+	for _, conflict := range r.Conflicts {
+		fmt.Printf("CONFLICT %s %s share %s\n", conflict.ScheduleTime, strings.Join(conflict.Collections, " and "), strings.Join(conflict.Uris, ", "))
+	}
+}
+
+func main() {
+	log.Namespace = "import-calendar"
+	file := flag.String("file", "", "Calendar file to import (.ics or .csv)")
+	format := flag.String("format", "", "Format of the file, ical or csv (default from its extension)")
+	scheduler := flag.String("scheduler", "http://localhost:8080/schedules", "The scheduler's schedules API")
+	dryRun := flag.Bool("dry-run", false, "Only show what the import would change")
+	token := flag.String("token", os.Getenv("SCHEDULES_API_TOKEN"), "The scheduler's SCHEDULES_API_TOKEN (default from the environment)")
+	flag.Parse()
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "-file is needed")
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	if *format == "" {
+		if *format, err = calendar.FormatOf(*file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	content, err := ioutil.ReadFile(*file)
+	if err != nil {
+		log.ErrorC("Could not read calendar", err, log.Data{"file": *file})
+		os.Exit(1)
+	}
+	// read it here too, so that a bad file is reported without reaching the scheduler
+	entries, err := calendar.Parse(bytes.NewReader(content), *format)
+	if err != nil {
+		log.ErrorC("Could not parse calendar", err, log.Data{"file": *file})
+		os.Exit(1)
+	}
+
+	query := url.Values{"format": {*format}}
+	if *dryRun {
+		query.Set("dryRun", "true")
+	}
+	request, err := http.NewRequest("POST", strings.TrimSuffix(*scheduler, "/")+"/import?"+query.Encode(), bytes.NewReader(content))
+	if err != nil {
+		log.ErrorC("Bad scheduler URL", err, log.Data{"scheduler": *scheduler})
+		os.Exit(2)
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Authorization", "Bearer "+*token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.ErrorC("Could not reach the scheduler", err, log.Data{"scheduler": *scheduler})
+		os.Exit(1)
+	}
+	defer response.Body.Close()
+	var result report
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		log.ErrorC("Could not read the scheduler's response", err, log.Data{"status": response.StatusCode})
+		os.Exit(1)
+	}
+	if result.Error != "" {
+		log.ErrorC("Import failed", fmt.Errorf("%s", result.Error), log.Data{"status": response.StatusCode})
+		os.Exit(1)
+	}
+
+	result.printDiff()
+	data := log.Data{"file": *file, "entries": len(entries), "conflicts": len(result.Conflicts)}
+	switch {
+	case result.DryRun:
+		log.Info("Dry run: nothing imported", data)
+	case !result.Applied:
+		log.ErrorC("Nothing imported", fmt.Errorf("%d conflicts", len(result.Conflicts)), data)
+		os.Exit(1)
+	default:
+		log.Info("Imported calendar", data)
+	}
+}
@@ -1,78 +1,40 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"path/filepath"
-	"strings"
 
-	"github.com/ONSdigital/dp-publish-pipeline/decrypt"
+	"github.com/ONSdigital/dp-publish-pipeline/admin"
+	"github.com/ONSdigital/dp-publish-pipeline/clock"
 	"github.com/ONSdigital/dp-publish-pipeline/health"
 	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/data"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
 	"github.com/ONSdigital/dp-publish-pipeline/s3"
+	"github.com/ONSdigital/dp-publish-pipeline/shutdown"
 	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/go-ns/log"
-	uuid "github.com/satori/go.uuid"
 )
 
-func uploadFile(zebedeeRoot string, jsonMessage []byte, s3UpstreamClient, s3Client s3.S3Client, completeFileProducer, completeFileFlagProducer kafka.Producer) error {
-	var message kafka.PublishFileMessage
-	if err := json.Unmarshal(jsonMessage, &message); err != nil {
-		return fmt.Errorf("Invalid JSON: %q", jsonMessage)
-	}
-	if message.CollectionId == "" || message.FileLocation == "" || message.Uri == "" {
-		return fmt.Errorf("Malformed JSON: %q", jsonMessage)
-	}
-	if strings.HasSuffix(message.FileLocation, ".json") {
-		return nil
-	}
-	var content []byte
-	var contentErr error
-	if strings.HasPrefix(message.FileLocation, "s3://") {
-		bucketPrefix := "s3://" + s3UpstreamClient.Bucket + "/"
-		if !strings.HasPrefix(message.FileLocation, bucketPrefix) {
-			return fmt.Errorf("Unexpected bucket: wanted %s, for %s", bucketPrefix, message.FileLocation)
-		}
-		if message.EncryptionKey != "" {
-			content, contentErr = decrypt.DecryptS3(s3UpstreamClient, message.FileLocation[len(bucketPrefix):], message.EncryptionKey)
-		} else {
-			content, contentErr = s3UpstreamClient.GetObject(message.FileLocation[len(bucketPrefix):])
-		}
-	} else if strings.HasPrefix(message.FileLocation, "file://") {
-		if message.EncryptionKey != "" {
-			content, contentErr = decrypt.DecryptFile(message.FileLocation[7:], message.EncryptionKey)
-		} else {
-			content, contentErr = ioutil.ReadFile(message.FileLocation[7:])
-		}
-	} else {
-		contentErr = fmt.Errorf("Bad FileLocation")
-	}
-	if contentErr != nil {
-		return fmt.Errorf("Job %d Collection %q - Failed to open/decrypt file %d: %s - error %s", message.ScheduleId, message.CollectionId, message.FileId, message.FileLocation, contentErr)
-	}
-	s3Path := filepath.Join(uuid.NewV1().String(), message.CollectionPath, filepath.Base(message.FileLocation))
-	s3Client.AddObject(string(content), s3Path, message.CollectionId, message.ScheduleId)
-	fullS3Path := "s3://" + s3Client.Bucket + "/" + s3Path
-	fileComplete, _ := json.Marshal(kafka.FileCompleteMessage{FileId: message.FileId, ScheduleId: message.ScheduleId, CollectionId: message.CollectionId, Uri: message.Uri, S3Location: fullS3Path})
-	completeFileProducer.Output <- fileComplete
-	fileComplete, _ = json.Marshal(kafka.FileCompleteFlagMessage{FileId: message.FileId, ScheduleId: message.ScheduleId, CollectionId: message.CollectionId, Uri: message.Uri})
-	completeFileFlagProducer.Output <- fileComplete
-
-	return nil
-}
-
 func main() {
 	log.Namespace = "publish-data"
 
-	zebedeeRoot := utils.GetEnvironmentVariable("ZEBEDEE_ROOT", "../test-data/")
 	consumeTopic := utils.GetEnvironmentVariable("CONSUME_TOPIC", "uk.gov.ons.dp.web.publish-file")
 	completeFileTopic := utils.GetEnvironmentVariable("PRODUCE_TOPIC", "uk.gov.ons.dp.web.complete-file")
 	completeFileFlagTopic := utils.GetEnvironmentVariable("COMPLETE_FILE_FLAG_TOPIC", "uk.gov.ons.dp.web.complete-file-flag")
+	fileFailedTopic := utils.GetEnvironmentVariable("FILE_FAILED_TOPIC", "uk.gov.ons.dp.web.file-failed")
+	abortTopic := utils.GetEnvironmentVariable("ABORT_TOPIC", "uk.gov.ons.dp.web.schedule-aborted")
+	embargoTopic := utils.GetEnvironmentVariable("EMBARGO_TOPIC", "uk.gov.ons.dp.web.embargoed")
+	rehearsalTopic := utils.GetEnvironmentVariable("REHEARSAL_TOPIC", "uk.gov.ons.dp.web.rehearsal")
+	dryRunPrefix := utils.GetEnvironmentVariable("DRY_RUN_PREFIX", "dry-run")
+	deadLetterTopic := utils.GetEnvironmentVariable("DEAD_LETTER_TOPIC", "")
 
 	healthCheckAddr := utils.GetEnvironmentVariable("HEALTHCHECK_ADDR", ":8080")
 	healthCheckEndpoint := utils.GetEnvironmentVariable("HEALTHCHECK_ENDPOINT", "/healthcheck")
+	metricsEndpoint := utils.GetEnvironmentVariable("METRICS_ENDPOINT", "/metrics")
+	adminEndpoint := utils.GetEnvironmentVariable("ADMIN_ENDPOINT", "/admin/consumers")
+	adminToken := utils.GetEnvironmentVariable("ADMIN_API_TOKEN", "")
 
 	upstreamBucketName := utils.GetEnvironmentVariable("UPSTREAM_S3_BUCKET", "upstream-content")
 	upstreamRegionName := utils.GetEnvironmentVariable("UPSTREAM_S3_REGION", "eu-west-1")
@@ -97,35 +59,99 @@ func main() {
 	}
 	s3Client.CreateBucket(regionName)
 
-	log.Info(fmt.Sprintf("Starting Publish-Data from %q from %q to %q, %q", zebedeeRoot, consumeTopic, completeFileTopic, completeFileFlagTopic), nil)
+	log.Info(fmt.Sprintf("Starting Publish-Data from %q to %q, %q", consumeTopic, completeFileTopic, completeFileFlagTopic), nil)
 
 	healthChannel := make(chan bool)
 	go func() {
 		http.HandleFunc(healthCheckEndpoint, health.NewHealthChecker(healthChannel, nil))
+		http.HandleFunc(metricsEndpoint, metrics.Handler)
 		log.Info(fmt.Sprintf("Listening for %s on %s", healthCheckEndpoint, healthCheckAddr), nil)
 		log.ErrorC("healthcheck listener exited", http.ListenAndServe(healthCheckAddr, nil), nil)
 		panic("healthcheck listener exited")
 	}()
 
-	consumer, err := kafka.NewConsumerGroup(consumeTopic, "publish-data")
+	if err := kafka.EnsureTopics(
+		kafka.Topic{Role: "publish-file", Name: consumeTopic},
+		kafka.Topic{Role: "complete-file", Name: completeFileTopic},
+		kafka.Topic{Role: "complete-file-flag", Name: completeFileFlagTopic},
+		kafka.Topic{Role: "file-failed", Name: fileFailedTopic},
+		kafka.Topic{Role: "schedule-aborted", Name: abortTopic},
+		kafka.Topic{Role: "rehearsal", Name: rehearsalTopic},
+		kafka.Topic{Role: "embargoed", Name: embargoTopic},
+	); err != nil {
+		log.ErrorC("Could not ensure kafka topics", err, nil)
+		panic(err)
+	}
+	bus := kafka.KafkaBus{}
+	consumer, err := bus.NewConsumerGroup(consumeTopic, "publish-data")
 	if err != nil {
 		log.ErrorC("Could not obtain consumer", err, nil)
 		panic(err)
 	}
-	completeFileProducer := kafka.NewProducer(completeFileTopic)
-	completeFileFlagProducer := kafka.NewProducer(completeFileFlagTopic)
+	consumer.SetDeadLetterTopic(deadLetterTopic, "publish-data")
+	retryPolicy, err := kafka.NewRetryPolicy()
+	if err != nil {
+		log.ErrorC("Could not read retry policy", err, nil)
+		panic(err)
+	}
+	consumer.SetRetryPolicy(retryPolicy)
+	aborted, err := kafka.WatchAbortedSchedules(bus, abortTopic)
+	if err != nil {
+		log.ErrorC("Could not watch for aborted schedules", err, nil)
+		panic(err)
+	}
+	consumer.SetAbortedSchedules(aborted)
+	trustedClock, err := clock.New()
+	if err != nil {
+		log.ErrorC("Could not start the trusted clock", err, nil)
+		panic(err)
+	}
+	embargo, err := kafka.NewEmbargo(bus, trustedClock, embargoTopic, "publish-data")
+	if err != nil {
+		log.ErrorC("Could not read the embargo config", err, nil)
+		panic(err)
+	}
+	consumer.SetEmbargo(embargo)
+	http.HandleFunc(adminEndpoint, admin.NewHandler(adminToken, consumer))
+	fileFailedProducer := bus.NewAckProducer(fileFailedTopic)
+	consumer.SetFailureHandler(kafka.NewFileFailedReporter(fileFailedProducer))
+	completeFileProducer := bus.NewAckProducer(completeFileTopic)
+	completeFileFlagProducer := bus.NewAckProducer(completeFileFlagTopic)
+	recorder := rehearsal.NewRecorder(bus, "publish-data", rehearsalTopic)
+
+	graceful, err := shutdown.New("publish-data")
+	if err != nil {
+		log.ErrorC("Could not prepare for shutdown", err, nil)
+		panic(err)
+	}
+	graceful.Add("close complete-file producer", completeFileProducer.Close)
+	graceful.Add("close complete-file-flag producer", completeFileFlagProducer.Close)
+	graceful.Add("close file-failed producer", fileFailedProducer.Close)
+	graceful.Add("close rehearsal producer", recorder.Close)
+	graceful.OnSignal(consumer.Stop)
+	graceful.Add("close consumer", consumer.Close)
+	graceful.Add("stop watching aborted schedules", aborted.Close)
+	graceful.Add("close embargo", embargo.Close)
+	graceful.Add("stop trusted clock", trustedClock.Close)
+
 	for {
 		select {
 		case consumerMessage := <-consumer.Incoming:
-			if err := uploadFile(zebedeeRoot, consumerMessage.GetData(), s3UpstreamClient, s3Client, completeFileProducer, completeFileFlagProducer); err != nil {
+			if err := consumer.Handle(consumerMessage, func(msg kafka.Message) error {
+				return data.UploadFile(msg.GetData(), s3UpstreamClient, &s3Client, s3Client.Bucket, completeFileProducer, completeFileFlagProducer, recorder, dryRunPrefix)
+			}); err != nil && err != kafka.ErrStopped {
 				log.Error(err, nil)
-			} else {
-				consumerMessage.Commit()
+				if _, unforwarded := err.(kafka.ForwardError); unforwarded {
+					panic(err)
+				}
 			}
 		case errorMessage := <-consumer.Errors:
 			log.Error(fmt.Errorf("Aborting due to consumer error: %v", errorMessage), nil)
 			panic(errorMessage)
 		case <-healthChannel:
+		case <-graceful.Signals:
+			graceful.Shutdown()
+			return
 		}
 	}
 }
@@ -3,23 +3,28 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 
 	elastic "gopkg.in/olivere/elastic.v5"
 
+	"github.com/ONSdigital/dp-publish-pipeline/admin"
 	"github.com/ONSdigital/dp-publish-pipeline/health"
 	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/dp-publish-pipeline/shutdown"
 	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/go-ns/log"
 	_ "github.com/lib/pq"
 )
 
-func publishDelete(jsonMessage []byte, deleteStatement *sql.Stmt, elasticClient *elastic.Client, producer chan []byte) error {
+// publishDelete deletes the content at the uri from postgres and elastic
+// search. For a dry run, it only records how many rows would be deleted.
+func publishDelete(jsonMessage []byte, deleteStatement, countStatement *sql.Stmt, elasticClient *elastic.Client, producer kafka.Producer, recorder *rehearsal.Recorder) error {
 	var message kafka.PublishDeleteMessage
-	err := json.Unmarshal(jsonMessage, &message)
+	envelope, err := kafka.Decode(jsonMessage, &message)
 	if err != nil {
 		return err
 	}
@@ -28,14 +33,29 @@ func publishDelete(jsonMessage []byte, deleteStatement *sql.Stmt, elasticClient
 		return errors.New("Missing json parameters")
 	}
 
-	log.Trace(fmt.Sprintf("Deleting content at %q from postgres from collection %q", message.Uri, message.CollectionId), nil)
-	_, sqlErr := deleteStatement.Exec(message.Uri + "?lang=%")
-	if sqlErr != nil {
-		return sqlErr
-	}
+	if message.DryRun {
+		var rows int64
+		if err = countStatement.QueryRow(message.Uri + "?lang=%").Scan(&rows); err != nil {
+			return err
+		}
+		if err = recorder.Record(kafka.RehearsalMessage{ScheduleId: message.ScheduleId, CollectionId: message.CollectionId, Action: "delete", Uri: message.Uri,
+			Detail: fmt.Sprintf("%d metadata rows, and its search documents", rows)}, kafka.GetCorrelationId(envelope)); err != nil {
+			return err
+		}
+	} else {
+		log.Trace(fmt.Sprintf("Deleting content at %q from postgres from collection %q", message.Uri, message.CollectionId), nil)
+		_, sqlErr := deleteStatement.Exec(message.Uri + "?lang=%")
+		if sqlErr != nil {
+			return sqlErr
+		}
 
-	elasticClient.DeleteByQuery("/ons/_all/_query?q=id:" + message.Uri).Do(context.Background())
-	producer <- jsonMessage
+		elasticClient.DeleteByQuery("/ons/_all/_query?q=id:" + message.Uri).Do(context.Background())
+	}
+	data, err := producer.Encode(kafka.FileCompleteFlagMessage{ScheduleId: message.ScheduleId, DeleteId: message.DeleteId, CollectionId: message.CollectionId, Uri: message.Uri}, kafka.GetCorrelationId(envelope))
+	if err != nil {
+		return err
+	}
+	producer.Output <- data
 	return nil
 }
 
@@ -68,8 +88,14 @@ func main() {
 
 	consumerTopic := utils.GetEnvironmentVariable("DELETE_TOPIC", "uk.gov.ons.dp.web.publish-delete")
 	producerTopic := utils.GetEnvironmentVariable("PUBLISH_DELETE_TOPIC", "uk.gov.ons.dp.web.complete-file-flag")
+	abortTopic := utils.GetEnvironmentVariable("ABORT_TOPIC", "uk.gov.ons.dp.web.schedule-aborted")
+	deadLetterTopic := utils.GetEnvironmentVariable("DEAD_LETTER_TOPIC", "")
 	healthCheckAddr := utils.GetEnvironmentVariable("HEALTHCHECK_ADDR", ":8080")
 	healthCheckEndpoint := utils.GetEnvironmentVariable("HEALTHCHECK_ENDPOINT", "/healthcheck")
+	metricsEndpoint := utils.GetEnvironmentVariable("METRICS_ENDPOINT", "/metrics")
+	adminEndpoint := utils.GetEnvironmentVariable("ADMIN_ENDPOINT", "/admin/consumers")
+	adminToken := utils.GetEnvironmentVariable("ADMIN_API_TOKEN", "")
+	rehearsalTopic := utils.GetEnvironmentVariable("REHEARSAL_TOPIC", "uk.gov.ons.dp.web.rehearsal")
 
 	db, err := createPostgresConnection()
 	if err != nil {
@@ -80,6 +106,8 @@ func main() {
 
 	deleteStatement := prepareSQLStatement("DELETE FROM metadata WHERE uri LIKE $1", db)
 	defer deleteStatement.Close()
+	countStatement := prepareSQLStatement("SELECT count(*) FROM metadata WHERE uri LIKE $1", db)
+	defer countStatement.Close()
 	healthCheckSqlStmt := prepareSQLStatement("SELECT 1 FROM metadata", db)
 	defer healthCheckSqlStmt.Close()
 
@@ -94,30 +122,74 @@ func main() {
 	healthChannel := make(chan bool)
 	go func() {
 		http.HandleFunc(healthCheckEndpoint, health.NewHealthChecker(healthChannel, healthCheckSqlStmt))
+		http.HandleFunc(metricsEndpoint, metrics.Handler)
 		log.Info(fmt.Sprintf("Listening for %s on %s", healthCheckEndpoint, healthCheckAddr), nil)
 		log.ErrorC("healthcheck listener exited", http.ListenAndServe(healthCheckAddr, nil), nil)
 		panic("healthcheck listener exited")
 	}()
 
-	consumer, err := kafka.NewConsumerGroup(consumerTopic, "publish-deletes")
+	if err := kafka.EnsureTopics(
+		kafka.Topic{Role: "publish-delete", Name: consumerTopic},
+		kafka.Topic{Role: "complete-file-flag", Name: producerTopic},
+		kafka.Topic{Role: "schedule-aborted", Name: abortTopic},
+		kafka.Topic{Role: "rehearsal", Name: rehearsalTopic},
+	); err != nil {
+		log.ErrorC("Could not ensure kafka topics", err, nil)
+		panic(err)
+	}
+	bus := kafka.KafkaBus{}
+	consumer, err := bus.NewConsumerGroup(consumerTopic, "publish-deletes")
 	if err != nil {
 		log.Error(err, nil)
 		panic(err)
 	}
-	producer := kafka.NewProducer(producerTopic)
+	consumer.SetDeadLetterTopic(deadLetterTopic, "publish-deleter")
+	aborted, err := kafka.WatchAbortedSchedules(bus, abortTopic)
+	if err != nil {
+		log.ErrorC("Could not watch for aborted schedules", err, nil)
+		panic(err)
+	}
+	consumer.SetAbortedSchedules(aborted)
+	http.HandleFunc(adminEndpoint, admin.NewHandler(adminToken, consumer))
+	stopAutoPause, err := admin.AutoPause(func() error {
+		_, err := healthCheckSqlStmt.Exec()
+		return err
+	}, consumer)
+	if err != nil {
+		log.ErrorC("Could not start auto-pause", err, nil)
+		panic(err)
+	}
+	producer := bus.NewProducer(producerTopic)
+	recorder := rehearsal.NewRecorder(bus, "publish-deleter", rehearsalTopic)
+
+	// the deferred closes of the DB and its statements follow these steps
+	graceful, err := shutdown.New("publish-deleter")
+	if err != nil {
+		log.ErrorC("Could not prepare for shutdown", err, nil)
+		panic(err)
+	}
+	graceful.Add("stop auto-pause", stopAutoPause)
+	graceful.Add("close producer", producer.Close)
+	graceful.Add("close rehearsal producer", recorder.Close)
+	graceful.Add("close consumer", consumer.Close)
+	graceful.Add("stop watching aborted schedules", aborted.Close)
+
 	for {
 		select {
 		case consumerMessage := <-consumer.Incoming:
-			if err := publishDelete(consumerMessage.GetData(), deleteStatement, elasticClient, producer.Output); err != nil {
+			if err := consumer.Handle(consumerMessage, func(msg kafka.Message) error {
+				return publishDelete(msg.GetData(), deleteStatement, countStatement, elasticClient, producer, recorder)
+			}); err != nil {
 				log.Error(err, nil)
 				panic(err)
-			} else {
-				consumerMessage.Commit()
 			}
 		case errorMessage := <-consumer.Errors:
 			log.Error(fmt.Errorf("Aborting: %+v", errorMessage), nil)
 			panic("got consumer error")
 		case <-healthChannel:
+		case <-graceful.Signals:
+			graceful.Shutdown()
+			return
 		}
 	}
 }
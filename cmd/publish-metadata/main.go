@@ -1,77 +1,40 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"strings"
 
-	"github.com/ONSdigital/dp-publish-pipeline/decrypt"
+	"github.com/ONSdigital/dp-publish-pipeline/admin"
+	"github.com/ONSdigital/dp-publish-pipeline/claimcheck"
+	"github.com/ONSdigital/dp-publish-pipeline/clock"
 	"github.com/ONSdigital/dp-publish-pipeline/health"
 	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/metadata"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
 	"github.com/ONSdigital/dp-publish-pipeline/s3"
+	"github.com/ONSdigital/dp-publish-pipeline/shutdown"
 	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/go-ns/log"
 )
 
-func sendData(zebedeeRoot string, jsonMessage []byte, fileProducer, flagProducer kafka.Producer, s3UpstreamClient s3.S3Client) error {
-	var message kafka.PublishFileMessage
-	err := json.Unmarshal(jsonMessage, &message)
-	if err != nil {
-		return fmt.Errorf("Failed to parse json message: %s", err)
-	}
-	if message.FileLocation == "" || message.CollectionId == "" || message.Uri == "" {
-		return fmt.Errorf("Json message missing fields: %s", string(jsonMessage))
-	}
-	if !strings.HasSuffix(message.FileLocation, ".json") {
-		return nil // leave non-metadata for other services
-	}
-
-	var content []byte
-	var contentErr error
-	if strings.HasPrefix(message.FileLocation, "file://") {
-		if message.EncryptionKey != "" {
-			content, contentErr = decrypt.DecryptFile(message.FileLocation[7:], message.EncryptionKey)
-		} else {
-			content, contentErr = ioutil.ReadFile(message.FileLocation[7:])
-		}
-	} else if strings.HasPrefix(message.FileLocation, "s3://") {
-		bucketPrefix := "s3://" + s3UpstreamClient.Bucket + "/"
-		if !strings.HasPrefix(message.FileLocation, bucketPrefix) {
-			return fmt.Errorf("Unexpected bucket: wanted %s, for %s", bucketPrefix, message.FileLocation)
-		}
-		if message.EncryptionKey != "" {
-			content, contentErr = decrypt.DecryptS3(s3UpstreamClient, message.FileLocation[len(bucketPrefix):], message.EncryptionKey)
-		} else {
-			content, contentErr = s3UpstreamClient.GetObject(message.FileLocation[len(bucketPrefix):])
-		}
-	} else {
-		contentErr = fmt.Errorf("Bad FileLocation")
-	}
-	if contentErr != nil {
-		return fmt.Errorf("Job %d Collection %q - Failed to obtain file %d: %q - %s", message.ScheduleId, message.CollectionId, message.FileId, message.FileLocation, contentErr)
-	}
-
-	data, _ := json.Marshal(kafka.FileCompleteMessage{FileId: message.FileId, ScheduleId: message.ScheduleId, Uri: message.Uri, FileContent: string(content), CollectionId: message.CollectionId})
-	fileProducer.Output <- data
-	data, _ = json.Marshal(kafka.FileCompleteFlagMessage{FileId: message.FileId, ScheduleId: message.ScheduleId, Uri: message.Uri, CollectionId: message.CollectionId})
-	flagProducer.Output <- data
-
-	log.Info(fmt.Sprintf("Job %d Collection %q - uri %s", message.ScheduleId, message.CollectionId, message.FileLocation), nil)
-	return nil
-}
-
 func main() {
 	log.Namespace = "publish-metadata"
 
-	zebedeeRoot := utils.GetEnvironmentVariable("ZEBEDEE_ROOT", "../test-data/")
 	consumeTopic := utils.GetEnvironmentVariable("CONSUME_TOPIC", "uk.gov.ons.dp.web.publish-file")
 	completeFileTopic := utils.GetEnvironmentVariable("PRODUCE_TOPIC", "uk.gov.ons.dp.web.complete-file")
 	completeFileFlagTopic := utils.GetEnvironmentVariable("COMPLETE_FILE_FLAG_TOPIC", "uk.gov.ons.dp.web.complete-file-flag")
+	fileFailedTopic := utils.GetEnvironmentVariable("FILE_FAILED_TOPIC", "uk.gov.ons.dp.web.file-failed")
+	abortTopic := utils.GetEnvironmentVariable("ABORT_TOPIC", "uk.gov.ons.dp.web.schedule-aborted")
+	embargoTopic := utils.GetEnvironmentVariable("EMBARGO_TOPIC", "uk.gov.ons.dp.web.embargoed")
+	rehearsalTopic := utils.GetEnvironmentVariable("REHEARSAL_TOPIC", "uk.gov.ons.dp.web.rehearsal")
+	deadLetterTopic := utils.GetEnvironmentVariable("DEAD_LETTER_TOPIC", "")
 
 	healthCheckAddr := utils.GetEnvironmentVariable("HEALTHCHECK_ADDR", ":8080")
 	healthCheckEndpoint := utils.GetEnvironmentVariable("HEALTHCHECK_ENDPOINT", "/healthcheck")
+	metricsEndpoint := utils.GetEnvironmentVariable("METRICS_ENDPOINT", "/metrics")
+	adminEndpoint := utils.GetEnvironmentVariable("ADMIN_ENDPOINT", "/admin/consumers")
+	adminToken := utils.GetEnvironmentVariable("ADMIN_API_TOKEN", "")
 	healthChannel := make(chan bool)
 
 	upstreamBucketName := utils.GetEnvironmentVariable("UPSTREAM_S3_BUCKET", "upstream-content")
@@ -84,18 +47,80 @@ func main() {
 		log.ErrorC("Could not obtain s3 client", err, nil)
 		panic(err)
 	}
+	claims, err := claimcheck.NewStore()
+	if err != nil {
+		log.ErrorC("Could not obtain claim-check store", err, nil)
+		panic(err)
+	}
 
 	log.Info(fmt.Sprintf("Starting Publish-metadata from %q to %q, %q", consumeTopic, completeFileTopic, completeFileFlagTopic), nil)
-	consumer, err := kafka.NewConsumerGroup(consumeTopic, "publish-metadata")
+	if err := kafka.EnsureTopics(
+		kafka.Topic{Role: "publish-file", Name: consumeTopic},
+		kafka.Topic{Role: "complete-file", Name: completeFileTopic},
+		kafka.Topic{Role: "complete-file-flag", Name: completeFileFlagTopic},
+		kafka.Topic{Role: "file-failed", Name: fileFailedTopic},
+		kafka.Topic{Role: "schedule-aborted", Name: abortTopic},
+		kafka.Topic{Role: "rehearsal", Name: rehearsalTopic},
+		kafka.Topic{Role: "embargoed", Name: embargoTopic},
+	); err != nil {
+		log.ErrorC("Could not ensure kafka topics", err, nil)
+		panic(err)
+	}
+	bus := kafka.KafkaBus{}
+	consumer, err := bus.NewConsumerGroup(consumeTopic, "publish-metadata")
 	if err != nil {
 		log.ErrorC("Could not obtain consumer", err, nil)
 		panic(err)
 	}
-	fileProducer := kafka.NewProducer(completeFileTopic)
-	flagProducer := kafka.NewProducer(completeFileFlagTopic)
+	consumer.SetDeadLetterTopic(deadLetterTopic, "publish-metadata")
+	retryPolicy, err := kafka.NewRetryPolicy()
+	if err != nil {
+		log.ErrorC("Could not read retry policy", err, nil)
+		panic(err)
+	}
+	consumer.SetRetryPolicy(retryPolicy)
+	aborted, err := kafka.WatchAbortedSchedules(bus, abortTopic)
+	if err != nil {
+		log.ErrorC("Could not watch for aborted schedules", err, nil)
+		panic(err)
+	}
+	consumer.SetAbortedSchedules(aborted)
+	trustedClock, err := clock.New()
+	if err != nil {
+		log.ErrorC("Could not start the trusted clock", err, nil)
+		panic(err)
+	}
+	embargo, err := kafka.NewEmbargo(bus, trustedClock, embargoTopic, "publish-metadata")
+	if err != nil {
+		log.ErrorC("Could not read the embargo config", err, nil)
+		panic(err)
+	}
+	consumer.SetEmbargo(embargo)
+	fileFailedProducer := bus.NewAckProducer(fileFailedTopic)
+	consumer.SetFailureHandler(kafka.NewFileFailedReporter(fileFailedProducer))
+	fileProducer := bus.NewAckProducer(completeFileTopic)
+	flagProducer := bus.NewAckProducer(completeFileFlagTopic)
+	recorder := rehearsal.NewRecorder(bus, "publish-metadata", rehearsalTopic)
+
+	graceful, err := shutdown.New("publish-metadata")
+	if err != nil {
+		log.ErrorC("Could not prepare for shutdown", err, nil)
+		panic(err)
+	}
+	graceful.Add("close complete-file producer", fileProducer.Close)
+	graceful.Add("close complete-file-flag producer", flagProducer.Close)
+	graceful.Add("close file-failed producer", fileFailedProducer.Close)
+	graceful.Add("close rehearsal producer", recorder.Close)
+	graceful.OnSignal(consumer.Stop)
+	graceful.Add("close consumer", consumer.Close)
+	graceful.Add("stop watching aborted schedules", aborted.Close)
+	graceful.Add("close embargo", embargo.Close)
+	graceful.Add("stop trusted clock", trustedClock.Close)
 
 	go func() {
 		http.HandleFunc(healthCheckEndpoint, health.NewHealthChecker(healthChannel, nil))
+		http.HandleFunc(metricsEndpoint, metrics.Handler)
+		http.HandleFunc(adminEndpoint, admin.NewHandler(adminToken, consumer))
 		log.Info(fmt.Sprintf("Listening for %s on %s", healthCheckEndpoint, healthCheckAddr), nil)
 		log.ErrorC("healthcheck listener exited", http.ListenAndServe(healthCheckAddr, nil), nil)
 		panic("healthcheck listener exited")
@@ -104,14 +129,22 @@ func main() {
 	for {
 		select {
 		case consumerMessage := <-consumer.Incoming:
-			if err := sendData(zebedeeRoot, consumerMessage.GetData(), fileProducer, flagProducer, s3UpstreamClient); err != nil {
+			if err := consumer.Handle(consumerMessage, func(msg kafka.Message) error {
+				return metadata.SendData(msg.GetData(), fileProducer, flagProducer, s3UpstreamClient, claims, recorder)
+			}); err != nil && err != kafka.ErrStopped {
 				log.Error(err, nil)
+				if _, unforwarded := err.(kafka.ForwardError); unforwarded {
+					panic(err)
+				}
+				consumerMessage.Commit()
 			}
-			consumerMessage.Commit()
 		case errorMessage := <-consumer.Errors:
 			log.Error(fmt.Errorf("Aborting: %s", errorMessage), nil)
 			panic(errorMessage)
 		case <-healthChannel:
+		case <-graceful.Signals:
+			graceful.Shutdown()
+			return
 		}
 	}
 }
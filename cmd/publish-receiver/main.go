@@ -2,16 +2,18 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
-	"path/filepath"
-	"strings"
 
+	"github.com/ONSdigital/dp-publish-pipeline/admin"
+	"github.com/ONSdigital/dp-publish-pipeline/claimcheck"
+	"github.com/ONSdigital/dp-publish-pipeline/clock"
 	"github.com/ONSdigital/dp-publish-pipeline/health"
 	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/receiver"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/dp-publish-pipeline/shutdown"
 	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/go-ns/log"
 	_ "github.com/lib/pq"
@@ -19,75 +21,6 @@ import (
 
 const FILE_COMPLETE_TOPIC_ENV = "FILE_COMPLETE_TOPIC"
 
-func storeData(jsonMessage []byte, s3 *sql.Stmt, meta *sql.Stmt) {
-	var dataSet kafka.FileCompleteMessage
-	err := json.Unmarshal(jsonMessage, &dataSet)
-	if err != nil {
-		log.ErrorC("Failed to parse json message", err, nil)
-		return
-	}
-	if dataSet.CollectionId == "" || dataSet.Uri == "" {
-		log.Error(fmt.Errorf("Unknown data from %v", dataSet), nil)
-		return
-	}
-	if dataSet.S3Location != "" {
-		addS3Data(dataSet, s3)
-	} else if dataSet.FileContent != "" {
-		addMetadata(dataSet, meta)
-	}
-}
-
-func addS3Data(dataSet kafka.FileCompleteMessage, s3 *sql.Stmt) {
-	results, err := s3.Query(dataSet.CollectionId,
-		resolveURI(dataSet.Uri),
-		dataSet.S3Location)
-	if err != nil {
-		log.Error(err, nil)
-	} else {
-		log.Trace(fmt.Sprintf("Job %d Collection %q Added S3 : %s", dataSet.ScheduleId, dataSet.CollectionId, dataSet.Uri), nil)
-		results.Close()
-	}
-}
-
-func addMetadata(dataSet kafka.FileCompleteMessage, meta *sql.Stmt) {
-	lang := getLanguage(dataSet.Uri)
-	results, err := meta.Query(dataSet.CollectionId,
-		resolveURI(dataSet.Uri)+"?lang="+lang,
-		dataSet.FileContent)
-	if err != nil {
-		log.Error(err, nil)
-	} else {
-		log.Trace(fmt.Sprintf("Job %d Collection %q Added metadata : %s", dataSet.ScheduleId, dataSet.CollectionId, dataSet.Uri), nil)
-		results.Close()
-	}
-}
-
-func getLanguage(uri string) string {
-	if strings.HasSuffix(uri, "data_cy.json") {
-		return "cy"
-	}
-	return "en"
-}
-
-// Within the zebedee reader it builds the uri based of what it is given. Instead
-// of repeating this per HTTP request, postgrese stores the URI the website expects
-// So the content-api does not need to build the uri each time.
-// Examples :
-//  File location                : URI
-//  data.json                    => / (Special case for root file)
-//  about/data.json              => /about
-//  timeseries/mmg/hhh/data.json => /timeseries/mmg/hhh
-//  trade/report/938438.json     => /trade/report/938438 (Special case for charts)
-func resolveURI(uri string) string {
-	if strings.HasSuffix(uri, "/data.json") || strings.HasSuffix(uri, "/data_cy.json") {
-		webURI := filepath.Dir(uri)
-		return webURI
-	} else if strings.HasSuffix(uri, ".json") {
-		return uri[:len(uri)-5]
-	}
-	return uri
-}
-
 func prep(sql string, db *sql.DB) *sql.Stmt {
 	statement, err := db.Prepare(sql)
 	if err != nil {
@@ -102,56 +35,120 @@ func main() {
 	fileCompleteTopic := utils.GetEnvironmentVariable(FILE_COMPLETE_TOPIC_ENV, "uk.gov.ons.dp.web.complete-file")
 	healthCheckAddr := utils.GetEnvironmentVariable("HEALTHCHECK_ADDR", ":8080")
 	healthCheckEndpoint := utils.GetEnvironmentVariable("HEALTHCHECK_ENDPOINT", "/healthcheck")
+	metricsEndpoint := utils.GetEnvironmentVariable("METRICS_ENDPOINT", "/metrics")
+	adminEndpoint := utils.GetEnvironmentVariable("ADMIN_ENDPOINT", "/admin/consumers")
+	adminToken := utils.GetEnvironmentVariable("ADMIN_API_TOKEN", "")
 	dbSource := utils.GetEnvironmentVariable("DB_ACCESS", "user=dp dbname=dp sslmode=disable")
-
-	fileCompleteConsumer, err := kafka.NewConsumerGroup(fileCompleteTopic, "publish-receiver")
+	deadLetterTopic := utils.GetEnvironmentVariable("DEAD_LETTER_TOPIC", "")
+	rehearsalTopic := utils.GetEnvironmentVariable("REHEARSAL_TOPIC", "uk.gov.ons.dp.web.rehearsal")
+	embargoTopic := utils.GetEnvironmentVariable("EMBARGO_TOPIC", "uk.gov.ons.dp.web.embargoed")
+
+	if err := kafka.EnsureTopics(
+		kafka.Topic{Role: "complete-file", Name: fileCompleteTopic},
+		kafka.Topic{Role: "rehearsal", Name: rehearsalTopic},
+		kafka.Topic{Role: "embargoed", Name: embargoTopic},
+	); err != nil {
+		log.ErrorC("Could not ensure kafka topics", err, nil)
+		panic(err)
+	}
+	bus := kafka.KafkaBus{}
+	fileCompleteConsumer, err := bus.NewConsumerGroup(fileCompleteTopic, "publish-receiver")
 	if err != nil {
 		log.ErrorC("Could not obtain consumer", err, nil)
 		panic(err)
 	}
+	fileCompleteConsumer.SetDeadLetterTopic(deadLetterTopic, "publish-receiver")
+	retryPolicy, err := kafka.NewRetryPolicy()
+	if err != nil {
+		log.ErrorC("Could not read retry policy", err, nil)
+		panic(err)
+	}
+	fileCompleteConsumer.SetRetryPolicy(retryPolicy)
+	trustedClock, err := clock.New()
+	if err != nil {
+		log.ErrorC("Could not start the trusted clock", err, nil)
+		panic(err)
+	}
+	embargo, err := kafka.NewEmbargo(bus, trustedClock, embargoTopic, "publish-receiver")
+	if err != nil {
+		log.ErrorC("Could not read the embargo config", err, nil)
+		panic(err)
+	}
+	fileCompleteConsumer.SetEmbargo(embargo)
+	recorder := rehearsal.NewRecorder(bus, "publish-receiver", rehearsalTopic)
+	claims, err := claimcheck.NewStore()
+	if err != nil {
+		log.ErrorC("Could not obtain claim-check store", err, nil)
+		panic(err)
+	}
 
 	db, err := sql.Open("postgres", dbSource)
 	if err != nil {
 		log.ErrorC("DB open error", err, nil)
 		panic(err)
 	}
+	defer db.Close()
 
-	s3Upsert := "INSERT INTO s3data(collection_id, uri, s3) VALUES($1, $2, $3) " +
-		"ON CONFLICT(uri) DO UPDATE " +
-		"SET (collection_id, s3) = ($1, $3)"
-	s3statement := prep(s3Upsert, db)
-	defer s3statement.Close()
-
-	metaUpsert := "INSERT INTO metadata(collection_id, uri, content) VALUES($1, $2, $3) " +
-		"ON CONFLICT(uri) DO UPDATE " +
-		"SET (collection_id, content) = ($1, $3)"
-	metaStatement := prep(metaUpsert, db)
-	defer metaStatement.Close()
+	store, err := receiver.New(db, claims, recorder)
+	if err != nil {
+		log.ErrorC("Could not prepare the receiver", err, nil)
+		panic(err)
+	}
 
 	healthChannel := make(chan bool)
 	healthCheckSqlPrep := prep("SELECT 1 FROM metadata", db)
+	defer healthCheckSqlPrep.Close()
+	stopAutoPause, err := admin.AutoPause(func() error {
+		_, err := healthCheckSqlPrep.Exec()
+		return err
+	}, fileCompleteConsumer)
+	if err != nil {
+		log.ErrorC("Could not start auto-pause", err, nil)
+		panic(err)
+	}
+
+	// the deferred closes of the DB and its statements follow these steps
+	graceful, err := shutdown.New("publish-receiver")
+	if err != nil {
+		log.ErrorC("Could not prepare for shutdown", err, nil)
+		panic(err)
+	}
+	graceful.Add("stop auto-pause", stopAutoPause)
+	graceful.OnSignal(fileCompleteConsumer.Stop)
+	graceful.Add("close consumer", fileCompleteConsumer.Close)
+	graceful.Add("close receiver", store.Close)
+	graceful.Add("close rehearsal producer", recorder.Close)
+	graceful.Add("close embargo", embargo.Close)
+	graceful.Add("stop trusted clock", trustedClock.Close)
 
 	log.Info("Started publish receiver", log.Data{"topic": fileCompleteTopic})
 
 	go func() {
 		http.HandleFunc(healthCheckEndpoint, health.NewHealthChecker(healthChannel, healthCheckSqlPrep))
+		http.HandleFunc(metricsEndpoint, metrics.Handler)
+		http.HandleFunc(adminEndpoint, admin.NewHandler(adminToken, fileCompleteConsumer))
 		log.Info(fmt.Sprintf("Listening for %s on %s", healthCheckEndpoint, healthCheckAddr), nil)
 		log.ErrorC("healthcheck listener exited", http.ListenAndServe(healthCheckAddr, nil), nil)
 		panic("healthcheck listener exited")
 	}()
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
 	for {
 		select {
 		case consumerMessage := <-fileCompleteConsumer.Incoming:
-			storeData(consumerMessage.GetData(), s3statement, metaStatement)
-			consumerMessage.Commit()
+			if err := fileCompleteConsumer.Handle(consumerMessage, func(msg kafka.Message) error {
+				return store.StoreData(msg.GetData())
+			}); err != nil && err != kafka.ErrStopped {
+				log.Error(err, nil)
+				if _, unforwarded := err.(kafka.ForwardError); unforwarded {
+					panic(err)
+				}
+				consumerMessage.Commit()
+			}
 		case errorMessage := <-fileCompleteConsumer.Errors:
 			log.Error(fmt.Errorf("got consumer error: %s", errorMessage), nil)
 			panic("got consumer error")
-		case <-signals:
-			log.Info("Service stopped", nil)
+		case <-graceful.Signals:
+			graceful.Shutdown()
 			return
 		case <-healthChannel:
 		}
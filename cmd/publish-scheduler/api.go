@@ -0,0 +1,520 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// schedule statuses, from the start and complete times of a job
+const (
+	statusUpcoming  = "upcoming"
+	statusHeld      = "held" // due, but waiting for its dependencies
+	statusRunning   = "running"
+	statusCompleted = "completed"
+	statusAborted   = "aborted"
+)
+
+const maxListLimit = 1000
+
+type scheduleView struct {
+	ScheduleId     int64        `json:"scheduleId"`
+	CollectionId   string       `json:"collectionId"`
+	CollectionPath string       `json:"collectionPath"`
+	Status         string       `json:"status"`
+	ScheduleTime   string       `json:"scheduleTime"`
+	StartTime      string       `json:"startTime,omitempty"`
+	CompleteTime   string       `json:"completeTime,omitempty"`
+	AbortTime      string       `json:"abortTime,omitempty"`
+	HeldTime       string       `json:"heldTime,omitempty"`
+	FlaggedTime    string       `json:"flaggedTime,omitempty"`
+	CalendarUid    string       `json:"calendarUid,omitempty"`
+	DryRun         bool         `json:"dryRun,omitempty"`
+	Files          *fileCounts  `json:"files,omitempty"`
+	Deletes        *fileCounts  `json:"deletes,omitempty"`
+	Dependencies   []dependency `json:"dependencies,omitempty"`
+	Validation     *validation  `json:"validation,omitempty"`
+}
+
+// validation is the result of checking a job when it was scheduled (see validate.go)
+type validation struct {
+	Status string   `json:"status"`
+	Time   string   `json:"time"`
+	Issues []string `json:"issues,omitempty"`
+}
+
+type dependency struct {
+	CollectionId string `json:"collectionId"`
+	Met          bool   `json:"met"`
+}
+
+// scheduleRow is a schedule as read from the database, in scheduleColumns
+type scheduleRow struct {
+	scheduleId, scheduleTime, startTime, completeTime, abortTime, heldTime, flaggedTime, validationTime sql.NullInt64
+	collectionId, collectionPath, calendarUid, validationStatus, validationIssues                       sql.NullString
+	dryRun                                                                                              bool
+}
+
+const scheduleColumns = "s.schedule_id, s.collection_id, s.collection_path, s.schedule_time, s.start_time, s.complete_time, s.abort_time, s.held_time, s.flagged_time, s.calendar_uid, s.validation_status, s.validation_time, s.validation_issues, s.dry_run"
+
+// fields are the destinations of scheduleColumns, for Scan
+func (row *scheduleRow) fields() []interface{} {
+	return []interface{}{&row.scheduleId, &row.collectionId, &row.collectionPath, &row.scheduleTime, &row.startTime, &row.completeTime, &row.abortTime, &row.heldTime, &row.flaggedTime, &row.calendarUid, &row.validationStatus, &row.validationTime, &row.validationIssues, &row.dryRun}
+}
+
+type fileCounts struct {
+	Total    int64 `json:"total"`
+	Complete int64 `json:"complete"`
+	Failed   int64 `json:"failed,omitempty"`
+}
+
+type auditView struct {
+	Action          string `json:"action"`
+	Source          string `json:"source"`
+	OldScheduleTime string `json:"oldScheduleTime,omitempty"`
+	NewScheduleTime string `json:"newScheduleTime,omitempty"`
+	Time            string `json:"time"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// scheduleFilter selects the schedules listed by the API
+type scheduleFilter struct {
+	collectionId string
+	status       string
+	validation   string // validated, invalid or pending
+	from, to     int64  // schedule times (UnixNano), 0 when not set
+	limit        int
+}
+
+// scheduleAPI serves the schedules, under prefix (e.g. "/schedules"):
+// GET prefix lists them, GET prefix/<id> fetches one with its file and delete
+// counts, GET prefix/<id>/audit lists the changes made to one,
+// GET prefix/<id>/rehearsal reports on one which is a dry run (see rehearsal.go),
+// POST prefix/<id>/cancel cancels one yet to start,
+// POST prefix/<id>/trigger starts one now and
+// POST prefix/<id>/abort stops one being published and
+// POST prefix/import imports a release calendar (see import.go).
+// A POST must be authorized by the bearer token, and is refused if there is none.
+type scheduleAPI struct {
+	dbMeta  dbMetaObj
+	prefix  string
+	aborter jobAborter
+	token   string
+}
+
+func newScheduleAPI(dbMeta dbMetaObj, prefix string, aborter jobAborter, token string) *scheduleAPI {
+	dbMeta.prep("api-get-schedule", "SELECT "+scheduleColumns+", "+
+		"(SELECT count(*) FROM schedule_file f WHERE f.schedule_id=s.schedule_id), "+
+		"(SELECT count(*) FROM schedule_file f WHERE f.schedule_id=s.schedule_id AND f.complete_time IS NOT NULL), "+
+		"(SELECT count(*) FROM schedule_file f WHERE f.schedule_id=s.schedule_id AND f.complete_time IS NULL AND f.failed_time IS NOT NULL), "+
+		"(SELECT count(*) FROM schedule_delete d WHERE d.schedule_id=s.schedule_id), "+
+		"(SELECT count(*) FROM schedule_delete d WHERE d.schedule_id=s.schedule_id AND d.complete_time IS NOT NULL) "+
+		"FROM schedule s WHERE s.schedule_id=$1")
+	dbMeta.prep("api-get-dependencies", "SELECT d.collection_id, NOT "+unmetDependency+" FROM schedule_dependency d JOIN schedule s ON s.schedule_id=d.schedule_id WHERE d.schedule_id=$1 ORDER BY d.collection_id")
+	dbMeta.prep("api-get-audit", "SELECT action, source, old_schedule_time, new_schedule_time, audit_time FROM schedule_audit WHERE schedule_id=$1 ORDER BY schedule_audit_id")
+	dbMeta.prep("api-awaiting-content", "SELECT "+awaitingContent+" FROM schedule s WHERE s.schedule_id=$1")
+	return &scheduleAPI{dbMeta: dbMeta, prefix: strings.TrimSuffix(prefix, "/"), aborter: aborter, token: token}
+}
+
+func (api *scheduleAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scheduleId, action, ok := api.route(r.URL.Path)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{"Not found"})
+		return
+	}
+	if r.Method != "GET" {
+		if api.token == "" {
+			writeJSON(w, http.StatusForbidden, apiError{"Changes through the schedules API are disabled, as it has no token"})
+			return
+		} else if !api.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, apiError{"A bearer token is needed to change schedules"})
+			return
+		}
+	}
+	switch {
+	case scheduleId == 0 && action == "import" && r.Method == "POST":
+		api.importCalendar(w, r)
+	case scheduleId == 0 && action == "" && r.Method == "GET":
+		api.list(w, r)
+	case scheduleId != 0 && action == "" && r.Method == "GET":
+		api.get(w, scheduleId)
+	case scheduleId != 0 && action == "audit" && r.Method == "GET":
+		api.audit(w, scheduleId)
+	case scheduleId != 0 && action == "rehearsal" && r.Method == "GET":
+		api.rehearsal(w, scheduleId)
+	case scheduleId != 0 && action == "cancel" && r.Method == "POST":
+		api.cancel(w, scheduleId)
+	case scheduleId != 0 && action == "trigger" && r.Method == "POST":
+		api.trigger(w, scheduleId)
+	case scheduleId != 0 && action == "abort" && r.Method == "POST":
+		api.abort(w, scheduleId)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{fmt.Sprintf("%s not allowed on %s", r.Method, r.URL.Path)})
+	}
+}
+
+// authorized reports whether r has the API's token, as "Authorization: Bearer <token>"
+func (api *scheduleAPI) authorized(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(api.token)) == 1
+}
+
+// route splits path into a schedule id (0 for the list) and an action (e.g. "cancel")
+func (api *scheduleAPI) route(path string) (int64, string, bool) {
+	if !strings.HasPrefix(path, api.prefix) {
+		return 0, "", false
+	}
+	parts := strings.Split(strings.Trim(path[len(api.prefix):], "/"), "/")
+	if parts[0] == "" {
+		return 0, "", true
+	} else if parts[0] == "import" && len(parts) == 1 {
+		return 0, "import", true
+	}
+	scheduleId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || scheduleId <= 0 || len(parts) > 2 {
+		return 0, "", false
+	}
+	if len(parts) == 2 {
+		return scheduleId, parts[1], true
+	}
+	return scheduleId, "", true
+}
+
+func parseScheduleFilter(r *http.Request) (scheduleFilter, error) {
+	query := r.URL.Query()
+	filter := scheduleFilter{collectionId: query.Get("collection"), status: query.Get("status"), validation: query.Get("validation"), limit: 100}
+	switch filter.status {
+	case "", statusUpcoming, statusHeld, statusRunning, statusCompleted, statusAborted:
+	default:
+		return filter, fmt.Errorf("Unknown status %q, expected %s, %s, %s, %s or %s", filter.status, statusUpcoming, statusHeld, statusRunning, statusCompleted, statusAborted)
+	}
+	switch filter.validation {
+	case "", validationValid, validationInvalid, validationPending:
+	default:
+		return filter, fmt.Errorf("Unknown validation %q, expected %s, %s or %s", filter.validation, validationValid, validationInvalid, validationPending)
+	}
+	for _, param := range []struct {
+		name  string
+		value *int64
+	}{{"from", &filter.from}, {"to", &filter.to}} {
+		if value := query.Get(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("Bad %s %q, expected e.g. 2017-03-01T09:30:00Z", param.name, value)
+			}
+			*param.value = t.UnixNano()
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return filter, fmt.Errorf("Bad limit %q, expected 1 to %d", value, maxListLimit)
+		}
+		filter.limit = limit
+	}
+	return filter, nil
+}
+
+// where returns the SQL conditions and arguments of the filter
+func (filter scheduleFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.collectionId != "" {
+		add("collection_id=$%d", filter.collectionId)
+	}
+	if filter.from != 0 {
+		add("schedule_time >= $%d", filter.from)
+	}
+	if filter.to != 0 {
+		add("schedule_time <= $%d", filter.to)
+	}
+	switch filter.status {
+	case statusUpcoming:
+		conditions = append(conditions, "start_time IS NULL AND held_time IS NULL")
+	case statusHeld:
+		conditions = append(conditions, "start_time IS NULL AND held_time IS NOT NULL")
+	case statusRunning:
+		conditions = append(conditions, "start_time IS NOT NULL AND complete_time IS NULL AND abort_time IS NULL")
+	case statusCompleted:
+		conditions = append(conditions, "complete_time IS NOT NULL")
+	case statusAborted:
+		conditions = append(conditions, "abort_time IS NOT NULL")
+	}
+	switch filter.validation {
+	case validationValid, validationInvalid:
+		add("validation_status=$%d", filter.validation)
+	case validationPending:
+		conditions = append(conditions, "validation_status IS NULL")
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (api *scheduleAPI) list(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseScheduleFilter(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	where, args := filter.where()
+	rows, err := api.dbMeta.db.Query("SELECT "+scheduleColumns+" FROM schedule s"+
+		where+" ORDER BY schedule_time, schedule_id LIMIT "+strconv.Itoa(filter.limit), args...)
+	if err != nil {
+		api.serverError(w, err)
+		return
+	}
+	defer rows.Close()
+	schedules := []scheduleView{}
+	for rows.Next() {
+		var row scheduleRow
+		if err = rows.Scan(row.fields()...); err != nil {
+			api.serverError(w, err)
+			return
+		}
+		schedules = append(schedules, row.view())
+	}
+	if err = rows.Err(); err != nil {
+		api.serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schedules)
+}
+
+// getSchedule returns the schedule with its counts and dependencies, or nil if there is no such schedule
+func (api *scheduleAPI) getSchedule(scheduleId int64) (*scheduleView, error) {
+	var row scheduleRow
+	var files, deletes fileCounts
+	err := api.dbMeta.prepped["api-get-schedule"].QueryRow(scheduleId).Scan(append(row.fields(),
+		&files.Total, &files.Complete, &files.Failed, &deletes.Total, &deletes.Complete)...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	view := row.view()
+	view.Files = &files
+	view.Deletes = &deletes
+
+	rows, err := api.dbMeta.prepped["api-get-dependencies"].Query(scheduleId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collectionId sql.NullString
+		var met sql.NullBool
+		if err = rows.Scan(&collectionId, &met); err != nil {
+			return nil, err
+		}
+		view.Dependencies = append(view.Dependencies, dependency{CollectionId: collectionId.String, Met: met.Bool})
+	}
+	return &view, rows.Err()
+}
+
+func (api *scheduleAPI) get(w http.ResponseWriter, scheduleId int64) {
+	view, err := api.getSchedule(scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+	} else if view == nil {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("Schedule %d not found", scheduleId)})
+	} else {
+		writeJSON(w, http.StatusOK, view)
+	}
+}
+
+func (api *scheduleAPI) cancel(w http.ResponseWriter, scheduleId int64) {
+	view, err := api.getSchedule(scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+		return
+	} else if view == nil {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("Schedule %d not found", scheduleId)})
+		return
+	}
+	cancelled, err := cancelSchedule(api.dbMeta, scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+		return
+	} else if !cancelled {
+		writeJSON(w, http.StatusConflict, apiError{fmt.Sprintf("Schedule %d is %s, only an upcoming (or held) schedule can be cancelled (a running one can be aborted)", scheduleId, view.Status)})
+		return
+	}
+	log.Info(fmt.Sprintf("Job %d Collection %q CANCELLED by API", scheduleId, view.CollectionId), nil)
+	view.Status = "cancelled"
+	writeJSON(w, http.StatusOK, view)
+}
+
+// trigger has a schedule start now, unless it would still be held back, by
+// its dependencies or (as imported from the calendar) for want of files
+func (api *scheduleAPI) trigger(w http.ResponseWriter, scheduleId int64) {
+	view, err := api.getSchedule(scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+		return
+	} else if view == nil {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("Schedule %d not found", scheduleId)})
+		return
+	}
+	var unmet []string
+	for _, dependency := range view.Dependencies {
+		if !dependency.Met {
+			unmet = append(unmet, dependency.CollectionId)
+		}
+	}
+	var awaiting bool
+	if err = api.dbMeta.prepped["api-awaiting-content"].QueryRow(scheduleId).Scan(&awaiting); err != nil {
+		api.serverError(w, err)
+		return
+	}
+	if len(unmet) > 0 {
+		writeJSON(w, http.StatusConflict, apiError{fmt.Sprintf("Schedule %d cannot start until its dependencies %s are met", scheduleId, strings.Join(unmet, ", "))})
+		return
+	} else if awaiting {
+		writeJSON(w, http.StatusConflict, apiError{fmt.Sprintf("Schedule %d cannot start until a schedule message gives it its files", scheduleId)})
+		return
+	}
+
+	triggered, err := moveJob(api.dbMeta, scheduleId, time.Now().UnixNano(), "trigger", "api")
+	if err != nil {
+		api.serverError(w, err)
+		return
+	}
+	view, err = api.getSchedule(scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+	} else if view == nil {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("Schedule %d not found", scheduleId)})
+	} else if !triggered {
+		writeJSON(w, http.StatusConflict, apiError{fmt.Sprintf("Schedule %d is %s, only an upcoming (or held) schedule can be triggered", scheduleId, view.Status)})
+	} else {
+		log.Info(fmt.Sprintf("Job %d Collection %q triggered by API", scheduleId, view.CollectionId), nil)
+		writeJSON(w, http.StatusOK, view)
+	}
+}
+
+func (api *scheduleAPI) abort(w http.ResponseWriter, scheduleId int64) {
+	abortedJob, err := api.aborter.abort(scheduleId, "api")
+	if err != nil {
+		api.serverError(w, err)
+		return
+	}
+	view, err := api.getSchedule(scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+	} else if view == nil {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("Schedule %d not found", scheduleId)})
+	} else if !abortedJob {
+		writeJSON(w, http.StatusConflict, apiError{fmt.Sprintf("Schedule %d is %s, only a running schedule can be aborted", scheduleId, view.Status)})
+	} else {
+		log.Info(fmt.Sprintf("Job %d Collection %q ABORTED by API", scheduleId, view.CollectionId), nil)
+		writeJSON(w, http.StatusOK, view)
+	}
+}
+
+// audit lists the changes to a schedule, which remain after it has been cancelled
+func (api *scheduleAPI) audit(w http.ResponseWriter, scheduleId int64) {
+	rows, err := api.dbMeta.prepped["api-get-audit"].Query(scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+		return
+	}
+	defer rows.Close()
+	changes := []auditView{}
+	for rows.Next() {
+		var (
+			action, source              sql.NullString
+			oldTime, newTime, auditTime sql.NullInt64
+		)
+		if err = rows.Scan(&action, &source, &oldTime, &newTime, &auditTime); err != nil {
+			api.serverError(w, err)
+			return
+		}
+		changes = append(changes, auditView{
+			Action:          action.String,
+			Source:          source.String,
+			OldScheduleTime: formatTime(oldTime),
+			NewScheduleTime: formatTime(newTime),
+			Time:            formatTime(auditTime),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		api.serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+func (api *scheduleAPI) serverError(w http.ResponseWriter, err error) {
+	log.ErrorC("Schedule API failed", err, nil)
+	writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+}
+
+func (row scheduleRow) view() scheduleView {
+	view := scheduleView{
+		ScheduleId:     row.scheduleId.Int64,
+		CollectionId:   row.collectionId.String,
+		CollectionPath: row.collectionPath.String,
+		Status:         statusUpcoming,
+		ScheduleTime:   formatTime(row.scheduleTime),
+		StartTime:      formatTime(row.startTime),
+		CompleteTime:   formatTime(row.completeTime),
+		AbortTime:      formatTime(row.abortTime),
+		HeldTime:       formatTime(row.heldTime),
+		FlaggedTime:    formatTime(row.flaggedTime),
+		CalendarUid:    row.calendarUid.String,
+		DryRun:         row.dryRun,
+	}
+	if row.validationStatus.Valid {
+		view.Validation = &validation{Status: row.validationStatus.String, Time: formatTime(row.validationTime), Issues: readIssues(row.validationIssues)}
+	}
+	if row.abortTime.Valid {
+		view.Status = statusAborted
+	} else if row.completeTime.Valid {
+		view.Status = statusCompleted
+	} else if row.startTime.Valid {
+		view.Status = statusRunning
+	} else if row.heldTime.Valid {
+		view.Status = statusHeld
+	}
+	return view
+}
+
+// formatTime formats a UnixNano time from the database, or "" for NULL
+func formatTime(t sql.NullInt64) string {
+	if !t.Valid {
+		return ""
+	}
+	return time.Unix(0, t.Int64).UTC().Format(time.RFC3339)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Error(err, nil)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScheduleAPIRoute(t *testing.T) {
+	api := &scheduleAPI{prefix: "/schedules"}
+	for path, want := range map[string]struct {
+		scheduleId int64
+		action     string
+		ok         bool
+	}{
+		"/schedules":            {0, "", true},
+		"/schedules/":           {0, "", true},
+		"/schedules/12":         {12, "", true},
+		"/schedules/12/cancel":  {12, "cancel", true},
+		"/schedules/12/audit":   {12, "audit", true},
+		"/schedules/12/abort":   {12, "abort", true},
+		"/schedules/import":     {0, "import", true},
+		"/schedules/abc":        {0, "", false},
+		"/schedules/12/cancel/": {12, "cancel", true},
+		"/schedules/12/a/b":     {0, "", false},
+		"/other":                {0, "", false},
+	} {
+		scheduleId, action, ok := api.route(path)
+		if scheduleId != want.scheduleId || action != want.action || ok != want.ok {
+			t.Errorf("Test failed, %s routed to %d %q %v", path, scheduleId, action, ok)
+		}
+	}
+}
+
+func TestScheduleAPIChangesNeedToken(t *testing.T) {
+	for _, test := range []struct {
+		token, authorization string
+		status               int
+	}{
+		{"", "", http.StatusForbidden},
+		{"", "Bearer ", http.StatusForbidden},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+	} {
+		api := &scheduleAPI{prefix: "/schedules", token: test.token}
+		request := httptest.NewRequest("POST", "/schedules/12/trigger", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		response := httptest.NewRecorder()
+		api.ServeHTTP(response, request)
+		if response.Code != test.status {
+			t.Errorf("Test failed, token %q authorization %q got %d, expected %d", test.token, test.authorization, response.Code, test.status)
+		}
+	}
+
+	api := &scheduleAPI{prefix: "/schedules", token: "secret"}
+	request := httptest.NewRequest("POST", "/schedules/12/trigger", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	if !api.authorized(request) {
+		t.Error("Test failed, expected the token to be accepted")
+	}
+}
+
+func TestScheduleFilter(t *testing.T) {
+	filter, err := parseScheduleFilter(httptest.NewRequest("GET", "/schedules?collection=test0001&status=running&from=2017-03-01T09:30:00Z&limit=5", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, args := filter.where()
+	if where != " WHERE collection_id=$1 AND schedule_time >= $2 AND start_time IS NOT NULL AND complete_time IS NULL AND abort_time IS NULL" ||
+		!reflect.DeepEqual(args, []interface{}{"test0001", int64(1488360600000000000)}) || filter.limit != 5 {
+		t.Errorf("Test failed, got %q %v limit %d", where, args, filter.limit)
+	}
+
+	for _, query := range []string{"status=paused", "from=yesterday", "limit=0", "validation=ok"} {
+		if _, err = parseScheduleFilter(httptest.NewRequest("GET", "/schedules?"+query, nil)); err == nil {
+			t.Errorf("Test failed, expected an error for %s", query)
+		}
+	}
+}
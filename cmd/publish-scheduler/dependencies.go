@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// unmetDependency is the SQL condition of a dependency d (of job s) being
+// unmet: its collection has yet to complete a job, or still has a job (not
+// aborted) due no later than s. Dry runs are ignored.
+const unmetDependency = "(NOT EXISTS(SELECT 1 FROM schedule p WHERE p.collection_id=d.collection_id AND p.complete_time IS NOT NULL AND NOT p.dry_run)" +
+	" OR EXISTS(SELECT 1 FROM schedule p WHERE p.collection_id=d.collection_id AND p.complete_time IS NULL AND p.abort_time IS NULL AND NOT p.dry_run AND p.schedule_time <= s.schedule_time))"
+
+// hasUnmetDependency is the SQL condition of job s being held back by a dependency
+const hasUnmetDependency = "EXISTS(SELECT 1 FROM schedule_dependency d WHERE d.schedule_id=s.schedule_id AND " + unmetDependency + ")"
+
+// unmetDependencies lists (comma-separated) the collections job s waits for
+const unmetDependencies = "(SELECT string_agg(d.collection_id, ',' ORDER BY d.collection_id) FROM schedule_dependency d WHERE d.schedule_id=s.schedule_id AND " + unmetDependency + ")"
+
+func (dbMeta dbMetaObj) prepDependencies() {
+	dbMeta.prep("insert-dependency", "INSERT INTO schedule_dependency (schedule_id, collection_id) VALUES ($1, $2) ON CONFLICT DO NOTHING")
+	dbMeta.prep("hold-blocked-jobs", "UPDATE schedule s SET held_time=$1 WHERE held_time IS NULL AND start_time IS NULL AND abort_time IS NULL AND schedule_time <= $1 AND "+hasUnmetDependency+
+		" RETURNING schedule_id, collection_id, "+unmetDependencies)
+	dbMeta.prep("flag-blocked-jobs", "UPDATE schedule s SET flagged_time=$1 WHERE flagged_time IS NULL AND start_time IS NULL AND abort_time IS NULL AND schedule_time <= $2 AND "+hasUnmetDependency+
+		" RETURNING schedule_id, collection_id, schedule_time, "+unmetDependencies)
+}
+
+// checkDependencies logs each due job when it is first held back by its
+// dependencies, and flags (logging an error) each job held back for longer
+// than timeoutNano (unless 0). Held jobs are not started by checkSchedule.
+func checkDependencies(dbMeta dbMetaObj, epochTime, timeoutNano int64) {
+	rows, err := dbMeta.prepped["hold-blocked-jobs"].Query(epochTime)
+	if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	for rows.Next() {
+		var scheduleId sql.NullInt64
+		var collectionId, waitingFor sql.NullString
+		if err = rows.Scan(&scheduleId, &collectionId, &waitingFor); err != nil {
+			log.Error(err, nil)
+			panic(err)
+		}
+		log.Info(fmt.Sprintf("Job %d Collection %q held, waiting for collections: %s", scheduleId.Int64, collectionId.String, waitingFor.String), nil)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	rows.Close()
+	if timeoutNano == 0 {
+		return
+	}
+
+	if rows, err = dbMeta.prepped["flag-blocked-jobs"].Query(epochTime, epochTime-timeoutNano); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scheduleId, scheduleTime sql.NullInt64
+		var collectionId, waitingFor sql.NullString
+		if err = rows.Scan(&scheduleId, &collectionId, &scheduleTime, &waitingFor); err != nil {
+			log.Error(err, nil)
+			panic(err)
+		}
+		log.Error(fmt.Errorf("Job %d Collection %q FLAGGED, held for over %s, waiting for collections: %s", scheduleId.Int64, collectionId.String, time.Duration(timeoutNano), waitingFor.String),
+			log.Data{"scheduleTime": time.Unix(0, scheduleTime.Int64).UTC().Format(time.RFC3339)})
+	}
+	if err = rows.Err(); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	dbMeta := testDB(t)
+	defer dbMeta.db.Close()
+
+	nine := time.Now().Add(24 * time.Hour).Truncate(time.Hour).UnixNano()
+	ten := nine + int64(time.Hour)
+	suffix := time.Now().UnixNano()
+	prerequisite := insertJob(t, dbMeta, fmt.Sprintf("prerequisite-%d", suffix), nine)
+	dependent := insertJob(t, dbMeta, fmt.Sprintf("dependent-%d", suffix), ten)
+	if _, err := dbMeta.prepped["insert-dependency"].Exec(dependent, fmt.Sprintf("prerequisite-%d", suffix)); err != nil {
+		t.Fatal(err)
+	}
+	defer dbMeta.db.Exec("DELETE FROM schedule_dependency WHERE schedule_id=$1", dependent)
+
+	blocked := func() bool {
+		var blocked bool
+		if err := dbMeta.db.QueryRow("SELECT "+hasUnmetDependency+" FROM schedule s WHERE s.schedule_id=$1", dependent).Scan(&blocked); err != nil {
+			t.Fatal(err)
+		}
+		return blocked
+	}
+	marked := func() (held, flagged sql.NullInt64) {
+		if err := dbMeta.db.QueryRow("SELECT held_time, flagged_time FROM schedule WHERE schedule_id=$1", dependent).Scan(&held, &flagged); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// due, while the prerequisite has yet to complete
+	checkDependencies(dbMeta, ten, int64(time.Hour))
+	if held, flagged := marked(); !blocked() || held.Int64 != ten || flagged.Valid {
+		t.Errorf("Test failed, expected the job held (not flagged) at %d, got held %v flagged %v", ten, held, flagged)
+	}
+
+	checkDependencies(dbMeta, ten+2*int64(time.Hour), int64(time.Hour))
+	if held, flagged := marked(); held.Int64 != ten || flagged.Int64 != ten+2*int64(time.Hour) {
+		t.Errorf("Test failed, expected the job flagged once held over the timeout, got held %v flagged %v", held, flagged)
+	}
+
+	if _, err := dbMeta.db.Exec("UPDATE schedule SET start_time=$2, complete_time=$2 WHERE schedule_id=$1", prerequisite, nine); err != nil {
+		t.Fatal(err)
+	}
+	if blocked() {
+		t.Error("Test failed, expected the job released once its prerequisite completed")
+	}
+}
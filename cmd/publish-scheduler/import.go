@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ONSdigital/dp-publish-pipeline/calendar"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// awaitingContent is the SQL condition of job s having been imported from the
+// release calendar, and yet to be given its files and deletes by a schedule message.
+// It is kept apart from calendar_uid, which jobs matched by an import are given too.
+const awaitingContent = "s.awaiting_content"
+
+// what importing a calendar entry does
+const (
+	importCreate     = "create"     // a job is created, to be given its files by a schedule message
+	importReschedule = "reschedule" // the collection's upcoming job is moved to the entry's time
+	importUnchanged  = "unchanged"  // the collection already has a job at the entry's time
+	importUnmatched  = "unmatched"  // the entry has no collection id, and its path is not that of a scheduled collection
+	importAmbiguous  = "ambiguous"  // the entry could be any of several jobs
+	importStarted    = "started"    // the entry's job has started, so cannot be moved
+)
+
+// maxCalendarSize is the largest calendar file the API accepts
+const maxCalendarSize = 10 * 1024 * 1024
+
+type importEntry struct {
+	calendar.Entry
+	Action               string `json:"action"`
+	ScheduleId           int64  `json:"scheduleId,omitempty"`
+	PreviousScheduleTime string `json:"previousScheduleTime,omitempty"`
+	Reason               string `json:"reason,omitempty"`
+}
+
+// importConflict is two (or more) collections publishing the same uris at the same time
+type importConflict struct {
+	ScheduleTime string   `json:"scheduleTime"`
+	Collections  []string `json:"collections"`
+	Uris         []string `json:"uris"`
+}
+
+type importReport struct {
+	DryRun    bool             `json:"dryRun"`
+	Applied   bool             `json:"applied"`
+	Entries   []importEntry    `json:"entries"`
+	Conflicts []importConflict `json:"conflicts"`
+}
+
+// existingJob is a job (not complete or aborted) which calendar entries are matched against
+type existingJob struct {
+	scheduleId                                int64
+	collectionId, collectionPath, calendarUid string
+	scheduleTime                              int64
+	started                                   bool
+	uris                                      []string
+}
+
+// loadExistingJobs reads the jobs yet to complete, with the uris they publish or delete
+func loadExistingJobs(db *sql.DB) ([]*existingJob, error) {
+	rows, err := db.Query("SELECT schedule_id, collection_id, collection_path, schedule_time, start_time, calendar_uid FROM schedule WHERE complete_time IS NULL AND abort_time IS NULL AND NOT dry_run ORDER BY schedule_time, schedule_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*existingJob
+	byId := make(map[int64]*existingJob)
+	for rows.Next() {
+		var scheduleId, scheduleTime, startTime sql.NullInt64
+		var collectionId, collectionPath, calendarUid sql.NullString
+		if err = rows.Scan(&scheduleId, &collectionId, &collectionPath, &scheduleTime, &startTime, &calendarUid); err != nil {
+			return nil, err
+		}
+		job := &existingJob{
+			scheduleId:     scheduleId.Int64,
+			collectionId:   collectionId.String,
+			collectionPath: collectionPath.String,
+			calendarUid:    calendarUid.String,
+			scheduleTime:   scheduleTime.Int64,
+			started:        startTime.Valid,
+		}
+		jobs = append(jobs, job)
+		byId[job.scheduleId] = job
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	uriRows, err := db.Query("SELECT f.schedule_id, f.uri FROM schedule_file f JOIN schedule s ON s.schedule_id=f.schedule_id WHERE s.complete_time IS NULL AND s.abort_time IS NULL" +
+		" UNION SELECT d.schedule_id, d.uri FROM schedule_delete d JOIN schedule s ON s.schedule_id=d.schedule_id WHERE s.complete_time IS NULL AND s.abort_time IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer uriRows.Close()
+	for uriRows.Next() {
+		var scheduleId sql.NullInt64
+		var uri sql.NullString
+		if err = uriRows.Scan(&scheduleId, &uri); err != nil {
+			return nil, err
+		}
+		if job, ok := byId[scheduleId.Int64]; ok {
+			job.uris = append(job.uris, uri.String)
+		}
+	}
+	return jobs, uriRows.Err()
+}
+
+// planImport decides what importing each calendar entry does to jobs, and
+// finds the conflicts it would cause: the uris a created or rescheduled job shares
+// with another job at the same time (jobs left as they are never conflict). An entry is matched to a
+// job by its uid (for an entry imported before), else to the jobs of its
+// collection, named by id or, failing that, by the path of a scheduled collection.
+func planImport(entries []calendar.Entry, jobs []*existingJob) importReport {
+	byUid := make(map[string]*existingJob)
+	byCollection := make(map[string][]*existingJob)
+	pathIds := make(map[string]string)
+	for _, job := range jobs {
+		if job.calendarUid != "" {
+			byUid[job.calendarUid] = job
+		}
+		byCollection[job.collectionId] = append(byCollection[job.collectionId], job)
+		pathIds[job.collectionPath] = job.collectionId
+	}
+
+	report := importReport{Entries: []importEntry{}, Conflicts: []importConflict{}}
+	claimed := make(map[int64]bool)
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		planned := importEntry{Entry: entry}
+		scheduleTime := entry.ReleaseTime.UnixNano()
+		match := byUid[entry.Uid]
+		if match == nil {
+			if planned.CollectionId == "" {
+				planned.CollectionId = pathIds[entry.CollectionPath]
+			}
+			if planned.CollectionId == "" {
+				planned.Action = importUnmatched
+				planned.Reason = fmt.Sprintf("No collection is scheduled with id %q or path %q", entry.CollectionId, entry.CollectionPath)
+				report.Entries = append(report.Entries, planned)
+				continue
+			}
+		} else {
+			planned.CollectionId = match.collectionId
+		}
+
+		key := fmt.Sprintf("%s@%d", planned.CollectionId, scheduleTime)
+		if listed[key] {
+			planned.Action = importAmbiguous
+			planned.Reason = "The collection is listed more than once at this time"
+			report.Entries = append(report.Entries, planned)
+			continue
+		}
+		listed[key] = true
+
+		if match == nil {
+			var upcoming []*existingJob
+			for _, job := range byCollection[planned.CollectionId] {
+				if claimed[job.scheduleId] {
+					continue
+				}
+				if job.scheduleTime == scheduleTime {
+					match = job
+					break
+				}
+				if !job.started {
+					upcoming = append(upcoming, job)
+				}
+			}
+			if match == nil && len(upcoming) > 1 {
+				planned.Action = importAmbiguous
+				planned.Reason = fmt.Sprintf("The collection has %d upcoming jobs", len(upcoming))
+				report.Entries = append(report.Entries, planned)
+				continue
+			} else if match == nil && len(upcoming) == 1 {
+				match = upcoming[0]
+			}
+		}
+
+		switch {
+		case match == nil:
+			planned.Action = importCreate
+			if planned.CollectionPath == "" {
+				planned.CollectionPath = planned.CollectionId
+			}
+		case claimed[match.scheduleId]:
+			planned.Action = importAmbiguous
+			planned.ScheduleId = match.scheduleId
+			planned.Reason = fmt.Sprintf("Job %d is matched by another entry", match.scheduleId)
+		case match.scheduleTime == scheduleTime:
+			planned.Action = importUnchanged
+		case match.started:
+			planned.Action = importStarted
+			planned.Reason = fmt.Sprintf("Job %d has started, so cannot be moved", match.scheduleId)
+		default:
+			planned.Action = importReschedule
+			planned.PreviousScheduleTime = formatTime(sql.NullInt64{Int64: match.scheduleTime, Valid: true})
+		}
+		if match != nil && planned.Action != importAmbiguous {
+			claimed[match.scheduleId] = true
+			planned.ScheduleId = match.scheduleId
+			planned.Uris = append(planned.Uris, match.uris...)
+		}
+		report.Entries = append(report.Entries, planned)
+	}
+
+	// the uris of each collection at each time, once imported, and the
+	// collections created or rescheduled there (only their overlaps are conflicts)
+	slots := make(map[int64]map[string]map[string]bool)
+	changed := make(map[int64]map[string]bool)
+	add := func(scheduleTime int64, collectionId string, uris []string, change bool) {
+		if change {
+			if changed[scheduleTime] == nil {
+				changed[scheduleTime] = make(map[string]bool)
+			}
+			changed[scheduleTime][collectionId] = true
+		}
+		if slots[scheduleTime] == nil {
+			slots[scheduleTime] = make(map[string]map[string]bool)
+		}
+		if slots[scheduleTime][collectionId] == nil {
+			slots[scheduleTime][collectionId] = make(map[string]bool)
+		}
+		for _, uri := range uris {
+			slots[scheduleTime][collectionId][uri] = true
+		}
+	}
+	for _, job := range jobs {
+		if !claimed[job.scheduleId] {
+			add(job.scheduleTime, job.collectionId, job.uris, false)
+		}
+	}
+	for _, planned := range report.Entries {
+		switch planned.Action {
+		case importCreate, importReschedule:
+			add(planned.ReleaseTime.UnixNano(), planned.CollectionId, planned.Uris, true)
+		case importUnchanged:
+			add(planned.ReleaseTime.UnixNano(), planned.CollectionId, planned.Uris, false)
+		}
+	}
+	var times []int64
+	for scheduleTime := range slots {
+		times = append(times, scheduleTime)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	for _, scheduleTime := range times {
+		var collections []string
+		for collectionId := range slots[scheduleTime] {
+			collections = append(collections, collectionId)
+		}
+		sort.Strings(collections)
+		for i, a := range collections {
+			for _, b := range collections[i+1:] {
+				if !changed[scheduleTime][a] && !changed[scheduleTime][b] {
+					continue
+				}
+				var shared []string
+				for uri := range slots[scheduleTime][a] {
+					if slots[scheduleTime][b][uri] {
+						shared = append(shared, uri)
+					}
+				}
+				if len(shared) > 0 {
+					sort.Strings(shared)
+					report.Conflicts = append(report.Conflicts, importConflict{
+						ScheduleTime: formatTime(sql.NullInt64{Int64: scheduleTime, Valid: true}),
+						Collections:  []string{a, b},
+						Uris:         shared,
+					})
+				}
+			}
+		}
+	}
+	return report
+}
+
+// applyImport creates and moves jobs as planned, through storeJobIn and
+// moveJobIn, in a single transaction, so that nothing is applied if any of it fails.
+// A created job is marked as awaiting its files: it is not started until a
+// schedule message for the collection has given it them (and moved it to the
+// message's time, if another).
+func applyImport(dbMeta dbMetaObj, report *importReport) error {
+	txn, err := dbMeta.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = applyImportIn(txn, dbMeta, report); err != nil {
+		txn.Rollback()
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	for _, planned := range report.Entries {
+		switch planned.Action {
+		case importCreate:
+			log.Info(fmt.Sprintf("Job %d Collection %q imported from the calendar at %d", planned.ScheduleId, planned.CollectionId, planned.ReleaseTime.UnixNano()), log.Data{"uid": planned.Uid})
+		case importReschedule:
+			log.Info(fmt.Sprintf("Job %d Collection %q RESCHEDULED to %d from the calendar", planned.ScheduleId, planned.CollectionId, planned.ReleaseTime.UnixNano()), nil)
+		}
+	}
+	return nil
+}
+
+func applyImportIn(txn *sql.Tx, dbMeta dbMetaObj, report *importReport) error {
+	auditStmt := txn.Stmt(dbMeta.prepped["insert-audit"])
+	uidStmt := txn.Stmt(dbMeta.prepped["set-calendar-uid"])
+	for i := range report.Entries {
+		planned := &report.Entries[i]
+		scheduleTime := planned.ReleaseTime.UnixNano()
+		switch planned.Action {
+		case importCreate:
+			if planned.Uid == "" {
+				planned.Uid = fmt.Sprintf("%s@%d", planned.CollectionId, planned.ReleaseTime.Unix())
+			}
+			job := scheduleJob{
+				collectionId:    planned.CollectionId,
+				collectionPath:  planned.CollectionPath,
+				scheduleTime:    scheduleTime,
+				calendarUid:     planned.Uid,
+				awaitingContent: true,
+			}
+			scheduleId, err := storeJobIn(txn, dbMeta, &job)
+			if err != nil {
+				return err
+			}
+			planned.ScheduleId = scheduleId
+			if err = auditJob(auditStmt, planned.ScheduleId, planned.CollectionId, "import", "calendar", 0, scheduleTime); err != nil {
+				return err
+			}
+		case importReschedule:
+			moved, err := moveJobIn(txn, dbMeta, planned.ScheduleId, scheduleTime, "import", "calendar")
+			if err != nil {
+				return err
+			} else if !moved {
+				planned.Action = importStarted
+				planned.Reason = fmt.Sprintf("Job %d started before it could be moved", planned.ScheduleId)
+				continue
+			}
+		}
+		if planned.Uid != "" && (planned.Action == importReschedule || planned.Action == importUnchanged) {
+			if _, err := uidStmt.Exec(planned.ScheduleId, planned.Uid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importCalendar plans (and unless dryRun=true, applies) the import of the
+// calendar in the request body, in format ical or csv (by default, from the Content-Type).
+// Nothing is applied while there are conflicts.
+func (api *scheduleAPI) importCalendar(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/calendar") {
+			format = calendar.ICalendar
+		} else if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = calendar.CSV
+		}
+	}
+	entries, err := calendar.Parse(http.MaxBytesReader(w, r.Body, maxCalendarSize), format)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	jobs, err := loadExistingJobs(api.dbMeta.db)
+	if err != nil {
+		api.serverError(w, err)
+		return
+	}
+	report := planImport(entries, jobs)
+	report.DryRun = r.URL.Query().Get("dryRun") == "true"
+	if report.DryRun {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	if len(report.Conflicts) > 0 {
+		writeJSON(w, http.StatusConflict, report)
+		return
+	}
+	if err = applyImport(api.dbMeta, &report); err != nil {
+		api.serverError(w, err)
+		return
+	}
+	report.Applied = true
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/calendar"
+)
+
+func TestPlanImport(t *testing.T) {
+	nine := time.Date(2017, 3, 1, 9, 30, 0, 0, time.UTC)
+	ten := nine.Add(time.Hour)
+	jobs := []*existingJob{
+		{scheduleId: 1, collectionId: "gdp-0001", collectionPath: "gdp", scheduleTime: nine.UnixNano(), uris: []string{"/gdp/bulletin"}},
+		{scheduleId: 2, collectionId: "lms-0001", collectionPath: "lms", scheduleTime: nine.UnixNano()},
+		{scheduleId: 3, collectionId: "cpi-0001", collectionPath: "cpi", scheduleTime: ten.UnixNano(), uris: []string{"/cpi/dataset"}},
+	}
+	report := planImport([]calendar.Entry{
+		{CollectionId: "gdp-0001", ReleaseTime: nine},
+		{CollectionPath: "lms", ReleaseTime: ten, Uris: []string{"/cpi/dataset"}},
+		{CollectionId: "trade-0001", ReleaseTime: ten},
+		{CollectionPath: "unknown", ReleaseTime: ten},
+	}, jobs)
+
+	want := []struct {
+		action     string
+		scheduleId int64
+	}{{importUnchanged, 1}, {importReschedule, 2}, {importCreate, 0}, {importUnmatched, 0}}
+	for i, planned := range report.Entries {
+		if planned.Action != want[i].action || planned.ScheduleId != want[i].scheduleId {
+			t.Errorf("Test failed, entry %d planned %s of job %d, expected %s of job %d", i, planned.Action, planned.ScheduleId, want[i].action, want[i].scheduleId)
+		}
+	}
+	if report.Entries[1].CollectionId != "lms-0001" || report.Entries[2].CollectionPath != "trade-0001" {
+		t.Errorf("Test failed, collections not matched: %+v", report.Entries)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Collections[0] != "cpi-0001" || report.Conflicts[0].Collections[1] != "lms-0001" || report.Conflicts[0].Uris[0] != "/cpi/dataset" {
+		t.Errorf("Test failed, expected lms-0001 to conflict with cpi-0001, got %+v", report.Conflicts)
+	}
+}
+
+func TestPlanImportIgnoresExistingConflicts(t *testing.T) {
+	nine := time.Date(2017, 3, 1, 9, 30, 0, 0, time.UTC)
+	ten := nine.Add(time.Hour)
+	// already scheduled together, before the import
+	jobs := []*existingJob{
+		{scheduleId: 1, collectionId: "gdp-0001", collectionPath: "gdp", scheduleTime: nine.UnixNano(), uris: []string{"/gdp/bulletin"}},
+		{scheduleId: 2, collectionId: "gdp-0002", collectionPath: "gdp-revised", scheduleTime: nine.UnixNano(), uris: []string{"/gdp/bulletin"}},
+	}
+	report := planImport([]calendar.Entry{
+		{CollectionId: "gdp-0001", ReleaseTime: nine},
+		{CollectionId: "trade-0001", ReleaseTime: ten, Uris: []string{"/trade/bulletin"}},
+	}, jobs)
+
+	if report.Entries[0].Action != importUnchanged || report.Entries[1].Action != importCreate {
+		t.Errorf("Test failed, unexpected plan: %+v", report.Entries)
+	}
+	if len(report.Conflicts) != 0 {
+		t.Errorf("Test failed, expected no conflicts from the unrelated import, got %+v", report.Conflicts)
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/ONSdigital/dp-publish-pipeline/admin"
 	"github.com/ONSdigital/dp-publish-pipeline/health"
 	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/leader"
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/scheduler"
+	"github.com/ONSdigital/dp-publish-pipeline/s3"
+	"github.com/ONSdigital/dp-publish-pipeline/shutdown"
 	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/dp-publish-pipeline/vault"
 
@@ -16,11 +22,10 @@ import (
 
 	"database/sql"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
-	tick             = time.Millisecond * 330
 	verboseTick      = false
 	maxLaunchPerTick = 20
 )
@@ -38,75 +43,64 @@ type scheduleJob struct {
 	encryptionKey  string
 	files          []kafka.FileResource
 	urisToDelete   []kafka.FileResource
+	dependsOn      []string // collections which must publish first
+	calendarUid    string   // of the release calendar entry the job was imported from
+	dryRun         bool     // rehearse, without changing the website (see rehearsal.go)
+
+	// imported from the calendar, so not started until a schedule message gives it its files and deletes
+	awaitingContent bool
 }
 
-func publishCollection(job scheduleJob, fileProducerChannel, deleteProducerChannel, totalProducerChannel chan []byte) {
-	if job.collectionId == "" {
-		log.ErrorC("No collectionId", fmt.Errorf("job: %v", job), nil)
-		panic("No collectionId")
+// publication is the part of the job which the scheduler package sends when it launches
+func (job scheduleJob) publication() scheduler.Job {
+	return scheduler.Job{
+		ScheduleId:     job.scheduleId,
+		CollectionId:   job.collectionId,
+		CollectionPath: job.collectionPath,
+		ScheduleTime:   job.scheduleTime,
+		EncryptionKey:  job.encryptionKey,
+		Files:          job.files,
+		UrisToDelete:   job.urisToDelete,
+		DryRun:         job.dryRun,
 	}
-
-	var data []byte
-	var err error
-
-	// Send published files to the kafka topic
-	for i := 0; i < len(job.files); i++ {
-		if data, err = json.Marshal(kafka.PublishFileMessage{
-			ScheduleId:     job.scheduleId,
-			FileId:         job.files[i].Id,
-			CollectionId:   job.collectionId,
-			CollectionPath: job.collectionPath,
-			EncryptionKey:  job.encryptionKey,
-			FileLocation:   job.files[i].Location,
-			Uri:            job.files[i].Uri,
-		}); err != nil {
-			log.ErrorC("failed to marshal", err, nil)
-			panic("failed to marshal")
-		}
-		fileProducerChannel <- data
-	}
-	log.Info(fmt.Sprintf("Job %d Collection %q sent %d files", job.scheduleId, job.collectionId, len(job.files)), nil)
-
-	// Send published deletes to the kafka topic
-	for i := 0; i < len(job.urisToDelete); i++ {
-		if data, err = json.Marshal(kafka.PublishDeleteMessage{
-			ScheduleId:   job.scheduleId,
-			DeleteId:     job.urisToDelete[i].Id,
-			Uri:          job.urisToDelete[i].Uri,
-			CollectionId: job.collectionId,
-		}); err != nil {
-			log.ErrorC("cannot marshal", err, nil)
-			panic(err)
-		}
-		deleteProducerChannel <- data
-	}
-	log.Info(fmt.Sprintf("Job %d Collection %q sent %d deletes", job.scheduleId, job.collectionId, len(job.urisToDelete)), nil)
 }
 
-func scheduleCollection(jsonMessage []byte, dbMeta dbMetaObj) {
+func scheduleCollection(jsonMessage []byte, dbMeta dbMetaObj, aborter jobAborter, validations *validator) error {
 	var message kafka.ScheduleMessage
-	if err := json.Unmarshal(jsonMessage, &message); err != nil {
-		log.ErrorC("Failed to parse json", err, log.Data{"msg": jsonMessage})
-		panic(err)
+	if _, err := kafka.Decode(jsonMessage, &message); err != nil {
+		return fmt.Errorf("Failed to parse json: %s", err)
 	} else if len(message.CollectionId) == 0 || message.Action == "" {
-		log.Error(fmt.Errorf("Empty collectionId/action"), log.Data{"msg": jsonMessage})
-		panic("Empty collectionId/action")
+		return fmt.Errorf("Empty collectionId/action")
 	}
 
 	scheduleTime, err := strconv.ParseInt(message.ScheduleTime, 10, 64)
 	if err != nil {
-		log.Error(fmt.Errorf("Collection %q Cannot numeric convert: %q", message.CollectionId, message.ScheduleTime), log.Data{"msg": message})
-		panic("Cannot numeric convert")
+		return fmt.Errorf("Collection %q Cannot numeric convert: %q", message.CollectionId, message.ScheduleTime)
 	}
 	scheduleTime *= 1000 * 1000 * 1000 // convert from epoch (seconds) to epoch-nanoseconds (UnixNano)
 
 	if message.Action == "cancel" {
 		cancelJob(dbMeta, message.CollectionId, scheduleTime)
+	} else if message.Action == "abort" {
+		abortJobs(aborter, message.CollectionId, scheduleTime)
+	} else if message.Action == "reschedule" {
+		var previousTime int64
+		if message.PreviousScheduleTime != "" {
+			if previousTime, err = strconv.ParseInt(message.PreviousScheduleTime, 10, 64); err != nil {
+				return fmt.Errorf("Collection %q Cannot numeric convert: %q", message.CollectionId, message.PreviousScheduleTime)
+			}
+			previousTime *= 1000 * 1000 * 1000
+		}
+		if err = rescheduleJob(dbMeta, message.CollectionId, previousTime, scheduleTime); err != nil {
+			log.Error(err, nil)
+		}
 	} else if message.Action == "schedule" {
 		newJob := scheduleJob{
 			collectionId:   message.CollectionId,
 			collectionPath: message.CollectionPath,
 			scheduleTime:   scheduleTime,
+			dependsOn:      message.DependsOn,
+			dryRun:         message.DryRun,
 		}
 
 		var files []kafka.FileResource
@@ -124,17 +118,33 @@ func scheduleCollection(jsonMessage []byte, dbMeta dbMetaObj) {
 		newJob.urisToDelete = make([]kafka.FileResource, len(deletes))
 		copy(newJob.urisToDelete, deletes)
 
+		// a job imported from the release calendar for the collection awaits these
+		// files (unless they are only to be rehearsed), and is moved to this time if
+		// imported at another
+		if !newJob.dryRun {
+			var importedId sql.NullInt64
+			err = dbMeta.prepped["find-imported-job"].QueryRow(newJob.collectionId, newJob.scheduleTime).Scan(&importedId)
+			if err != nil && err != sql.ErrNoRows {
+				log.Error(err, nil)
+				panic(err)
+			}
+			newJob.scheduleId = importedId.Int64
+		}
+
 		newJob.scheduleId = storeJob(dbMeta, &newJob)
-		log.Info(fmt.Sprintf("Job %d Collection %q scheduled: %d files, %d deletes", newJob.scheduleId, newJob.collectionId, len(newJob.files), len(newJob.urisToDelete)), nil)
+		log.Info(fmt.Sprintf("Job %d Collection %q scheduled: %d files, %d deletes", newJob.scheduleId, newJob.collectionId, len(newJob.files), len(newJob.urisToDelete)), log.Data{"dependsOn": newJob.dependsOn, "dryRun": newJob.dryRun})
+		validations.Validate()
 	} else {
-		log.Error(fmt.Errorf("Collection %q No/invalid action", message.CollectionId), log.Data{"msg": message})
-		panic("No/invalid action")
+		return fmt.Errorf("Collection %q No/invalid action %q", message.CollectionId, message.Action)
 	}
+	return nil
 }
 
-func checkSchedule(publishChannel chan scheduleJob, dbMeta dbMetaObj, restartGapNano int64, vaultClient *vault.VaultClient) {
-	epochTime := time.Now().UnixNano()
+// checkSchedule launches the jobs due by epochTime (and any to resend),
+// returning the schedule ids of those launched
+func checkSchedule(publishChannel chan scheduleJob, dbMeta dbMetaObj, epochTime, restartGapNano int64, vaultClient *vault.VaultClient) []int64 {
 	launchedThisTick := 0
+	var launched []int64
 
 	var rows *sql.Rows
 	var err error
@@ -153,9 +163,10 @@ func checkSchedule(publishChannel chan scheduleJob, dbMeta dbMetaObj, restartGap
 		var (
 			collectionId, collectionPath        sql.NullString
 			scheduleId, startTime, scheduleTime sql.NullInt64
+			dryRun                              bool
 		)
 
-		if err = rows.Scan(&scheduleId, &startTime, &scheduleTime, &collectionId, &collectionPath); err != nil {
+		if err = rows.Scan(&scheduleId, &startTime, &scheduleTime, &collectionId, &collectionPath, &dryRun); err != nil {
 			log.Error(err, nil)
 			panic(err)
 		}
@@ -175,14 +186,17 @@ func checkSchedule(publishChannel chan scheduleJob, dbMeta dbMetaObj, restartGap
 			encryptionKey:  getEncryptionKeyFromVault(collectionId.String, vaultClient),
 			files:          files,
 			urisToDelete:   deletes,
+			dryRun:         dryRun,
 		}
 		publishChannel <- jobToGo
 		launchedThisTick++
+		launched = append(launched, scheduleId.Int64)
 		log.Info(fmt.Sprintf("Job %d Collection %q launch#%d with %d files at time:%d", scheduleId.Int64, collectionId.String, launchedThisTick, len(files), epochTime), nil)
 	}
 	if verboseTick && launchedThisTick == 0 {
 		log.Trace(fmt.Sprintf("No collections ready at %d", epochTime), nil)
 	}
+	return launched
 }
 
 func loadDataFromDataBase(dbMeta dbMetaObj, scheduleId int64, loadDeletes bool) []kafka.FileResource {
@@ -223,38 +237,67 @@ func loadDataFromDataBase(dbMeta dbMetaObj, scheduleId int64, loadDeletes bool)
 }
 
 func storeJob(dbMeta dbMetaObj, jobObj *scheduleJob) int64 {
+	txn, err := dbMeta.db.Begin()
+	if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	scheduleId, err := storeJobIn(txn, dbMeta, jobObj)
+	if err == nil {
+		err = txn.Commit()
+	}
+	if err != nil {
+		rollbackAndError(txn, err)
+	}
+	return scheduleId
+}
+
+// storeJobIn inserts the job (or fills the imported job jobObj.scheduleId) in txn
+func storeJobIn(txn *sql.Tx, dbMeta dbMetaObj, jobObj *scheduleJob) (int64, error) {
 	var (
-		txn                           *sql.Tx
 		fileStmt, jobStmt, deleteStmt *sql.Stmt
 		err                           error
 		scheduleId                    sql.NullInt64
 		fileId                        int64
 	)
 
-	if txn, err = dbMeta.db.Begin(); err != nil {
-		log.Error(err, nil)
-		panic(err)
-	}
-
-	if jobStmt, err = txn.Prepare("INSERT INTO schedule (collection_id, collection_path, schedule_time, start_time, complete_time) VALUES ($1, $2, $3, NULL, NULL) RETURNING schedule_id"); err != nil {
-		rollbackAndError(txn, err)
+	if jobStmt, err = txn.Prepare("INSERT INTO schedule (collection_id, collection_path, schedule_time, start_time, complete_time, calendar_uid, awaiting_content, dry_run) VALUES ($1, $2, $3, NULL, NULL, $4, $5, $6) RETURNING schedule_id"); err != nil {
+		return 0, err
 	}
 	if fileStmt, err = txn.Prepare("INSERT INTO schedule_file (schedule_id, uri, file_location) VALUES ($1, $2, $3) RETURNING schedule_file_id"); err != nil {
-		rollbackAndError(txn, err)
+		return 0, err
 	}
 	if deleteStmt, err = txn.Prepare("INSERT INTO schedule_delete (schedule_id, uri) VALUES ($1, $2) RETURNING schedule_delete_id"); err != nil {
-		rollbackAndError(txn, err)
+		return 0, err
 	}
 
-	// insert job into schedule
-	res := jobStmt.QueryRow((*jobObj).collectionId, (*jobObj).collectionPath, (*jobObj).scheduleTime)
-	if err = res.Scan(&scheduleId); err != nil {
-		rollbackAndError(txn, err)
+	if (*jobObj).scheduleId != 0 {
+		// fill the existing (imported) job, at the time it is now scheduled for
+		scheduleId = sql.NullInt64{Int64: (*jobObj).scheduleId, Valid: true}
+		var importedTime int64
+		if err = txn.QueryRow("UPDATE schedule SET collection_path=$2, awaiting_content=false WHERE schedule_id=$1 RETURNING schedule_time", scheduleId.Int64, (*jobObj).collectionPath).Scan(&importedTime); err != nil {
+			return 0, err
+		}
+		if importedTime != (*jobObj).scheduleTime {
+			if moved, err := moveJobIn(txn, dbMeta, scheduleId.Int64, (*jobObj).scheduleTime, "reschedule", "schedule"); err != nil {
+				return 0, err
+			} else if !moved {
+				return 0, fmt.Errorf("Job %d Collection %q started before it could be given its files", scheduleId.Int64, (*jobObj).collectionId)
+			}
+			log.Info(fmt.Sprintf("Job %d Collection %q imported at %d, RESCHEDULED to %d by its schedule message", scheduleId.Int64, (*jobObj).collectionId, importedTime, (*jobObj).scheduleTime), nil)
+		}
+	} else {
+		// insert job into schedule
+		res := jobStmt.QueryRow((*jobObj).collectionId, (*jobObj).collectionPath, (*jobObj).scheduleTime,
+			sql.NullString{String: (*jobObj).calendarUid, Valid: (*jobObj).calendarUid != ""}, (*jobObj).awaitingContent, (*jobObj).dryRun)
+		if err = res.Scan(&scheduleId); err != nil {
+			return 0, err
+		}
 	}
 	// insert files into schedule_file
 	for i := 0; i < len((*jobObj).files); i++ {
 		if fileId, err = storeFile(fileStmt, scheduleId.Int64, (*jobObj).files[i].Uri, (*jobObj).files[i].Location); err != nil {
-			rollbackAndError(txn, err)
+			return 0, err
 		}
 		(*jobObj).files[i].Id = fileId
 	}
@@ -262,16 +305,22 @@ func storeJob(dbMeta dbMetaObj, jobObj *scheduleJob) int64 {
 	// insert deleted files into schedule_delete
 	for i := 0; i < len((*jobObj).urisToDelete); i++ {
 		if _, err = storeFile(deleteStmt, scheduleId.Int64, (*jobObj).urisToDelete[i].Uri, ""); err != nil {
-			rollbackAndError(txn, err)
+			return 0, err
 		}
 		(*jobObj).urisToDelete[i].Id = fileId
 	}
 
-	if err = txn.Commit(); err != nil {
-		rollbackAndError(txn, err)
+	// insert prerequisite collections into schedule_dependency
+	dependencyStmt := txn.Stmt(dbMeta.prepped["insert-dependency"])
+	for _, dependency := range (*jobObj).dependsOn {
+		if _, err = dependencyStmt.Exec(scheduleId.Int64, dependency); err != nil {
+			return 0, err
+		}
 	}
-
-	return scheduleId.Int64
+	if err = notifyChange(txn, dbMeta, scheduleId.Int64); err != nil {
+		return 0, err
+	}
+	return scheduleId.Int64, nil
 }
 
 func storeFile(stmt *sql.Stmt, scheduleId int64, uri, location string) (int64, error) {
@@ -316,32 +365,30 @@ func cancelJob(dbMeta dbMetaObj, collectionId string, scheduleTime int64) {
 	}
 
 	var scheduleIds []interface{}
-	placeholder := ""
 	for rows.Next() {
 		if err = rows.Scan(&scheduleId); err != nil {
 			rollbackAndError(txn, err)
 		}
 		scheduleIds = append(scheduleIds, scheduleId.Int64)
-		if len(placeholder) > 0 {
-			placeholder += ","
-		}
-		placeholder += "$" + strconv.Itoa(len(scheduleIds))
 	}
 
 	if len(scheduleIds) > 0 {
-		// delete files from schedule_file
-		if _, err := txn.Exec("DELETE FROM schedule_file WHERE schedule_id IN ("+placeholder+")", scheduleIds...); err != nil {
-			rollbackAndError(txn, fmt.Errorf("Jobs %v Collection %q Cannot delete files: %s", scheduleIds, collectionId, err))
+		if err = deleteJobFiles(txn, scheduleIds); err != nil {
+			rollbackAndError(txn, fmt.Errorf("Jobs %v Collection %q %s", scheduleIds, collectionId, err))
 		}
-		// delete files from schedule_delete
-		if _, err := txn.Exec("DELETE FROM schedule_delete WHERE schedule_id IN ("+placeholder+")", scheduleIds...); err != nil {
-			rollbackAndError(txn, fmt.Errorf("Jobs %v Collection %q Cannot delete file-deletes: %s", scheduleIds, collectionId, err))
+		for _, cancelledId := range scheduleIds {
+			if err = auditJob(txn.Stmt(dbMeta.prepped["insert-audit"]), cancelledId.(int64), collectionId, "cancel", "message", scheduleTime, 0); err != nil {
+				rollbackAndError(txn, err)
+			}
+			if err = notifyChange(txn, dbMeta, cancelledId.(int64)); err != nil {
+				rollbackAndError(txn, err)
+			}
 		}
 
 		log.Info(fmt.Sprintf("Jobs %v Collection %q at %d CANCELLED", scheduleIds, collectionId, scheduleTime), nil)
 
 	} else {
-		log.Info(fmt.Sprintf("Job ?? Collection %q at %d not found to cancel", collectionId, scheduleTime), nil)
+		log.Error(fmt.Errorf("Job ?? Collection %q at %d not found to cancel", collectionId, scheduleTime), nil)
 	}
 
 	if err = txn.Commit(); err != nil {
@@ -349,17 +396,272 @@ func cancelJob(dbMeta dbMetaObj, collectionId string, scheduleTime int64) {
 	}
 }
 
+// deleteJobFiles deletes the files, deletes and dependencies of the (cancelled) jobs
+func deleteJobFiles(txn *sql.Tx, scheduleIds []interface{}) error {
+	placeholder := ""
+	for i := range scheduleIds {
+		if len(placeholder) > 0 {
+			placeholder += ","
+		}
+		placeholder += "$" + strconv.Itoa(i+1)
+	}
+	// delete files from schedule_file
+	if _, err := txn.Exec("DELETE FROM schedule_file WHERE schedule_id IN ("+placeholder+")", scheduleIds...); err != nil {
+		return fmt.Errorf("Cannot delete files: %s", err)
+	}
+	// delete files from schedule_delete
+	if _, err := txn.Exec("DELETE FROM schedule_delete WHERE schedule_id IN ("+placeholder+")", scheduleIds...); err != nil {
+		return fmt.Errorf("Cannot delete file-deletes: %s", err)
+	}
+	// delete prerequisites from schedule_dependency
+	if _, err := txn.Exec("DELETE FROM schedule_dependency WHERE schedule_id IN ("+placeholder+")", scheduleIds...); err != nil {
+		return fmt.Errorf("Cannot delete dependencies: %s", err)
+	}
+	return nil
+}
+
+// cancelSchedule cancels the job scheduleId, returning false if it has already started (or does not exist)
+func cancelSchedule(dbMeta dbMetaObj, scheduleId int64) (bool, error) {
+	txn, err := dbMeta.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	var collectionId sql.NullString
+	var scheduleTime sql.NullInt64
+	err = txn.QueryRow("DELETE FROM schedule WHERE schedule_id=$1 AND start_time IS NULL RETURNING collection_id, schedule_time", scheduleId).Scan(&collectionId, &scheduleTime)
+	if err == sql.ErrNoRows {
+		txn.Rollback()
+		return false, nil
+	} else if err != nil {
+		txn.Rollback()
+		return false, err
+	}
+	if err = deleteJobFiles(txn, []interface{}{scheduleId}); err != nil {
+		txn.Rollback()
+		return false, fmt.Errorf("Job %d %s", scheduleId, err)
+	}
+	if err = auditJob(txn.Stmt(dbMeta.prepped["insert-audit"]), scheduleId, collectionId.String, "cancel", "api", scheduleTime.Int64, 0); err != nil {
+		txn.Rollback()
+		return false, err
+	}
+	if err = notifyChange(txn, dbMeta, scheduleId); err != nil {
+		txn.Rollback()
+		return false, err
+	}
+	return true, txn.Commit()
+}
+
+// moveJob moves the upcoming job scheduleId to newTime, recording the change
+// as action (by source) in the audit. It returns false if the job is not upcoming.
+func moveJob(dbMeta dbMetaObj, scheduleId, newTime int64, action, source string) (bool, error) {
+	txn, err := dbMeta.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	moved, err := moveJobIn(txn, dbMeta, scheduleId, newTime, action, source)
+	if err != nil || !moved {
+		txn.Rollback()
+		return false, err
+	}
+	return true, txn.Commit()
+}
+
+// moveJobIn moves the job as moveJob does, in txn. Having been moved, it is
+// no longer held or flagged, so its dependencies are checked afresh when due.
+func moveJobIn(txn *sql.Tx, dbMeta dbMetaObj, scheduleId, newTime int64, action, source string) (bool, error) {
+	var collectionId sql.NullString
+	var oldTime sql.NullInt64
+	err := txn.QueryRow("SELECT collection_id, schedule_time FROM schedule WHERE schedule_id=$1 AND start_time IS NULL AND complete_time IS NULL FOR UPDATE", scheduleId).Scan(&collectionId, &oldTime)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if _, err = txn.Exec("UPDATE schedule SET schedule_time=$2, held_time=NULL, flagged_time=NULL WHERE schedule_id=$1", scheduleId, newTime); err != nil {
+		return false, err
+	}
+	if err = auditJob(txn.Stmt(dbMeta.prepped["insert-audit"]), scheduleId, collectionId.String, action, source, oldTime.Int64, newTime); err != nil {
+		return false, err
+	}
+	if err = notifyChange(txn, dbMeta, scheduleId); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rescheduleJob moves the collection's upcoming job to newTime, keeping its
+// files and deletes. If previousTime is 0, the collection must have only one
+// upcoming job, otherwise the job at previousTime is moved. An error is
+// returned when there is no such job to move.
+func rescheduleJob(dbMeta dbMetaObj, collectionId string, previousTime, newTime int64) error {
+	rows, err := dbMeta.prepped["find-upcoming-jobs"].Query(collectionId)
+	if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	var scheduleIds []int64
+	for rows.Next() {
+		var scheduleId, scheduleTime sql.NullInt64
+		if err = rows.Scan(&scheduleId, &scheduleTime); err != nil {
+			log.Error(err, nil)
+			panic(err)
+		}
+		if previousTime == 0 || scheduleTime.Int64 == previousTime {
+			scheduleIds = append(scheduleIds, scheduleId.Int64)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	if len(scheduleIds) == 0 && previousTime == 0 {
+		return fmt.Errorf("Collection %q has no upcoming job to reschedule", collectionId)
+	} else if len(scheduleIds) == 0 {
+		return fmt.Errorf("Collection %q has no upcoming job at %d to reschedule", collectionId, previousTime)
+	} else if len(scheduleIds) > 1 {
+		return fmt.Errorf("Jobs %v Collection %q not rescheduled, give the PreviousScheduleTime of the one to move", scheduleIds, collectionId)
+	}
+
+	moved, err := moveJob(dbMeta, scheduleIds[0], newTime, "reschedule", "message")
+	if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	} else if !moved {
+		return fmt.Errorf("Job %d Collection %q started before it could be rescheduled", scheduleIds[0], collectionId)
+	}
+	log.Info(fmt.Sprintf("Job %d Collection %q RESCHEDULED to %d", scheduleIds[0], collectionId, newTime), nil)
+	return nil
+}
+
+// jobAborter aborts running jobs: it marks them aborted in the database, so
+// that they are neither resent nor completed, and announces them on the abort
+// topic, so that the publishing services drop their remaining messages
+type jobAborter struct {
+	dbMeta   dbMetaObj
+	producer kafka.Producer
+	aborted  *kafka.AbortedSchedules
+}
+
+// abort aborts the running job scheduleId, recording source in the audit. It
+// returns false if the job is not running (or does not exist).
+func (aborter jobAborter) abort(scheduleId int64, source string) (bool, error) {
+	txn, err := aborter.dbMeta.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	abortTime := time.Now().UnixNano()
+	var collectionId sql.NullString
+	var scheduleTime sql.NullInt64
+	err = txn.QueryRow("UPDATE schedule SET abort_time=$2 WHERE schedule_id=$1 AND start_time IS NOT NULL AND complete_time IS NULL AND abort_time IS NULL RETURNING collection_id, schedule_time", scheduleId, abortTime).Scan(&collectionId, &scheduleTime)
+	if err == sql.ErrNoRows {
+		txn.Rollback()
+		return false, nil
+	} else if err != nil {
+		txn.Rollback()
+		return false, err
+	}
+	if err = auditJob(txn.Stmt(aborter.dbMeta.prepped["insert-audit"]), scheduleId, collectionId.String, "abort", source, scheduleTime.Int64, 0); err != nil {
+		txn.Rollback()
+		return false, err
+	}
+
+	// announce the abort before committing, so that a failed announcement can be retried
+	data, err := aborter.producer.Encode(kafka.ScheduleAbortedMessage{ScheduleId: scheduleId, CollectionId: collectionId.String, AbortTime: abortTime}, "")
+	if err == nil {
+		err = aborter.producer.Send(data)
+	}
+	if err != nil {
+		txn.Rollback()
+		return false, fmt.Errorf("Job %d Collection %q could not announce abort: %s", scheduleId, collectionId.String, err)
+	}
+	aborter.aborted.Add(scheduleId)
+	return true, txn.Commit()
+}
+
+// abortJobs aborts the collection's running job(s) at scheduleTime
+func abortJobs(aborter jobAborter, collectionId string, scheduleTime int64) {
+	rows, err := aborter.dbMeta.prepped["find-running-jobs"].Query(collectionId, scheduleTime)
+	if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	var scheduleIds []int64
+	for rows.Next() {
+		var scheduleId sql.NullInt64
+		if err = rows.Scan(&scheduleId); err != nil {
+			log.Error(err, nil)
+			panic(err)
+		}
+		scheduleIds = append(scheduleIds, scheduleId.Int64)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	if len(scheduleIds) == 0 {
+		log.Error(fmt.Errorf("Job ?? Collection %q at %d not found running to abort", collectionId, scheduleTime), nil)
+		return
+	}
+
+	for _, scheduleId := range scheduleIds {
+		abortedJob, err := aborter.abort(scheduleId, "message")
+		if err != nil {
+			log.Error(err, nil)
+			panic(err)
+		} else if abortedJob {
+			log.Info(fmt.Sprintf("Job %d Collection %q at %d ABORTED", scheduleId, collectionId, scheduleTime), nil)
+		}
+	}
+}
+
+// auditJob records a change to a job. A time of 0 is recorded as NULL.
+func auditJob(stmt *sql.Stmt, scheduleId int64, collectionId, action, source string, oldTime, newTime int64) error {
+	_, err := stmt.Exec(scheduleId, collectionId, action, source,
+		sql.NullInt64{Int64: oldTime, Valid: oldTime != 0},
+		sql.NullInt64{Int64: newTime, Valid: newTime != 0},
+		time.Now().UnixNano())
+	return err
+}
+
 func getEncryptionKeyFromVault(collectionId string, vaultClient *vault.VaultClient) string {
-	data, err := vaultClient.Read("secret/zebedee-cms/" + collectionId)
+	key, err := readEncryptionKey(collectionId, vaultClient)
 	if err != nil {
 		log.ErrorC("Failed to find encryption key", err, nil)
 		panic("Failed to find encryption key")
 	}
-	key, ok := data["encryption_key"].(string)
-	if ok {
-		return key
+	return key
+}
+
+// readEncryptionKey returns the collection's key, or "" if vault has none
+func readEncryptionKey(collectionId string, vaultClient *vault.VaultClient) (string, error) {
+	data, err := vaultClient.Read("secret/zebedee-cms/" + collectionId)
+	if err != nil {
+		return "", err
+	}
+	key, _ := data["encryption_key"].(string)
+	return key, nil
+}
+
+// readEmbargoSigner returns the signer of embargoes, with the key ("private_key",
+// PEM encoded) at path in vault, or nil if vault has none
+func readEmbargoSigner(vaultClient *vault.VaultClient, path string) (*kafka.EmbargoSigner, error) {
+	data, err := vaultClient.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	key, _ := data["private_key"].(string)
+	if key == "" {
+		return nil, nil
 	}
-	return ""
+	return kafka.NewEmbargoSigner(key)
+}
+
+// prepJobs prepares the statements finding the jobs of a collection (to be
+// rescheduled or aborted), and auditing their changes
+func (dbMeta dbMetaObj) prepJobs() {
+	dbMeta.prep("find-upcoming-jobs", "SELECT schedule_id, schedule_time FROM schedule WHERE collection_id=$1 AND start_time IS NULL AND complete_time IS NULL")
+	dbMeta.prep("find-running-jobs", "SELECT schedule_id FROM schedule WHERE collection_id=$1 AND schedule_time=$2 AND start_time IS NOT NULL AND complete_time IS NULL AND abort_time IS NULL")
+	dbMeta.prep("insert-audit", "INSERT INTO schedule_audit (schedule_id, collection_id, action, source, old_schedule_time, new_schedule_time, audit_time) VALUES ($1, $2, $3, $4, $5, $6, $7)")
 }
 
 func (dbMeta dbMetaObj) prep(tag, sql string) {
@@ -371,6 +673,15 @@ func (dbMeta dbMetaObj) prep(tag, sql string) {
 	}
 }
 
+func (dbMeta dbMetaObj) close() error {
+	for tag, stmt := range dbMeta.prepped {
+		if err := stmt.Close(); err != nil {
+			log.ErrorC("Could not close statement", err, log.Data{"tag": tag})
+		}
+	}
+	return dbMeta.db.Close()
+}
+
 func main() {
 	log.Namespace = "publish-scheduler"
 	maxMessageSize, err := utils.GetEnvironmentVariableInt("KAFKA_MESSAGE_SIZE", 157286400) // default to 150MB
@@ -378,6 +689,9 @@ func main() {
 	produceFileTopic := utils.GetEnvironmentVariable("PUBLISH_FILE_TOPIC", "uk.gov.ons.dp.web.publish-file")
 	produceDeleteTopic := utils.GetEnvironmentVariable("PUBLISH_DELETE_TOPIC", "uk.gov.ons.dp.web.publish-delete")
 	produceTotalTopic := utils.GetEnvironmentVariable("PUBLISH_COUNT_TOPIC", "uk.gov.ons.dp.web.publish-count")
+	abortTopic := utils.GetEnvironmentVariable("ABORT_TOPIC", "uk.gov.ons.dp.web.schedule-aborted")
+	rehearsalTopic := utils.GetEnvironmentVariable("REHEARSAL_TOPIC", "uk.gov.ons.dp.web.rehearsal")
+	deadLetterTopic := utils.GetEnvironmentVariable("DEAD_LETTER_TOPIC", "")
 	dbSource := utils.GetEnvironmentVariable("DB_ACCESS", "user=dp dbname=dp sslmode=disable")
 	restartGap, err := utils.GetEnvironmentVariableInt("RESEND_AFTER_QUIET_SECONDS", 0)
 	if err != nil {
@@ -385,17 +699,56 @@ func main() {
 		panic("Failed to parse RESEND_AFTER_QUIET_SECONDS")
 	}
 	restartGapNano := int64(restartGap * 1000 * 1000 * 1000)
+	dependencyTimeout, err := utils.GetEnvironmentVariableInt("DEPENDENCY_TIMEOUT_MINUTES", 60)
+	if err != nil {
+		log.ErrorC("Failed to parse DEPENDENCY_TIMEOUT_MINUTES", err, nil)
+		panic("Failed to parse DEPENDENCY_TIMEOUT_MINUTES")
+	}
+	dependencyTimeoutNano := int64(time.Duration(dependencyTimeout) * time.Minute)
+	reconcileSeconds, err := utils.GetEnvironmentVariableInt("RECONCILE_SECONDS", 30)
+	if err != nil || reconcileSeconds <= 0 {
+		log.ErrorC("Failed to parse RECONCILE_SECONDS", err, nil)
+		panic("Failed to parse RECONCILE_SECONDS")
+	}
 	vaultToken := utils.GetEnvironmentVariable("VAULT_TOKEN", "")
 	vaultAddr := utils.GetEnvironmentVariable("VAULT_ADDR", "http://127.0.0.1:8200")
 	vaultRenewTime, err := utils.GetEnvironmentVariableInt("VAULT_RENEW_TIME", 5)
+	embargoKeyPath := utils.GetEnvironmentVariable("EMBARGO_SIGNING_KEY_PATH", "secret/publish-scheduler/embargo")
+	embargoRequired := utils.GetEnvironmentVariable("EMBARGO_REQUIRED", "0") != "0"
 	healthCheckAddr := utils.GetEnvironmentVariable("HEALTHCHECK_ADDR", ":8080")
 	healthCheckEndpoint := utils.GetEnvironmentVariable("HEALTHCHECK_ENDPOINT", "/healthcheck")
+	metricsEndpoint := utils.GetEnvironmentVariable("METRICS_ENDPOINT", "/metrics")
+	adminEndpoint := utils.GetEnvironmentVariable("ADMIN_ENDPOINT", "/admin/consumers")
+	schedulesEndpoint := utils.GetEnvironmentVariable("SCHEDULES_ENDPOINT", "/schedules")
+	schedulesToken := utils.GetEnvironmentVariable("SCHEDULES_API_TOKEN", "")
+	adminToken := utils.GetEnvironmentVariable("ADMIN_API_TOKEN", schedulesToken)
+
+	upstreamBucketName := utils.GetEnvironmentVariable("UPSTREAM_S3_BUCKET", "upstream-content")
+	upstreamRegionName := utils.GetEnvironmentVariable("UPSTREAM_S3_REGION", "eu-west-1")
+	upstreamEndpoint := utils.GetEnvironmentVariable("UPSTREAM_S3_URL", "localhost:4000")
+	upstreamS3Secure := (utils.GetEnvironmentVariable("UPSTREAM_S3_SECURE", "1") == "1")
+	upstreamIAM := (utils.GetEnvironmentVariable("UPSTREAM_S3_IAM", "1") == "1")
 
 	vaultClient, err := vault.CreateVaultClient(vaultToken, vaultAddr)
 	if err != nil {
 		log.ErrorC("Failed to connect to vault", err, nil)
 		panic("Failed to connect to vault")
 	}
+	signer, err := readEmbargoSigner(vaultClient, embargoKeyPath)
+	if err != nil {
+		log.ErrorC("Failed to read the embargo signing key", err, log.Data{"path": embargoKeyPath})
+		panic("Failed to read the embargo signing key")
+	} else if signer == nil && embargoRequired {
+		log.Error(fmt.Errorf("No embargo signing key in vault at %s", embargoKeyPath), nil)
+		panic("No embargo signing key in vault")
+	} else if signer == nil {
+		log.Info("No embargo signing key in vault, so files are sent unsigned", log.Data{"path": embargoKeyPath})
+	}
+	s3UpstreamClient, err := s3.CreateClient(upstreamRegionName, upstreamBucketName, upstreamEndpoint, upstreamIAM, upstreamS3Secure)
+	if err != nil {
+		log.ErrorC("Could not create s3 upstream client", err, nil)
+		panic(err)
+	}
 
 	db, err := sql.Open("postgres", dbSource)
 	if err != nil {
@@ -410,32 +763,128 @@ func main() {
 	dbMeta.prep("load-incomplete-files", "SELECT schedule_file_id, uri, file_location FROM schedule_file WHERE schedule_id=$1 AND complete_time IS NULL")
 	dbMeta.prep("load-incomplete-deletes", "SELECT schedule_delete_id, uri FROM schedule_delete WHERE schedule_id=$1 AND complete_time IS NULL")
 	dbMeta.prep("healthcheck", "SELECT 1 FROM schedule_delete")
+	dbMeta.prepJobs()
+	dbMeta.prepDependencies()
+	dbMeta.prepLaunchQueue()
+	dbMeta.prepRehearsals()
+	dbMeta.prep("set-calendar-uid", "UPDATE schedule SET calendar_uid=$2 WHERE schedule_id=$1")
+	dbMeta.prep("find-imported-job", "SELECT schedule_id FROM schedule s WHERE collection_id=$1 AND start_time IS NULL AND complete_time IS NULL AND abort_time IS NULL AND NOT dry_run AND "+awaitingContent+" ORDER BY schedule_time=$2 DESC, schedule_time LIMIT 1")
+	// a job held back by its dependencies, or imported and yet to be given its files, is not ready
 	if restartGap == 0 {
-		dbMeta.prep("select-ready", "UPDATE schedule s SET start_time=$1 WHERE complete_time IS NULL AND start_time IS NULL AND schedule_time <= $1 RETURNING schedule_id, start_time, schedule_time, collection_id, collection_path")
+		dbMeta.prep("select-ready", "UPDATE schedule s SET start_time=$1 WHERE complete_time IS NULL AND abort_time IS NULL AND start_time IS NULL AND schedule_time <= $1 AND NOT "+hasUnmetDependency+" AND NOT "+awaitingContent+" RETURNING schedule_id, start_time, schedule_time, collection_id, collection_path, dry_run")
 	} else {
-		dbMeta.prep("select-ready", "UPDATE schedule s SET start_time=$1 WHERE complete_time IS NULL AND schedule_time <= $1 AND (start_time IS NULL OR (start_time <= $2 AND NOT EXISTS(SELECT 1 FROM schedule_file sf WHERE s.schedule_id=sf.schedule_id AND sf.complete_time > $2))) RETURNING schedule_id, start_time, schedule_time, collection_id, collection_path")
+		dbMeta.prep("select-ready", "UPDATE schedule s SET start_time=$1 WHERE complete_time IS NULL AND abort_time IS NULL AND schedule_time <= $1 AND ((start_time IS NULL AND NOT "+hasUnmetDependency+" AND NOT "+awaitingContent+") OR (start_time <= $2 AND NOT EXISTS(SELECT 1 FROM schedule_file sf WHERE s.schedule_id=sf.schedule_id AND sf.complete_time > $2))) RETURNING schedule_id, start_time, schedule_time, collection_id, collection_path, dry_run")
+	}
+
+	// several schedulers may run, but only the leader launches jobs and checks dependencies
+	// (every instance renews its vault token, to be ready to lead)
+	elector, err := leader.NewElector(db, "publish-scheduler")
+	if err != nil {
+		log.ErrorC("Could not start leader election", err, nil)
+		panic(err)
 	}
 
 	log.Info(fmt.Sprintf("Starting publish scheduler topics: %q -> %q/%q/%q", scheduleTopic, produceFileTopic, produceDeleteTopic, produceTotalTopic), nil)
 
+	if err := kafka.EnsureTopics(
+		kafka.Topic{Role: "schedule", Name: scheduleTopic},
+		kafka.Topic{Role: "publish-file", Name: produceFileTopic},
+		kafka.Topic{Role: "publish-delete", Name: produceDeleteTopic},
+		kafka.Topic{Role: "publish-count", Name: produceTotalTopic},
+		kafka.Topic{Role: "schedule-aborted", Name: abortTopic},
+		kafka.Topic{Role: "rehearsal", Name: rehearsalTopic},
+	); err != nil {
+		log.ErrorC("Could not ensure kafka topics", err, nil)
+		panic(err)
+	}
 	kafka.SetMaxMessageSize(int32(maxMessageSize))
-	totalProducer := kafka.NewProducer(produceTotalTopic)
-	scheduleConsumer, err := kafka.NewConsumerGroup(scheduleTopic, "publish-scheduler")
+	bus := kafka.KafkaBus{}
+	totalProducer := bus.NewProducer(produceTotalTopic)
+	scheduleConsumer, err := bus.NewConsumerGroup(scheduleTopic, "publish-scheduler")
 	if err != nil {
 		log.ErrorC("Could not obtain consumer", err, nil)
 		panic("Could not obtain consumer")
 	}
-	fileProducer := kafka.NewProducer(produceFileTopic)
-	deleteProducer := kafka.NewProducer(produceDeleteTopic)
+	scheduleConsumer.SetDeadLetterTopic(deadLetterTopic, "publish-scheduler")
+	rehearsalConsumer, err := bus.NewConsumerGroup(rehearsalTopic, "publish-scheduler")
+	if err != nil {
+		log.ErrorC("Could not obtain rehearsal consumer", err, nil)
+		panic("Could not obtain rehearsal consumer")
+	}
+	rehearsalConsumer.SetDeadLetterTopic(deadLetterTopic, "publish-scheduler")
+	fileProducer := bus.NewProducer(produceFileTopic)
+	deleteProducer := bus.NewProducer(produceDeleteTopic)
+	aborted, err := kafka.WatchAbortedSchedules(bus, abortTopic)
+	if err != nil {
+		log.ErrorC("Could not watch for aborted schedules", err, nil)
+		panic(err)
+	}
+	aborter := jobAborter{dbMeta: dbMeta, producer: bus.NewAckProducer(abortTopic), aborted: aborted}
+	schedules := newScheduleAPI(dbMeta, schedulesEndpoint, aborter, schedulesToken)
+	if schedulesToken == "" {
+		log.Info("No SCHEDULES_API_TOKEN, so the schedules API is read-only", nil)
+	}
+	validations := newValidator(dbMeta, s3UpstreamClient, func(collectionId string) (string, error) {
+		return readEncryptionKey(collectionId, vaultClient)
+	})
 
 	publishChannel := make(chan scheduleJob)
 	healthChannel := make(chan bool)
 	exitChannel := make(chan bool)
+	quitScheduler := make(chan bool)
+	quitMainLoop := make(chan bool)
+	var publishing sync.WaitGroup
+
+	// jobs are launched when due, by the launch queue, which follows the changes
+	// notified by the database; it is reloaded every RECONCILE_SECONDS in case
+	// any were missed. Due jobs not launched (e.g. held) stay queued, to be
+	// checked again after recheck, as are stalled jobs to resend.
+	launches := newLaunchQueue()
+	listener := pq.NewListener(dbSource, time.Second, time.Minute, nil)
+	if err = listener.Listen(scheduleChannel); err != nil {
+		log.ErrorC("Could not listen for schedule changes", err, nil)
+		panic(err)
+	}
+	quitListener := make(chan bool)
+	go listenForChanges(listener, launches, dbMeta, quitListener)
+	loadLaunchQueue(launches, dbMeta)
+	log.Info(fmt.Sprintf("Loaded %d upcoming jobs", launches.Len()), nil)
 
 	go func() {
-		tock := time.Tick(tick)
-		for _ = range tock {
-			checkSchedule(publishChannel, dbMeta, restartGapNano, vaultClient)
+		reconcile := time.NewTicker(time.Duration(reconcileSeconds) * time.Second)
+		defer reconcile.Stop()
+		// a standby which becomes the leader checks at once, rather than when the next job is due
+		leadership := time.NewTicker(time.Second)
+		defer leadership.Stop()
+		// running jobs are not queued, so are checked for resending as often as held jobs
+		var resends <-chan time.Time
+		if restartGapNano > 0 {
+			resend := time.NewTicker(recheck)
+			defer resend.Stop()
+			resends = resend.C
+		}
+		leading := false
+		for {
+			select {
+			case <-launches.Due():
+			case <-resends:
+			case <-reconcile.C:
+				loadLaunchQueue(launches, dbMeta)
+			case <-leadership.C:
+				if leading == elector.IsLeader() {
+					continue
+				}
+			case <-quitScheduler:
+				return
+			}
+			leading = elector.IsLeader()
+			epochTime := time.Now().UnixNano()
+			var launched []int64
+			if leading {
+				launched = checkSchedule(publishChannel, dbMeta, epochTime, restartGapNano, vaultClient)
+				checkDependencies(dbMeta, epochTime, dependencyTimeoutNano)
+			}
+			launches.Launched(epochTime, launched)
 		}
 	}()
 
@@ -452,7 +901,13 @@ func main() {
 	}()
 
 	go func() {
-		http.HandleFunc(healthCheckEndpoint, health.NewHealthChecker(healthChannel, dbMeta.prepped["healthcheck"]))
+		http.HandleFunc(healthCheckEndpoint, health.NewHealthCheckerWithDetail(healthChannel, dbMeta.prepped["healthcheck"], func() interface{} {
+			return map[string]interface{}{"leader": elector.Status()}
+		}))
+		http.HandleFunc(metricsEndpoint, metrics.Handler)
+		http.HandleFunc(adminEndpoint, admin.NewHandler(adminToken, scheduleConsumer))
+		http.Handle(schedules.prefix, schedules)
+		http.Handle(schedules.prefix+"/", schedules)
 		log.Info(fmt.Sprintf("Listening for %s on %s", healthCheckEndpoint, healthCheckAddr), nil)
 		log.ErrorC("healthcheck listener exited", http.ListenAndServe(healthCheckAddr, nil), nil)
 		panic("healthcheck listener exited")
@@ -462,18 +917,81 @@ func main() {
 		for {
 			select {
 			case scheduleMessage := <-scheduleConsumer.Incoming:
-				scheduleCollection(scheduleMessage.GetData(), dbMeta)
-				scheduleMessage.Commit()
+				if err := scheduleConsumer.Handle(scheduleMessage, func(msg kafka.Message) error {
+					return scheduleCollection(msg.GetData(), dbMeta, aborter, validations)
+				}); err != nil {
+					log.ErrorC("Failed to schedule collection", err, log.Data{"msg": string(scheduleMessage.GetData())})
+					panic(err)
+				}
+			case rehearsalMessage := <-rehearsalConsumer.Incoming:
+				if err := rehearsalConsumer.Handle(rehearsalMessage, func(msg kafka.Message) error {
+					return storeRehearsal(msg.GetData(), dbMeta)
+				}); err != nil {
+					log.ErrorC("Failed to store rehearsal record", err, log.Data{"msg": string(rehearsalMessage.GetData())})
+					if _, unforwarded := err.(kafka.ForwardError); unforwarded {
+						panic(err)
+					}
+					rehearsalMessage.Commit()
+				}
 			case publishMessage := <-publishChannel:
-				go publishCollection(publishMessage, fileProducer.Output, deleteProducer.Output, totalProducer.Output)
+				publishing.Add(1)
+				go func() {
+					defer publishing.Done()
+					scheduler.Publish(publishMessage.publication(), fileProducer, deleteProducer, aborted, signer)
+				}()
 			case <-healthChannel:
 			case errorMessage := <-scheduleConsumer.Errors:
 				log.Error(fmt.Errorf("Aborting"), log.Data{"messageReceived": errorMessage})
 				exitChannel <- true
 				return
+			case errorMessage := <-rehearsalConsumer.Errors:
+				log.Error(fmt.Errorf("Aborting"), log.Data{"messageReceived": errorMessage})
+				exitChannel <- true
+				return
+			case <-quitMainLoop:
+				return
 			}
 		}
 	}()
-	<-exitChannel
-	log.Info("Service publish scheduler stopped", nil)
+
+	// the main loop must keep running until the scheduler has stopped,
+	// as checkSchedule hands launched jobs to it
+	graceful, err := shutdown.New("publish-scheduler")
+	if err != nil {
+		log.ErrorC("Could not prepare for shutdown", err, nil)
+		panic(err)
+	}
+	graceful.Add("stop scheduler", func() error {
+		quitScheduler <- true
+		return nil
+	})
+	graceful.Add("stop listening for schedule changes", func() error {
+		quitListener <- true
+		return listener.Close()
+	})
+	graceful.Add("stop leader election", elector.Close)
+	graceful.Add("stop main loop", func() error {
+		quitMainLoop <- true
+		return nil
+	})
+	graceful.Add("finish validating", validations.Close)
+	graceful.Add("finish publishing", func() error {
+		publishing.Wait()
+		return nil
+	})
+	graceful.Add("close publish-file producer", fileProducer.Close)
+	graceful.Add("close publish-delete producer", deleteProducer.Close)
+	graceful.Add("close publish-count producer", totalProducer.Close)
+	graceful.Add("close schedule-aborted producer", aborter.producer.Close)
+	graceful.Add("close consumer", scheduleConsumer.Close)
+	graceful.Add("close rehearsal consumer", rehearsalConsumer.Close)
+	graceful.Add("stop watching aborted schedules", aborted.Close)
+	graceful.Add("close database", dbMeta.close)
+
+	select {
+	case <-exitChannel:
+		log.Info("Service publish scheduler stopped", nil)
+	case <-graceful.Signals:
+		graceful.Shutdown()
+	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDB connects to the local database (skipping the test without one), with
+// the statements of jobs and their dependencies prepared
+func testDB(t *testing.T) dbMetaObj {
+	db, err := sql.Open("postgres", "user=dp dbname=dp sslmode=disable")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skip("Local postgres database was not found")
+	}
+	dbMeta := dbMetaObj{db: db, prepped: make(map[string]*sql.Stmt)}
+	dbMeta.prepJobs()
+	dbMeta.prepDependencies()
+	dbMeta.prepLaunchQueue()
+	return dbMeta
+}
+
+// insertJob stores an upcoming job of collectionId, removing it (and its audit) when the test ends
+func insertJob(t *testing.T, dbMeta dbMetaObj, collectionId string, scheduleTime int64) int64 {
+	var scheduleId int64
+	if err := dbMeta.db.QueryRow("INSERT INTO schedule(collection_id, collection_path, schedule_time) VALUES($1, $1, $2) RETURNING schedule_id",
+		collectionId, scheduleTime).Scan(&scheduleId); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbMeta.db.Exec("DELETE FROM schedule WHERE schedule_id=$1", scheduleId)
+		dbMeta.db.Exec("DELETE FROM schedule_audit WHERE schedule_id=$1", scheduleId)
+	})
+	return scheduleId
+}
+
+func scheduleTimeOf(t *testing.T, dbMeta dbMetaObj, scheduleId int64) int64 {
+	var scheduleTime int64
+	if err := dbMeta.db.QueryRow("SELECT schedule_time FROM schedule WHERE schedule_id=$1", scheduleId).Scan(&scheduleTime); err != nil {
+		t.Fatal(err)
+	}
+	return scheduleTime
+}
+
+func TestRescheduleJob(t *testing.T) {
+	dbMeta := testDB(t)
+	defer dbMeta.db.Close()
+
+	// well ahead, so that no running scheduler launches them
+	nine := time.Now().Add(24 * time.Hour).Truncate(time.Hour).UnixNano()
+	ten, eleven := nine+int64(time.Hour), nine+2*int64(time.Hour)
+	collectionId := fmt.Sprintf("reschedule-%d", time.Now().UnixNano())
+	first := insertJob(t, dbMeta, collectionId, nine)
+	second := insertJob(t, dbMeta, collectionId, ten)
+
+	// two upcoming jobs, so the one to move must be given
+	if err := rescheduleJob(dbMeta, collectionId, 0, eleven); err == nil || !strings.Contains(err.Error(), "PreviousScheduleTime") {
+		t.Errorf("Test failed, expected the reschedule to be ambiguous, got %v", err)
+	}
+	if scheduleTimeOf(t, dbMeta, first) != nine || scheduleTimeOf(t, dbMeta, second) != ten {
+		t.Error("Test failed, expected an ambiguous reschedule to move nothing")
+	}
+
+	if err := rescheduleJob(dbMeta, collectionId, nine, eleven); err != nil {
+		t.Fatal(err)
+	}
+	if moved := scheduleTimeOf(t, dbMeta, first); moved != eleven {
+		t.Errorf("Test failed, expected job %d moved to %d, got %d", first, eleven, moved)
+	}
+	var action, source string
+	var oldTime, newTime sql.NullInt64
+	if err := dbMeta.db.QueryRow("SELECT action, source, old_schedule_time, new_schedule_time FROM schedule_audit WHERE schedule_id=$1", first).Scan(&action, &source, &oldTime, &newTime); err != nil {
+		t.Fatal(err)
+	}
+	if action != "reschedule" || source != "message" || oldTime.Int64 != nine || newTime.Int64 != eleven {
+		t.Errorf("Test failed, unexpected audit: %s by %s from %d to %d", action, source, oldTime.Int64, newTime.Int64)
+	}
+
+	// once started, a job stays where it is
+	if _, err := dbMeta.db.Exec("UPDATE schedule SET start_time=$2 WHERE schedule_id=$1", second, time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rescheduleJob(dbMeta, collectionId, ten, nine); err == nil {
+		t.Error("Test failed, expected a started job not to be rescheduled")
+	}
+	if scheduleTimeOf(t, dbMeta, second) != ten {
+		t.Error("Test failed, expected the started job left at its time")
+	}
+}
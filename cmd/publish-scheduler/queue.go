@@ -0,0 +1,230 @@
+package main
+
+import (
+	"container/heap"
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/go-ns/log"
+	"github.com/lib/pq"
+)
+
+// scheduleChannel is the postgres channel on which changes to jobs are
+// notified (with the schedule id), by the schedulers and publish-tracker
+const scheduleChannel = "schedule"
+
+// recheck is how soon a due job which was not launched (held back by its
+// dependencies, awaiting its files, or skipped as too many were launched) is
+// checked again, as is a running job for resending
+var recheck = time.Second
+
+// launchQueue holds the schedule times of upcoming jobs, so that the scheduler
+// wakes when the next is due, rather than polling for it
+type launchQueue struct {
+	mutex sync.Mutex
+	times map[int64]int64 // the schedule time of each upcoming job, by schedule id
+	queue launchTimes     // the times in order, with any since moved or removed
+	timer *time.Timer
+	due   chan bool
+}
+
+type launchTime struct {
+	scheduleId   int64
+	scheduleTime int64
+}
+
+// launchTimes is a heap of launchTime, the earliest first
+type launchTimes []launchTime
+
+func (t launchTimes) Len() int            { return len(t) }
+func (t launchTimes) Less(i, j int) bool  { return t[i].scheduleTime < t[j].scheduleTime }
+func (t launchTimes) Swap(i, j int)       { t[i], t[j] = t[j], t[i] }
+func (t *launchTimes) Push(x interface{}) { *t = append(*t, x.(launchTime)) }
+func (t *launchTimes) Pop() interface{} {
+	old := *t
+	last := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return last
+}
+
+func newLaunchQueue() *launchQueue {
+	return &launchQueue{times: make(map[int64]int64), due: make(chan bool, 1)}
+}
+
+// Due receives when a job is due, or the scheduler is woken
+func (q *launchQueue) Due() <-chan bool {
+	return q.due
+}
+
+// wake has the scheduler check for jobs now
+func (q *launchQueue) wake() {
+	select {
+	case q.due <- true:
+	default:
+	}
+}
+
+// Set queues (or moves) the job scheduleId
+func (q *launchQueue) Set(scheduleId, scheduleTime int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if queued, ok := q.times[scheduleId]; ok && queued == scheduleTime {
+		return
+	}
+	q.times[scheduleId] = scheduleTime
+	heap.Push(&q.queue, launchTime{scheduleId, scheduleTime})
+	q.reset()
+}
+
+// Remove drops the job scheduleId from the queue
+func (q *launchQueue) Remove(scheduleId int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.times, scheduleId)
+	q.reset()
+}
+
+// Replace replaces the queue with times (of each job, by schedule id)
+func (q *launchQueue) Replace(times map[int64]int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.times = times
+	q.queue = q.queue[:0]
+	for scheduleId, scheduleTime := range times {
+		q.queue = append(q.queue, launchTime{scheduleId, scheduleTime})
+	}
+	heap.Init(&q.queue)
+	q.reset()
+}
+
+// Launched drops the launched jobs, of those due by epochTime for which the
+// scheduler has checked. The others due are kept, to be checked again after recheck.
+func (q *launchQueue) Launched(epochTime int64, launched []int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, scheduleId := range launched {
+		delete(q.times, scheduleId)
+	}
+	var notLaunched []int64
+	for len(q.queue) > 0 && q.queue[0].scheduleTime <= epochTime {
+		next := heap.Pop(&q.queue).(launchTime)
+		if q.times[next.scheduleId] == next.scheduleTime {
+			notLaunched = append(notLaunched, next.scheduleId)
+		}
+	}
+	recheckTime := epochTime + int64(recheck)
+	for _, scheduleId := range notLaunched {
+		q.times[scheduleId] = recheckTime
+		heap.Push(&q.queue, launchTime{scheduleId, recheckTime})
+	}
+	q.reset()
+}
+
+// Len is the number of jobs queued
+func (q *launchQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.times)
+}
+
+// reset drops the times since moved or removed from the front of the queue,
+// and sets the timer for the next job due. The mutex must be held.
+func (q *launchQueue) reset() {
+	for len(q.queue) > 0 {
+		if scheduleTime, ok := q.times[q.queue[0].scheduleId]; ok && scheduleTime == q.queue[0].scheduleTime {
+			break
+		}
+		heap.Pop(&q.queue)
+	}
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	if len(q.queue) > 0 {
+		q.timer = time.AfterFunc(time.Until(time.Unix(0, q.queue[0].scheduleTime)), q.wake)
+	}
+}
+
+func (dbMeta dbMetaObj) prepLaunchQueue() {
+	dbMeta.prep("notify-change", "SELECT pg_notify('"+scheduleChannel+"', $1)")
+	dbMeta.prep("load-upcoming", "SELECT schedule_id, schedule_time FROM schedule WHERE start_time IS NULL AND complete_time IS NULL AND abort_time IS NULL")
+	dbMeta.prep("find-upcoming", "SELECT schedule_time FROM schedule WHERE schedule_id=$1 AND start_time IS NULL AND complete_time IS NULL AND abort_time IS NULL")
+}
+
+// notifyChange notifies the schedulers, when txn commits, that the jobs have changed
+func notifyChange(txn *sql.Tx, dbMeta dbMetaObj, scheduleIds ...int64) error {
+	stmt := txn.Stmt(dbMeta.prepped["notify-change"])
+	for _, scheduleId := range scheduleIds {
+		if _, err := stmt.Exec(strconv.FormatInt(scheduleId, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadLaunchQueue fills the queue with the upcoming jobs in the database
+func loadLaunchQueue(queue *launchQueue, dbMeta dbMetaObj) {
+	rows, err := dbMeta.prepped["load-upcoming"].Query()
+	if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	defer rows.Close()
+	times := make(map[int64]int64)
+	for rows.Next() {
+		var scheduleId, scheduleTime sql.NullInt64
+		if err = rows.Scan(&scheduleId, &scheduleTime); err != nil {
+			log.Error(err, nil)
+			panic(err)
+		}
+		times[scheduleId.Int64] = scheduleTime.Int64
+	}
+	if err = rows.Err(); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	queue.Replace(times)
+}
+
+// refreshLaunchQueue updates the queue for a change to the job scheduleId. A
+// job no longer upcoming wakes the scheduler, as its completion may release
+// the jobs held back by it.
+func refreshLaunchQueue(queue *launchQueue, dbMeta dbMetaObj, scheduleId int64) {
+	var scheduleTime sql.NullInt64
+	err := dbMeta.prepped["find-upcoming"].QueryRow(scheduleId).Scan(&scheduleTime)
+	if err == sql.ErrNoRows {
+		queue.Remove(scheduleId)
+		queue.wake()
+		return
+	} else if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	queue.Set(scheduleId, scheduleTime.Int64)
+}
+
+// listenForChanges keeps the queue up to date with the changes notified on scheduleChannel
+func listenForChanges(listener *pq.Listener, queue *launchQueue, dbMeta dbMetaObj, quit chan bool) {
+	for {
+		select {
+		case notification := <-listener.Notify:
+			if notification == nil {
+				// reconnected, so changes may have been missed
+				log.Info("Reconnected to listen for schedule changes, reloading the launch queue", nil)
+				loadLaunchQueue(queue, dbMeta)
+				continue
+			}
+			scheduleId, err := strconv.ParseInt(notification.Extra, 10, 64)
+			if err != nil {
+				log.ErrorC("Bad schedule change notified", err, log.Data{"payload": notification.Extra})
+				continue
+			}
+			refreshLaunchQueue(queue, dbMeta, scheduleId)
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLaunchQueueWakesWhenDue(t *testing.T) {
+	queue := newLaunchQueue()
+	now := time.Now()
+	queue.Set(1, now.Add(time.Hour).UnixNano())
+	queue.Set(2, now.Add(50*time.Millisecond).UnixNano())
+	queue.Set(3, now.Add(time.Hour).UnixNano())
+	// moved earlier, then cancelled
+	queue.Set(3, now.Add(10*time.Millisecond).UnixNano())
+	queue.Remove(3)
+
+	select {
+	case <-queue.Due():
+		t.Error("Test failed, woken before a job was due")
+	case <-time.After(30 * time.Millisecond):
+	}
+	select {
+	case <-queue.Due():
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, not woken when a job was due")
+	}
+
+	queue.Launched(time.Now().UnixNano(), []int64{2})
+	if queue.Len() != 1 {
+		t.Errorf("Test failed, expected only job 1 queued, got %d jobs", queue.Len())
+	}
+
+	// a job due already (e.g. triggered) wakes at once
+	queue.Set(4, now.UnixNano())
+	select {
+	case <-queue.Due():
+	case <-time.After(time.Second):
+		t.Error("Test failed, not woken for a job already due")
+	}
+}
+
+func TestLaunchQueueRechecksJobsNotLaunched(t *testing.T) {
+	defer func(interval time.Duration) { recheck = interval }(recheck)
+	recheck = 50 * time.Millisecond
+	queue := newLaunchQueue()
+	now := time.Now()
+	queue.Set(1, now.UnixNano())
+	queue.Set(2, now.UnixNano())
+	<-queue.Due()
+
+	// job 1 is held, so is checked again
+	queue.Launched(now.UnixNano(), []int64{2})
+	if queue.Len() != 1 {
+		t.Fatalf("Test failed, expected held job 1 kept, got %d jobs", queue.Len())
+	}
+	select {
+	case <-queue.Due():
+		t.Fatal("Test failed, held job rechecked at once")
+	case <-time.After(20 * time.Millisecond):
+	}
+	select {
+	case <-queue.Due():
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, held job not rechecked")
+	}
+
+	// released, it is launched
+	queue.Launched(time.Now().UnixNano(), []int64{1})
+	if queue.Len() != 0 {
+		t.Errorf("Test failed, expected no jobs queued, got %d", queue.Len())
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+)
+
+// A dry run job is published as any other, but the services only fetch,
+// decrypt and stage its files, recording what they did or would have done
+// (see the rehearsal package). The records are stored here, as the job's
+// rehearsal report.
+
+type rehearsalReport struct {
+	Schedule *scheduleView `json:"schedule"`
+	// Summary counts the records of each action, by service
+	Summary map[string]map[string]int `json:"summary"`
+	Records []rehearsalRecord         `json:"records"`
+}
+
+type rehearsalRecord struct {
+	Service  string `json:"service"`
+	Action   string `json:"action"`
+	Uri      string `json:"uri"`
+	Location string `json:"location,omitempty"`
+	Sha256   string `json:"sha256,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Time     string `json:"time"`
+}
+
+func (dbMeta dbMetaObj) prepRehearsals() {
+	// a record redelivered (or of a file resent) replaces the one before
+	dbMeta.prep("insert-rehearsal", "INSERT INTO rehearsal (schedule_id, collection_id, service, action, uri, location, sha256, size, detail, record_time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"+
+		" ON CONFLICT (schedule_id, service, action, uri) DO UPDATE SET location=EXCLUDED.location, sha256=EXCLUDED.sha256, size=EXCLUDED.size, detail=EXCLUDED.detail, record_time=EXCLUDED.record_time")
+	dbMeta.prep("api-get-rehearsal", "SELECT service, action, uri, location, sha256, size, detail, record_time FROM rehearsal WHERE schedule_id=$1 ORDER BY service, action, uri")
+}
+
+// storeRehearsal stores a record from the rehearsal topic
+func storeRehearsal(jsonMessage []byte, dbMeta dbMetaObj) error {
+	var record kafka.RehearsalMessage
+	if _, err := kafka.Decode(jsonMessage, &record); err != nil {
+		return fmt.Errorf("Failed to parse json: %s", err)
+	} else if record.ScheduleId == 0 || record.Service == "" || record.Action == "" {
+		return fmt.Errorf("Rehearsal record missing fields: %q", jsonMessage)
+	}
+	_, err := dbMeta.prepped["insert-rehearsal"].Exec(record.ScheduleId, record.CollectionId, record.Service, record.Action, record.Uri,
+		record.Location, record.Sha256, record.Size, record.Detail, time.Now().UnixNano())
+	return err
+}
+
+// rehearsal reports what was done, and would have been, in the dry run scheduleId
+func (api *scheduleAPI) rehearsal(w http.ResponseWriter, scheduleId int64) {
+	view, err := api.getSchedule(scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+		return
+	} else if view == nil {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("Schedule %d not found", scheduleId)})
+		return
+	} else if !view.DryRun {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("Schedule %d is not a dry run, so has no rehearsal", scheduleId)})
+		return
+	}
+	rows, err := api.dbMeta.prepped["api-get-rehearsal"].Query(scheduleId)
+	if err != nil {
+		api.serverError(w, err)
+		return
+	}
+	defer rows.Close()
+	report := rehearsalReport{Schedule: view, Summary: make(map[string]map[string]int), Records: []rehearsalRecord{}}
+	for rows.Next() {
+		var record rehearsalRecord
+		var recordTime int64
+		if err = rows.Scan(&record.Service, &record.Action, &record.Uri, &record.Location, &record.Sha256, &record.Size, &record.Detail, &recordTime); err != nil {
+			api.serverError(w, err)
+			return
+		}
+		record.Time = time.Unix(0, recordTime).UTC().Format(time.RFC3339)
+		report.add(record)
+	}
+	if err = rows.Err(); err != nil {
+		api.serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (report *rehearsalReport) add(record rehearsalRecord) {
+	if report.Summary[record.Service] == nil {
+		report.Summary[record.Service] = make(map[string]int)
+	}
+	report.Summary[record.Service][record.Action]++
+	report.Records = append(report.Records, record)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/decrypt"
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/s3"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// validation statuses of a job, NULL while it is yet to be validated
+const (
+	validationValid   = "validated"
+	validationInvalid = "invalid"
+	validationPending = "pending" // only in the API's filter
+)
+
+// revalidate is how often the validator looks for pending jobs without being
+// woken (e.g. for those scheduled through another scheduler), and
+// validationLease is how long a job it has claimed is left to it, before
+// another validator may check it instead
+var (
+	revalidate      = time.Minute
+	validationLease = 10 * time.Minute
+)
+
+// statWorkers bounds the locations of a job checked at once
+const statWorkers = 16
+
+// validator checks, when a job is scheduled rather than when it is released,
+// that its files can be published: that each location exists (in the upstream
+// bucket or on disk), that the collection's key is in vault and decrypts a
+// sample file, and that the uris are well-formed. The result is recorded on
+// the job. Pending jobs are read from the database and checked in turn, away
+// from the main loop, each by whichever scheduler claims it first.
+type validator struct {
+	dbMeta   dbMetaObj
+	upstream s3.S3Client
+	// encryptionKey reads the key of a collection from vault
+	encryptionKey func(collectionId string) (string, error)
+	wake          chan bool
+	quit          chan bool
+	done          chan bool
+}
+
+func newValidator(dbMeta dbMetaObj, upstream s3.S3Client, encryptionKey func(string) (string, error)) *validator {
+	dbMeta.prep("record-validation", "UPDATE schedule SET validation_status=$2, validation_time=$3, validation_issues=$4 WHERE schedule_id=$1")
+	// jobs yet to be given their files are checked once they have them
+	dbMeta.prep("find-unvalidated", "SELECT schedule_id FROM schedule s WHERE validation_status IS NULL AND start_time IS NULL AND complete_time IS NULL AND abort_time IS NULL AND NOT "+awaitingContent+" AND (validation_time IS NULL OR validation_time < $1) ORDER BY schedule_time LIMIT 100")
+	// while a job is pending, its validation_time is when it was claimed
+	dbMeta.prep("claim-validation", "UPDATE schedule SET validation_time=$2 WHERE schedule_id=$1 AND validation_status IS NULL AND (validation_time IS NULL OR validation_time < $3) RETURNING collection_id")
+	v := &validator{
+		dbMeta:        dbMeta,
+		upstream:      upstream,
+		encryptionKey: encryptionKey,
+		wake:          make(chan bool, 1),
+		quit:          make(chan bool),
+		done:          make(chan bool),
+	}
+	go func() {
+		defer close(v.done)
+		ticker := time.NewTicker(revalidate)
+		defer ticker.Stop()
+		for {
+			v.validatePending()
+			select {
+			case <-v.wake:
+			case <-ticker.C:
+			case <-v.quit:
+				return
+			}
+		}
+	}()
+	return v
+}
+
+// Validate triggers a scan for pending jobs (such as one just stored), without
+// waiting for it. A scan already due is not triggered twice.
+func (v *validator) Validate() {
+	if v == nil {
+		return
+	}
+	select {
+	case v.wake <- true:
+	default:
+	}
+}
+
+// Close stops checking jobs. A job being checked is left pending, to be
+// checked again once its claim has lapsed.
+func (v *validator) Close() error {
+	close(v.quit)
+	<-v.done
+	return nil
+}
+
+// validatePending checks the pending jobs (in order of schedule time) until
+// there are none left, or the validator is closed
+func (v *validator) validatePending() {
+	for {
+		now := time.Now()
+		rows, err := v.dbMeta.prepped["find-unvalidated"].Query(now.Add(-validationLease).UnixNano())
+		if err != nil {
+			log.ErrorC("Could not find jobs to validate", err, nil)
+			return
+		}
+		var scheduleIds []int64
+		for rows.Next() {
+			var scheduleId int64
+			if err = rows.Scan(&scheduleId); err != nil {
+				break
+			}
+			scheduleIds = append(scheduleIds, scheduleId)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			log.ErrorC("Could not find jobs to validate", err, nil)
+			return
+		}
+		if len(scheduleIds) == 0 {
+			return
+		}
+		for _, scheduleId := range scheduleIds {
+			select {
+			case <-v.quit:
+				return
+			default:
+			}
+			job, claimed, err := v.claim(scheduleId)
+			if err != nil {
+				log.ErrorC(fmt.Sprintf("Job %d Could not claim for validation", scheduleId), err, nil)
+				return
+			} else if !claimed {
+				continue
+			}
+			if issues, checked := v.checkUnlessClosed(job); checked {
+				v.record(job, issues)
+			}
+		}
+	}
+}
+
+// claim takes the job to check, unless another validator has it (or it has
+// since been checked), and loads its files and deletes
+func (v *validator) claim(scheduleId int64) (scheduleJob, bool, error) {
+	now := time.Now()
+	job := scheduleJob{scheduleId: scheduleId}
+	err := v.dbMeta.prepped["claim-validation"].QueryRow(scheduleId, now.UnixNano(), now.Add(-validationLease).UnixNano()).Scan(&job.collectionId)
+	if err == sql.ErrNoRows {
+		return job, false, nil
+	} else if err != nil {
+		return job, false, err
+	}
+	// the job has not started, so none of its files or deletes are complete
+	job.files = loadDataFromDataBase(v.dbMeta, scheduleId, false)
+	job.urisToDelete = loadDataFromDataBase(v.dbMeta, scheduleId, true)
+	return job, true, nil
+}
+
+// checkUnlessClosed checks the job, reporting false if the validator was closed first
+func (v *validator) checkUnlessClosed(job scheduleJob) ([]string, bool) {
+	checked := make(chan []string, 1)
+	go func() { checked <- v.check(job) }()
+	select {
+	case issues := <-checked:
+		return issues, true
+	case <-v.quit:
+		return nil, false
+	}
+}
+
+// check returns the issues found with the job, none if it is valid
+func (v *validator) check(job scheduleJob) []string {
+	var issues []string
+	for i, err := range v.checkLocations(job.files) {
+		file := job.files[i]
+		if uriErr := checkUri(file.Uri); uriErr != nil {
+			issues = append(issues, uriErr.Error())
+		}
+		if err != nil {
+			issues = append(issues, fmt.Sprintf("File %q: %s", file.Uri, err))
+		}
+	}
+	for _, deleted := range job.urisToDelete {
+		if err := checkUri(deleted.Uri); err != nil {
+			issues = append(issues, "Delete: "+err.Error())
+		}
+	}
+
+	key, err := v.encryptionKey(job.collectionId)
+	if err != nil {
+		issues = append(issues, fmt.Sprintf("Encryption key not read from vault: %s", err))
+	} else if key == "" {
+		issues = append(issues, "No encryption key in vault")
+	} else if sample := sampleFile(job.files); sample != nil {
+		if err = v.checkDecrypts(*sample, key); err != nil {
+			issues = append(issues, fmt.Sprintf("Sample %q did not decrypt: %s", sample.Location, err))
+		}
+	}
+	return issues
+}
+
+// checkUri checks that uri is a path on the website
+func checkUri(uri string) error {
+	parsed, err := url.Parse(uri)
+	switch {
+	case err != nil:
+		return fmt.Errorf("Malformed uri %q: %s", uri, err)
+	case !strings.HasPrefix(uri, "/") || parsed.Scheme != "" || parsed.Host != "":
+		return fmt.Errorf("Malformed uri %q: not a path starting /", uri)
+	case parsed.RawQuery != "" || parsed.Fragment != "":
+		return fmt.Errorf("Malformed uri %q: has a query or fragment", uri)
+	case strings.ContainsAny(uri, " \t\r\n") || strings.Contains(uri, "//"):
+		return fmt.Errorf("Malformed uri %q: has whitespace or an empty segment", uri)
+	}
+	for _, segment := range strings.Split(uri, "/") {
+		if segment == ".." || segment == "." {
+			return fmt.Errorf("Malformed uri %q: has a relative segment", uri)
+		}
+	}
+	return nil
+}
+
+// checkLocations checks the location of each file (statWorkers at a time),
+// returning the error of each, in the order of files
+func (v *validator) checkLocations(files []kafka.FileResource) []error {
+	errs := make([]error, len(files))
+	indexes := make(chan int)
+	var workers sync.WaitGroup
+	for w := 0; w < statWorkers && w < len(files); w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range indexes {
+				errs[i] = v.checkLocation(files[i].Location)
+			}
+		}()
+	}
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	workers.Wait()
+	return errs
+}
+
+// checkLocation checks that the file is in the upstream bucket or on disk, as publish-data reads it
+func (v *validator) checkLocation(location string) error {
+	bucketPrefix := "s3://" + v.upstream.Bucket + "/"
+	switch {
+	case strings.HasPrefix(location, bucketPrefix):
+		if _, err := v.upstream.StatObject(location[len(bucketPrefix):]); err != nil {
+			return fmt.Errorf("not found in bucket %s: %s", v.upstream.Bucket, err)
+		}
+	case strings.HasPrefix(location, "s3://"):
+		return fmt.Errorf("unexpected bucket: wanted %s, for %s", bucketPrefix, location)
+	case strings.HasPrefix(location, "file://"):
+		if _, err := os.Stat(location[7:]); err != nil {
+			return fmt.Errorf("not found on disk: %s", err)
+		}
+	default:
+		return fmt.Errorf("bad location %q", location)
+	}
+	return nil
+}
+
+// sampleFile is a file whose decryption can be checked: a json file (which
+// should decrypt to json), else the first file, else nil
+func sampleFile(files []kafka.FileResource) *kafka.FileResource {
+	for i := range files {
+		if strings.HasSuffix(files[i].Location, ".json") {
+			return &files[i]
+		}
+	}
+	if len(files) > 0 {
+		return &files[0]
+	}
+	return nil
+}
+
+// checkDecrypts decrypts the file with key, checking that a json file decrypts to json
+func (v *validator) checkDecrypts(file kafka.FileResource, key string) error {
+	var content []byte
+	var err error
+	bucketPrefix := "s3://" + v.upstream.Bucket + "/"
+	if strings.HasPrefix(file.Location, bucketPrefix) {
+		content, err = decrypt.DecryptS3(v.upstream, file.Location[len(bucketPrefix):], key)
+	} else if strings.HasPrefix(file.Location, "file://") {
+		content, err = decrypt.DecryptFile(file.Location[7:], key)
+	} else {
+		// its location is already reported
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(file.Location, ".json") && !json.Valid(content) {
+		return fmt.Errorf("not json, so the key is wrong")
+	}
+	return nil
+}
+
+// record stores the result on the job, logging an invalid job as an error
+func (v *validator) record(job scheduleJob, issues []string) {
+	status := validationValid
+	if len(issues) > 0 {
+		status = validationInvalid
+		log.Error(fmt.Errorf("Job %d Collection %q is invalid: %s", job.scheduleId, job.collectionId, strings.Join(issues, "; ")), log.Data{"issues": issues})
+	} else {
+		log.Info(fmt.Sprintf("Job %d Collection %q validated: %d files, %d deletes", job.scheduleId, job.collectionId, len(job.files), len(job.urisToDelete)), nil)
+	}
+	// issues are stored a line each
+	for i := range issues {
+		issues[i] = strings.Replace(issues[i], "\n", " ", -1)
+	}
+	if _, err := v.dbMeta.prepped["record-validation"].Exec(job.scheduleId, status, time.Now().UnixNano(),
+		sql.NullString{String: strings.Join(issues, "\n"), Valid: len(issues) > 0}); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+}
+
+// readIssues splits the issues stored by record
+func readIssues(issues sql.NullString) []string {
+	if !issues.Valid || issues.String == "" {
+		return nil
+	}
+	return strings.Split(issues.String, "\n")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/s3"
+)
+
+// encryptFile writes content to path as zebedee does: the IV, then the content encrypted with AES-CTR
+func encryptFile(t *testing.T, path, key string, content []byte) {
+	aesKey, _ := base64.StdEncoding.DecodeString(key)
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, block.BlockSize())
+	encrypted := make([]byte, len(content))
+	cipher.NewCTR(block, iv).XORKeyStream(encrypted, content)
+	if err = ioutil.WriteFile(path, append(iv, encrypted...), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidatorCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := "6y/+G0ZVPBBjtA5GOWj9Ow=="
+	encryptFile(t, filepath.Join(dir, "data.json"), key, []byte(`{"type":"bulletin"}`))
+
+	v := &validator{upstream: s3.S3Client{Bucket: "upstream-content"}, encryptionKey: func(string) (string, error) { return key, nil }}
+	job := scheduleJob{
+		collectionId: "test0001",
+		files:        []kafka.FileResource{{Uri: "/gdp/data.json", Location: "file://" + filepath.Join(dir, "data.json")}},
+		urisToDelete: []kafka.FileResource{{Uri: "/gdp/old.json"}},
+	}
+	if issues := v.check(job); len(issues) != 0 {
+		t.Errorf("Test failed, expected a valid job, got %q", issues)
+	}
+
+	job.files = append(job.files,
+		kafka.FileResource{Uri: "gdp/../chart.png", Location: "file://" + filepath.Join(dir, "chart.png")},
+		kafka.FileResource{Uri: "/gdp/table.xls", Location: "s3://another-bucket/gdp/table.xls"})
+	job.urisToDelete = append(job.urisToDelete, kafka.FileResource{Uri: "/gdp?page=2"})
+	issues := v.check(job)
+	for i, want := range []string{"not a path", "not found on disk", "unexpected bucket", "has a query"} {
+		if len(issues) != 4 || !strings.Contains(issues[i], want) {
+			t.Errorf("Test failed, expected issue %d to be %q, got %q", i, want, issues)
+		}
+	}
+
+	// the wrong key does not decrypt the json sample to json
+	v.encryptionKey = func(string) (string, error) { return "AAAAAAAAAAAAAAAAAAAAAA==", nil }
+	job.files = job.files[:1]
+	job.urisToDelete = nil
+	if issues = v.check(job); len(issues) != 1 || !strings.Contains(issues[0], "did not decrypt") {
+		t.Errorf("Test failed, expected the sample not to decrypt, got %q", issues)
+	}
+}
+
+func TestValidatorChecksLocationsInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := &validator{upstream: s3.S3Client{Bucket: "upstream-content"}}
+	var files []kafka.FileResource
+	for i := 0; i < 3*statWorkers; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		// every third file is missing
+		if i%3 != 0 {
+			if err = ioutil.WriteFile(path, []byte("{}"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files = append(files, kafka.FileResource{Uri: fmt.Sprintf("/gdp/%d.json", i), Location: "file://" + path})
+	}
+	for i, err := range v.checkLocations(files) {
+		if (err != nil) != (i%3 == 0) {
+			t.Errorf("Test failed, file %d got %v", i, err)
+		}
+	}
+}
@@ -8,8 +8,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ONSdigital/dp-publish-pipeline/admin"
+	"github.com/ONSdigital/dp-publish-pipeline/claimcheck"
 	"github.com/ONSdigital/dp-publish-pipeline/health"
 	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/dp-publish-pipeline/shutdown"
 	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/go-ns/log"
 	"gopkg.in/olivere/elastic.v5"
@@ -45,12 +50,17 @@ type PageDescription struct {
 }
 
 func main() {
-	kafkaBrokers := utils.GetEnvironmentVariableAsArray("KAFKA_ADDR", "localhost:9092")
+	kafkaBrokers := kafka.Brokers()
 	consumerTopic := utils.GetEnvironmentVariable("KAFKA_CONSUMER_TOPIC", "uk.gov.ons.dp.web.complete-file")
+	deadLetterTopic := utils.GetEnvironmentVariable("DEAD_LETTER_TOPIC", "")
 	elasticSearchNodes := utils.GetEnvironmentVariableAsArray("ELASTIC_SEARCH_NODES", "http://127.0.0.1:9200")
 	elasticSearchIndex := utils.GetEnvironmentVariable("ELASTIC_SEARCH_INDEX", "ons")
 	healthCheckAddr := utils.GetEnvironmentVariable("HEALTHCHECK_ADDR", ":8080")
 	healthCheckEndpoint := utils.GetEnvironmentVariable("HEALTHCHECK_ENDPOINT", "/healthcheck")
+	metricsEndpoint := utils.GetEnvironmentVariable("METRICS_ENDPOINT", "/metrics")
+	adminEndpoint := utils.GetEnvironmentVariable("ADMIN_ENDPOINT", "/admin/consumers")
+	adminToken := utils.GetEnvironmentVariable("ADMIN_API_TOKEN", "")
+	rehearsalTopic := utils.GetEnvironmentVariable("REHEARSAL_TOPIC", "uk.gov.ons.dp.web.rehearsal")
 	log.Namespace = "publish-search-indexer"
 	log.Debug("Starting publish search indexer",
 		log.Data{"kafka_brokers": kafkaBrokers,
@@ -83,17 +93,64 @@ func main() {
 	}
 
 	// Setup kafka using consumer groups
+	if err := kafka.EnsureTopics(
+		kafka.Topic{Role: "complete-file", Name: consumerTopic},
+		kafka.Topic{Role: "rehearsal", Name: rehearsalTopic},
+	); err != nil {
+		log.ErrorC("Could not ensure kafka topics", err, nil)
+		panic(err)
+	}
 	groupName := "publish-search-index"
-	consumer, consumerErr := kafka.NewConsumerGroup(consumerTopic, groupName)
+	bus := kafka.KafkaBus{}
+	consumer, consumerErr := bus.NewConsumerGroup(consumerTopic, groupName)
 	if err != nil {
 		log.ErrorC("Failed to create kafka consumer", consumerErr, log.Data{"topic": consumerTopic,
 			"group": groupName})
 		panic(consumerErr)
 	}
+	consumer.SetDeadLetterTopic(deadLetterTopic, "publish-search-indexer")
+	retryPolicy, err := kafka.NewRetryPolicy()
+	if err != nil {
+		log.ErrorC("Could not read retry policy", err, nil)
+		panic(err)
+	}
+	consumer.SetRetryPolicy(retryPolicy)
+	recorder := rehearsal.NewRecorder(bus, "publish-search-indexer", rehearsalTopic)
+	claims, err := claimcheck.NewStore()
+	if err != nil {
+		log.ErrorC("Could not obtain claim-check store", err, nil)
+		panic(err)
+	}
+	stopAutoPause, err := admin.AutoPause(func() error {
+		clusterHealth, err := searchClient.ClusterHealth().Do(context.Background())
+		if err == nil && clusterHealth.Status == "red" {
+			err = fmt.Errorf("elastic search cluster %q is red", clusterHealth.ClusterName)
+		}
+		return err
+	}, consumer)
+	if err != nil {
+		log.ErrorC("Could not start auto-pause", err, nil)
+		panic(err)
+	}
+
+	// offsets are committed as documents are added to the bulk processor,
+	// so it must be flushed before the consumer commits for the last time
+	graceful, err := shutdown.New("publish-search-indexer")
+	if err != nil {
+		log.ErrorC("Could not prepare for shutdown", err, nil)
+		panic(err)
+	}
+	graceful.Add("stop auto-pause", stopAutoPause)
+	graceful.Add("flush bulk processor", bulk.Close)
+	graceful.OnSignal(consumer.Stop)
+	graceful.Add("close consumer", consumer.Close)
+	graceful.Add("close rehearsal producer", recorder.Close)
 
 	healthChannel := make(chan bool)
 	go func() {
 		http.HandleFunc(healthCheckEndpoint, health.NewHealthChecker(healthChannel, nil))
+		http.HandleFunc(metricsEndpoint, metrics.Handler)
+		http.HandleFunc(adminEndpoint, admin.NewHandler(adminToken, consumer))
 		log.Info(fmt.Sprintf("Listening for %s on %s", healthCheckEndpoint, healthCheckAddr), nil)
 		log.ErrorC("healthcheck listener exited", http.ListenAndServe(healthCheckAddr, nil), nil)
 		panic("healthcheck listener exited")
@@ -102,16 +159,20 @@ func main() {
 	for {
 		select {
 		case consumerMessage := <-consumer.Incoming:
-			err := processMessage(consumerMessage.GetData(), bulk, elasticSearchIndex)
-			if err != nil {
+			err := consumer.Handle(consumerMessage, func(msg kafka.Message) error {
+				return processMessage(msg.GetData(), bulk, elasticSearchIndex, claims, recorder)
+			})
+			if err != nil && err != kafka.ErrStopped {
 				log.ErrorC("Failed to process kafka message", err, log.Data{})
 				panic(err)
 			}
-			consumerMessage.Commit()
 		case err := <-consumer.Errors:
 			log.ErrorC("Kafka client error", err, log.Data{})
 			panic(err)
 		case <-healthChannel:
+		case <-graceful.Signals:
+			graceful.Shutdown()
+			return
 		}
 	}
 }
@@ -131,10 +192,10 @@ func after(executionId int64, requests []elastic.BulkableRequest, response *elas
 	}
 }
 
-func processMessage(msg []byte, bulkProcessor *elastic.BulkProcessor, elasticSearchIndex string) error {
+func processMessage(msg []byte, bulkProcessor *elastic.BulkProcessor, elasticSearchIndex string, claims *claimcheck.Store, recorder *rehearsal.Recorder) error {
 	// First deserialise the event to check that its a json file to index.
 	var event kafka.FileCompleteMessage
-	err := json.Unmarshal(msg, &event)
+	envelope, err := kafka.Decode(msg, &event)
 	if err != nil {
 		return err
 	}
@@ -142,6 +203,9 @@ func processMessage(msg []byte, bulkProcessor *elastic.BulkProcessor, elasticSea
 		// Skip any messages which contain s3 location as it will not contain any json
 		return nil
 	}
+	if err = claims.Resolve(&event); err != nil {
+		return err
+	}
 
 	// If the message has JSON content, deserialise it as a page.
 	var page Page
@@ -154,6 +218,12 @@ func processMessage(msg []byte, bulkProcessor *elastic.BulkProcessor, elasticSea
 		return nil
 	}
 
+	if event.DryRun {
+		// only record the document that would have been indexed
+		return recorder.Record(kafka.RehearsalMessage{ScheduleId: event.ScheduleId, CollectionId: event.CollectionId, Action: "index", Uri: event.Uri,
+			Detail: fmt.Sprintf("%s/%s/%s", elasticSearchIndex, page.Type, page.URI)}, kafka.GetCorrelationId(envelope))
+	}
+
 	request := elastic.NewBulkIndexRequest().
 		Index(elasticSearchIndex).
 		Type(page.Type).
@@ -2,14 +2,18 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/ONSdigital/dp-publish-pipeline/admin"
 	"github.com/ONSdigital/dp-publish-pipeline/health"
 	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/tracker"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/dp-publish-pipeline/shutdown"
 	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/go-ns/log"
 
@@ -20,96 +24,17 @@ var (
 	tick = time.Millisecond * 260
 )
 
-type dbMetaObj struct {
-	db      *sql.DB
-	prepped map[string]*sql.Stmt
-}
-
-// have all files been completed for jobs yet to be marked as complete
-func checkForCompletedJobs(dbMeta dbMetaObj, producer kafka.Producer) {
-	rows, err := dbMeta.prepped["find-completed-jobs"].Query()
-	if err != nil {
-		log.Error(err, nil)
-		panic(err)
-	}
-	defer rows.Close()
-
-	var scheduleId, deletesRemaining, filesRemaining sql.NullInt64
-	completedTime := time.Now().UnixNano()
-
-	for rows.Next() {
-		if err := rows.Scan(&scheduleId, &deletesRemaining, &filesRemaining); err != nil {
-			log.Error(err, nil)
-			panic(err)
-		}
-		if deletesRemaining.Int64 == 0 && filesRemaining.Int64 == 0 {
-			duration, collectionId, err := markJobComplete(dbMeta, producer, scheduleId.Int64, completedTime)
-			if err != nil {
-				log.Error(err, nil)
-			} else {
-				log.Info(fmt.Sprintf("Job %d Collection %q completes in %s", scheduleId.Int64, collectionId, duration), nil)
-			}
-		}
-	}
-}
-
-func markJobComplete(dbMeta dbMetaObj, producer kafka.Producer, scheduleId, completedTime int64) (time.Duration, string, error) {
-	var startTime sql.NullInt64
-	var collectionId sql.NullString
-	res := dbMeta.prepped["update-complete-job"].QueryRow(scheduleId, completedTime)
-	if err := res.Scan(&collectionId, &startTime); err != nil {
-		if err == sql.ErrNoRows {
-			return 0, "", fmt.Errorf("Job %d already complete?", scheduleId)
-		}
-		log.Error(err, nil)
-		panic(err)
-	}
-
-	data, _ := json.Marshal(kafka.CollectionCompleteMessage{scheduleId, collectionId.String})
-	producer.Output <- data
-
-	return time.Duration(completedTime-startTime.Int64) * time.Nanosecond, collectionId.String, nil
-}
-
-func markFileComplete(jsonMessage []byte, dbMeta dbMetaObj) {
-	var file kafka.FileCompleteFlagMessage
-	if err := json.Unmarshal(jsonMessage, &file); err != nil {
-		log.ErrorC("Failed to parse json message", err, log.Data{"json": jsonMessage})
-		return
-	}
-	if file.ScheduleId == 0 || (file.FileId == 0 && file.DeleteId == 0) {
-		log.Error(errors.New("Json message is missing fields"), log.Data{"json": string(jsonMessage)})
-		return
-	}
-
-	if file.FileId != 0 {
-		if _, err := dbMeta.prepped["update-completed-file"].Exec(file.FileId, time.Now().UnixNano()); err != nil {
-			log.ErrorC("Could not update file", err, log.Data{"fileId": file.FileId})
-			panic(err)
-		}
-	} else if file.DeleteId != 0 {
-		if _, err := dbMeta.prepped["update-delete-file"].Exec(file.DeleteId, time.Now().UnixNano()); err != nil {
-			log.ErrorC("Could not update delete", err, log.Data{"deleteId": file.DeleteId})
-			panic(err)
-		}
-	}
-}
-
-func (dbMeta dbMetaObj) prep(tag, sql string) {
-	var err error
-	dbMeta.prepped[tag], err = dbMeta.db.Prepare(sql)
-	if err != nil {
-		log.ErrorC("Could not prepare statement on database", err, log.Data{"tag": tag})
-		panic(err)
-	}
-}
-
 func main() {
 	log.Namespace = "publish-tracker"
 	completeFileTopic := utils.GetEnvironmentVariable("COMPLETE_FILE_FLAG_TOPIC", "uk.gov.ons.dp.web.complete-file-flag")
 	completeCollectionTopic := utils.GetEnvironmentVariable("COMPLETE_TOPIC", "uk.gov.ons.dp.web.complete")
+	fileFailedTopic := utils.GetEnvironmentVariable("FILE_FAILED_TOPIC", "uk.gov.ons.dp.web.file-failed")
+	rehearsalTopic := utils.GetEnvironmentVariable("REHEARSAL_TOPIC", "uk.gov.ons.dp.web.rehearsal")
 	healthCheckAddr := utils.GetEnvironmentVariable("HEALTHCHECK_ADDR", ":8080")
 	healthCheckEndpoint := utils.GetEnvironmentVariable("HEALTHCHECK_ENDPOINT", "/healthcheck")
+	metricsEndpoint := utils.GetEnvironmentVariable("METRICS_ENDPOINT", "/metrics")
+	adminEndpoint := utils.GetEnvironmentVariable("ADMIN_ENDPOINT", "/admin/consumers")
+	adminToken := utils.GetEnvironmentVariable("ADMIN_API_TOKEN", "")
 	maxConcurrentFileCompletes, err := utils.GetEnvironmentVariableInt("MAX_CONCURRENT_FILE_COMPLETES", 40)
 	if err != nil {
 		log.ErrorC("Cannot convert MAX_CONCURRENT_FILE_COMPLETES to integer", err, nil)
@@ -127,32 +52,96 @@ func main() {
 		log.ErrorC("Could not establish a connection with the database", err, nil)
 		panic(err)
 	}
-	dbMeta := dbMetaObj{db: db, prepped: make(map[string]*sql.Stmt)}
-	dbMeta.prep("find-completed-jobs", "SELECT schedule.schedule_id, (SELECT count(*) FROM schedule_delete WHERE schedule.schedule_id = schedule_delete.schedule_id AND schedule_delete.complete_time IS NULL) AS deletes_remaining, (SELECT count(*) FROM schedule_file WHERE schedule.schedule_id = schedule_file.schedule_id AND schedule_file.complete_time IS NULL) AS files_remaining FROM schedule WHERE complete_time is NULL GROUP BY schedule.schedule_id")
-	dbMeta.prep("update-completed-file", "UPDATE schedule_file SET complete_time=$2 WHERE schedule_file_id=$1")
-	dbMeta.prep("update-delete-file", "UPDATE schedule_delete SET complete_time=$2 WHERE schedule_delete_id=$1")
-	dbMeta.prep("update-complete-job", "UPDATE schedule SET complete_time=$2 WHERE schedule_id=$1 AND start_time IS NOT NULL AND complete_time IS NULL RETURNING collection_id, start_time")
-	dbMeta.prep("healthcheck", "SELECT 1 FROM schedule_delete")
+	healthCheck, err := db.Prepare("SELECT 1 FROM schedule_delete")
+	if err != nil {
+		log.ErrorC("Could not prepare statement on database", err, nil)
+		panic(err)
+	}
 
-	fileConsumer, err := kafka.NewConsumerGroup(completeFileTopic, "publish-tracker")
+	if err := kafka.EnsureTopics(
+		kafka.Topic{Role: "complete-file-flag", Name: completeFileTopic},
+		kafka.Topic{Role: "complete", Name: completeCollectionTopic},
+		kafka.Topic{Role: "file-failed", Name: fileFailedTopic},
+		kafka.Topic{Role: "rehearsal", Name: rehearsalTopic},
+	); err != nil {
+		log.ErrorC("Could not ensure kafka topics", err, nil)
+		panic(err)
+	}
+	bus := kafka.KafkaBus{}
+	fileConsumer, err := bus.NewConsumerGroup(completeFileTopic, "publish-tracker")
 	if err != nil {
 		log.ErrorC("Could not obtain consumer", err, nil)
 		panic(err)
 	}
-	producer := kafka.NewProducer(completeCollectionTopic)
+	failedConsumer, err := bus.NewConsumerGroup(fileFailedTopic, "publish-tracker")
+	if err != nil {
+		log.ErrorC("Could not obtain consumer", err, nil)
+		panic(err)
+	}
+	producer := bus.NewProducer(completeCollectionTopic)
+	recorder := rehearsal.NewRecorder(bus, "publish-tracker", rehearsalTopic)
+	jobs, err := tracker.New(db, producer, recorder)
+	if err != nil {
+		log.ErrorC("Could not prepare the tracker", err, nil)
+		panic(err)
+	}
+	stopAutoPause, err := admin.AutoPause(func() error {
+		_, err := healthCheck.Exec()
+		return err
+	}, fileConsumer, failedConsumer)
+	if err != nil {
+		log.ErrorC("Could not start auto-pause", err, nil)
+		panic(err)
+	}
 
 	rateLimitFileCompletes := make(chan bool, maxConcurrentFileCompletes)
 	healthChannel := make(chan bool)
 
+	quitJobChecker := make(chan bool)
 	go func() {
-		tock := time.Tick(tick)
-		for _ = range tock {
-			checkForCompletedJobs(dbMeta, producer)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				jobs.CheckForCompletedJobs()
+			case <-quitJobChecker:
+				return
+			}
 		}
 	}()
 
+	graceful, err := shutdown.New("publish-tracker")
+	if err != nil {
+		log.ErrorC("Could not prepare for shutdown", err, nil)
+		panic(err)
+	}
+	graceful.Add("stop auto-pause", stopAutoPause)
+	graceful.Add("stop job checker", func() error {
+		quitJobChecker <- true
+		return nil
+	})
+	graceful.Add("finish file completes", func() error {
+		// taking every slot waits for all goroutines holding one
+		for i := 0; i < cap(rateLimitFileCompletes); i++ {
+			rateLimitFileCompletes <- true
+		}
+		return nil
+	})
+	graceful.Add("close producer", producer.Close)
+	graceful.Add("close rehearsal producer", recorder.Close)
+	graceful.Add("close file-complete-flag consumer", fileConsumer.Close)
+	graceful.Add("close file-failed consumer", failedConsumer.Close)
+	graceful.Add("close tracker", jobs.Close)
+	graceful.Add("close database", func() error {
+		healthCheck.Close()
+		return db.Close()
+	})
+
 	go func() {
-		http.HandleFunc(healthCheckEndpoint, health.NewHealthChecker(healthChannel, dbMeta.prepped["healthcheck"]))
+		http.HandleFunc(healthCheckEndpoint, health.NewHealthChecker(healthChannel, healthCheck))
+		http.HandleFunc(metricsEndpoint, metrics.Handler)
+		http.HandleFunc(adminEndpoint, admin.NewHandler(adminToken, fileConsumer, failedConsumer))
 		log.Info(fmt.Sprintf("Listening for %s on %s", healthCheckEndpoint, healthCheckAddr), nil)
 		log.ErrorC("healthcheck listener exited", http.ListenAndServe(healthCheckAddr, nil), nil)
 		panic("healthcheck listener exited")
@@ -164,13 +153,26 @@ func main() {
 			rateLimitFileCompletes <- true
 			go func() {
 				defer func() { <-rateLimitFileCompletes }()
-				markFileComplete(consumerMessage.GetData(), dbMeta)
-				consumerMessage.Commit()
+				fileConsumer.Handle(consumerMessage, func(msg kafka.Message) error {
+					jobs.MarkFileComplete(msg.GetData())
+					return nil
+				})
 			}()
+		case consumerMessage := <-failedConsumer.Incoming:
+			failedConsumer.Handle(consumerMessage, func(msg kafka.Message) error {
+				jobs.MarkFileFailed(msg.GetData())
+				return nil
+			})
+		case errorMessage := <-failedConsumer.Errors:
+			log.Error(errors.New("Aborting after consumer error"), log.Data{"msg": errorMessage})
+			panic("Aborting after consumer error")
 		case errorMessage := <-fileConsumer.Errors:
 			log.Error(errors.New("Aborting after consumer error"), log.Data{"msg": errorMessage})
 			panic("Aborting after consumer error")
 		case <-healthChannel:
+		case <-graceful.Signals:
+			graceful.Shutdown()
+			return
 		}
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// filter selects the complete-file messages of a collection and/or schedule
+type filter struct {
+	collectionId string
+	scheduleId   int64
+}
+
+// matches decodes data as a FileCompleteMessage, and reports whether it
+// belongs to the filter's collection and schedule (when set)
+func (f filter) matches(data []byte) (bool, error) {
+	var file kafka.FileCompleteMessage
+	if _, err := kafka.Decode(data, &file); err != nil {
+		return false, err
+	}
+	if f.collectionId != "" && file.CollectionId != f.collectionId {
+		return false, nil
+	}
+	if f.scheduleId != 0 && file.ScheduleId != f.scheduleId {
+		return false, nil
+	}
+	return true, nil
+}
+
+func parseTime(name, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad -%s %q, expected e.g. 2017-03-01T09:30:00Z\n", name, value)
+		os.Exit(2)
+	}
+	return t
+}
+
+func main() {
+	log.Namespace = "replay-events"
+	topic := flag.String("topic", "uk.gov.ons.dp.web.complete-file", "Topic to replay")
+	collectionId := flag.String("collection", "", "Only replay files of this collection")
+	scheduleId := flag.Int64("schedule", 0, "Only replay files of this schedule (job)")
+	since := flag.String("since", "", "Replay messages produced at or after this time (RFC3339), default the oldest kept")
+	until := flag.String("until", "", "Replay messages produced at or before this time (RFC3339), default now")
+	to := flag.String("to", "", "Topic to republish matching messages to")
+	dryRun := flag.Bool("dry-run", false, "Only count the matching messages")
+	flag.Parse()
+	if *to == "" && !*dryRun {
+		fmt.Fprintln(os.Stderr, "One of -to or -dry-run is needed")
+		flag.Usage()
+		os.Exit(2)
+	}
+	f := filter{collectionId: *collectionId, scheduleId: *scheduleId}
+	sinceTime, untilTime := parseTime("since", *since), parseTime("until", *until)
+
+	var producer kafka.Producer
+	if !*dryRun {
+		producer = kafka.NewAckProducer(*to)
+	}
+	var read, undecodable, matched int
+	err := kafka.Replay(*topic, sinceTime, untilTime, func(msg kafka.Replayed) error {
+		read++
+		isMatch, err := f.matches(msg.Value)
+		if err != nil {
+			undecodable++
+			log.ErrorC("Skipping message", err, log.Data{"partition": msg.Partition, "offset": msg.Offset})
+			return nil
+		}
+		if !isMatch {
+			return nil
+		}
+		matched++
+		if *dryRun {
+			return nil
+		}
+		// the message is sent as read, so keeps its envelope, codec and key
+		if err = producer.Send(msg.Value); err != nil {
+			return fmt.Errorf("Could not republish offset %d: %s", msg.Offset, err)
+		}
+		return nil
+	})
+	if !*dryRun {
+		if closeErr := producer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	data := log.Data{"topic": *topic, "read": read, "undecodable": undecodable, "matched": matched, "dryRun": *dryRun}
+	if err != nil {
+		log.ErrorC("Replay failed", err, data)
+		os.Exit(1)
+	}
+	if *dryRun {
+		log.Info(fmt.Sprintf("Dry run: %d of %d messages match", matched, read), data)
+		return
+	}
+	data["to"] = *to
+	log.Info(fmt.Sprintf("Republished %d of %d messages to %q", matched, read, *to), data)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+)
+
+func TestFilterMatches(t *testing.T) {
+	data, _ := kafka.Encode(kafka.FileCompleteMessage{ScheduleId: 7, CollectionId: "test0001", Uri: "/about/data.json"}, "")
+	for _, test := range []struct {
+		filter filter
+		want   bool
+	}{
+		{filter{}, true},
+		{filter{collectionId: "test0001"}, true},
+		{filter{collectionId: "test0001", scheduleId: 7}, true},
+		{filter{collectionId: "test0002"}, false},
+		{filter{collectionId: "test0001", scheduleId: 8}, false},
+	} {
+		if got, err := test.filter.matches(data); err != nil || got != test.want {
+			t.Errorf("Test failed, %+v matched %v (%v), expected %v", test.filter, got, err, test.want)
+		}
+	}
+	if _, err := (filter{}).matches([]byte("{one: two")); err == nil {
+		t.Error("Test failed, expected an error for bad json")
+	}
+}
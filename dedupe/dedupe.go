@@ -0,0 +1,135 @@
+package dedupe
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// Key identifies a file (FileId) or delete (DeleteId) of a scheduled publish
+type Key struct {
+	ScheduleId int64
+	FileId     int64
+	DeleteId   int64
+}
+
+// Store records, in the processed_message table, the keys of the messages a
+// consumer has applied, so that a message delivered again (kafka delivers at
+// least once) can be skipped. Keys are kept for DEDUPE_RETENTION_HOURS.
+type Store struct {
+	db        *sql.DB
+	consumer  string
+	retention time.Duration
+	claim     *sql.Stmt
+	purge     *sql.Stmt
+	applied   int64
+	skipped   int64
+	quit      chan bool
+}
+
+// Report is reported by the metrics endpoint for each Store
+type Report struct {
+	Applied int64 `json:"applied"`
+	Skipped int64 `json:"skipped"`
+}
+
+// NewStore returns the Store of consumer (e.g. the name of the service), and
+// starts purging its keys once older than the retention window
+func NewStore(db *sql.DB, consumer string) (*Store, error) {
+	retentionHours, err := utils.GetEnvironmentVariableInt("DEDUPE_RETENTION_HOURS", 168)
+	if err != nil || retentionHours < 1 {
+		return nil, fmt.Errorf("Bad value for DEDUPE_RETENTION_HOURS: %v", err)
+	}
+	s := &Store{
+		db:        db,
+		consumer:  consumer,
+		retention: time.Duration(retentionHours) * time.Hour,
+		quit:      make(chan bool),
+	}
+	if s.claim, err = db.Prepare("INSERT INTO processed_message(consumer, schedule_id, file_id, delete_id, applied_time) VALUES($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING"); err != nil {
+		return nil, err
+	}
+	if s.purge, err = db.Prepare("DELETE FROM processed_message WHERE consumer=$1 AND applied_time < $2"); err != nil {
+		s.claim.Close()
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			s.purgeExpired()
+			select {
+			case <-ticker.C:
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+	metrics.Register("dedupe."+consumer, s.report)
+	return s, nil
+}
+
+// Apply calls apply (within a transaction) unless the message with key has
+// already been applied by the consumer, returning whether apply was called.
+// The key is only recorded if apply succeeds. A key without a FileId or
+// DeleteId cannot be told apart from others, so is always applied.
+func (s *Store) Apply(key Key, apply func(tx *sql.Tx) error) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	if key.FileId != 0 || key.DeleteId != 0 {
+		result, err := tx.Stmt(s.claim).Exec(s.consumer, key.ScheduleId, key.FileId, key.DeleteId, time.Now().UnixNano())
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+			tx.Rollback()
+			if err == nil {
+				atomic.AddInt64(&s.skipped, 1)
+				log.Trace("Skipped duplicate message", log.Data{"consumer": s.consumer, "scheduleId": key.ScheduleId, "fileId": key.FileId, "deleteId": key.DeleteId})
+			}
+			return false, err
+		}
+	}
+	if err = apply(tx); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	atomic.AddInt64(&s.applied, 1)
+	return true, nil
+}
+
+func (s *Store) purgeExpired() {
+	expired := time.Now().Add(-s.retention).UnixNano()
+	result, err := s.purge.Exec(s.consumer, expired)
+	if err != nil {
+		log.ErrorC("Could not purge processed messages", err, log.Data{"consumer": s.consumer})
+		return
+	}
+	if purged, _ := result.RowsAffected(); purged > 0 {
+		log.Trace("Purged processed messages", log.Data{"consumer": s.consumer, "purged": purged})
+	}
+}
+
+func (s *Store) report() interface{} {
+	return Report{Applied: atomic.LoadInt64(&s.applied), Skipped: atomic.LoadInt64(&s.skipped)}
+}
+
+// Close stops purging, and closes the store's statements (but not its database)
+func (s *Store) Close() error {
+	close(s.quit)
+	metrics.Unregister("dedupe." + s.consumer)
+	s.purge.Close()
+	return s.claim.Close()
+}
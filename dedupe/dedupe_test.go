@@ -0,0 +1,50 @@
+package dedupe
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+func TestApplySkipsDuplicates(t *testing.T) {
+	db, err := sql.Open("postgres", "user=dp dbname=dp sslmode=disable")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skip("Local postgres database was not found")
+	}
+	defer db.Close()
+	store, err := NewStore(db, "dedupe-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	defer db.Exec("DELETE FROM processed_message WHERE consumer=$1", "dedupe-test")
+
+	applied := 0
+	apply := func(tx *sql.Tx) error {
+		applied++
+		return nil
+	}
+	key := Key{ScheduleId: 1, FileId: 2}
+	if _, err := store.Apply(key, func(tx *sql.Tx) error { return errors.New("failed") }); err == nil {
+		t.Error("Test failed, expected the error of apply")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := store.Apply(key, apply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Apply(Key{ScheduleId: 1, DeleteId: 2}, apply); err != nil {
+		t.Fatal(err)
+	}
+	if applied != 2 {
+		t.Errorf("Test failed, applied %d times, expected 2", applied)
+	}
+	if report := store.report().(Report); report.Applied != 2 || report.Skipped != 1 {
+		t.Errorf("Test failed, got %+v", report)
+	}
+}
@@ -10,11 +10,17 @@ import (
 )
 
 type healthMessage struct {
-	Status string `json:"status"`
-	Error  string `json:"error,omitempty"`
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Detail interface{} `json:"detail,omitempty"`
 }
 
 func NewHealthChecker(healthChannel chan bool, dbStmt *sql.Stmt) func(http.ResponseWriter, *http.Request) {
+	return NewHealthCheckerWithDetail(healthChannel, dbStmt, nil)
+}
+
+// NewHealthCheckerWithDetail is NewHealthChecker, adding the result of detail to the health output
+func NewHealthCheckerWithDetail(healthChannel chan bool, dbStmt *sql.Stmt, detail func() interface{}) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
 			healthIssue string
@@ -38,13 +44,18 @@ func NewHealthChecker(healthChannel chan bool, dbStmt *sql.Stmt) func(http.Respo
 			}
 		}
 
-		// when there's a healthIssue, change headers and content
-		if healthIssue != "" {
-			w.WriteHeader(http.StatusInternalServerError)
-			if body, err = json.Marshal(healthMessage{
-				Status: "error",
-				Error:  healthIssue,
-			}); err != nil {
+		// when there's a healthIssue or detail, change headers and content
+		if healthIssue != "" || detail != nil {
+			message := healthMessage{Status: "OK"}
+			if healthIssue != "" {
+				w.WriteHeader(http.StatusInternalServerError)
+				message.Status = "error"
+				message.Error = healthIssue
+			}
+			if detail != nil {
+				message.Detail = detail()
+			}
+			if body, err = json.Marshal(message); err != nil {
 				log.Error(err, nil)
 				panic(err)
 			}
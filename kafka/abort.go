@@ -0,0 +1,131 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// AbortedSchedules is the set of schedules (jobs) aborted while publishing,
+// as announced by ScheduleAbortedMessages on the abort topic. Every watcher
+// reads the whole topic, in no consumer group, so each instance of a service
+// learns of every abort.
+type AbortedSchedules struct {
+	mutex    sync.RWMutex
+	ids      map[int64]bool
+	consumer BroadcastConsumer
+	quit     chan bool
+	done     chan bool
+}
+
+// how long WatchAbortedSchedules waits to read the aborts already announced
+const abortsCatchUpTimeout = time.Minute
+
+// WatchAbortedSchedules starts reading the aborts announced on topic, from its
+// oldest message, and returns once it has read every abort announced before it
+// started, so that no message of an aborted job is handled while it catches up
+func WatchAbortedSchedules(bus Bus, topic string) (*AbortedSchedules, error) {
+	consumer, err := bus.NewBroadcastConsumer(topic)
+	if err != nil {
+		return nil, err
+	}
+	aborted := &AbortedSchedules{ids: make(map[int64]bool), consumer: consumer, quit: make(chan bool), done: make(chan bool)}
+	behind := make(map[int32]int64)
+	for partition, mark := range consumer.HighWaterMarks() {
+		behind[partition] = mark
+	}
+	caughtUp := make(chan bool)
+	go aborted.watch(behind, caughtUp)
+	select {
+	case <-caughtUp:
+		return aborted, nil
+	case <-time.After(abortsCatchUpTimeout):
+		aborted.Close()
+		return nil, fmt.Errorf("Could not read the aborts already announced on %q within %s", topic, abortsCatchUpTimeout)
+	}
+}
+
+// watch reads aborts until closed, closing caughtUp once it has read up to the
+// offset behind each partition
+func (aborted *AbortedSchedules) watch(behind map[int32]int64, caughtUp chan bool) {
+	defer close(aborted.done)
+	if len(behind) == 0 {
+		close(caughtUp)
+	}
+	for {
+		select {
+		case msg := <-aborted.consumer.Messages():
+			var abort ScheduleAbortedMessage
+			if _, err := Decode(msg.Value, &abort); err != nil {
+				log.ErrorC("Could not decode schedule-aborted message", err, log.Data{"partition": msg.Partition, "offset": msg.Offset})
+			} else if abort.ScheduleId != 0 {
+				aborted.Add(abort.ScheduleId)
+				log.Info(fmt.Sprintf("Job %d Collection %q aborted", abort.ScheduleId, abort.CollectionId), nil)
+			}
+			if mark, ok := behind[msg.Partition]; ok && msg.Offset+1 >= mark {
+				delete(behind, msg.Partition)
+				if len(behind) == 0 {
+					close(caughtUp)
+				}
+			}
+		case err := <-aborted.consumer.Errors():
+			log.ErrorC("Could not read schedule-aborted messages", err, nil)
+		case <-aborted.quit:
+			return
+		}
+	}
+}
+
+// Add marks scheduleId aborted, ahead of its ScheduleAbortedMessage being read back
+func (aborted *AbortedSchedules) Add(scheduleId int64) {
+	aborted.mutex.Lock()
+	aborted.ids[scheduleId] = true
+	aborted.mutex.Unlock()
+}
+
+// Aborted reports whether scheduleId has been aborted. A nil AbortedSchedules has none.
+func (aborted *AbortedSchedules) Aborted(scheduleId int64) bool {
+	if aborted == nil {
+		return false
+	}
+	aborted.mutex.RLock()
+	defer aborted.mutex.RUnlock()
+	return aborted.ids[scheduleId]
+}
+
+func (aborted *AbortedSchedules) empty() bool {
+	if aborted == nil {
+		return true
+	}
+	aborted.mutex.RLock()
+	defer aborted.mutex.RUnlock()
+	return len(aborted.ids) == 0
+}
+
+// Close stops watching for aborts
+func (aborted *AbortedSchedules) Close() error {
+	close(aborted.quit)
+	<-aborted.done
+	return aborted.consumer.Close()
+}
+
+// SetAbortedSchedules has Handle drop (commit without handling) any message
+// whose ScheduleId has been aborted
+func (cg *ConsumerGroup) SetAbortedSchedules(aborted *AbortedSchedules) {
+	cg.aborted = aborted
+}
+
+// isAborted reports whether msg belongs to an aborted schedule
+func (cg *ConsumerGroup) isAborted(msg Message) bool {
+	if cg.aborted.empty() {
+		return false
+	}
+	fields, err := readKeyFields(msg.GetData())
+	if err != nil || !cg.aborted.Aborted(fields.ScheduleId) {
+		return false
+	}
+	log.Info(fmt.Sprintf("Job %d aborted, dropping message", fields.ScheduleId), log.Data{"topic": msg.GetTopic(), "partition": msg.GetPartition(), "offset": msg.GetOffset()})
+	return true
+}
@@ -0,0 +1,121 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// kafkaBroadcast is a BroadcastConsumer reading each partition of a topic with
+// a partition consumer of its own, as Replay does, so no group is created
+type kafkaBroadcast struct {
+	client     sarama.Client
+	consumer   sarama.Consumer
+	partitions []sarama.PartitionConsumer
+	marks      map[int32]int64
+	messages   chan *sarama.ConsumerMessage
+	errors     chan error
+	closing    chan bool
+	wg         sync.WaitGroup
+}
+
+func newKafkaBroadcast(topic string) (*kafkaBroadcast, error) {
+	config := sarama.NewConfig()
+	if err := Configure(config); err != nil {
+		return nil, fmt.Errorf("Bad kafka config for %q: %s", topic, err)
+	}
+	config.Consumer.Return.Errors = true
+	client, err := sarama.NewClient(Brokers(), config)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	b := &kafkaBroadcast{
+		client:   client,
+		consumer: consumer,
+		marks:    make(map[int32]int64),
+		messages: make(chan *sarama.ConsumerMessage),
+		errors:   make(chan error),
+		closing:  make(chan bool),
+	}
+	if err = b.start(topic); err != nil {
+		b.Close()
+		return nil, fmt.Errorf("Cannot read %q: %s", topic, err)
+	}
+	return b, nil
+}
+
+// start consumes every partition of topic from its oldest message
+func (b *kafkaBroadcast) start(topic string) error {
+	partitions, err := b.client.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		// the high water mark is the offset of the next message to be produced
+		newest, err := b.client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		oldest, err := b.client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		if newest > oldest {
+			b.marks[partition] = newest
+		}
+		consumer, err := b.consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		b.partitions = append(b.partitions, consumer)
+		b.wg.Add(1)
+		go b.forward(consumer)
+	}
+	return nil
+}
+
+// forward passes on the messages and errors of a partition until closed
+func (b *kafkaBroadcast) forward(partition sarama.PartitionConsumer) {
+	defer b.wg.Done()
+	for {
+		select {
+		case msg := <-partition.Messages():
+			select {
+			case b.messages <- msg:
+			case <-b.closing:
+				return
+			}
+		case err := <-partition.Errors():
+			select {
+			case b.errors <- err:
+			case <-b.closing:
+				return
+			}
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+func (b *kafkaBroadcast) Messages() <-chan *sarama.ConsumerMessage { return b.messages }
+
+func (b *kafkaBroadcast) Errors() <-chan error { return b.errors }
+
+func (b *kafkaBroadcast) HighWaterMarks() map[int32]int64 { return b.marks }
+
+// Close stops reading, and disconnects from the brokers
+func (b *kafkaBroadcast) Close() error {
+	close(b.closing)
+	b.wg.Wait()
+	for _, partition := range b.partitions {
+		partition.Close()
+	}
+	b.consumer.Close()
+	return b.client.Close()
+}
@@ -0,0 +1,44 @@
+package kafka
+
+import "github.com/Shopify/sarama"
+
+// Bus makes the consumers and producers a service uses to reach its topics.
+// KafkaBus connects to the brokers at KAFKA_ADDR, while a MemoryBus keeps its
+// topics in memory, so that services can be tested without a broker.
+type Bus interface {
+	NewConsumerGroup(topic string, group string) (*ConsumerGroup, error)
+	// NewBroadcastConsumer reads every message of topic, from the oldest,
+	// in no consumer group, so that every instance of a service reads them all
+	NewBroadcastConsumer(topic string) (BroadcastConsumer, error)
+	NewProducer(topic string) Producer
+	NewAckProducer(topic string) Producer
+}
+
+// BroadcastConsumer reads every partition of a topic. It is not a member of any
+// consumer group, so commits nothing, and each one starts from the oldest message.
+type BroadcastConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan error
+	// HighWaterMarks returns, for each partition which held any messages when
+	// the consumer started, the offset after the last of them
+	HighWaterMarks() map[int32]int64
+	Close() error
+}
+
+type KafkaBus struct{}
+
+func (KafkaBus) NewConsumerGroup(topic string, group string) (*ConsumerGroup, error) {
+	return newKafkaConsumerGroup(topic, group, sarama.OffsetNewest)
+}
+
+func (KafkaBus) NewBroadcastConsumer(topic string) (BroadcastConsumer, error) {
+	return newKafkaBroadcast(topic)
+}
+
+func (KafkaBus) NewProducer(topic string) Producer {
+	return newKafkaProducer(topic, false)
+}
+
+func (KafkaBus) NewAckProducer(topic string) Producer {
+	return newKafkaProducer(topic, true)
+}
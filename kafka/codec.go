@@ -0,0 +1,460 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// binaryMagic started the binary-encoded messages of earlier releases,
+// followed by the 4-byte (big-endian) id of their schema, which the reader had
+// to have registered. binarySchemaMagic starts those written now: the id is
+// followed by the writer's schema itself, so that a reader with another
+// version of the message can still resolve it. JSON messages cannot start with
+// either byte.
+const (
+	binaryMagic       = 0
+	binarySchemaMagic = 1
+)
+
+// Codec encodes the messages sent to a topic. Decode reads messages written by
+// any codec, so the codec of a topic can be changed while messages are in flight.
+type Codec interface {
+	Name() string
+	Encode(message interface{}, correlationId string) ([]byte, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Encode(message interface{}, correlationId string) ([]byte, error) {
+	return Encode(message, correlationId)
+}
+
+// binaryCodec writes messages in an Avro-style binary encoding, framed with
+// the id of their schema in the registry
+type binaryCodec struct {
+	registry *SchemaRegistry
+}
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (c binaryCodec) Encode(message interface{}, correlationId string) ([]byte, error) {
+	data, err := c.frame(message)
+	if err != nil || !useEnvelope() {
+		return data, err
+	}
+	return c.frame(newEnvelope(messageType(message), correlationId, data))
+}
+
+func (c binaryCodec) frame(message interface{}) ([]byte, error) {
+	// written with this service's own schema for the message, which readers
+	// with other (compatible) versions resolve against theirs
+	schema, err := SchemaOf(message)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.registry.Schema(schema.Id()); err != nil {
+		return nil, fmt.Errorf("%s is not registered: %s", schema.Name, err)
+	}
+	return writeFrame(schema, reflect.Indirect(reflect.ValueOf(message)))
+}
+
+// writeFrame encodes value with schema, framed with the schema's id and the schema itself
+func writeFrame(schema *Schema, value reflect.Value) ([]byte, error) {
+	var schemaBuf bytes.Buffer
+	writeSchema(&schemaBuf, schema)
+	var buf bytes.Buffer
+	buf.WriteByte(binarySchemaMagic)
+	binary.Write(&buf, binary.BigEndian, schema.Id())
+	writeLong(&buf, int64(schemaBuf.Len()))
+	buf.Write(schemaBuf.Bytes())
+	if err := writeValue(&buf, schema, value); err != nil {
+		return nil, fmt.Errorf("Cannot encode %s: %s", schema.Name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// GetCodec returns the codec called name: "json" or "binary"
+func GetCodec(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return jsonCodec{}, nil
+	case "binary":
+		registry, err := getSchemaRegistry()
+		if err != nil {
+			return nil, err
+		}
+		return binaryCodec{registry}, nil
+	}
+	return nil, fmt.Errorf("Unknown codec %q", name)
+}
+
+// GetTopicCodec returns the codec for messages sent to topic. KAFKA_TOPIC_CODECS
+// lists the topics with their own codec, as "topic=codec,topic=codec", and
+// KAFKA_CODEC is the codec of any other topic (default "json").
+func GetTopicCodec(topic string) (Codec, error) {
+	name := utils.GetEnvironmentVariable("KAFKA_CODEC", "json")
+	for _, topicCodec := range strings.Split(utils.GetEnvironmentVariable("KAFKA_TOPIC_CODECS", ""), ",") {
+		if parts := strings.SplitN(strings.TrimSpace(topicCodec), "=", 2); len(parts) == 2 && parts[0] == topic {
+			name = parts[1]
+		}
+	}
+	return GetCodec(name)
+}
+
+func useEnvelope() bool {
+	return utils.GetEnvironmentVariable("KAFKA_MESSAGE_ENVELOPE", "0") == "1"
+}
+
+func newEnvelope(messageType, correlationId string, payload []byte) Envelope {
+	if correlationId == "" {
+		correlationId = NewCorrelationId()
+	}
+	return Envelope{
+		Type:          messageType,
+		Version:       SchemaVersion,
+		ProducedAt:    time.Now().UnixNano(),
+		Producer:      log.Namespace,
+		CorrelationId: correlationId,
+		Payload:       payload,
+	}
+}
+
+func isBinary(data []byte) bool {
+	return len(data) > 0 && (data[0] == binaryMagic || data[0] == binarySchemaMagic)
+}
+
+// decodeBinary reads data (framed by binaryCodec) into message, returning its
+// Envelope (or nil)
+func decodeBinary(data []byte, message interface{}) (*Envelope, error) {
+	registry, err := getSchemaRegistry()
+	if err != nil {
+		return nil, err
+	}
+	schema, reader, err := openFrame(registry, data)
+	if err != nil {
+		return nil, err
+	}
+	if schema.Name != "Envelope" {
+		if schema.Name != messageType(message) {
+			return nil, fmt.Errorf("Expected %s, got %s message", messageType(message), schema.Name)
+		}
+		return nil, readValue(reader, schema, reflect.ValueOf(message).Elem())
+	}
+	var envelope Envelope
+	if err = readValue(reader, schema, reflect.ValueOf(&envelope).Elem()); err != nil {
+		return nil, err
+	}
+	if err = checkEnvelope(&envelope, message); err != nil {
+		return &envelope, err
+	}
+	if _, err = decodeBinary(envelope.Payload, message); err != nil {
+		return &envelope, err
+	}
+	return &envelope, nil
+}
+
+// readBinaryFields reads some fields of a binary message (bare or enveloped)
+// into fields, skipping the rest where it lies rather than decoding it. An
+// enveloped payload is read in place, not copied out of its envelope.
+func readBinaryFields(data []byte, fields interface{}) error {
+	registry, err := getSchemaRegistry()
+	if err != nil {
+		return err
+	}
+	schema, reader, err := openFrame(registry, data)
+	if err != nil {
+		return err
+	}
+	if schema.Name != "Envelope" {
+		return readValue(reader, schema, reflect.ValueOf(fields).Elem())
+	}
+	for _, field := range schema.Fields {
+		if field.Name != "Payload" {
+			if err = readValue(reader, field.Type, reflect.Value{}); err != nil {
+				return fmt.Errorf("Envelope.%s: %s", field.Name, err)
+			}
+			continue
+		}
+		length, err := binary.ReadVarint(reader)
+		if err != nil {
+			return err
+		}
+		if length < 0 || length > int64(reader.Len()) {
+			return fmt.Errorf("Envelope.Payload: Bad length %d", length)
+		}
+		start := len(data) - reader.Len()
+		return readBinaryFields(data[start:start+int(length)], fields)
+	}
+	return fmt.Errorf("Envelope has no Payload")
+}
+
+// openFrame returns the (writer's) schema of data, and a reader of the encoded
+// message. A schema framed with the message is read once, then remembered by its id.
+func openFrame(registry *SchemaRegistry, data []byte) (*Schema, *bytes.Reader, error) {
+	if len(data) < 5 || !isBinary(data) {
+		return nil, nil, fmt.Errorf("Not a binary message")
+	}
+	id := binary.BigEndian.Uint32(data[1:5])
+	reader := bytes.NewReader(data[5:])
+	if data[0] == binaryMagic {
+		// the reader must know the schema
+		schema, err := registry.Schema(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		return schema, reader, nil
+	}
+
+	length, err := binary.ReadVarint(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length < 0 || length > int64(reader.Len()) {
+		return nil, nil, fmt.Errorf("Bad schema length %d", length)
+	}
+	start := len(data) - reader.Len()
+	schemaData := data[start : start+int(length)]
+	reader = bytes.NewReader(data[start+int(length):])
+	if schema, known := registry.known(id); known {
+		return schema, reader, nil
+	}
+	schema, err := readSchema(bytes.NewReader(schemaData))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Bad schema %d: %s", id, err)
+	}
+	if schema.Id() != id {
+		return nil, nil, fmt.Errorf("Schema %s does not match its id %d", schema.Name, id)
+	}
+	registry.remember(id, schema)
+	return schema, reader, nil
+}
+
+// writeSchema writes schema in the binary encoding: its type, then for a
+// record its name and fields (each a name and schema), or for an array the
+// schema of its items
+func writeSchema(buf *bytes.Buffer, schema *Schema) {
+	writeString(buf, schema.Type)
+	switch schema.Type {
+	case "record":
+		writeString(buf, schema.Name)
+		writeLong(buf, int64(len(schema.Fields)))
+		for _, field := range schema.Fields {
+			writeString(buf, field.Name)
+			writeSchema(buf, field.Type)
+		}
+	case "array":
+		writeSchema(buf, schema.Items)
+	}
+}
+
+// readSchema reads a schema written by writeSchema
+func readSchema(reader *bytes.Reader) (*Schema, error) {
+	schemaType, err := readBytes(reader)
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{Type: string(schemaType)}
+	switch schema.Type {
+	case "long", "string", "bytes", "boolean":
+	case "record":
+		name, err := readBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		schema.Name = string(name)
+		count, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 || count > int64(reader.Len()) {
+			return nil, fmt.Errorf("Bad field count %d", count)
+		}
+		for i := int64(0); i < count; i++ {
+			fieldName, err := readBytes(reader)
+			if err != nil {
+				return nil, err
+			}
+			fieldType, err := readSchema(reader)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", schema.Name, fieldName, err)
+			}
+			schema.Fields = append(schema.Fields, Field{Name: string(fieldName), Type: fieldType})
+		}
+	case "array":
+		if schema.Items, err = readSchema(reader); err != nil {
+			return nil, fmt.Errorf("items: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported schema type %q", schema.Type)
+	}
+	return schema, nil
+}
+
+func writeValue(buf *bytes.Buffer, schema *Schema, value reflect.Value) error {
+	switch schema.Type {
+	case "long":
+		writeLong(buf, value.Int())
+	case "boolean":
+		if value.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "string":
+		writeLong(buf, int64(value.Len()))
+		buf.WriteString(value.String())
+	case "bytes":
+		writeLong(buf, int64(value.Len()))
+		buf.Write(value.Bytes())
+	case "array":
+		// a single block of items, ended by an empty block
+		if value.Len() > 0 {
+			writeLong(buf, int64(value.Len()))
+			for i := 0; i < value.Len(); i++ {
+				if err := writeValue(buf, schema.Items, value.Index(i)); err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buf, 0)
+	case "record":
+		for _, field := range schema.Fields {
+			fieldValue := value.FieldByName(field.Name)
+			if !fieldValue.IsValid() {
+				return fmt.Errorf("%s has no field %s", value.Type(), field.Name)
+			}
+			if err := writeValue(buf, field.Type, fieldValue); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported schema type %q", schema.Type)
+	}
+	return nil
+}
+
+func writeLong(buf *bytes.Buffer, n int64) {
+	varint := make([]byte, binary.MaxVarintLen64)
+	buf.Write(varint[:binary.PutVarint(varint, n)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeLong(buf, int64(len(s)))
+	buf.WriteString(s)
+}
+
+// readValue reads a value written with schema into value. Fields of the
+// writer's schema which value does not have are skipped (value is invalid).
+func readValue(reader *bytes.Reader, schema *Schema, value reflect.Value) error {
+	if value.IsValid() {
+		if readerSchema, err := schemaOfType(value.Type()); err != nil || readerSchema.Type != schema.Type {
+			return fmt.Errorf("Cannot read %s into %s", schema.Type, value.Type())
+		}
+	}
+	switch schema.Type {
+	case "long":
+		n, err := binary.ReadVarint(reader)
+		if err != nil {
+			return err
+		}
+		if value.IsValid() {
+			if value.OverflowInt(n) {
+				return fmt.Errorf("%d overflows %s", n, value.Type())
+			}
+			value.SetInt(n)
+		}
+	case "boolean":
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if value.IsValid() {
+			value.SetBool(b != 0)
+		}
+	case "string", "bytes":
+		if !value.IsValid() {
+			return skipBytes(reader)
+		}
+		content, err := readBytes(reader)
+		if err != nil {
+			return err
+		}
+		if schema.Type == "string" {
+			value.SetString(string(content))
+		} else {
+			value.SetBytes(content)
+		}
+	case "array":
+		for {
+			count, err := binary.ReadVarint(reader)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				break
+			}
+			for i := int64(0); i < count; i++ {
+				item := reflect.Value{}
+				if value.IsValid() {
+					value.Set(reflect.Append(value, reflect.Zero(value.Type().Elem())))
+					item = value.Index(value.Len() - 1)
+				}
+				if err := readValue(reader, schema.Items, item); err != nil {
+					return err
+				}
+			}
+		}
+	case "record":
+		for _, field := range schema.Fields {
+			fieldValue := reflect.Value{}
+			if value.IsValid() {
+				fieldValue = value.FieldByName(field.Name)
+			}
+			if err := readValue(reader, field.Type, fieldValue); err != nil {
+				return fmt.Errorf("%s.%s: %s", schema.Name, field.Name, err)
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported schema type %q", schema.Type)
+	}
+	return nil
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadVarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length > int64(reader.Len()) {
+		return nil, fmt.Errorf("Bad length %d", length)
+	}
+	content := make([]byte, length)
+	if _, err = io.ReadFull(reader, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// skipBytes passes over a string or bytes without reading it, as a skipped
+// field may be large (e.g. FileContent)
+func skipBytes(reader *bytes.Reader) error {
+	length, err := binary.ReadVarint(reader)
+	if err != nil {
+		return err
+	}
+	if length < 0 || length > int64(reader.Len()) {
+		return fmt.Errorf("Bad length %d", length)
+	}
+	_, err = reader.Seek(length, io.SeekCurrent)
+	return err
+}
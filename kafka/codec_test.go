@@ -0,0 +1,249 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	codec, err := GetCodec("binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := ScheduleMessage{
+		Action:       "schedule",
+		CollectionId: "test0001",
+		ScheduleTime: "1490000000",
+		Files:        []FileResource{{Id: 1, Location: "s3://bucket/a.json", Uri: "/a"}, {Id: -2, Uri: "/b"}},
+		UrisToDelete: []string{"/c"},
+	}
+	data, err := codec.Encode(sent, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received ScheduleMessage
+	envelope, err := Decode(data, &received)
+	if err != nil || envelope != nil {
+		t.Fatalf("Test failed, got: %v %v", envelope, err)
+	}
+	if !reflect.DeepEqual(sent, received) {
+		t.Errorf("Test failed, expected: %+v got: %+v", sent, received)
+	}
+}
+
+func TestBinaryIsSmaller(t *testing.T) {
+	codec, _ := GetCodec("binary")
+	// a page, whose markdown is escaped once in its json, and again in a json message
+	sections := make([]map[string]string, 10)
+	for i := range sections {
+		sections[i] = map[string]string{"title": fmt.Sprintf("Section %d", i+1),
+			"markdown": `The "Consumer Prices Index" rose by 2.3% in the 12 months to "March", see [the "data"](/economy/inflation "CPI")`}
+	}
+	content, _ := json.Marshal(map[string]interface{}{"type": "bulletin", "uri": "/economy/inflation", "sections": sections})
+	message := FileCompleteMessage{ScheduleId: 12, FileId: 34, CollectionId: "test0002", Uri: "/economy/inflation/data.json", FileContent: string(content)}
+	binaryData, _ := codec.Encode(message, "")
+	jsonData, _ := Encode(message, "")
+	if len(binaryData) >= len(jsonData) {
+		t.Errorf("Test failed, binary %d bytes, json %d bytes", len(binaryData), len(jsonData))
+	}
+}
+
+func TestBinaryEnvelope(t *testing.T) {
+	os.Setenv("KAFKA_MESSAGE_ENVELOPE", "1")
+	defer os.Unsetenv("KAFKA_MESSAGE_ENVELOPE")
+	codec, _ := GetCodec("binary")
+	data, err := codec.Encode(PublishDeleteMessage{ScheduleId: 43, DeleteId: 34, CollectionId: "123", Uri: "/aboutus"}, "corr-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message PublishDeleteMessage
+	envelope, err := Decode(data, &message)
+	if err != nil || envelope == nil || envelope.CorrelationId != "corr-1" || envelope.Type != "PublishDeleteMessage" {
+		t.Fatalf("Test failed, got envelope: %+v %v", envelope, err)
+	}
+	if message.DeleteId != 34 || message.Uri != "/aboutus" {
+		t.Errorf("Test failed, got: %+v", message)
+	}
+	if key := KeyByUri(data); string(key) != "/aboutus" {
+		t.Errorf("Test failed, expected key: /aboutus got: %s", key)
+	}
+	var wrong PublishFileMessage
+	if _, err = Decode(data, &wrong); err == nil {
+		t.Error("Test failed, expected an error decoding into the wrong type")
+	}
+}
+
+type fileV1 struct {
+	FileId  int64
+	Uri     string
+	Retired string
+}
+
+type fileV2 struct {
+	FileId int32
+	Uri    string
+	Size   int64
+}
+
+func TestBinaryReadsOlderSchema(t *testing.T) {
+	writer, _ := SchemaOf(fileV1{})
+	writer.Name = "file"
+	var buf bytes.Buffer
+	if err := writeValue(&buf, writer, reflect.ValueOf(fileV1{FileId: 7, Uri: "/a", Retired: "gone"})); err != nil {
+		t.Fatal(err)
+	}
+
+	var received fileV2
+	if err := readValue(bytes.NewReader(buf.Bytes()), writer, reflect.ValueOf(&received).Elem()); err != nil {
+		t.Fatal(err)
+	}
+	if received.FileId != 7 || received.Uri != "/a" || received.Size != 0 {
+		t.Errorf("Test failed, got: %+v", received)
+	}
+}
+
+// publishFileV0 is a PublishFileMessage as written before embargoes and dry runs
+type publishFileV0 struct {
+	ScheduleId     int64
+	FileId         int64
+	CollectionId   string
+	CollectionPath string
+	EncryptionKey  string
+	FileLocation   string
+	Uri            string
+}
+
+// publishFileV9 is a PublishFileMessage as a later release might write it
+type publishFileV9 struct {
+	ScheduleId   int64
+	FileId       int64
+	CollectionId string
+	Uri          string
+	ScheduleTime int64
+	Checksum     string
+	Tags         []string
+}
+
+// frameAs frames message as a writer whose struct for it is called name would
+func frameAs(t *testing.T, name string, message interface{}) []byte {
+	schema, err := SchemaOf(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema.Name = name
+	data, err := writeFrame(schema, reflect.ValueOf(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBinaryReadsOtherWriterVersions(t *testing.T) {
+	// from an older writer, whose schema this reader has never registered
+	var received PublishFileMessage
+	data := frameAs(t, "PublishFileMessage", publishFileV0{ScheduleId: 1, FileId: 2, CollectionId: "test0001", FileLocation: "s3://bucket/a.json", Uri: "/a"})
+	if _, err := Decode(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.FileId != 2 || received.FileLocation != "s3://bucket/a.json" || received.Uri != "/a" || received.ScheduleTime != 0 || received.DryRun {
+		t.Errorf("Test failed, got: %+v", received)
+	}
+
+	// from a newer writer, with fields this reader does not have
+	received = PublishFileMessage{}
+	data = frameAs(t, "PublishFileMessage", publishFileV9{ScheduleId: 3, FileId: 4, Uri: "/b", ScheduleTime: 1490000000, Checksum: "abc", Tags: []string{"x"}})
+	if _, err := Decode(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.FileId != 4 || received.Uri != "/b" || received.ScheduleTime != 1490000000 || received.CollectionPath != "" {
+		t.Errorf("Test failed, got: %+v", received)
+	}
+
+	// and each reads what this writer sends
+	codec, _ := GetCodec("binary")
+	data, err := codec.Encode(PublishFileMessage{ScheduleId: 5, FileId: 6, Uri: "/c", ScheduleTime: 1490000000, DryRun: true}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, _ := getSchemaRegistry()
+	schema, reader, err := openFrame(registry, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var older publishFileV0
+	if err = readValue(reader, schema, reflect.ValueOf(&older).Elem()); err != nil || older.FileId != 6 || older.Uri != "/c" {
+		t.Errorf("Test failed, older reader got: %+v %v", older, err)
+	}
+	_, reader, _ = openFrame(registry, data)
+	var newer publishFileV9
+	if err = readValue(reader, schema, reflect.ValueOf(&newer).Elem()); err != nil || newer.FileId != 6 || newer.ScheduleTime != 1490000000 || newer.Checksum != "" {
+		t.Errorf("Test failed, newer reader got: %+v %v", newer, err)
+	}
+}
+
+func TestBinaryRefusesMismatchedSchema(t *testing.T) {
+	data := frameAs(t, "PublishFileMessage", publishFileV0{FileId: 2})
+	// the id no longer fingerprints the schema framed with it
+	data[1]++
+	var received PublishFileMessage
+	if _, err := Decode(data, &received); err == nil {
+		t.Error("Test failed, expected an error for a schema not matching its id")
+	}
+}
+
+type fileV3 struct {
+	FileId string
+}
+
+func TestRegistryRejectsIncompatibleSchema(t *testing.T) {
+	registry, _ := NewSchemaRegistry("")
+	if _, err := registry.Register(fileV1{}); err != nil {
+		t.Fatal(err)
+	}
+	// registered under the same subject (struct name) as fileV1
+	registry.Subjects["fileV3"] = registry.Subjects["fileV1"]
+	_, err := registry.Register(fileV3{})
+	if err == nil || !strings.Contains(err.Error(), "FileId") {
+		t.Errorf("Test failed, expected incompatible FileId, got: %v", err)
+	}
+}
+
+func TestRegistryOnlyRemembersRegisteredSubjects(t *testing.T) {
+	registry, _ := NewSchemaRegistry("")
+	if _, err := registry.Register(fileV1{}); err != nil {
+		t.Fatal(err)
+	}
+	unknown, _ := SchemaOf(fileV3{})
+	registry.remember(unknown.Id(), unknown)
+	if _, known := registry.known(unknown.Id()); known {
+		t.Error("Test failed, expected a schema of an unregistered subject to be forgotten")
+	}
+	for i := 0; i <= maxReadSchemas; i++ {
+		version := &Schema{Type: "record", Name: "fileV1", Fields: []Field{{Name: fmt.Sprintf("Field%d", i), Type: &Schema{Type: "long"}}}}
+		registry.remember(version.Id(), version)
+	}
+	if len(registry.read) != maxReadSchemas {
+		t.Errorf("Test failed, expected %d schemas remembered, got %d", maxReadSchemas, len(registry.read))
+	}
+}
+
+func TestTopicCodec(t *testing.T) {
+	os.Setenv("KAFKA_TOPIC_CODECS", "uk.gov.ons.dp.web.complete-file=binary")
+	defer os.Unsetenv("KAFKA_TOPIC_CODECS")
+	if codec, err := GetTopicCodec("uk.gov.ons.dp.web.complete-file"); err != nil || codec.Name() != "binary" {
+		t.Errorf("Test failed, expected binary, got: %v %v", codec, err)
+	}
+	if codec, err := GetTopicCodec("uk.gov.ons.dp.web.complete"); err != nil || codec.Name() != "json" {
+		t.Errorf("Test failed, expected json, got: %v %v", codec, err)
+	}
+	if _, err := GetCodec("xml"); err == nil {
+		t.Error("Test failed, expected an error for an unknown codec")
+	}
+}
@@ -0,0 +1,114 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+// Brokers returns the brokers listed (separated by ",") in KAFKA_ADDR
+func Brokers() []string {
+	var brokers []string
+	for _, broker := range utils.GetEnvironmentVariableAsArray("KAFKA_ADDR", "localhost:9092") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	return brokers
+}
+
+// Configure sets up config to connect to the brokers as set in the environment.
+// KAFKA_CLIENT_ID is the client id sent to the brokers (default: the service
+// name). KAFKA_TLS "1" connects using TLS, trusting the CAs in KAFKA_TLS_CA_FILE
+// (default: the system's) and authenticating with any client certificate and
+// key in KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE. KAFKA_SASL_MECHANISM
+// "PLAIN", "SCRAM-SHA-256" or "SCRAM-SHA-512" authenticates with
+// KAFKA_SASL_USER and KAFKA_SASL_PASSWORD.
+func Configure(config *sarama.Config) error {
+	config.ClientID = utils.GetEnvironmentVariable("KAFKA_CLIENT_ID", log.Namespace)
+	if config.ClientID == "" {
+		config.ClientID = "dp-publish-pipeline"
+	}
+
+	if utils.GetEnvironmentVariable("KAFKA_TLS", "0") == "1" {
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	switch mechanism := utils.GetEnvironmentVariable("KAFKA_SASL_MECHANISM", ""); mechanism {
+	case "":
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+		config.Net.SASL.User = utils.GetEnvironmentVariable("KAFKA_SASL_USER", "")
+		config.Net.SASL.Password = utils.GetEnvironmentVariable("KAFKA_SASL_PASSWORD", "")
+		if mechanism == sarama.SASLTypeSCRAMSHA256 {
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: sha256.New} }
+		} else if mechanism == sarama.SASLTypeSCRAMSHA512 {
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: sha512.New} }
+		}
+	default:
+		return fmt.Errorf("Unknown KAFKA_SASL_MECHANISM %q", mechanism)
+	}
+	return config.Validate()
+}
+
+// scramClient is the client side of a SASL/SCRAM exchange, for sarama
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if caFile := utils.GetEnvironmentVariable("KAFKA_TLS_CA_FILE", ""); caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read KAFKA_TLS_CA_FILE: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No certificates found in KAFKA_TLS_CA_FILE %s", caFile)
+		}
+	}
+	certFile := utils.GetEnvironmentVariable("KAFKA_TLS_CERT_FILE", "")
+	keyFile := utils.GetEnvironmentVariable("KAFKA_TLS_KEY_FILE", "")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load KAFKA_TLS_CERT_FILE/KAFKA_TLS_KEY_FILE: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestBrokers(t *testing.T) {
+	os.Setenv("KAFKA_ADDR", "kafka-1:9092, kafka-2:9092,,kafka-3:9092")
+	defer os.Unsetenv("KAFKA_ADDR")
+	expected := []string{"kafka-1:9092", "kafka-2:9092", "kafka-3:9092"}
+	if brokers := Brokers(); !reflect.DeepEqual(brokers, expected) {
+		t.Errorf("Test failed, expected: %v got: %v", expected, brokers)
+	}
+}
+
+func TestConfigureSASLPlain(t *testing.T) {
+	os.Setenv("KAFKA_SASL_MECHANISM", "PLAIN")
+	os.Setenv("KAFKA_SASL_USER", "publisher")
+	os.Setenv("KAFKA_SASL_PASSWORD", "secret")
+	os.Setenv("KAFKA_CLIENT_ID", "publish-test")
+	defer func() {
+		for _, name := range []string{"KAFKA_SASL_MECHANISM", "KAFKA_SASL_USER", "KAFKA_SASL_PASSWORD", "KAFKA_CLIENT_ID"} {
+			os.Unsetenv(name)
+		}
+	}()
+	config := sarama.NewConfig()
+	if err := Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	if !config.Net.SASL.Enable || config.Net.SASL.User != "publisher" || config.Net.SASL.Password != "secret" || config.ClientID != "publish-test" {
+		t.Errorf("Test failed, got: %+v client %q", config.Net.SASL, config.ClientID)
+	}
+
+	os.Unsetenv("KAFKA_SASL_PASSWORD")
+	if err := Configure(sarama.NewConfig()); err == nil {
+		t.Error("Test failed, expected an error without a password")
+	}
+}
+
+func TestConfigureSASLSCRAM(t *testing.T) {
+	os.Setenv("KAFKA_SASL_MECHANISM", "SCRAM-SHA-512")
+	os.Setenv("KAFKA_SASL_USER", "publisher")
+	os.Setenv("KAFKA_SASL_PASSWORD", "secret")
+	defer func() {
+		for _, name := range []string{"KAFKA_SASL_MECHANISM", "KAFKA_SASL_USER", "KAFKA_SASL_PASSWORD"} {
+			os.Unsetenv(name)
+		}
+	}()
+	config := sarama.NewConfig()
+	if err := Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || config.Net.SASL.SCRAMClientGeneratorFunc == nil {
+		t.Fatalf("Test failed, expected SCRAM-SHA-512, got: %+v", config.Net.SASL)
+	}
+	client := config.Net.SASL.SCRAMClientGeneratorFunc()
+	if err := client.Begin("publisher", "secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	if first, err := client.Step(""); err != nil || !strings.HasPrefix(first, "n,,n=publisher,r=") || client.Done() {
+		t.Errorf("Test failed, expected the client's first message, got: %q %v", first, err)
+	}
+}
+
+func TestConfigureTLS(t *testing.T) {
+	os.Setenv("KAFKA_TLS", "1")
+	defer os.Unsetenv("KAFKA_TLS")
+	config := sarama.NewConfig()
+	if err := Configure(config); err != nil || !config.Net.TLS.Enable || config.Net.TLS.Config == nil {
+		t.Errorf("Test failed, expected TLS, got: %+v %v", config.Net.TLS, err)
+	}
+
+	os.Setenv("KAFKA_TLS_CA_FILE", "/does/not/exist.pem")
+	defer os.Unsetenv("KAFKA_TLS_CA_FILE")
+	if err := Configure(sarama.NewConfig()); err == nil {
+		t.Error("Test failed, expected an error for a missing CA file")
+	}
+}
@@ -1,11 +1,11 @@
 package kafka
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"sync"
 	"time"
 
-	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/go-ns/log"
 	"github.com/Shopify/sarama"
 	"github.com/bsm/sarama-cluster"
@@ -14,74 +14,385 @@ import (
 var tick = time.Millisecond * 4000
 
 type ConsumerGroup struct {
-	Consumer *cluster.Consumer
-	Incoming chan Message
-	Closer   chan bool
-	Errors   chan error
+	Consumer   consumerBackend
+	Incoming   chan Message
+	Closer     chan bool
+	Errors     chan error
+	closed     chan error
+	bus        Bus
+	metrics    *consumerMetrics
+	deadLetter *Producer
+	service    string
+	retry      RetryPolicy
+	onFailure  FailureHandler
+	topic      string
+	group      string
+	pauseMutex sync.Mutex
+	pause      PauseState
+	wake       chan bool
+	unpaused   chan bool // closed by Resume, for a Handle waiting to retry while paused
+	stopping   chan bool // closed by Stop
+	stopOnce   sync.Once
+	aborted    *AbortedSchedules
+	embargo    *Embargo
+}
+
+// PauseState is whether a ConsumerGroup is paused and, if so, why and since when
+type PauseState struct {
+	Topic  string `json:"topic"`
+	Group  string `json:"group"`
+	Paused bool   `json:"paused"`
+	Reason string `json:"reason,omitempty"`
+	Since  string `json:"since,omitempty"`
 }
 
 type Message struct {
 	message  *sarama.ConsumerMessage
-	consumer *cluster.Consumer
+	consumer consumerBackend
+	metrics  *consumerMetrics
+	attempt  int
+	parked   *parkedLetter // committed in place of message, which was re-driven from the embargo topic
+}
+
+// consumerBackend is the member of a consumer group which a ConsumerGroup
+// reads from: a sarama-cluster Consumer, or a member of a MemoryBus group
+type consumerBackend interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan error
+	MarkOffset(msg *sarama.ConsumerMessage, metadata string)
+	CommitOffsets() error
+	HighWaterMarks() map[string]map[int32]int64
+	Close() error
+}
+
+// Handler processes a single message taken from ConsumerGroup.Incoming,
+// returning an error when the message could not be processed
+type Handler func(msg Message) error
+
+// ErrStopped is returned by Handle for a message it was waiting to retry when
+// the group was stopped (see Stop). The message is left uncommitted.
+var ErrStopped = errors.New("Consumer group stopped before the message was retried")
+
+// ForwardError is returned by Handle for a message it could not forward (to the
+// dead-letter topic, or the embargo topic). Unlike a message whose handler
+// failed, it must not be committed: the service should stop, and consume it
+// again when restarted.
+type ForwardError struct {
+	Err error
+}
+
+func (e ForwardError) Error() string {
+	return e.Err.Error()
 }
 
 func (M Message) GetData() []byte {
 	return M.message.Value
 }
 
+func (M Message) GetTopic() string {
+	return M.message.Topic
+}
+
+func (M Message) GetPartition() int32 {
+	return M.message.Partition
+}
+
+func (M Message) GetOffset() int64 {
+	return M.message.Offset
+}
+
+// GetAttempt is the (1-based) number of the attempt being made at this message.
+// It is only counted by this process, so a redelivered message starts again at 1.
+func (M Message) GetAttempt() int {
+	return M.attempt
+}
+
 func (M Message) Commit() {
+	if M.parked != nil {
+		M.parked.offsets.handled(M.parked)
+		return
+	}
 	M.consumer.MarkOffset(M.message, "metadata")
+	if M.metrics != nil {
+		M.metrics.marked(M.message.Partition, M.message.Offset)
+	}
 	//M.consumer.CommitOffsets()
 	//log.Printf("Offset : %d, Partition : %d", M.message.Offset, M.message.Partition)
 }
 
+// SetDeadLetterTopic sends any message whose handler fails (see Handle) to topic,
+// tagged with the name of the service, so that the group can move on past it
+// once the brokers have accepted it. An empty topic leaves dead-lettering off.
+func (cg *ConsumerGroup) SetDeadLetterTopic(topic, service string) {
+	if topic == "" {
+		return
+	}
+	producer := cg.bus.NewAckProducer(topic)
+	cg.deadLetter = &producer
+	cg.service = service
+	log.Info(fmt.Sprintf("Dead-lettering failed messages of %s to %q", service, topic), nil)
+}
+
+// SetRetryPolicy has Handle retry a failing handler according to policy
+func (cg *ConsumerGroup) SetRetryPolicy(policy RetryPolicy) {
+	cg.retry = policy
+}
+
+// SetFailureHandler has Handle call onFailure for any message whose final attempt fails
+func (cg *ConsumerGroup) SetFailureHandler(onFailure FailureHandler) {
+	cg.onFailure = onFailure
+}
+
+// Handle passes msg to handler (retrying it according to the retry policy)
+// and commits it on success. After the final failed attempt, the failure
+// handler is called. Then, if a dead-letter topic has been set, the message is
+// sent there and, once the brokers accept it, committed. Otherwise (or if the
+// failure handler fails, or the message cannot be dead-lettered, when the
+// error is a ForwardError) it is left uncommitted and the error is returned.
+// While waiting to retry, a paused group waits until resumed, and a stopped one
+// returns ErrStopped. A message of an aborted schedule (see SetAbortedSchedules) is committed unhandled,
+// as is one refused by the embargo (see SetEmbargo), once parked (else a ForwardError is returned).
+func (cg *ConsumerGroup) Handle(msg Message, handler Handler) error {
+	if cg.isAborted(msg) {
+		msg.Commit()
+		return nil
+	}
+	if refused, err := cg.embargo.refuses(msg); err != nil {
+		return err
+	} else if refused {
+		msg.Commit()
+		return nil
+	}
+	var err error
+	for msg.attempt = 1; ; msg.attempt++ {
+		started := time.Now()
+		err = handler(msg)
+		cg.metrics.handled(msg.GetPartition(), time.Since(started))
+		if err == nil {
+			msg.Commit()
+			return nil
+		}
+		if msg.attempt >= cg.retry.MaxAttempts {
+			break
+		}
+		backoff := cg.retry.Backoff(msg.attempt)
+		log.ErrorC(fmt.Sprintf("Attempt %d/%d failed, retrying in %s", msg.attempt, cg.retry.MaxAttempts, backoff), err, log.Data{"topic": msg.GetTopic(), "partition": msg.GetPartition(), "offset": msg.GetOffset()})
+		if !cg.waitToRetry(backoff) {
+			return ErrStopped
+		}
+	}
+	if cg.onFailure != nil {
+		if failureErr := cg.onFailure(msg, err); failureErr != nil {
+			return ForwardError{fmt.Errorf("Cannot report failed message (%s): %s", err, failureErr)}
+		}
+	}
+	if cg.deadLetter == nil {
+		return err
+	}
+	data, marshalErr := cg.deadLetter.Encode(DeadLetterMessage{
+		Service:   cg.service,
+		Topic:     msg.GetTopic(),
+		Partition: msg.GetPartition(),
+		Offset:    msg.GetOffset(),
+		Attempts:  msg.GetAttempt(),
+		Error:     err.Error(),
+		Value:     msg.GetData(),
+	}, "")
+	if marshalErr != nil {
+		return ForwardError{fmt.Errorf("Cannot dead-letter message (%s): %s", err, marshalErr)}
+	}
+	if sendErr := cg.deadLetter.Send(data); sendErr != nil {
+		return ForwardError{fmt.Errorf("Cannot dead-letter message (%s): %s", err, sendErr)}
+	}
+	log.ErrorC("Message sent to dead-letter topic", err, log.Data{"topic": msg.GetTopic(), "partition": msg.GetPartition(), "offset": msg.GetOffset()})
+	msg.Commit()
+	return nil
+}
+
+// waitToRetry waits out backoff and then, if the group is paused, until it is
+// resumed. It returns false if the group was stopped first.
+func (cg *ConsumerGroup) waitToRetry(backoff time.Duration) bool {
+	select {
+	case <-time.After(backoff):
+	case <-cg.stopping:
+		return false
+	}
+	for {
+		cg.pauseMutex.Lock()
+		unpaused := cg.unpaused
+		cg.pauseMutex.Unlock()
+		if unpaused == nil {
+			return true
+		}
+		select {
+		case <-unpaused:
+		case <-cg.stopping:
+			return false
+		}
+	}
+}
+
+// Pause stops passing messages to Incoming until Resume is called. A message
+// already taken from Incoming is still handled, but a retry of it waits until
+// the group is resumed (see Handle). The group keeps its partitions, and its
+// place in them, while paused.
+func (cg *ConsumerGroup) Pause(reason string) {
+	cg.pauseMutex.Lock()
+	if cg.unpaused == nil {
+		cg.unpaused = make(chan bool)
+	}
+	cg.pause.Paused = true
+	cg.pause.Reason = reason
+	cg.pause.Since = time.Now().UTC().Format(time.RFC3339)
+	cg.pauseMutex.Unlock()
+	log.Info(fmt.Sprintf("Paused kafka consumer of topic %q group %q", cg.topic, cg.group), log.Data{"reason": reason})
+	cg.wakeUp()
+}
+
+// Resume undoes Pause
+func (cg *ConsumerGroup) Resume() {
+	cg.pauseMutex.Lock()
+	wasPaused := cg.pause.Paused
+	cg.pause = PauseState{Topic: cg.topic, Group: cg.group}
+	if cg.unpaused != nil {
+		close(cg.unpaused)
+		cg.unpaused = nil
+	}
+	cg.pauseMutex.Unlock()
+	if wasPaused {
+		log.Info(fmt.Sprintf("Resumed kafka consumer of topic %q group %q", cg.topic, cg.group), nil)
+		cg.wakeUp()
+	}
+}
+
+// PauseState reports whether the group is paused
+func (cg *ConsumerGroup) PauseState() PauseState {
+	cg.pauseMutex.Lock()
+	defer cg.pauseMutex.Unlock()
+	return cg.pause
+}
+
+// wakeUp has the consuming goroutine notice a change in the pause state
+func (cg *ConsumerGroup) wakeUp() {
+	select {
+	case cg.wake <- true:
+	default:
+	}
+}
+
+// Stop has Handle give up on any message it is waiting to retry, so that a
+// service shutting down need not wait out the backoff (see shutdown.OnSignal)
+func (cg *ConsumerGroup) Stop() {
+	cg.stopOnce.Do(func() { close(cg.stopping) })
+}
+
+// Close stops (see Stop) and consumes no more, then commits the offsets of all
+// committed messages and leaves the group. Messages not yet taken from Incoming
+// will be consumed again by the group.
+func (cg *ConsumerGroup) Close() error {
+	cg.Stop()
+	cg.Closer <- true
+	err := <-cg.closed
+	cg.metrics.close()
+	if cg.deadLetter != nil {
+		if dlErr := cg.deadLetter.Close(); dlErr != nil && err == nil {
+			err = dlErr
+		}
+	}
+	return err
+}
+
+// commitOffsets commits the offsets marked so far to the brokers
+func (cg *ConsumerGroup) commitOffsets() {
+	marked := cg.metrics.markedOffsets()
+	if err := cg.Consumer.CommitOffsets(); err != nil {
+		log.ErrorC("Could not commit offsets", err, log.Data{"topic": cg.topic, "group": cg.group})
+		return
+	}
+	cg.metrics.committed(marked)
+}
+
 func SetMaxMessageSize(maxSize int32) {
 	sarama.MaxRequestSize = maxSize
 	sarama.MaxResponseSize = maxSize
 }
 
 func NewConsumerGroup(topic string, group string) (*ConsumerGroup, error) {
+	return KafkaBus{}.NewConsumerGroup(topic, group)
+}
+
+// newKafkaConsumerGroup joins group, which (when it has no committed offsets)
+// starts from initialOffset: sarama.OffsetNewest or sarama.OffsetOldest
+func newKafkaConsumerGroup(topic string, group string, initialOffset int64) (*ConsumerGroup, error) {
 	config := cluster.NewConfig()
+	if err := Configure(&config.Config); err != nil {
+		return nil, fmt.Errorf("Bad kafka config for %q: %s", topic, err)
+	}
 	config.Group.Return.Notifications = true
 	config.Consumer.Return.Errors = true
 	config.Consumer.MaxWaitTime = 50 * time.Millisecond
-	brokers := []string{utils.GetEnvironmentVariable("KAFKA_ADDR", "localhost:9092")}
-
-	consumer, err := cluster.NewConsumer(brokers, group, []string{topic}, config)
+	config.Consumer.Offsets.Initial = initialOffset
+	consumer, err := cluster.NewConsumer(Brokers(), group, []string{topic}, config)
 	if err != nil {
 		return nil, fmt.Errorf("Bad NewConsumer of %q: %s", topic, err)
 	}
+	return startConsumerGroup(consumer, consumer.Notifications(), topic, group, KafkaBus{}), nil
+}
 
+// startConsumerGroup passes the messages and errors of consumer to the returned
+// ConsumerGroup's Incoming and Errors. bus makes any dead-letter producer.
+func startConsumerGroup(consumer consumerBackend, notifications <-chan *cluster.Notification, topic, group string, bus Bus) *ConsumerGroup {
 	cg := ConsumerGroup{
+		bus:      bus,
+		metrics:  newConsumerMetrics(consumer, topic, group),
 		Consumer: consumer,
 		Incoming: make(chan Message),
 		Closer:   make(chan bool),
 		Errors:   make(chan error),
+		closed:   make(chan error, 1),
+		topic:    topic,
+		group:    group,
+		pause:    PauseState{Topic: topic, Group: group},
+		wake:     make(chan bool, 1),
+		stopping: make(chan bool),
 	}
-	signals := make(chan os.Signal, 1)
-	//signal.Notify(signals, os.)
 
 	go func() {
-		defer cg.Consumer.Close()
+		// closing the consumer commits the offsets marked so far
+		defer func() { cg.closed <- cg.Consumer.Close() }()
 		log.Info(fmt.Sprintf("Started kafka consumer of topic %q group %q", topic, group), nil)
 		for {
 			select {
 			case err := <-cg.Consumer.Errors():
 				log.Error(err, nil)
-				cg.Errors <- err
+				select {
+				case cg.Errors <- err:
+				case <-cg.Closer:
+					log.Info(fmt.Sprintf("Closing kafka consumer of topic %q group %q", topic, group), nil)
+					return
+				}
 			default:
+				// a nil channel is never ready, so nothing is taken while paused
+				messages := cg.Consumer.Messages()
+				if cg.PauseState().Paused {
+					messages = nil
+				}
 				select {
-				case msg := <-cg.Consumer.Messages():
-					cg.Incoming <- Message{msg, cg.Consumer}
-				case n, more := <-cg.Consumer.Notifications():
+				case msg := <-messages:
+					cg.metrics.received(msg.Partition, msg.Offset)
+					select {
+					case cg.Incoming <- Message{message: msg, consumer: cg.Consumer, metrics: cg.metrics}:
+					case <-cg.Closer:
+						log.Info(fmt.Sprintf("Closing kafka consumer of topic %q group %q", topic, group), nil)
+						return
+					}
+				case n, more := <-notifications:
 					if more {
 						log.Trace("Rebalancing group", log.Data{"topic": topic, "group": group, "partitions": n.Current[topic]})
 					}
+				case <-cg.wake:
 				case <-time.After(tick):
-					cg.Consumer.CommitOffsets()
-				case <-signals:
-					log.Info(fmt.Sprintf("Quitting kafka consumer of topic %q group %q", topic, group), nil)
-					return
+					cg.commitOffsets()
 				case <-cg.Closer:
 					log.Info(fmt.Sprintf("Closing kafka consumer of topic %q group %q", topic, group), nil)
 					return
@@ -89,5 +400,5 @@ func NewConsumerGroup(topic string, group string) (*ConsumerGroup, error) {
 			}
 		}
 	}()
-	return &cg, nil
+	return &cg
 }
@@ -0,0 +1,39 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHandleDeadLettersOnceSent(t *testing.T) {
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	dead, _ := bus.NewConsumerGroup("dead-letter", "test")
+	defer dead.Close()
+	consumer.SetDeadLetterTopic("dead-letter", "test-service")
+	producer := bus.NewProducer("test-topic")
+	producer.Output <- []byte(`{"CollectionId":"test0001"}`)
+	producer.Output <- []byte(`{"CollectionId":"test0002"}`)
+	producer.Close()
+	failing := func(msg Message) error { return errors.New("cannot handle") }
+
+	if err := consumer.Handle(receive(t, consumer), failing); err != nil {
+		t.Fatal(err)
+	}
+	var letter DeadLetterMessage
+	Decode(receive(t, dead).GetData(), &letter)
+	if letter.Service != "test-service" || letter.Error != "cannot handle" || string(letter.Value) != `{"CollectionId":"test0001"}` {
+		t.Errorf("Test failed, got %+v", letter)
+	}
+
+	// a message which cannot be dead-lettered is left uncommitted
+	bus.FailSends("dead-letter", errors.New("no brokers"))
+	err := consumer.Handle(receive(t, consumer), failing)
+	if _, unforwarded := err.(ForwardError); !unforwarded {
+		t.Errorf("Test failed, expected a ForwardError, got %v", err)
+	}
+	consumer.Close()
+	if lag := bus.Lag("test-topic", "group"); lag != 1 {
+		t.Errorf("Test failed, expected only the dead-lettered message committed, got lag %d", lag)
+	}
+}
@@ -1,9 +1,6 @@
 package kafka
 
 import (
-	"os"
-
-	"github.com/ONSdigital/dp-publish-pipeline/utils"
 	"github.com/ONSdigital/go-ns/log"
 	"github.com/Shopify/sarama"
 )
@@ -13,13 +10,16 @@ type Consumer struct {
 	Consumer sarama.PartitionConsumer
 	Incoming chan []byte
 	Closer   chan bool
+	closed   chan bool
 }
 
 func NewConsumer(topic string) Consumer {
 	config := sarama.NewConfig()
+	if err := Configure(config); err != nil {
+		panic(err)
+	}
 	config.Consumer.Return.Errors = true
-	brokers := []string{utils.GetEnvironmentVariable("KAFKA_ADDR", "localhost:9092")}
-	master, err := sarama.NewConsumer(brokers, config)
+	master, err := sarama.NewConsumer(Brokers(), config)
 	if err != nil {
 		panic(err)
 	}
@@ -31,10 +31,10 @@ func NewConsumer(topic string) Consumer {
 
 	messageChannel := make(chan []byte)
 	closerChannel := make(chan bool)
-	signals := make(chan os.Signal, 1)
-	//signal.Notify(signals, os.Interrupt)
+	closedChannel := make(chan bool)
 
 	go func() {
+		defer close(closedChannel)
 		defer consumer.Close()
 		log.Info("Started kafka consumer", log.Data{"topic": topic})
 		for {
@@ -45,10 +45,12 @@ func NewConsumer(topic string) Consumer {
 			default:
 				select {
 				case msg := <-consumer.Messages():
-					messageChannel <- msg.Value
-				case <-signals:
-					log.Info("Quitting kafka consumer", log.Data{"topic": topic})
-					return
+					select {
+					case messageChannel <- msg.Value:
+					case <-closerChannel:
+						log.Info("Closing kafka consumer", log.Data{"topic": topic})
+						return
+					}
 				case <-closerChannel:
 					log.Info("Closing kafka consumer", log.Data{"topic": topic})
 					return
@@ -56,5 +58,15 @@ func NewConsumer(topic string) Consumer {
 			}
 		}
 	}()
-	return Consumer{Master: master, Consumer: consumer, Incoming: messageChannel, Closer: closerChannel}
+	return Consumer{Master: master, Consumer: consumer, Incoming: messageChannel, Closer: closerChannel, closed: closedChannel}
+}
+
+// Close stops consuming and closes the connection to the broker
+func (c Consumer) Close() error {
+	select {
+	case c.Closer <- true:
+	case <-c.closed:
+	}
+	<-c.closed
+	return c.Master.Close()
 }
@@ -0,0 +1,123 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// EmbargoSigner signs the embargo (the ScheduleTime) of each file which
+// publish-scheduler sends, with an ECDSA key held in vault, so that no other
+// producer can set (or change) the time a file is embargoed until. The services
+// which enforce the embargo check the signature with the public key.
+type EmbargoSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+// ecdsaSignature is the ASN.1 form of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// NewEmbargoSigner signs with the PEM encoded EC private key (as made by
+// `openssl ecparam -name prime256v1 -genkey -noout`)
+func NewEmbargoSigner(pemKey string) (*EmbargoSigner, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("no PEM encoded key")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return &EmbargoSigner{key: key}, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("not an EC private key: %s", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an EC private key")
+	}
+	return &EmbargoSigner{key: ecKey}, nil
+}
+
+// Sign returns the signature of the file's embargo, for its EmbargoSignature.
+// A nil EmbargoSigner signs nothing.
+func (s *EmbargoSigner) Sign(file PublishFileMessage) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	fields := embargoFields{
+		ScheduleId:   file.ScheduleId,
+		FileId:       file.FileId,
+		CollectionId: file.CollectionId,
+		Uri:          file.Uri,
+		ScheduleTime: file.ScheduleTime,
+	}
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, fields.digest())
+	if err != nil {
+		return "", err
+	}
+	signature, err := asn1.Marshal(ecdsaSignature{r, sig})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// parseEmbargoKey reads the PEM encoded EC public key of the EmbargoSigner
+// (as made by `openssl ec -pubout`), or just its base64 body
+func parseEmbargoKey(pemKey string) (*ecdsa.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(pemKey)); block != nil {
+		der = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pemKey)); err == nil {
+		// the body of the PEM, on one line (as set by a nomad template)
+		der = decoded
+	} else {
+		return nil, errors.New("no PEM (or base64) encoded key")
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an EC public key")
+	}
+	return ecKey, nil
+}
+
+// digest is what the signature of an embargo covers: the file, and when it is due
+func (fields embargoFields) digest() []byte {
+	claim, _ := json.Marshal([]interface{}{fields.ScheduleId, fields.FileId, fields.CollectionId, fields.Uri, fields.ScheduleTime})
+	sum := sha256.Sum256(claim)
+	return sum[:]
+}
+
+// verifySignature checks that the embargo of fields was signed by publish-scheduler
+func verifySignature(key *ecdsa.PublicKey, fields embargoFields) error {
+	if fields.EmbargoSignature == "" {
+		return errors.New("not signed")
+	}
+	der, err := base64.StdEncoding.DecodeString(fields.EmbargoSignature)
+	if err != nil {
+		return fmt.Errorf("bad signature: %s", err)
+	}
+	var signature ecdsaSignature
+	if rest, err := asn1.Unmarshal(der, &signature); err != nil || len(rest) > 0 || signature.R == nil || signature.S == nil {
+		return fmt.Errorf("bad signature: %v", err)
+	}
+	if !ecdsa.Verify(key, fields.digest(), signature.R, signature.S) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
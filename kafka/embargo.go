@@ -0,0 +1,343 @@
+package kafka
+
+import (
+	"container/heap"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+	"github.com/Shopify/sarama"
+)
+
+// EmbargoClock tells the time trusted to enforce embargoes (see the clock package)
+type EmbargoClock interface {
+	Now() (time.Time, error)
+}
+
+// Embargo refuses any message which arrives before its ScheduleTime (the
+// release time of its job) by a trusted clock. A message due within
+// EMBARGO_MAX_WAIT_MS (e.g. as the clocks of the scheduler and the service
+// differ) is held until it is due. Any other is parked - wrapped, as a dead
+// letter is, on the embargo topic - and committed unhandled, then re-driven
+// (handed back to the consumer) once due. With EMBARGO_REQUIRED "1", a
+// message is refused for good unless its ScheduleTime is signed by
+// publish-scheduler (see EmbargoSigner), as checked with EMBARGO_PUBLIC_KEY.
+// Otherwise (the default, until the keys are provisioned) one which cannot be
+// trusted (without a ScheduleTime, or not signed when there is a key) is let
+// through, as if it had no embargo.
+type Embargo struct {
+	clock     EmbargoClock
+	maxWait   time.Duration
+	required  bool
+	key       *ecdsa.PublicKey
+	park      Producer
+	parked    *ConsumerGroup // of the embargo topic, to re-drive the service's parked messages
+	offsets   *letterOffsets
+	service   string
+	quit      chan bool
+	redriving sync.WaitGroup
+}
+
+// the fields of a message which its embargo is read from
+type embargoFields struct {
+	ScheduleId       int64
+	FileId           int64
+	CollectionId     string
+	Uri              string
+	ScheduleTime     int64
+	EmbargoSignature string
+}
+
+// how often a parked message is checked for being due, at most
+var redriveCheck = time.Minute
+
+// parkedLetter is a message read back from the embargo topic, to be re-driven once due
+type parkedLetter struct {
+	letter  Message // as read from the embargo topic
+	parked  DeadLetterMessage
+	fields  embargoFields
+	due     time.Time
+	handled bool
+	offsets *letterOffsets
+}
+
+// parkedLetters is a heap of parkedLetter, the first due first
+type parkedLetters []*parkedLetter
+
+func (l parkedLetters) Len() int            { return len(l) }
+func (l parkedLetters) Less(i, j int) bool  { return l[i].due.Before(l[j].due) }
+func (l parkedLetters) Swap(i, j int)       { l[i], l[j] = l[j], l[i] }
+func (l *parkedLetters) Push(x interface{}) { *l = append(*l, x.(*parkedLetter)) }
+func (l *parkedLetters) Pop() interface{} {
+	old := *l
+	last := old[len(old)-1]
+	*l = old[:len(old)-1]
+	return last
+}
+
+// letterOffsets holds the letters read from each partition of the embargo
+// topic, in order, until handled. As committing an offset commits those before
+// it, a letter handled before those read ahead of it is committed with the last of them.
+type letterOffsets struct {
+	mutex   sync.Mutex
+	pending map[int32][]*parkedLetter
+}
+
+// read adds letter to those of its partition being handled
+func (o *letterOffsets) read(letter *parkedLetter) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	partition := letter.letter.GetPartition()
+	pending := o.pending[partition]
+	if last := len(pending) - 1; last >= 0 && pending[last].letter.GetOffset() >= letter.letter.GetOffset() {
+		// read again from the last commit, as the partition was reassigned
+		pending = nil
+	}
+	o.pending[partition] = append(pending, letter)
+}
+
+// handled commits the letters of letter's partition which have been handled,
+// up to the first which has not
+func (o *letterOffsets) handled(letter *parkedLetter) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	letter.handled = true
+	partition := letter.letter.GetPartition()
+	pending := o.pending[partition]
+	var committed *parkedLetter
+	for len(pending) > 0 && pending[0].handled {
+		committed, pending = pending[0], pending[1:]
+	}
+	o.pending[partition] = pending
+	if committed != nil {
+		committed.letter.Commit()
+	}
+}
+
+// message is the parked message, to be committed from the embargo topic once handled
+func (l *parkedLetter) message() Message {
+	return Message{
+		message:  &sarama.ConsumerMessage{Topic: l.parked.Topic, Partition: l.parked.Partition, Offset: l.parked.Offset, Value: l.parked.Value},
+		consumer: l.letter.consumer,
+		metrics:  l.letter.metrics,
+		parked:   l,
+	}
+}
+
+// NewEmbargo parks the messages which service refuses on topic, and re-drives them from there
+func NewEmbargo(bus Bus, clock EmbargoClock, topic, service string) (*Embargo, error) {
+	maxWait, err := utils.GetEnvironmentVariableInt("EMBARGO_MAX_WAIT_MS", 5000)
+	if err != nil || maxWait < 0 {
+		return nil, fmt.Errorf("Bad value for EMBARGO_MAX_WAIT_MS: %v", err)
+	}
+	required := utils.GetEnvironmentVariable("EMBARGO_REQUIRED", "0") != "0"
+	var key *ecdsa.PublicKey
+	if pemKey := utils.GetEnvironmentVariable("EMBARGO_PUBLIC_KEY", ""); pemKey != "" {
+		if key, err = parseEmbargoKey(pemKey); err != nil {
+			return nil, fmt.Errorf("Bad value for EMBARGO_PUBLIC_KEY: %s", err)
+		}
+	} else if required {
+		return nil, errors.New("No EMBARGO_PUBLIC_KEY to check embargoes with, as EMBARGO_REQUIRED needs")
+	}
+	parked, err := bus.NewConsumerGroup(topic, service+"-embargo")
+	if err != nil {
+		return nil, err
+	}
+	return &Embargo{
+		clock:    clock,
+		maxWait:  time.Duration(maxWait) * time.Millisecond,
+		required: required,
+		key:      key,
+		park:     bus.NewAckProducer(topic),
+		parked:   parked,
+		offsets:  &letterOffsets{pending: make(map[int32][]*parkedLetter)},
+		service:  service,
+		quit:     make(chan bool),
+	}, nil
+}
+
+// Close stops re-driving, and closes the consumer and producer of parked messages
+func (e *Embargo) Close() error {
+	close(e.quit)
+	e.redriving.Wait()
+	err := e.parked.Close()
+	if parkErr := e.park.Close(); err == nil {
+		err = parkErr
+	}
+	return err
+}
+
+// SetEmbargo has Handle refuse (park and commit without handling) any message
+// whose embargo has not passed, and pass to Incoming each message it parked
+// once due. An Embargo is set on one ConsumerGroup.
+func (cg *ConsumerGroup) SetEmbargo(embargo *Embargo) {
+	cg.embargo = embargo
+	if embargo != nil {
+		embargo.redriving.Add(1)
+		go embargo.redrive(cg)
+	}
+}
+
+// check returns why the embargo of fields cannot be trusted, if it cannot
+func (e *Embargo) check(fields embargoFields) error {
+	if fields.ScheduleTime == 0 {
+		return errors.New("no schedule time, so no embargo to check")
+	}
+	if e.key == nil {
+		return nil
+	}
+	if err := verifySignature(e.key, fields); err != nil {
+		return fmt.Errorf("schedule time not signed by publish-scheduler: %s", err)
+	}
+	return nil
+}
+
+// refuses reports whether msg was refused, and parked. It returns a
+// ForwardError if msg could not be parked. A nil Embargo refuses nothing.
+func (e *Embargo) refuses(msg Message) (bool, error) {
+	if e == nil {
+		return false, nil
+	}
+	var fields embargoFields
+	var reason error
+	if err := readFields(msg.GetData(), &fields); err != nil {
+		reason = fmt.Errorf("cannot read the embargo: %s", err)
+	} else {
+		reason = e.check(fields)
+	}
+	if reason != nil && !e.required {
+		// treated as having no embargo (the handler reports a message which cannot be read)
+		return false, nil
+	}
+	for reason == nil {
+		now, err := e.clock.Now()
+		if err != nil {
+			reason = fmt.Errorf("no trusted time to check the embargo: %s", err)
+			break
+		}
+		wait := time.Unix(0, fields.ScheduleTime).Sub(now)
+		if wait <= 0 {
+			return false, nil
+		} else if wait > e.maxWait {
+			reason = fmt.Errorf("embargoed until %s, %s after the trusted time %s", time.Unix(0, fields.ScheduleTime).UTC().Format(time.RFC3339Nano), wait, now.UTC().Format(time.RFC3339Nano))
+			break
+		}
+		time.Sleep(wait)
+	}
+
+	logData := log.Data{
+		"security":     "embargo-refused",
+		"service":      e.service,
+		"topic":        msg.GetTopic(),
+		"partition":    msg.GetPartition(),
+		"offset":       msg.GetOffset(),
+		"scheduleId":   fields.ScheduleId,
+		"collectionId": fields.CollectionId,
+		"uri":          fields.Uri,
+	}
+	log.ErrorC("SECURITY: refused a message before its embargo had passed, parking it", reason, logData)
+	data, err := e.park.Encode(DeadLetterMessage{
+		Service:   e.service,
+		Topic:     msg.GetTopic(),
+		Partition: msg.GetPartition(),
+		Offset:    msg.GetOffset(),
+		Error:     reason.Error(),
+		Value:     msg.GetData(),
+	}, "")
+	if err == nil {
+		err = e.park.Send(data)
+	}
+	if err != nil {
+		// left uncommitted, so it is refused again when redelivered
+		return true, ForwardError{fmt.Errorf("Cannot park embargoed message (%s): %s", reason, err)}
+	}
+	return true, nil
+}
+
+// redrive passes to cg the messages the service parked from cg's topic, each
+// once it is due (so one due later holds back none due before it)
+func (e *Embargo) redrive(cg *ConsumerGroup) {
+	defer e.redriving.Done()
+	var waiting parkedLetters // until due
+	var due []*parkedLetter   // to pass to cg, in turn
+	nextCheck := time.Now()
+	for {
+		var incoming chan Message
+		var next Message
+		if len(due) > 0 {
+			incoming, next = cg.Incoming, due[0].message()
+		}
+		var check <-chan time.Time
+		if len(waiting) > 0 {
+			check = time.After(time.Until(nextCheck))
+		}
+		select {
+		case msg := <-e.parked.Incoming:
+			if letter := e.readLetter(cg, msg); letter != nil {
+				heap.Push(&waiting, letter)
+				nextCheck = time.Now()
+			}
+		case <-e.parked.Errors:
+			// already logged by the consumer
+		case incoming <- next:
+			log.Info(fmt.Sprintf("Job %d Collection %q re-driving a parked message, as its embargo has passed", due[0].fields.ScheduleId, due[0].fields.CollectionId),
+				log.Data{"service": e.service, "topic": due[0].parked.Topic, "partition": due[0].parked.Partition, "offset": due[0].parked.Offset, "uri": due[0].fields.Uri})
+			due = due[1:]
+		case <-check:
+			nextCheck = time.Now().Add(redriveCheck)
+			now, err := e.clock.Now()
+			if err != nil {
+				continue
+			}
+			for len(waiting) > 0 && !now.Before(waiting[0].due) {
+				due = append(due, heap.Pop(&waiting).(*parkedLetter))
+			}
+			if len(waiting) > 0 && waiting[0].due.Sub(now) < redriveCheck {
+				nextCheck = time.Now().Add(waiting[0].due.Sub(now))
+			}
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+// readLetter reads a letter from the embargo topic, to be re-driven to cg once
+// due. It returns nil (and commits the letter) for one not to be re-driven.
+func (e *Embargo) readLetter(cg *ConsumerGroup, msg Message) *parkedLetter {
+	letter := &parkedLetter{letter: msg, offsets: e.offsets}
+	e.offsets.read(letter)
+	if _, err := Decode(msg.GetData(), &letter.parked); err != nil || letter.parked.Service != e.service || letter.parked.Topic != cg.topic {
+		// parked by another service, or from another topic
+		e.offsets.handled(letter)
+		return nil
+	}
+	reason := readFields(letter.parked.Value, &letter.fields)
+	if reason == nil {
+		reason = e.check(letter.fields)
+	}
+	if reason != nil {
+		if e.required {
+			// refused for good, so left parked for inspection
+			log.ErrorC("SECURITY: a parked message cannot be trusted, so is never re-driven", reason, log.Data{
+				"security":     "embargo-refused",
+				"service":      e.service,
+				"topic":        letter.parked.Topic,
+				"partition":    letter.parked.Partition,
+				"offset":       letter.parked.Offset,
+				"scheduleId":   letter.fields.ScheduleId,
+				"collectionId": letter.fields.CollectionId,
+				"uri":          letter.fields.Uri,
+			})
+			e.offsets.handled(letter)
+			return nil
+		}
+		// no embargo to wait for
+		return letter
+	}
+	letter.due = time.Unix(0, letter.fields.ScheduleTime)
+	return letter
+}
@@ -0,0 +1,385 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// fixedClock is a trusted clock which is always at the same time
+type fixedClock time.Time
+
+func (c fixedClock) Now() (time.Time, error) { return time.Time(c), nil }
+
+type localClock struct{}
+
+func (localClock) Now() (time.Time, error) { return time.Now(), nil }
+
+// settableClock is a trusted clock which is moved on by the test
+type settableClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *settableClock) Now() (time.Time, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now, nil
+}
+
+func (c *settableClock) set(now time.Time) {
+	c.mutex.Lock()
+	c.now = now
+	c.mutex.Unlock()
+}
+
+// newTestSigner makes a signing key, whose public key embargoes are checked with
+func newTestSigner(t *testing.T) *EmbargoSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	signer, err := NewEmbargoSigner(string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ = x509.MarshalPKIXPublicKey(&key.PublicKey)
+	os.Setenv("EMBARGO_PUBLIC_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	return signer
+}
+
+// sign sets the file's EmbargoSignature
+func sign(t *testing.T, signer *EmbargoSigner, file PublishFileMessage) PublishFileMessage {
+	var err error
+	if file.EmbargoSignature, err = signer.Sign(file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestEmbargoParksEarlyMessages(t *testing.T) {
+	os.Setenv("EMBARGO_MAX_WAIT_MS", "50")
+	defer os.Unsetenv("EMBARGO_MAX_WAIT_MS")
+	os.Setenv("EMBARGO_REQUIRED", "1")
+	defer os.Unsetenv("EMBARGO_REQUIRED")
+	signer := newTestSigner(t)
+	defer os.Unsetenv("EMBARGO_PUBLIC_KEY")
+	release := time.Now().Add(time.Hour)
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("publish-file", "publish-data")
+	parked, _ := bus.NewConsumerGroup("embargoed", "test")
+	defer parked.Close()
+	// the schedule time of file 3 is moved after it was signed
+	forged := sign(t, signer, PublishFileMessage{ScheduleId: 3, FileId: 3, CollectionId: "test0003", Uri: "/rpi/data.json", ScheduleTime: release.UnixNano()})
+	forged.ScheduleTime = release.Add(-2 * time.Hour).UnixNano()
+	producer := bus.NewProducer("publish-file")
+	for _, file := range []PublishFileMessage{
+		sign(t, signer, PublishFileMessage{ScheduleId: 1, FileId: 1, CollectionId: "test0001", Uri: "/gdp/data.json", ScheduleTime: release.UnixNano()}),
+		sign(t, signer, PublishFileMessage{ScheduleId: 2, FileId: 2, CollectionId: "test0002", Uri: "/cpi/data.json", ScheduleTime: release.Add(-2 * time.Hour).UnixNano()}),
+		forged,
+		{ScheduleId: 4, FileId: 4, CollectionId: "test0004", Uri: "/ppi/data.json"},
+	} {
+		data, _ := producer.Encode(file, "")
+		producer.Output <- data
+	}
+	producer.Output <- []byte("not json")
+	producer.Close()
+
+	embargo, err := NewEmbargo(bus, fixedClock(time.Now()), "embargoed", "publish-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer.SetEmbargo(embargo)
+	handled := make(map[int64]bool)
+	for i := 0; i < 5; i++ {
+		if err = consumer.Handle(receive(t, consumer), func(msg Message) error {
+			var file PublishFileMessage
+			_, err := Decode(msg.GetData(), &file)
+			handled[file.FileId] = true
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consumer.Close()
+	embargo.Close()
+	if len(handled) != 1 || !handled[2] || bus.Lag("publish-file", "publish-data") != 0 {
+		t.Errorf("Test failed, expected only file 2 handled, and all committed: %v", handled)
+	}
+
+	var parkedIds []int64
+	var letter DeadLetterMessage
+	for i := 0; i < 4; i++ {
+		letter = DeadLetterMessage{}
+		Decode(receive(t, parked).GetData(), &letter)
+		var file PublishFileMessage
+		Decode(letter.Value, &file)
+		if letter.Service != "publish-data" || letter.Topic != "publish-file" {
+			t.Errorf("Test failed, got %+v", letter)
+		}
+		parkedIds = append(parkedIds, file.FileId)
+	}
+	if parkedIds[0] != 1 || parkedIds[1] != 3 || parkedIds[2] != 4 {
+		t.Errorf("Test failed, expected files 1, 3 and 4 parked, got %v", parkedIds)
+	}
+	if string(letter.Value) != "not json" || !strings.HasPrefix(letter.Error, "cannot read the embargo") {
+		t.Errorf("Test failed, expected the unreadable message parked, got %+v", letter)
+	}
+
+	// unless required, neither a key nor a schedule time is needed
+	os.Setenv("EMBARGO_REQUIRED", "0")
+	publicKey := os.Getenv("EMBARGO_PUBLIC_KEY")
+	os.Unsetenv("EMBARGO_PUBLIC_KEY")
+	embargo, err = NewEmbargo(bus, fixedClock(time.Now()), "embargoed", "publish-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer embargo.Close()
+	data, _ := Encode(PublishFileMessage{ScheduleId: 4, FileId: 4}, "")
+	if refused, err := embargo.refuses(Message{message: &sarama.ConsumerMessage{Topic: "publish-file", Value: data}}); refused || err != nil {
+		t.Errorf("Test failed, expected a message without a schedule time let through, got %v %v", refused, err)
+	}
+
+	// nor, with a key, a signature (as when the scheduler has yet to sign)
+	os.Setenv("EMBARGO_PUBLIC_KEY", publicKey)
+	embargo, err = NewEmbargo(bus, fixedClock(time.Now()), "embargoed", "publish-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer embargo.Close()
+	data, _ = Encode(PublishFileMessage{ScheduleId: 5, FileId: 5, ScheduleTime: release.UnixNano()}, "")
+	for _, value := range [][]byte{data, []byte("not json")} {
+		if refused, err := embargo.refuses(Message{message: &sarama.ConsumerMessage{Topic: "publish-file", Value: value}}); refused || err != nil {
+			t.Errorf("Test failed, expected %q let through, got %v %v", value, refused, err)
+		}
+	}
+}
+
+func TestEmbargoLeavesUnparkedMessageUncommitted(t *testing.T) {
+	signer := newTestSigner(t)
+	defer os.Unsetenv("EMBARGO_PUBLIC_KEY")
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("publish-file", "publish-data")
+	embargo, err := NewEmbargo(bus, localClock{}, "embargoed", "publish-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer embargo.Close()
+	consumer.SetEmbargo(embargo)
+	producer := bus.NewProducer("publish-file")
+	data, _ := producer.Encode(sign(t, signer, PublishFileMessage{ScheduleId: 1, FileId: 1, CollectionId: "test0001", Uri: "/gdp/data.json", ScheduleTime: time.Now().Add(time.Hour).UnixNano()}), "")
+	producer.Output <- data
+	producer.Close()
+
+	bus.FailSends("embargoed", errors.New("no brokers"))
+	err = consumer.Handle(receive(t, consumer), func(msg Message) error {
+		t.Error("Test failed, embargoed message handled")
+		return nil
+	})
+	if _, unforwarded := err.(ForwardError); !unforwarded {
+		t.Errorf("Test failed, expected a ForwardError, got %v", err)
+	}
+	consumer.Close()
+	if lag := bus.Lag("publish-file", "publish-data"); lag != 1 {
+		t.Errorf("Test failed, expected the message left uncommitted, got lag %d", lag)
+	}
+}
+
+func TestEmbargoNeedsKeyWhenRequired(t *testing.T) {
+	os.Unsetenv("EMBARGO_PUBLIC_KEY")
+	embargo, err := NewEmbargo(NewMemoryBus(1), localClock{}, "embargoed", "publish-data")
+	if err != nil {
+		t.Fatalf("Test failed, expected no key needed by default, got %v", err)
+	}
+	embargo.Close()
+
+	os.Setenv("EMBARGO_REQUIRED", "1")
+	defer os.Unsetenv("EMBARGO_REQUIRED")
+	if _, err = NewEmbargo(NewMemoryBus(1), localClock{}, "embargoed", "publish-data"); err == nil {
+		t.Error("Test failed, expected an error without EMBARGO_PUBLIC_KEY")
+	}
+}
+
+func TestParseEmbargoKeyBody(t *testing.T) {
+	newTestSigner(t)
+	defer os.Unsetenv("EMBARGO_PUBLIC_KEY")
+	block, _ := pem.Decode([]byte(os.Getenv("EMBARGO_PUBLIC_KEY")))
+	if _, err := parseEmbargoKey(base64.StdEncoding.EncodeToString(block.Bytes)); err != nil {
+		t.Errorf("Test failed, expected the base64 body of the key read, got %v", err)
+	}
+	if _, err := parseEmbargoKey("not a key"); err == nil {
+		t.Error("Test failed, expected an error for a bad key")
+	}
+}
+
+func TestEmbargoRedrivesParkedMessagesOnceDue(t *testing.T) {
+	defer func(check time.Duration) { redriveCheck = check }(redriveCheck)
+	redriveCheck = 10 * time.Millisecond
+	signer := newTestSigner(t)
+	defer os.Unsetenv("EMBARGO_PUBLIC_KEY")
+	release := time.Now().Add(time.Hour)
+	clock := &settableClock{now: time.Now()}
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("publish-file", "publish-data")
+	defer consumer.Close()
+	embargo, err := NewEmbargo(bus, clock, "embargoed", "publish-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer.SetEmbargo(embargo)
+
+	// file 1 is parked first, but due an hour after file 2
+	producer := bus.NewAckProducer("publish-file")
+	for _, file := range []PublishFileMessage{
+		{ScheduleId: 1, FileId: 1, CollectionId: "test0001", Uri: "/gdp/data.json", ScheduleTime: release.Add(time.Hour).UnixNano()},
+		{ScheduleId: 2, FileId: 2, CollectionId: "test0002", Uri: "/cpi/data.json", ScheduleTime: release.UnixNano()},
+	} {
+		data, _ := producer.Encode(sign(t, signer, file), "")
+		producer.Send(data)
+	}
+	producer.Close()
+	var handled []int64
+	handler := func(msg Message) error {
+		var file PublishFileMessage
+		_, err := Decode(msg.GetData(), &file)
+		handled = append(handled, file.FileId)
+		return err
+	}
+	consumer.Handle(receive(t, consumer), handler)
+	consumer.Handle(receive(t, consumer), handler)
+	select {
+	case <-consumer.Incoming:
+		t.Fatal("Test failed, parked message re-driven before it was due")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.set(release)
+	if err = consumer.Handle(receive(t, consumer), handler); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-consumer.Incoming:
+		t.Fatal("Test failed, file 1 re-driven before it was due")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.set(release.Add(time.Hour))
+	if err = consumer.Handle(receive(t, consumer), handler); err != nil {
+		t.Fatal(err)
+	}
+	embargo.Close()
+	if len(handled) != 2 || handled[0] != 2 || handled[1] != 1 || bus.Lag("embargoed", "publish-data-embargo") != 0 {
+		t.Errorf("Test failed, expected files 2 then 1 handled once due, and committed from the embargo topic: %v", handled)
+	}
+}
+
+func TestEmbargoCommitsLetterOnceThoseBeforeAreHandled(t *testing.T) {
+	defer func(check time.Duration) { redriveCheck = check }(redriveCheck)
+	redriveCheck = 10 * time.Millisecond
+	signer := newTestSigner(t)
+	defer os.Unsetenv("EMBARGO_PUBLIC_KEY")
+	release := time.Now().Add(time.Hour)
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("publish-file", "publish-data")
+	defer consumer.Close()
+	clock := &settableClock{now: time.Now()}
+	embargo, err := NewEmbargo(bus, clock, "embargoed", "publish-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer.SetEmbargo(embargo)
+	producer := bus.NewAckProducer("publish-file")
+	for _, file := range []PublishFileMessage{
+		{ScheduleId: 1, FileId: 1, CollectionId: "test0001", Uri: "/gdp/data.json", ScheduleTime: release.Add(time.Hour).UnixNano()},
+		{ScheduleId: 2, FileId: 2, CollectionId: "test0002", Uri: "/cpi/data.json", ScheduleTime: release.UnixNano()},
+	} {
+		data, _ := producer.Encode(sign(t, signer, file), "")
+		producer.Send(data)
+	}
+	producer.Close()
+	handler := func(msg Message) error { return nil }
+	consumer.Handle(receive(t, consumer), handler)
+	consumer.Handle(receive(t, consumer), handler)
+
+	// file 2 is handled, but its letter is not committed past file 1's
+	clock.set(release)
+	consumer.Handle(receive(t, consumer), handler)
+	embargo.Close()
+	if lag := bus.Lag("embargoed", "publish-data-embargo"); lag != 2 {
+		t.Fatalf("Test failed, expected both letters left uncommitted, got lag %d", lag)
+	}
+
+	// so when restarted, file 1 is still re-driven
+	embargo, err = NewEmbargo(bus, clock, "embargoed", "publish-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer.SetEmbargo(embargo)
+	clock.set(release.Add(time.Hour))
+	var handled []int64
+	for i := 0; i < 2; i++ {
+		consumer.Handle(receive(t, consumer), func(msg Message) error {
+			var file PublishFileMessage
+			_, err := Decode(msg.GetData(), &file)
+			handled = append(handled, file.FileId)
+			return err
+		})
+	}
+	embargo.Close()
+	if len(handled) != 2 || bus.Lag("embargoed", "publish-data-embargo") != 0 {
+		t.Errorf("Test failed, expected files 2 and 1 re-driven again, and committed: %v", handled)
+	}
+}
+
+func TestEmbargoRedrivesUnsignedMessagesUnlessRequired(t *testing.T) {
+	newTestSigner(t)
+	defer os.Unsetenv("EMBARGO_PUBLIC_KEY")
+	os.Setenv("EMBARGO_REQUIRED", "0")
+	defer os.Unsetenv("EMBARGO_REQUIRED")
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("publish-file", "publish-data")
+	defer consumer.Close()
+	embargo, err := NewEmbargo(bus, localClock{}, "embargoed", "publish-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer embargo.Close()
+	consumer.SetEmbargo(embargo)
+
+	// parked unsigned while the embargo was required
+	value, _ := Encode(PublishFileMessage{ScheduleId: 1, FileId: 1, ScheduleTime: time.Now().Add(time.Hour).UnixNano()}, "")
+	producer := bus.NewAckProducer("embargoed")
+	data, _ := producer.Encode(DeadLetterMessage{Service: "publish-data", Topic: "publish-file", Error: "schedule time not signed by publish-scheduler: not signed", Value: value}, "")
+	producer.Send(data)
+	producer.Close()
+	handled := false
+	if err = consumer.Handle(receive(t, consumer), func(msg Message) error {
+		handled = true
+		return nil
+	}); err != nil || !handled {
+		t.Errorf("Test failed, expected the unsigned message re-driven and handled, got %v %v", handled, err)
+	}
+}
+
+func TestEmbargoHoldsMessagesDueSoon(t *testing.T) {
+	embargo := &Embargo{clock: localClock{}, maxWait: time.Second}
+	data, _ := Encode(PublishFileMessage{ScheduleId: 1, FileId: 1, ScheduleTime: time.Now().Add(50 * time.Millisecond).UnixNano()}, "")
+	started := time.Now()
+	if refused, err := embargo.refuses(Message{message: &sarama.ConsumerMessage{Topic: "publish-file", Value: data}}); refused || err != nil {
+		t.Errorf("Test failed, expected a message due soon to be held, got %v %v", refused, err)
+	}
+	if time.Since(started) < 50*time.Millisecond {
+		t.Errorf("Test failed, released after %s, before the message was due", time.Since(started))
+	}
+}
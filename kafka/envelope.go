@@ -0,0 +1,100 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// SchemaVersion is the version of the messages in types.go. It must be raised
+// whenever a message changes in a way older services could not read.
+const SchemaVersion = 1
+
+// Envelope wraps a message (Payload) sent between services. Type is the name
+// of the message's struct in types.go, e.g. "PublishFileMessage".
+type Envelope struct {
+	Type          string
+	Version       int
+	ProducedAt    int64 // epoch-nanoseconds
+	Producer      string
+	CorrelationId string
+	Payload       json.RawMessage
+}
+
+// Encode marshals message to JSON and, when KAFKA_MESSAGE_ENVELOPE is "1",
+// wraps it in an Envelope naming this service (log.Namespace) as the producer.
+// An empty correlationId starts a new correlation. While the envelope is off,
+// the bare message is sent, as all services understood before the envelope.
+func Encode(message interface{}, correlationId string) ([]byte, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	if !useEnvelope() {
+		return payload, nil
+	}
+	return json.Marshal(newEnvelope(messageType(message), correlationId, payload))
+}
+
+// Decode unmarshals data, either an Envelope or a bare message, into message.
+// The Envelope is returned, or nil for a bare message. An enveloped message of
+// the wrong type, or of a newer SchemaVersion, is rejected. data may be JSON or
+// written by the binary codec.
+func Decode(data []byte, message interface{}) (*Envelope, error) {
+	if isBinary(data) {
+		return decodeBinary(data, message)
+	}
+	envelope, payload, err := openEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	if envelope != nil {
+		if err = checkEnvelope(envelope, message); err != nil {
+			return envelope, err
+		}
+	}
+	if err = json.Unmarshal(payload, message); err != nil {
+		return envelope, err
+	}
+	return envelope, nil
+}
+
+func checkEnvelope(envelope *Envelope, message interface{}) error {
+	if envelope.Type != messageType(message) {
+		return fmt.Errorf("Expected %s, got %s message from %s", messageType(message), envelope.Type, envelope.Producer)
+	}
+	if envelope.Version > SchemaVersion {
+		return fmt.Errorf("Cannot read %s version %d (from %s), only up to version %d", envelope.Type, envelope.Version, envelope.Producer, SchemaVersion)
+	}
+	return nil
+}
+
+// GetCorrelationId is the correlation id of envelope, or "" for a bare message
+func GetCorrelationId(envelope *Envelope) string {
+	if envelope == nil {
+		return ""
+	}
+	return envelope.CorrelationId
+}
+
+func NewCorrelationId() string {
+	return uuid.NewV4().String()
+}
+
+// openEnvelope returns the Envelope (or nil, for a bare message) and payload of data
+func openEnvelope(data []byte) (*Envelope, []byte, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, nil, err
+	}
+	if envelope.Type == "" || envelope.Payload == nil {
+		return nil, data, nil
+	}
+	return &envelope, envelope.Payload, nil
+}
+
+func messageType(message interface{}) string {
+	return reflect.Indirect(reflect.ValueOf(message)).Type().Name()
+}
@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDecodeBareMessage(t *testing.T) {
+	var message PublishDeleteMessage
+	envelope, err := Decode([]byte(`{"ScheduleId":43,"DeleteId":34,"CollectionId":"123","Uri":"/aboutus"}`), &message)
+	if err != nil || envelope != nil {
+		t.Fatalf("Test failed, expected a bare message, got: %v %v", envelope, err)
+	}
+	if message.DeleteId != 34 || message.Uri != "/aboutus" {
+		t.Errorf("Test failed, got: %+v", message)
+	}
+}
+
+func TestEncodeWithoutEnvelope(t *testing.T) {
+	os.Setenv("KAFKA_MESSAGE_ENVELOPE", "0")
+	defer os.Unsetenv("KAFKA_MESSAGE_ENVELOPE")
+	data, _ := Encode(CollectionCompleteMessage{ScheduleId: 12, CollectionId: "test0002"}, "")
+	if string(data) != `{"ScheduleId":12,"CollectionId":"test0002"}` {
+		t.Errorf("Test failed, got: %s", data)
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	os.Setenv("KAFKA_MESSAGE_ENVELOPE", "1")
+	defer os.Unsetenv("KAFKA_MESSAGE_ENVELOPE")
+	data, err := Encode(PublishDeleteMessage{ScheduleId: 43, DeleteId: 34, CollectionId: "123", Uri: "/aboutus"}, "corr-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message PublishDeleteMessage
+	envelope, err := Decode(data, &message)
+	if err != nil || envelope == nil {
+		t.Fatalf("Test failed, expected an envelope, got: %v %v", envelope, err)
+	}
+	if envelope.Type != "PublishDeleteMessage" || envelope.Version != SchemaVersion || envelope.CorrelationId != "corr-1" || envelope.ProducedAt == 0 {
+		t.Errorf("Test failed, got envelope: %+v", envelope)
+	}
+	if message.DeleteId != 34 || message.Uri != "/aboutus" {
+		t.Errorf("Test failed, got: %+v", message)
+	}
+	if key := KeyByUri(data); string(key) != "/aboutus" {
+		t.Errorf("Test failed, expected key: /aboutus got: %s", key)
+	}
+}
+
+func TestDecodeRejectsWrongType(t *testing.T) {
+	os.Setenv("KAFKA_MESSAGE_ENVELOPE", "1")
+	defer os.Unsetenv("KAFKA_MESSAGE_ENVELOPE")
+	data, _ := Encode(PublishDeleteMessage{ScheduleId: 43, DeleteId: 34}, "")
+
+	var message FileCompleteMessage
+	if _, err := Decode(data, &message); err == nil {
+		t.Error("Test failed, expected an error decoding the wrong type")
+	}
+}
+
+func TestDecodeRejectsNewerVersion(t *testing.T) {
+	data := []byte(`{"Type":"PublishDeleteMessage","Version":99,"Payload":{"DeleteId":34}}`)
+	var message PublishDeleteMessage
+	if _, err := Decode(data, &message); err == nil {
+		t.Error("Test failed, expected an error decoding a newer version")
+	}
+}
@@ -0,0 +1,81 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// KeyFunc picks the key of a message sent by a Producer. Messages with the
+// same key go to the same partition, so are consumed in the order sent.
+type KeyFunc func(data []byte) []byte
+
+// the fields (shared by most messages in types.go) which messages can be keyed by
+type keyFields struct {
+	CollectionId string
+	ScheduleId   int64
+	Uri          string
+}
+
+// readKeyFields reads the key fields of a bare or enveloped message, in JSON or binary
+func readKeyFields(data []byte) (keyFields, error) {
+	var fields keyFields
+	err := readFields(data, &fields)
+	return fields, err
+}
+
+// readFields reads some fields of a bare or enveloped message, in JSON or
+// binary, into fields. The key of every message sent is read, so the rest of
+// the message (e.g. a large FileContent) is skipped rather than decoded.
+func readFields(data []byte, fields interface{}) error {
+	if isBinary(data) {
+		return readBinaryFields(data, fields)
+	}
+	_, payload, err := openEnvelope(data)
+	if err == nil {
+		err = json.Unmarshal(payload, fields)
+	}
+	return err
+}
+
+// KeyByCollection keys a message by its CollectionId, or failing that, its
+// ScheduleId. Messages with neither (or which are not JSON) have no key.
+func KeyByCollection(data []byte) []byte {
+	fields, err := readKeyFields(data)
+	if err != nil {
+		return nil
+	}
+	if fields.CollectionId != "" {
+		return []byte(fields.CollectionId)
+	}
+	if fields.ScheduleId != 0 {
+		return []byte(strconv.FormatInt(fields.ScheduleId, 10))
+	}
+	return nil
+}
+
+// KeyByUri keys a message by its Uri, falling back to KeyByCollection
+func KeyByUri(data []byte) []byte {
+	if fields, err := readKeyFields(data); err == nil && fields.Uri != "" {
+		return []byte(fields.Uri)
+	}
+	return KeyByCollection(data)
+}
+
+// NoKey sends messages without a key, so they are spread across all partitions
+func NoKey(data []byte) []byte {
+	return nil
+}
+
+// GetKeyFunc maps the name of a key ("collection", "uri" or "none") to its KeyFunc
+func GetKeyFunc(name string) (KeyFunc, error) {
+	switch name {
+	case "collection":
+		return KeyByCollection, nil
+	case "uri":
+		return KeyByUri, nil
+	case "none":
+		return NoKey, nil
+	}
+	return nil, fmt.Errorf("Unknown message key %q", name)
+}
@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyByCollection(t *testing.T) {
+	key := KeyByCollection([]byte(`{"ScheduleId":12,"CollectionId":"test0002","Uri":"/about/data.json"}`))
+	if string(key) != "test0002" {
+		t.Errorf("Test failed, expected: %s got: %s", "test0002", key)
+	}
+}
+
+func TestKeyByCollectionFallsBackToSchedule(t *testing.T) {
+	key := KeyByCollection([]byte(`{"ScheduleId":12}`))
+	if string(key) != "12" {
+		t.Errorf("Test failed, expected: %s got: %s", "12", key)
+	}
+}
+
+func TestKeyByCollectionWithoutFields(t *testing.T) {
+	if key := KeyByCollection([]byte(`{one: two`)); key != nil {
+		t.Errorf("Test failed, expected no key, got: %s", key)
+	}
+}
+
+func TestKeyByUri(t *testing.T) {
+	key := KeyByUri([]byte(`{"ScheduleId":12,"CollectionId":"test0002","Uri":"/about/data.json"}`))
+	if string(key) != "/about/data.json" {
+		t.Errorf("Test failed, expected: %s got: %s", "/about/data.json", key)
+	}
+	key = KeyByUri([]byte(`{"ScheduleId":12,"CollectionId":"test0002"}`))
+	if string(key) != "test0002" {
+		t.Errorf("Test failed, expected: %s got: %s", "test0002", key)
+	}
+}
+
+func TestKeyByUriOfBinaryMessage(t *testing.T) {
+	os.Setenv("KAFKA_MESSAGE_ENVELOPE", "1")
+	defer os.Unsetenv("KAFKA_MESSAGE_ENVELOPE")
+	codec, _ := GetCodec("binary")
+	data, err := codec.Encode(FileCompleteMessage{ScheduleId: 12, CollectionId: "test0002", Uri: "/about/data.json", FileContent: strings.Repeat("x", 1<<20)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := KeyByUri(data); string(key) != "/about/data.json" {
+		t.Errorf("Test failed, expected: %s got: %s", "/about/data.json", key)
+	}
+	if key := KeyByCollection(data); string(key) != "test0002" {
+		t.Errorf("Test failed, expected: %s got: %s", "test0002", key)
+	}
+}
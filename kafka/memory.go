@@ -0,0 +1,415 @@
+package kafka
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// MemoryBus is a Bus which holds its topics in memory, for running services
+// (or parts of them) without a broker. As in Kafka, messages are spread across
+// the partitions of a topic by key, and every consumer group receives every
+// message, with each partition read by one member of the group at a time.
+// As with KafkaBus, a new group starts after the last message of the topic.
+// Offsets are committed per group, so a member leaving the group (or a group
+// consuming the topic again) resumes after the last committed message.
+type MemoryBus struct {
+	mutex      sync.Mutex
+	partitions int
+	topics     map[string]*memoryTopic
+	changed    chan bool        // closed, and replaced, when messages arrive or a group rebalances
+	failures   map[string]error // topic: the error any message sent to it fails with
+}
+
+type memoryTopic struct {
+	name       string
+	partitions [][]*sarama.ConsumerMessage
+	groups     map[string]*memoryGroup
+	next       int // partition of the next message without a key
+}
+
+type memoryGroup struct {
+	offsets []int64 // committed: the offset of the next message to consume, per partition
+	members []*memoryMember
+}
+
+// memoryMember is a consumer in a MemoryBus group
+type memoryMember struct {
+	bus      *MemoryBus
+	topic    *memoryTopic
+	group    *memoryGroup
+	owned    map[int32]int64 // partition: the offset of the next message to deliver
+	marked   map[int32]int64 // partition: the offset after the last marked message
+	messages chan *sarama.ConsumerMessage
+	errors   chan error
+	closing  chan bool
+	done     chan bool
+}
+
+// memoryBroadcast is a BroadcastConsumer of a MemoryBus topic: a member of no
+// group, which owns every partition
+type memoryBroadcast struct {
+	*memoryMember
+	marks map[int32]int64 // as of when it started
+}
+
+// memoryProducer is a sarama.AsyncProducer sending to a MemoryBus topic
+type memoryProducer struct {
+	bus       *MemoryBus
+	topic     string
+	acks      bool
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+// NewMemoryBus returns an empty bus, whose topics each have the given number of partitions
+func NewMemoryBus(partitions int) *MemoryBus {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBus{
+		partitions: partitions,
+		topics:     make(map[string]*memoryTopic),
+		changed:    make(chan bool),
+		failures:   make(map[string]error),
+	}
+}
+
+func (b *MemoryBus) NewConsumerGroup(topic string, group string) (*ConsumerGroup, error) {
+	return b.newConsumerGroup(topic, group, sarama.OffsetNewest)
+}
+
+// newConsumerGroup joins group, which (when new) starts from the initial
+// offset: sarama.OffsetNewest or sarama.OffsetOldest
+func (b *MemoryBus) newConsumerGroup(topic string, group string, initial int64) (*ConsumerGroup, error) {
+	b.mutex.Lock()
+	t := b.topic(topic)
+	g, ok := t.groups[group]
+	if !ok {
+		g = &memoryGroup{offsets: make([]int64, b.partitions)}
+		if initial == sarama.OffsetNewest {
+			for p, messages := range t.partitions {
+				g.offsets[p] = int64(len(messages))
+			}
+		}
+		t.groups[group] = g
+	}
+	member := &memoryMember{
+		bus:      b,
+		topic:    t,
+		group:    g,
+		owned:    make(map[int32]int64),
+		marked:   make(map[int32]int64),
+		messages: make(chan *sarama.ConsumerMessage),
+		errors:   make(chan error),
+		closing:  make(chan bool),
+		done:     make(chan bool),
+	}
+	g.members = append(g.members, member)
+	b.rebalance(g)
+	b.mutex.Unlock()
+
+	go member.deliver()
+	return startConsumerGroup(member, nil, topic, group, b), nil
+}
+
+// NewBroadcastConsumer reads every partition of topic from its first message, in no group
+func (b *MemoryBus) NewBroadcastConsumer(topic string) (BroadcastConsumer, error) {
+	b.mutex.Lock()
+	t := b.topic(topic)
+	c := &memoryBroadcast{
+		memoryMember: &memoryMember{
+			bus:      b,
+			topic:    t,
+			owned:    make(map[int32]int64),
+			messages: make(chan *sarama.ConsumerMessage),
+			errors:   make(chan error),
+			closing:  make(chan bool),
+			done:     make(chan bool),
+		},
+		marks: make(map[int32]int64),
+	}
+	for p, messages := range t.partitions {
+		c.owned[int32(p)] = 0
+		if len(messages) > 0 {
+			c.marks[int32(p)] = int64(len(messages))
+		}
+	}
+	b.mutex.Unlock()
+
+	go c.deliver()
+	return c, nil
+}
+
+func (b *MemoryBus) NewProducer(topic string) Producer {
+	return startProducer(b.newProducer(topic, false), topic, false)
+}
+
+func (b *MemoryBus) NewAckProducer(topic string) Producer {
+	return startProducer(b.newProducer(topic, true), topic, true)
+}
+
+// Lag is the number of messages of topic not yet committed by group
+func (b *MemoryBus) Lag(topic, group string) int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	t := b.topic(topic)
+	var lag int64
+	for p, messages := range t.partitions {
+		lag += int64(len(messages))
+		if g, ok := t.groups[group]; ok {
+			lag -= g.offsets[p]
+		}
+	}
+	return lag
+}
+
+// FailSends has every message sent to topic from now on fail with err, as if
+// the brokers had refused it (a nil err undoes this)
+func (b *MemoryBus) FailSends(topic string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		delete(b.failures, topic)
+	} else {
+		b.failures[topic] = err
+	}
+}
+
+// topic returns the named topic, creating it if need be. The lock must be held.
+func (b *MemoryBus) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{
+			name:       name,
+			partitions: make([][]*sarama.ConsumerMessage, b.partitions),
+			groups:     make(map[string]*memoryGroup),
+		}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// notify wakes every member waiting for messages. The lock must be held.
+func (b *MemoryBus) notify() {
+	close(b.changed)
+	b.changed = make(chan bool)
+}
+
+// rebalance commits the group's marked offsets, then shares the partitions out
+// among its members. A member resumes a partition it already had where it left
+// off, and any other from the group's committed offset. The lock must be held.
+func (b *MemoryBus) rebalance(g *memoryGroup) {
+	for _, member := range g.members {
+		member.commit()
+	}
+	for i, member := range g.members {
+		owned := make(map[int32]int64)
+		for p := i; p < len(g.offsets); p += len(g.members) {
+			if next, ok := member.owned[int32(p)]; ok {
+				owned[int32(p)] = next
+			} else {
+				owned[int32(p)] = g.offsets[p]
+			}
+		}
+		member.owned = owned
+		member.marked = make(map[int32]int64)
+	}
+	b.notify()
+}
+
+// append adds msg to its topic, choosing its partition by its key, unless
+// sends to the topic fail (see FailSends)
+func (b *MemoryBus) append(msg *sarama.ProducerMessage) error {
+	var key, value []byte
+	if msg.Key != nil {
+		key, _ = msg.Key.Encode()
+	}
+	if msg.Value != nil {
+		value, _ = msg.Value.Encode()
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.failures[msg.Topic]; err != nil {
+		return err
+	}
+	t := b.topic(msg.Topic)
+	partition := t.next
+	if key == nil {
+		t.next = (t.next + 1) % len(t.partitions)
+	} else {
+		hash := fnv.New32a()
+		hash.Write(key)
+		partition = int(hash.Sum32() % uint32(len(t.partitions)))
+	}
+	msg.Partition = int32(partition)
+	msg.Offset = int64(len(t.partitions[partition]))
+	t.partitions[partition] = append(t.partitions[partition], &sarama.ConsumerMessage{
+		Key:       key,
+		Value:     value,
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: time.Now(),
+	})
+	b.notify()
+	return nil
+}
+
+func (b *MemoryBus) newProducer(topic string, acks bool) *memoryProducer {
+	p := &memoryProducer{
+		bus:       b,
+		topic:     topic,
+		acks:      acks,
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+	go func() {
+		for msg := range p.input {
+			// as with sarama, errors are returned in either mode
+			if err := p.bus.append(msg); err != nil {
+				p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			} else if p.acks {
+				p.successes <- msg
+			}
+		}
+		close(p.successes)
+		close(p.errors)
+	}()
+	return p
+}
+
+func (p *memoryProducer) Input() chan<- *sarama.ProducerMessage { return p.input }
+
+func (p *memoryProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+
+func (p *memoryProducer) Errors() <-chan *sarama.ProducerError { return p.errors }
+
+func (p *memoryProducer) AsyncClose() {
+	close(p.input)
+}
+
+// Close drains successes and errors until the producer has flushed, as sarama's does
+func (p *memoryProducer) Close() error {
+	p.AsyncClose()
+	if p.acks {
+		go func() {
+			for range p.successes {
+			}
+		}()
+	}
+	var errors sarama.ProducerErrors
+	for err := range p.errors {
+		errors = append(errors, err)
+	}
+	if len(errors) > 0 {
+		return errors
+	}
+	return nil
+}
+
+// deliver sends the member the messages of its partitions, in order, until closed
+func (m *memoryMember) deliver() {
+	defer close(m.done)
+	for {
+		m.bus.mutex.Lock()
+		msg := m.next()
+		changed := m.bus.changed
+		m.bus.mutex.Unlock()
+
+		if msg == nil {
+			select {
+			case <-changed:
+				continue
+			case <-m.closing:
+				return
+			}
+		}
+		select {
+		case m.messages <- msg:
+		case <-m.closing:
+			return
+		}
+	}
+}
+
+// next returns the next message to deliver (or nil if there is none yet). The lock must be held.
+func (m *memoryMember) next() *sarama.ConsumerMessage {
+	for p, offset := range m.owned {
+		if offset < int64(len(m.topic.partitions[p])) {
+			m.owned[p] = offset + 1
+			return m.topic.partitions[p][offset]
+		}
+	}
+	return nil
+}
+
+func (m *memoryMember) Messages() <-chan *sarama.ConsumerMessage { return m.messages }
+
+func (m *memoryMember) Errors() <-chan error { return m.errors }
+
+// HighWaterMarks returns the offset of the next message to be produced to each partition of the member's topic
+func (m *memoryMember) HighWaterMarks() map[string]map[int32]int64 {
+	m.bus.mutex.Lock()
+	defer m.bus.mutex.Unlock()
+	marks := make(map[int32]int64)
+	for p, messages := range m.topic.partitions {
+		marks[int32(p)] = int64(len(messages))
+	}
+	return map[string]map[int32]int64{m.topic.name: marks}
+}
+
+// MarkOffset marks msg as consumed, unless its partition has since moved to another member
+func (m *memoryMember) MarkOffset(msg *sarama.ConsumerMessage, metadata string) {
+	m.bus.mutex.Lock()
+	defer m.bus.mutex.Unlock()
+	if _, ok := m.owned[msg.Partition]; ok && msg.Offset+1 > m.marked[msg.Partition] {
+		m.marked[msg.Partition] = msg.Offset + 1
+	}
+}
+
+func (m *memoryMember) CommitOffsets() error {
+	m.bus.mutex.Lock()
+	defer m.bus.mutex.Unlock()
+	m.commit()
+	return nil
+}
+
+// commit records the member's marked offsets as the group's. The lock must be held.
+func (m *memoryMember) commit() {
+	for p, offset := range m.marked {
+		if offset > m.group.offsets[p] {
+			m.group.offsets[p] = offset
+		}
+	}
+}
+
+// Close commits the member's marked offsets, and leaves its group
+func (m *memoryMember) Close() error {
+	close(m.closing)
+	<-m.done
+	m.bus.mutex.Lock()
+	defer m.bus.mutex.Unlock()
+	m.commit()
+	for i, member := range m.group.members {
+		if member == m {
+			m.group.members = append(m.group.members[:i], m.group.members[i+1:]...)
+			break
+		}
+	}
+	m.bus.rebalance(m.group)
+	return nil
+}
+
+func (c *memoryBroadcast) HighWaterMarks() map[int32]int64 { return c.marks }
+
+// Close stops delivering messages. With no group, there is nothing to commit.
+func (c *memoryBroadcast) Close() error {
+	close(c.closing)
+	<-c.done
+	return nil
+}
@@ -0,0 +1,203 @@
+package kafka
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, consumer *ConsumerGroup) Message {
+	select {
+	case msg := <-consumer.Incoming:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, no message received")
+	}
+	return Message{}
+}
+
+func TestMemoryBusDeliversToEachGroup(t *testing.T) {
+	bus := NewMemoryBus(2)
+	consumers := make(map[string]*ConsumerGroup)
+	for _, group := range []string{"group-a", "group-b"} {
+		consumers[group], _ = bus.NewConsumerGroup("test-topic", group)
+	}
+	producer := bus.NewAckProducer("test-topic")
+	for i := 0; i < 4; i++ {
+		data, _ := Encode(CollectionCompleteMessage{ScheduleId: int64(i), CollectionId: fmt.Sprintf("test%04d", i)}, "")
+		if err := producer.Send(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	producer.Close()
+
+	for group, consumer := range consumers {
+		received := make(map[int64]bool)
+		for i := 0; i < 4; i++ {
+			msg := receive(t, consumer)
+			consumer.Handle(msg, func(msg Message) error {
+				var message CollectionCompleteMessage
+				_, err := Decode(msg.GetData(), &message)
+				received[message.ScheduleId] = true
+				return err
+			})
+		}
+		consumer.Close()
+		if len(received) != 4 || bus.Lag("test-topic", group) != 0 {
+			t.Errorf("Test failed, group %s received %v, lag %d", group, received, bus.Lag("test-topic", group))
+		}
+	}
+}
+
+func TestMemoryBusRedeliversUncommitted(t *testing.T) {
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	producer := bus.NewProducer("test-topic")
+	producer.Output <- []byte(`{"CollectionId":"test0001"}`)
+	producer.Output <- []byte(`{"CollectionId":"test0002"}`)
+	producer.Close()
+
+	receive(t, consumer).Commit()
+	receive(t, consumer) // left uncommitted
+	consumer.Close()
+	if lag := bus.Lag("test-topic", "group"); lag != 1 {
+		t.Errorf("Test failed, expected lag 1, got %d", lag)
+	}
+
+	consumer, _ = bus.NewConsumerGroup("test-topic", "group")
+	defer consumer.Close()
+	if msg := receive(t, consumer); string(msg.GetData()) != `{"CollectionId":"test0002"}` || msg.GetOffset() != 1 {
+		t.Errorf("Test failed, expected the uncommitted message again, got %s at %d", msg.GetData(), msg.GetOffset())
+	}
+}
+
+func TestMemoryBusSharesPartitions(t *testing.T) {
+	bus := NewMemoryBus(4)
+	first, _ := bus.NewConsumerGroup("test-topic", "group")
+	defer first.Close()
+	second, _ := bus.NewConsumerGroup("test-topic", "group")
+	defer second.Close()
+
+	producer := bus.NewProducer("test-topic")
+	for i := 0; i < 8; i++ {
+		producer.Output <- []byte(fmt.Sprintf(`{"FileId":%d}`, i))
+	}
+	producer.Close()
+
+	counts := make(map[*ConsumerGroup]int)
+	for i := 0; i < 8; i++ {
+		select {
+		case msg := <-first.Incoming:
+			msg.Commit()
+			counts[first]++
+		case msg := <-second.Incoming:
+			msg.Commit()
+			counts[second]++
+		case <-time.After(time.Second):
+			t.Fatal("Test failed, no message received")
+		}
+	}
+	if counts[first] != 4 || counts[second] != 4 {
+		t.Errorf("Test failed, expected 4 messages each, got %d and %d", counts[first], counts[second])
+	}
+}
+
+func TestPausedConsumerGroupKeepsMessages(t *testing.T) {
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	defer consumer.Close()
+	consumer.Pause("test")
+	if state := consumer.PauseState(); !state.Paused || state.Reason != "test" || state.Topic != "test-topic" {
+		t.Errorf("Test failed, got %+v", state)
+	}
+
+	producer := bus.NewProducer("test-topic")
+	producer.Output <- []byte(`{"CollectionId":"test0001"}`)
+	producer.Close()
+	select {
+	case <-consumer.Incoming:
+		t.Fatal("Test failed, message received while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	consumer.Resume()
+	receive(t, consumer).Commit()
+	if consumer.PauseState().Paused {
+		t.Error("Test failed, still paused after Resume")
+	}
+}
+
+func TestAbortedSchedulesAreDropped(t *testing.T) {
+	bus := NewMemoryBus(2)
+	abortProducer := bus.NewAckProducer("test-aborts")
+	data, _ := Encode(ScheduleAbortedMessage{ScheduleId: 1, CollectionId: "test0001"}, "")
+	if err := abortProducer.Send(data); err != nil {
+		t.Fatal(err)
+	}
+	abortProducer.Close()
+	aborted, err := WatchAbortedSchedules(bus, "test-aborts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aborted.Close()
+	// the aborts already announced are read before it returns, in no group
+	if !aborted.Aborted(1) || len(bus.topics["test-aborts"].groups) != 0 {
+		t.Fatal("Test failed, expected the abort read without joining a group")
+	}
+
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	consumer.SetAbortedSchedules(aborted)
+	producer := bus.NewAckProducer("test-topic")
+	for i := 0; i < 4; i++ {
+		data, _ := Encode(PublishFileMessage{ScheduleId: int64(1 + i%2), FileId: int64(i)}, "")
+		producer.Send(data)
+	}
+	producer.Close()
+	var handled []int64
+	for i := 0; i < 4; i++ {
+		consumer.Handle(receive(t, consumer), func(msg Message) error {
+			var message PublishFileMessage
+			_, err := Decode(msg.GetData(), &message)
+			handled = append(handled, message.ScheduleId)
+			return err
+		})
+	}
+	consumer.Close()
+	if len(handled) != 2 || handled[0] != 2 || handled[1] != 2 || bus.Lag("test-topic", "group") != 0 {
+		t.Errorf("Test failed, expected only schedule 2 handled and all committed, got %v, lag %d", handled, bus.Lag("test-topic", "group"))
+	}
+}
+
+func TestAckProducerAcksEverySendOnClose(t *testing.T) {
+	bus := NewMemoryBus(1)
+	producer := bus.NewAckProducer("test-topic")
+	acked := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		data, _ := Encode(CollectionCompleteMessage{ScheduleId: int64(i)}, "")
+		producer.SendWithAck(data, func(err error) { acked <- err })
+	}
+	if err := producer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case err := <-acked:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Test failed, only %d of 20 sends acknowledged", i)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- producer.Send([]byte("{}")) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Test failed, expected a send after close to fail")
+		}
+	case <-time.After(time.Second):
+		t.Error("Test failed, a send after close blocked")
+	}
+}
@@ -0,0 +1,148 @@
+package kafka
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/metrics"
+)
+
+// consumerMetrics tracks, per partition, how far a ConsumerGroup has got
+// through its topic, and how fast
+type consumerMetrics struct {
+	mutex      sync.Mutex
+	name       string
+	topic      string
+	group      string
+	consumer   consumerBackend
+	partitions map[int32]*partitionMetrics
+}
+
+type partitionMetrics struct {
+	marked    int64 // the offset after the last message marked (by Message.Commit), -1 before the first
+	committed int64 // the offset after the last message committed to the brokers, -1 before the first
+	handled   metrics.Window
+}
+
+// PartitionReport is reported by the metrics endpoint for each partition
+// consumed. Messages marked (by Message.Commit) are committed to the brokers
+// periodically. Lag is the number of messages not yet committed, as of the
+// last fetch from the broker.
+type PartitionReport struct {
+	HighWaterMark int64                `json:"highWaterMark"`
+	Marked        int64                `json:"marked"`
+	Committed     int64                `json:"committed"`
+	Lag           int64                `json:"lag"`
+	Handled       metrics.WindowReport `json:"handled"`
+}
+
+// ConsumerReport is reported by the metrics endpoint for each ConsumerGroup
+type ConsumerReport struct {
+	Topic      string                     `json:"topic"`
+	Group      string                     `json:"group"`
+	Partitions map[string]PartitionReport `json:"partitions"`
+}
+
+// newConsumerMetrics registers the metrics of a consumer (as "kafka.consumer.<group>.<topic>")
+func newConsumerMetrics(consumer consumerBackend, topic, group string) *consumerMetrics {
+	m := &consumerMetrics{
+		name:       "kafka.consumer." + group + "." + topic,
+		topic:      topic,
+		group:      group,
+		consumer:   consumer,
+		partitions: make(map[int32]*partitionMetrics),
+	}
+	metrics.Register(m.name, m.report)
+	return m
+}
+
+// partition returns the metrics of partition. The lock must be held.
+func (m *consumerMetrics) partition(partition int32) *partitionMetrics {
+	p, ok := m.partitions[partition]
+	if !ok {
+		p = &partitionMetrics{marked: -1, committed: -1}
+		m.partitions[partition] = p
+	}
+	return p
+}
+
+// received notes the offset of the first message received from partition,
+// from which the group was resuming, as the committed (and marked) offset
+func (m *consumerMetrics) received(partition int32, offset int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if p := m.partition(partition); p.committed < 0 {
+		p.committed = offset
+		if p.marked < offset {
+			p.marked = offset
+		}
+	}
+}
+
+// handled records an attempt at handling a message, which took d
+func (m *consumerMetrics) handled(partition int32, d time.Duration) {
+	m.mutex.Lock()
+	p := m.partition(partition)
+	m.mutex.Unlock()
+	p.handled.Record(d)
+}
+
+// marked records the message at offset as marked for the next commit
+func (m *consumerMetrics) marked(partition int32, offset int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if p := m.partition(partition); offset+1 > p.marked {
+		p.marked = offset + 1
+	}
+}
+
+// markedOffsets returns the marked offset of each partition, to be passed to
+// committed once they have been committed
+func (m *consumerMetrics) markedOffsets() map[int32]int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	offsets := make(map[int32]int64, len(m.partitions))
+	for partition, p := range m.partitions {
+		offsets[partition] = p.marked
+	}
+	return offsets
+}
+
+// committed records offsets (as returned by markedOffsets) as committed to the brokers
+func (m *consumerMetrics) committed(offsets map[int32]int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for partition, offset := range offsets {
+		if p := m.partition(partition); offset > p.committed {
+			p.committed = offset
+		}
+	}
+}
+
+func (m *consumerMetrics) report() interface{} {
+	highWaterMarks := m.consumer.HighWaterMarks()[m.topic]
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for partition := range highWaterMarks {
+		m.partition(partition)
+	}
+	report := ConsumerReport{Topic: m.topic, Group: m.group, Partitions: make(map[string]PartitionReport)}
+	for partition, p := range m.partitions {
+		partitionReport := PartitionReport{
+			HighWaterMark: highWaterMarks[partition],
+			Marked:        p.marked,
+			Committed:     p.committed,
+			Handled:       p.handled.Report(),
+		}
+		if p.committed >= 0 && partitionReport.HighWaterMark > p.committed {
+			partitionReport.Lag = partitionReport.HighWaterMark - p.committed
+		}
+		report.Partitions[strconv.Itoa(int(partition))] = partitionReport
+	}
+	return report
+}
+
+func (m *consumerMetrics) close() {
+	metrics.Unregister(m.name)
+}
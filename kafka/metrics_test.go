@@ -0,0 +1,32 @@
+package kafka
+
+import (
+	"testing"
+)
+
+func TestConsumerMetrics(t *testing.T) {
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	defer consumer.Close()
+	producer := bus.NewProducer("test-topic")
+	for i := 0; i < 3; i++ {
+		producer.Output <- []byte(`{"CollectionId":"test0001"}`)
+	}
+	producer.Close()
+
+	consumer.Handle(receive(t, consumer), func(msg Message) error { return nil })
+
+	report := consumer.metrics.report().(ConsumerReport)
+	partition := report.Partitions["0"]
+	if partition.HighWaterMark != 3 || partition.Marked != 1 || partition.Committed != 0 || partition.Lag != 3 || partition.Handled.Total != 1 {
+		t.Errorf("Test failed, got: %+v", partition)
+	}
+
+	// marked messages only count as committed once their offsets are
+	consumer.commitOffsets()
+	report = consumer.metrics.report().(ConsumerReport)
+	partition = report.Partitions["0"]
+	if partition.Marked != 1 || partition.Committed != 1 || partition.Lag != 2 {
+		t.Errorf("Test failed, got: %+v", partition)
+	}
+}
@@ -1,6 +1,7 @@
 package kafka
 
 import (
+	"fmt"
 	"strconv"
 
 	"github.com/ONSdigital/dp-publish-pipeline/utils"
@@ -12,48 +13,191 @@ type Producer struct {
 	producer sarama.AsyncProducer
 	Output   chan []byte
 	Closer   chan bool
+	closed   chan error
+	stopped  chan bool
+	acked    chan pendingMessage
+	codec    Codec
+}
+
+// pendingMessage is sent by a delivery-acknowledged Producer, which calls ack
+// once the broker has accepted (or failed) it
+type pendingMessage struct {
+	data []byte
+	ack  func(error)
 }
 
 func NewProducer(topic string) Producer {
+	return KafkaBus{}.NewProducer(topic)
+}
+
+// NewAckProducer returns a Producer in delivery-acknowledged mode: as well as
+// via Output, messages can be sent with Send or SendWithAck, which report when
+// each message has been accepted by all in-sync replicas of the topic
+func NewAckProducer(topic string) Producer {
+	return KafkaBus{}.NewAckProducer(topic)
+}
+
+func newKafkaProducer(topic string, acks bool) Producer {
 	envMax, err := strconv.ParseInt(utils.GetEnvironmentVariable("KAFKA_MAX_BYTES", "2000000"), 10, 32)
 	if err != nil {
 		panic("Bad value for KAFKA_MAX_BYTES")
 	}
 	config := sarama.NewConfig()
+	if err = Configure(config); err != nil {
+		log.ErrorC("Bad kafka config", err, log.Data{"topic": topic})
+		panic(err)
+	}
 	config.Producer.MaxMessageBytes = int(envMax)
-	producer, err := sarama.NewAsyncProducer([]string{utils.GetEnvironmentVariable("KAFKA_ADDR", "localhost:9092")}, config)
+	if acks {
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Producer.Return.Successes = true
+	}
+	producer, err := sarama.NewAsyncProducer(Brokers(), config)
 	if err != nil {
 		panic(err)
 	}
+	return startProducer(producer, topic, acks)
+}
+
+// startProducer sends the messages given to the returned Producer to topic,
+// via producer. In acks mode, producer must return successes.
+func startProducer(producer sarama.AsyncProducer, topic string, acks bool) Producer {
+	keyFunc, err := GetKeyFunc(utils.GetEnvironmentVariable("KAFKA_MESSAGE_KEY", "collection"))
+	if err != nil {
+		panic("Bad value for KAFKA_MESSAGE_KEY")
+	}
+	codec, err := GetTopicCodec(topic)
+	if err != nil {
+		log.ErrorC("Bad codec", err, log.Data{"topic": topic})
+		panic(err)
+	}
 	outputChannel := make(chan []byte)
 	closerChannel := make(chan bool)
-	//signals := make(chan os.Signal, 1)
-	//signal.Notify(signals, os.Interrupt)
+	closedChannel := make(chan error, 1)
+	stoppedChannel := make(chan bool)
+	errorChannel := producer.Errors()
+	var ackChannel chan pendingMessage
+	var acknowledged chan error
+	if acks {
+		ackChannel = make(chan pendingMessage)
+		// errors are reported to the sender, by acknowledge()
+		errorChannel = nil
+		acknowledged = make(chan error, 1)
+		go func() { acknowledged <- acknowledge(producer, topic) }()
+	}
 	go func() {
-		defer producer.Close()
-		log.Info("Started kafka producer", log.Data{"topic": topic})
+		// closing the producer flushes any messages still buffered
+		defer func() {
+			close(stoppedChannel)
+			if acks {
+				// sarama's Close would drain successes and errors itself, taking
+				// them from acknowledge(), so leave it to drain them until closed
+				producer.AsyncClose()
+				closedChannel <- <-acknowledged
+			} else {
+				closedChannel <- producer.Close()
+			}
+		}()
+		log.Info("Started kafka producer", log.Data{"topic": topic, "acks": acks, "codec": codec.Name()})
 		for {
 			select {
-			case err := <-producer.Errors():
+			case err := <-errorChannel:
 				log.ErrorC("Producer[outer]", err, log.Data{"topic": topic})
 				panic(err)
 			case message := <-outputChannel:
 
 				select {
-				case err := <-producer.Errors():
+				case err := <-errorChannel:
 					log.ErrorC("Producer[inner]", err, log.Data{"topic": topic})
 					panic(err)
-				case producer.Input() <- &sarama.ProducerMessage{Topic: topic, Value: sarama.StringEncoder(message)}:
+				case producer.Input() <- &sarama.ProducerMessage{Topic: topic, Key: encodeKey(keyFunc(message)), Value: sarama.StringEncoder(message)}:
 				}
 
+			case pending := <-ackChannel:
+				producer.Input() <- &sarama.ProducerMessage{Topic: topic, Key: encodeKey(keyFunc(pending.data)), Value: sarama.StringEncoder(pending.data), Metadata: pending.ack}
+
 			case <-closerChannel:
 				log.Info("Closing kafka producer", log.Data{"topic": topic})
 				return
-				//case <-signals:
-				//log.Printf("Quitting kafka producer of topic %q", topic)
-				//return
 			}
 		}
 	}()
-	return Producer{producer, outputChannel, closerChannel}
+	return Producer{producer, outputChannel, closerChannel, closedChannel, stoppedChannel, ackChannel, codec}
+}
+
+// Encode encodes message with the codec of the producer's topic
+func (p Producer) Encode(message interface{}, correlationId string) ([]byte, error) {
+	return p.codec.Encode(message, correlationId)
+}
+
+// Close waits for all messages sent so far to be delivered, then closes the producer
+func (p Producer) Close() error {
+	p.Closer <- true
+	return <-p.closed
+}
+
+// encodeKey leaves a message without a key (rather than with an empty one) when key is nil
+func encodeKey(key []byte) sarama.Encoder {
+	if key == nil {
+		return nil
+	}
+	return sarama.ByteEncoder(key)
+}
+
+// acknowledge calls back the sender of each message once the broker has
+// accepted or failed it. Messages sent via Output have no callback, so only
+// their errors are logged, and returned once the producer has closed.
+func acknowledge(producer sarama.AsyncProducer, topic string) error {
+	var failed sarama.ProducerErrors
+	successes, errors := producer.Successes(), producer.Errors()
+	for successes != nil || errors != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			if ack, isAck := msg.Metadata.(func(error)); isAck {
+				ack(nil)
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			if ack, isAck := err.Msg.Metadata.(func(error)); isAck {
+				ack(err.Err)
+			} else {
+				log.ErrorC("Producer[ack]", err, log.Data{"topic": topic})
+				failed = append(failed, err)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// SendWithAck queues data to be sent, then calls ack with nil once the broker
+// has accepted it, or with the error if it could not be delivered. ack is called
+// from the producer's acknowledging goroutine, so should not block. Once the
+// producer has been closed, ack is called with an error straight away.
+func (p Producer) SendWithAck(data []byte, ack func(error)) {
+	if p.acked == nil {
+		ack(fmt.Errorf("Producer is not in delivery-acknowledged mode"))
+		return
+	}
+	select {
+	case p.acked <- pendingMessage{data: data, ack: ack}:
+	case <-p.stopped:
+		ack(fmt.Errorf("Producer is closed"))
+	}
+}
+
+// Send blocks until data has been accepted by the broker, or has failed
+func (p Producer) Send(data []byte) error {
+	done := make(chan error, 1)
+	p.SendWithAck(data, func(err error) { done <- err })
+	return <-done
 }
@@ -0,0 +1,89 @@
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Replayed is a message read again by Replay
+type Replayed struct {
+	Partition int32
+	Offset    int64
+	Timestamp time.Time
+	Value     []byte
+}
+
+// Replay passes to replay, partition by partition, each message of topic
+// produced between since and until (a zero time leaves that end of the range
+// open), stopping at the newest message as of the call. Offsets are looked up
+// by timestamp, which needs brokers of kafka 0.10.1 or later. Replay is not a
+// member of any consumer group, so commits nothing.
+func Replay(topic string, since, until time.Time, replay func(msg Replayed) error) error {
+	config := sarama.NewConfig()
+	if err := Configure(config); err != nil {
+		return fmt.Errorf("Bad kafka config for %q: %s", topic, err)
+	}
+	config.Version = sarama.V0_10_1_0
+	config.Consumer.Return.Errors = true
+	client, err := sarama.NewClient(Brokers(), config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if err = replayPartition(client, consumer, topic, partition, since, until, replay); err != nil {
+			return fmt.Errorf("Replay of %q partition %d: %s", topic, partition, err)
+		}
+	}
+	return nil
+}
+
+func replayPartition(client sarama.Client, consumer sarama.Consumer, topic string, partition int32, since, until time.Time, replay func(msg Replayed) error) error {
+	// the high water mark is the offset of the next message to be produced
+	end, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	// for a time, the offset of the first message at or after it (-1 if none)
+	start, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err == nil && !since.IsZero() {
+		start, err = client.GetOffset(topic, partition, since.UnixNano()/int64(time.Millisecond))
+	}
+	if err != nil || start < 0 || start >= end {
+		return err
+	}
+
+	partitionConsumer, err := consumer.ConsumePartition(topic, partition, start)
+	if err != nil {
+		return err
+	}
+	defer partitionConsumer.Close()
+	for {
+		select {
+		case msg := <-partitionConsumer.Messages():
+			if !until.IsZero() && msg.Timestamp.After(until) {
+				return nil
+			}
+			if err := replay(Replayed{Partition: partition, Offset: msg.Offset, Timestamp: msg.Timestamp, Value: msg.Value}); err != nil {
+				return err
+			}
+			if msg.Offset+1 >= end {
+				return nil
+			}
+		case err := <-partitionConsumer.Errors():
+			return err
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// RetryPolicy bounds the attempts ConsumerGroup.Handle makes at a message,
+// backing off exponentially (from InitialBackoff, capped at MaxBackoff) between
+// each one. A MaxAttempts of zero or one means the message is tried only once.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// FailureHandler is told about a message which has failed its final attempt. It
+// returns an error if it could not record the failure, in which case the message
+// is left uncommitted (see ConsumerGroup.Handle).
+type FailureHandler func(msg Message, err error) error
+
+// NewRetryPolicy reads a RetryPolicy from KAFKA_RETRY_ATTEMPTS,
+// KAFKA_RETRY_BACKOFF_MS and KAFKA_RETRY_MAX_BACKOFF_MS
+func NewRetryPolicy() (RetryPolicy, error) {
+	attempts, err := utils.GetEnvironmentVariableInt("KAFKA_RETRY_ATTEMPTS", 3)
+	if err != nil {
+		return RetryPolicy{}, fmt.Errorf("Bad value for KAFKA_RETRY_ATTEMPTS: %s", err)
+	}
+	backoff, err := utils.GetEnvironmentVariableInt("KAFKA_RETRY_BACKOFF_MS", 100)
+	if err != nil {
+		return RetryPolicy{}, fmt.Errorf("Bad value for KAFKA_RETRY_BACKOFF_MS: %s", err)
+	}
+	maxBackoff, err := utils.GetEnvironmentVariableInt("KAFKA_RETRY_MAX_BACKOFF_MS", 5000)
+	if err != nil {
+		return RetryPolicy{}, fmt.Errorf("Bad value for KAFKA_RETRY_MAX_BACKOFF_MS: %s", err)
+	}
+	return RetryPolicy{
+		MaxAttempts:    attempts,
+		InitialBackoff: time.Duration(backoff) * time.Millisecond,
+		MaxBackoff:     time.Duration(maxBackoff) * time.Millisecond,
+	}, nil
+}
+
+// NewFileFailedReporter returns a FailureHandler for consumers of PublishFileMessages
+// which sends a FileFailedMessage to producer, a delivery-acknowledged Producer,
+// for each file that finally fails
+func NewFileFailedReporter(producer Producer) FailureHandler {
+	return func(msg Message, err error) error {
+		var file PublishFileMessage
+		envelope, decodeErr := Decode(msg.GetData(), &file)
+		if decodeErr != nil || file.FileId == 0 {
+			log.ErrorC("Cannot report failure of unidentified file", err, log.Data{"msg": string(msg.GetData())})
+			return nil
+		}
+		data, encodeErr := producer.Encode(FileFailedMessage{
+			ScheduleId:   file.ScheduleId,
+			FileId:       file.FileId,
+			CollectionId: file.CollectionId,
+			Uri:          file.Uri,
+			Attempts:     msg.GetAttempt(),
+			Error:        err.Error(),
+		}, GetCorrelationId(envelope))
+		if encodeErr != nil {
+			return fmt.Errorf("Cannot encode failure of file %d: %s", file.FileId, encodeErr)
+		}
+		if sendErr := producer.Send(data); sendErr != nil {
+			return fmt.Errorf("Cannot report failure of file %d: %s", file.FileId, sendErr)
+		}
+		log.ErrorC(fmt.Sprintf("Job %d Collection %q file %d failed after %d attempts", file.ScheduleId, file.CollectionId, file.FileId, msg.GetAttempt()), err, nil)
+		return nil
+	}
+}
+
+// Backoff is the pause after the given (1-based) failed attempt
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffDoubles(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}
+	for i, want := range expected {
+		if got := policy.Backoff(i + 1); got != want {
+			t.Errorf("Test failed, attempt %d expected: %s got: %s", i+1, want, got)
+		}
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 50, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	if got := policy.Backoff(40); got != time.Second {
+		t.Errorf("Test failed, expected: %s got: %s", time.Second, got)
+	}
+}
+
+func TestHandleRetriesThenReportsFailure(t *testing.T) {
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	consumer.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	var failures []int
+	consumer.SetFailureHandler(func(msg Message, err error) error {
+		failures = append(failures, msg.GetAttempt())
+		return nil
+	})
+	producer := bus.NewProducer("test-topic")
+	producer.Output <- []byte(`{"CollectionId":"test0001"}`)
+	producer.Output <- []byte(`{"CollectionId":"test0002"}`)
+	producer.Close()
+
+	attempts := 0
+	if err := consumer.Handle(receive(t, consumer), func(msg Message) error {
+		attempts++
+		return errors.New("cannot handle")
+	}); err == nil || attempts != 3 || len(failures) != 1 || failures[0] != 3 {
+		t.Errorf("Test failed, expected 3 attempts then one failure, got %d attempts, failures %v, error %v", attempts, failures, err)
+	}
+
+	// the second message succeeds at its second attempt
+	attempts = 0
+	if err := consumer.Handle(receive(t, consumer), func(msg Message) error {
+		if attempts++; msg.GetAttempt() < 2 {
+			return errors.New("not yet")
+		}
+		return nil
+	}); err != nil || attempts != 2 || len(failures) != 1 {
+		t.Errorf("Test failed, expected success at attempt 2, got %d attempts, failures %v, error %v", attempts, failures, err)
+	}
+	consumer.Close()
+	// the failed message is left uncommitted, but the next one commits past it
+	if lag := bus.Lag("test-topic", "group"); lag != 0 {
+		t.Errorf("Test failed, expected the second message committed, got lag %d", lag)
+	}
+}
+
+func TestHandleGivesUpRetryingWhenStopped(t *testing.T) {
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	consumer.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour})
+	producer := bus.NewProducer("test-topic")
+	producer.Output <- []byte(`{"CollectionId":"test0001"}`)
+	producer.Close()
+
+	msg := receive(t, consumer)
+	handled := make(chan error)
+	go func() {
+		handled <- consumer.Handle(msg, func(msg Message) error { return errors.New("cannot handle") })
+	}()
+	time.Sleep(20 * time.Millisecond)
+	consumer.Stop()
+	select {
+	case err := <-handled:
+		if err != ErrStopped {
+			t.Errorf("Test failed, expected ErrStopped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, still waiting to retry once stopped")
+	}
+	consumer.Close()
+	if lag := bus.Lag("test-topic", "group"); lag != 1 {
+		t.Errorf("Test failed, expected the message left uncommitted, got lag %d", lag)
+	}
+}
+
+func TestHandleWaitsToRetryWhilePaused(t *testing.T) {
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	defer consumer.Close()
+	consumer.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	producer := bus.NewProducer("test-topic")
+	producer.Output <- []byte(`{"CollectionId":"test0001"}`)
+	producer.Close()
+
+	msg := receive(t, consumer)
+	consumer.Pause("test")
+	attempts := make(chan int, 2)
+	handled := make(chan error)
+	go func() {
+		handled <- consumer.Handle(msg, func(msg Message) error {
+			attempts <- msg.GetAttempt()
+			if msg.GetAttempt() < 2 {
+				return errors.New("not yet")
+			}
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if len(attempts) != 1 {
+		t.Errorf("Test failed, expected no retry while paused, got %d attempts", len(attempts))
+	}
+	consumer.Resume()
+	select {
+	case err := <-handled:
+		if err != nil || len(attempts) != 2 {
+			t.Errorf("Test failed, expected success once resumed, got %v after %d attempts", err, len(attempts))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, not retried once resumed")
+	}
+}
+
+func TestHandleLeavesUnreportedFailureUncommitted(t *testing.T) {
+	bus := NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("test-topic", "group")
+	consumer.SetDeadLetterTopic("dead-letter", "test-service")
+	failed := bus.NewAckProducer("file-failed")
+	defer failed.Close()
+	consumer.SetFailureHandler(NewFileFailedReporter(failed))
+	producer := bus.NewProducer("test-topic")
+	producer.Output <- []byte(`{"ScheduleId":1,"FileId":2,"CollectionId":"test0001"}`)
+	producer.Close()
+
+	bus.FailSends("file-failed", errors.New("no brokers"))
+	err := consumer.Handle(receive(t, consumer), func(msg Message) error { return errors.New("cannot handle") })
+	if _, unforwarded := err.(ForwardError); !unforwarded {
+		t.Errorf("Test failed, expected a ForwardError, got %v", err)
+	}
+	consumer.Close()
+	if lag := bus.Lag("test-topic", "group"); lag != 1 || bus.Lag("dead-letter", "none") != 0 {
+		t.Errorf("Test failed, expected the message neither dead-lettered nor committed, got lag %d", lag)
+	}
+}
@@ -0,0 +1,249 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+)
+
+// Schema describes the binary encoding of a message, in the style of an Avro
+// schema. Type is one of "record", "array", "long", "string", "bytes" or "boolean".
+type Schema struct {
+	Type   string  `json:"type"`
+	Name   string  `json:"name,omitempty"`   // record
+	Fields []Field `json:"fields,omitempty"` // record
+	Items  *Schema `json:"items,omitempty"`  // array
+}
+
+type Field struct {
+	Name string  `json:"name"`
+	Type *Schema `json:"type"`
+}
+
+// messageTypes are registered with the schema registry on first use. Any message
+// sent with the binary codec must be listed here.
+var messageTypes = []interface{}{
+	ScheduleMessage{},
+	PublishFileMessage{},
+	PublishDeleteMessage{},
+	FileCompleteMessage{},
+	FileCompleteFlagMessage{},
+	CollectionCompleteMessage{},
+	DeadLetterMessage{},
+	FileFailedMessage{},
+	ScheduleAbortedMessage{},
+	RehearsalMessage{},
+	Envelope{},
+}
+
+// SchemaOf derives the schema of a message struct from its fields
+func SchemaOf(message interface{}) (*Schema, error) {
+	return schemaOfType(reflect.Indirect(reflect.ValueOf(message)).Type())
+}
+
+func schemaOfType(t reflect.Type) (*Schema, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "long"}, nil
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "bytes"}, nil
+		}
+		items, err := schemaOfType(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+	case reflect.Struct:
+		schema := &Schema{Type: "record", Name: t.Name()}
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue // unexported
+			}
+			fieldSchema, err := schemaOfType(t.Field(i).Type)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", t.Name(), t.Field(i).Name, err)
+			}
+			schema.Fields = append(schema.Fields, Field{Name: t.Field(i).Name, Type: fieldSchema})
+		}
+		return schema, nil
+	}
+	return nil, fmt.Errorf("Unsupported type %s", t)
+}
+
+// Id is the fingerprint of the schema, so every service derives the same id
+// for the same schema without needing to ask a shared registry
+func (s *Schema) Id() uint32 {
+	canonical, _ := json.Marshal(s)
+	hash := fnv.New32a()
+	hash.Write(canonical)
+	return hash.Sum32()
+}
+
+// compatible checks that data written with either schema can be read with the
+// other: fields may be added or removed (missing fields are read as zero values)
+// but a field may not change its type
+func compatible(older, newer *Schema) error {
+	if older.Type != newer.Type {
+		return fmt.Errorf("%s changed to %s", older.Type, newer.Type)
+	}
+	switch older.Type {
+	case "array":
+		if err := compatible(older.Items, newer.Items); err != nil {
+			return fmt.Errorf("items: %s", err)
+		}
+	case "record":
+		for _, oldField := range older.Fields {
+			for _, newField := range newer.Fields {
+				if oldField.Name != newField.Name {
+					continue
+				}
+				if err := compatible(oldField.Type, newField.Type); err != nil {
+					return fmt.Errorf("%s.%s: %s", older.Name, oldField.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SchemaRegistry is a local stand-in for a schema registry. It holds every
+// version of each subject (message name) and refuses a new version that is
+// incompatible with any earlier one. If given a path, the registry is kept in
+// that file, so that a release whose schemas are incompatible with those of
+// earlier releases (on the same host) is refused. Readers need not share it:
+// each binary message carries its writer's schema, which is remembered (but
+// not registered) once read.
+type SchemaRegistry struct {
+	mutex    sync.Mutex
+	path     string
+	Subjects map[string][]uint32 `json:"subjects"`
+	Schemas  map[uint32]*Schema  `json:"schemas"`
+	read     map[uint32]*Schema  // writers' schemas read from messages
+}
+
+func NewSchemaRegistry(path string) (*SchemaRegistry, error) {
+	registry := &SchemaRegistry{
+		path:     path,
+		Subjects: make(map[string][]uint32),
+		Schemas:  make(map[uint32]*Schema),
+		read:     make(map[uint32]*Schema),
+	}
+	if path == "" {
+		return registry, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, registry); err != nil {
+		return nil, fmt.Errorf("Bad schema registry %s: %s", path, err)
+	}
+	return registry, nil
+}
+
+// Register adds message's schema as the latest version of its subject, and
+// returns the schema's id
+func (r *SchemaRegistry) Register(message interface{}) (uint32, error) {
+	schema, err := SchemaOf(message)
+	if err != nil {
+		return 0, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	id := schema.Id()
+	if _, exists := r.Schemas[id]; exists {
+		return id, nil
+	}
+	for _, previous := range r.Subjects[schema.Name] {
+		if err := compatible(r.Schemas[previous], schema); err != nil {
+			return 0, fmt.Errorf("Schema for %s is incompatible with version %d: %s", schema.Name, previous, err)
+		}
+	}
+	r.Subjects[schema.Name] = append(r.Subjects[schema.Name], id)
+	r.Schemas[id] = schema
+	return id, r.save()
+}
+
+// Schema returns the schema with the given id
+func (r *SchemaRegistry) Schema(id uint32) (*Schema, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	schema, ok := r.Schemas[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown schema id %d", id)
+	}
+	return schema, nil
+}
+
+// known returns the schema with the given id, if registered or read from a message
+func (r *SchemaRegistry) known(id uint32) (*Schema, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if schema, ok := r.Schemas[id]; ok {
+		return schema, true
+	}
+	schema, ok := r.read[id]
+	return schema, ok
+}
+
+// maxReadSchemas bounds the writers' schemas remembered, as each is read from a
+// message rather than registered. Beyond it, a schema is read with every message.
+const maxReadSchemas = 100
+
+// remember keeps a writer's schema read from a message, so it is read only once.
+// Only versions of registered subjects are kept, up to maxReadSchemas of them.
+func (r *SchemaRegistry) remember(id uint32, schema *Schema) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, registered := r.Subjects[schema.Name]; !registered || len(r.read) >= maxReadSchemas {
+		return
+	}
+	r.read[id] = schema
+}
+
+func (r *SchemaRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.path, content, 0644)
+}
+
+var (
+	schemaRegistry     *SchemaRegistry
+	schemaRegistryErr  error
+	schemaRegistryOnce sync.Once
+)
+
+// getSchemaRegistry returns the registry (kept in KAFKA_SCHEMA_REGISTRY, if set)
+// holding all messageTypes
+func getSchemaRegistry() (*SchemaRegistry, error) {
+	schemaRegistryOnce.Do(func() {
+		schemaRegistry, schemaRegistryErr = NewSchemaRegistry(utils.GetEnvironmentVariable("KAFKA_SCHEMA_REGISTRY", ""))
+		if schemaRegistryErr != nil {
+			return
+		}
+		for _, message := range messageTypes {
+			if _, schemaRegistryErr = schemaRegistry.Register(message); schemaRegistryErr != nil {
+				return
+			}
+		}
+	})
+	return schemaRegistry, schemaRegistryErr
+}
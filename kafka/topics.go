@@ -0,0 +1,235 @@
+package kafka
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+	"github.com/Shopify/sarama"
+)
+
+// TopicSpec is how a topic is set up on the brokers
+type TopicSpec struct {
+	Role              string // what the topic is for, which the catalogue is keyed by
+	Name              string // what the topic is called, as configured by the service
+	Partitions        int32
+	ReplicationFactor int16
+	MaxMessageBytes   int32
+}
+
+// Topics is the catalogue of the pipeline's topics, by role. The topic of a
+// role is named "uk.gov.ons.dp.web.<role>", unless renamed by a service's env var.
+var Topics = []TopicSpec{
+	{Role: "schedule", Partitions: 1, ReplicationFactor: 3, MaxMessageBytes: 157286400},
+	{Role: "publish-file", Partitions: 10, ReplicationFactor: 3, MaxMessageBytes: 1000012},
+	{Role: "publish-delete", Partitions: 4, ReplicationFactor: 3, MaxMessageBytes: 1000012},
+	{Role: "publish-count", Partitions: 1, ReplicationFactor: 3, MaxMessageBytes: 1000012},
+	{Role: "complete-file", Partitions: 10, ReplicationFactor: 3, MaxMessageBytes: 10485760},
+	{Role: "complete-file-flag", Partitions: 10, ReplicationFactor: 3, MaxMessageBytes: 1000012},
+	{Role: "complete", Partitions: 1, ReplicationFactor: 3, MaxMessageBytes: 1000012},
+	{Role: "file-failed", Partitions: 1, ReplicationFactor: 3, MaxMessageBytes: 1000012},
+	{Role: "schedule-aborted", Partitions: 1, ReplicationFactor: 3, MaxMessageBytes: 1000012},
+	{Role: "rehearsal", Partitions: 4, ReplicationFactor: 3, MaxMessageBytes: 1000012},
+	{Role: "embargoed", Partitions: 1, ReplicationFactor: 3, MaxMessageBytes: 10485760},
+}
+
+// Topic is the topic a service uses for a role of the catalogue, under the name it is configured with
+type Topic struct {
+	Role string
+	Name string
+}
+
+// topicSpec returns the catalogue's spec of the topic's role, named as the
+// topic is, with the replication factor overridden by KAFKA_TOPIC_REPLICATION
+// (e.g. 1, for a single broker)
+func topicSpec(topic Topic) (TopicSpec, error) {
+	for _, spec := range Topics {
+		if spec.Role != topic.Role {
+			continue
+		}
+		spec.Name = topic.Name
+		replication, err := utils.GetEnvironmentVariableInt("KAFKA_TOPIC_REPLICATION", int(spec.ReplicationFactor))
+		if err != nil {
+			return spec, fmt.Errorf("Bad value for KAFKA_TOPIC_REPLICATION: %s", err)
+		}
+		spec.ReplicationFactor = int16(replication)
+		return spec, nil
+	}
+	return TopicSpec{}, fmt.Errorf("Topic role %q (of topic %q) is not in the topic catalogue", topic.Role, topic.Name)
+}
+
+// EnsureTopics checks the topics against the catalogue, as set by
+// KAFKA_TOPICS: "" (the default) checks nothing, leaving topics to be
+// auto-created by the brokers, "validate" returns an error if any topic is
+// missing or its partitions, replication or max.message.bytes differ from the
+// catalogue, and "create" creates any missing topics then validates the rest.
+// Either needs kafka 0.11 or later.
+func EnsureTopics(topics ...Topic) error {
+	mode := utils.GetEnvironmentVariable("KAFKA_TOPICS", "")
+	if mode == "" {
+		return nil
+	}
+	if mode != "validate" && mode != "create" {
+		return fmt.Errorf("Unknown KAFKA_TOPICS %q, expected validate or create", mode)
+	}
+	var specs []TopicSpec
+	for _, topic := range topics {
+		spec, err := topicSpec(topic)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+	}
+
+	config := sarama.NewConfig()
+	if err := Configure(config); err != nil {
+		return err
+	}
+	// topic configs are described by kafka 0.11 or later
+	config.Version = sarama.V0_11_0_0
+	// the client reads the metadata of all topics, which (unlike asking for
+	// a missing topic by name) does not trigger auto-creation
+	client, err := sarama.NewClient(Brokers(), config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	existing, err := client.Topics()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, topic := range existing {
+		exists[topic] = true
+	}
+
+	var missing, present []TopicSpec
+	var mismatches []string
+	for _, spec := range specs {
+		if !exists[spec.Name] {
+			missing = append(missing, spec)
+			continue
+		}
+		present = append(present, spec)
+		if mismatch, err := checkTopic(client, spec); err != nil {
+			return err
+		} else if mismatch != "" {
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+	if len(present) > 0 {
+		configMismatches, err := checkTopicConfigs(client, present)
+		if err != nil {
+			return err
+		}
+		mismatches = append(mismatches, configMismatches...)
+	}
+	if len(missing) > 0 && mode == "create" {
+		if err = createTopics(client, missing); err != nil {
+			return err
+		}
+		for _, spec := range missing {
+			log.Info(fmt.Sprintf("Created topic %q", spec.Name), log.Data{"partitions": spec.Partitions, "replicationFactor": spec.ReplicationFactor, "maxMessageBytes": spec.MaxMessageBytes})
+		}
+		missing = nil
+	}
+	for _, spec := range missing {
+		mismatches = append(mismatches, fmt.Sprintf("%q is missing", spec.Name))
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("Topics do not match the catalogue: %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// checkTopic describes how the partitions and replication of an existing topic differ from spec, if at all
+func checkTopic(client sarama.Client, spec TopicSpec) (string, error) {
+	partitions, err := client.Partitions(spec.Name)
+	if err != nil {
+		return "", err
+	}
+	if int32(len(partitions)) != spec.Partitions {
+		return fmt.Sprintf("%q has %d partitions, expected %d", spec.Name, len(partitions), spec.Partitions), nil
+	}
+	for _, partition := range partitions {
+		replicas, err := client.Replicas(spec.Name, partition)
+		if err != nil {
+			return "", err
+		}
+		if len(replicas) != int(spec.ReplicationFactor) {
+			return fmt.Sprintf("%q partition %d has %d replicas, expected %d", spec.Name, partition, len(replicas), spec.ReplicationFactor), nil
+		}
+	}
+	return "", nil
+}
+
+// checkTopicConfigs describes how the max.message.bytes of existing topics differ from their specs
+func checkTopicConfigs(client sarama.Client, specs []TopicSpec) ([]string, error) {
+	controller, err := client.Controller()
+	if err != nil {
+		return nil, err
+	}
+	request := &sarama.DescribeConfigsRequest{}
+	for _, spec := range specs {
+		request.Resources = append(request.Resources, &sarama.ConfigResource{
+			Type:        sarama.TopicResource,
+			Name:        spec.Name,
+			ConfigNames: []string{"max.message.bytes"},
+		})
+	}
+	response, err := controller.DescribeConfigs(request)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot describe the configs of topics: %s", err)
+	}
+	maxMessageBytes := make(map[string]string, len(response.Resources))
+	for _, resource := range response.Resources {
+		if kerr := sarama.KError(resource.ErrorCode); kerr != sarama.ErrNoError {
+			return nil, fmt.Errorf("Cannot describe the config of topic %q: %s %s", resource.Name, kerr, resource.ErrorMsg)
+		}
+		for _, entry := range resource.Configs {
+			if entry.Name == "max.message.bytes" {
+				maxMessageBytes[resource.Name] = entry.Value
+			}
+		}
+	}
+	var mismatches []string
+	for _, spec := range specs {
+		if value := maxMessageBytes[spec.Name]; value != strconv.Itoa(int(spec.MaxMessageBytes)) {
+			mismatches = append(mismatches, fmt.Sprintf("%q has max.message.bytes %q, expected %d", spec.Name, value, spec.MaxMessageBytes))
+		}
+	}
+	return mismatches, nil
+}
+
+// createTopics creates topics on the controller broker
+func createTopics(client sarama.Client, specs []TopicSpec) error {
+	controller, err := client.Controller()
+	if err != nil {
+		return err
+	}
+	request := &sarama.CreateTopicsRequest{
+		TopicDetails: make(map[string]*sarama.TopicDetail, len(specs)),
+		Timeout:      30 * time.Second,
+	}
+	for _, spec := range specs {
+		maxMessageBytes := strconv.Itoa(int(spec.MaxMessageBytes))
+		request.TopicDetails[spec.Name] = &sarama.TopicDetail{
+			NumPartitions:     spec.Partitions,
+			ReplicationFactor: spec.ReplicationFactor,
+			ConfigEntries:     map[string]*string{"max.message.bytes": &maxMessageBytes},
+		}
+	}
+	response, err := controller.CreateTopics(request)
+	if err != nil {
+		return err
+	}
+	for topic, topicErr := range response.TopicErrors {
+		if topicErr.Err != sarama.ErrNoError && topicErr.Err != sarama.ErrTopicAlreadyExists {
+			return fmt.Errorf("Could not create topic %q: %s", topic, topicErr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// describeMaxMessageBytes answers a DescribeConfigs request with the max.message.bytes of topic
+func describeMaxMessageBytes(topic, maxMessageBytes string) sarama.MockResponse {
+	return sarama.NewMockWrapper(&sarama.DescribeConfigsResponse{Resources: []*sarama.ResourceResponse{{
+		Type:    sarama.TopicResource,
+		Name:    topic,
+		Configs: []*sarama.ConfigEntry{{Name: "max.message.bytes", Value: maxMessageBytes}},
+	}}})
+}
+
+func TestEnsureTopicsCreatesMissing(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetController(broker.BrokerID()).
+			SetLeader("uk.gov.ons.dp.web.complete", 0, broker.BrokerID()),
+		"CreateTopicsRequest":    sarama.NewMockCreateTopicsResponse(t),
+		"DescribeConfigsRequest": describeMaxMessageBytes("uk.gov.ons.dp.web.complete", "1000012"),
+	})
+	for name, value := range map[string]string{"KAFKA_ADDR": broker.Addr(), "KAFKA_TOPICS": "create", "KAFKA_TOPIC_REPLICATION": "1"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	if err := EnsureTopics(Topic{Role: "complete", Name: "uk.gov.ons.dp.web.complete"}, Topic{Role: "file-failed", Name: "uk.gov.ons.dp.web.file-failed"}); err != nil {
+		t.Fatal(err)
+	}
+	var created []string
+	for _, call := range broker.History() {
+		if request, ok := call.Request.(*sarama.CreateTopicsRequest); ok {
+			for topic, detail := range request.TopicDetails {
+				if maxMessageBytes := detail.ConfigEntries["max.message.bytes"]; maxMessageBytes == nil || *maxMessageBytes != "1000012" || detail.ReplicationFactor != 1 {
+					t.Errorf("Test failed, %q created as %+v", topic, detail)
+				}
+				created = append(created, topic)
+			}
+		}
+	}
+	if len(created) != 1 || created[0] != "uk.gov.ons.dp.web.file-failed" {
+		t.Errorf("Test failed, expected only the missing topic created, got %v", created)
+	}
+}
+
+func TestEnsureTopicsValidatesRenamedTopic(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetController(broker.BrokerID()).
+			SetLeader("test-complete", 0, broker.BrokerID()),
+		"DescribeConfigsRequest": describeMaxMessageBytes("test-complete", "1000000"),
+	})
+	for name, value := range map[string]string{"KAFKA_ADDR": broker.Addr(), "KAFKA_TOPICS": "validate", "KAFKA_TOPIC_REPLICATION": "1"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	err := EnsureTopics(Topic{Role: "complete", Name: "test-complete"})
+	if err == nil || !strings.Contains(err.Error(), `"test-complete" has max.message.bytes "1000000", expected 1000012`) {
+		t.Errorf("Test failed, expected the max.message.bytes of the renamed topic to differ, got %v", err)
+	}
+}
+
+func TestTopicSpecReplicationOverride(t *testing.T) {
+	os.Setenv("KAFKA_TOPIC_REPLICATION", "1")
+	defer os.Unsetenv("KAFKA_TOPIC_REPLICATION")
+	spec, err := topicSpec(Topic{Role: "publish-file", Name: "test-publish-file"})
+	if err != nil || spec.Name != "test-publish-file" || spec.ReplicationFactor != 1 || spec.Partitions != 10 {
+		t.Errorf("Test failed, got %+v (%v)", spec, err)
+	}
+	if _, err = topicSpec(Topic{Role: "test", Name: "test-topic"}); err == nil {
+		t.Error("Test failed, expected an error for a role not in the catalogue")
+	}
+}
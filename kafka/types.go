@@ -19,12 +19,15 @@ type FileResource struct {
 }
 
 type ScheduleMessage struct {
-	Action         string
-	CollectionId   string
-	CollectionPath string
-	ScheduleTime   string
-	Files          []FileResource
-	UrisToDelete   []string
+	Action               string
+	CollectionId         string
+	CollectionPath       string
+	ScheduleTime         string
+	PreviousScheduleTime string // optional, for a reschedule: the time of the job to move
+	Files                []FileResource
+	UrisToDelete         []string
+	DependsOn            []string // optional, the collections which must publish before this one
+	DryRun               bool     `json:",omitempty"` // optional, rehearse the publish without changing the website
 }
 
 type PublishFileMessage struct {
@@ -35,6 +38,10 @@ type PublishFileMessage struct {
 	EncryptionKey  string
 	FileLocation   string
 	Uri            string
+	DryRun         bool  `json:",omitempty"`
+	ScheduleTime   int64 `json:",omitempty"` // the release time (UnixNano) of the job, before which the file is embargoed
+	// EmbargoSignature is publish-scheduler's signature of the ScheduleTime, see EmbargoSigner
+	EmbargoSignature string `json:",omitempty"`
 }
 
 type PublishDeleteMessage struct {
@@ -42,16 +49,34 @@ type PublishDeleteMessage struct {
 	DeleteId     int64
 	CollectionId string
 	Uri          string
+	DryRun       bool `json:",omitempty"`
 }
 
-// S3Location and FileContent are mutually exclusive
+// S3Location and FileContent are mutually exclusive. Large FileContent may be
+// staged in s3 instead (see claimcheck), at ContentLocation.
 type FileCompleteMessage struct {
+	ScheduleId      int64
+	FileId          int64
+	CollectionId    string
+	Uri             string
+	S3Location      string
+	FileContent     string
+	ContentLocation string
+	ContentSha256   string
+	DryRun          bool  `json:",omitempty"`
+	ScheduleTime    int64 `json:",omitempty"` // as for PublishFileMessage
+	// EmbargoSignature is passed on from the PublishFileMessage
+	EmbargoSignature string `json:",omitempty"`
+}
+
+// FileFailedMessage reports a file which could not be published after Attempts tries
+type FileFailedMessage struct {
 	ScheduleId   int64
 	FileId       int64
 	CollectionId string
 	Uri          string
-	S3Location   string
-	FileContent  string
+	Attempts     int
+	Error        string
 }
 
 // (FileId) and (DeleteId) are mutually exclusive
@@ -63,7 +88,40 @@ type FileCompleteFlagMessage struct {
 	DeleteId     int64
 }
 
+// ScheduleAbortedMessage announces a schedule (job) aborted while publishing,
+// whose remaining messages are to be dropped
+type ScheduleAbortedMessage struct {
+	ScheduleId   int64
+	CollectionId string
+	AbortTime    int64
+}
+
 type CollectionCompleteMessage struct {
 	ScheduleId   int64
 	CollectionId string
 }
+
+// RehearsalMessage records what a service did, or would have done, for a
+// file (or delete) of a dry run. Action is e.g. "store-metadata".
+type RehearsalMessage struct {
+	ScheduleId   int64
+	CollectionId string
+	Service      string
+	Action       string
+	Uri          string
+	Location     string // where the content was read or staged
+	Sha256       string // of the content
+	Size         int64
+	Detail       string
+}
+
+// DeadLetterMessage wraps a message (Value) which a service failed to process
+type DeadLetterMessage struct {
+	Service   string
+	Topic     string
+	Partition int32
+	Offset    int64
+	Attempts  int
+	Error     string
+	Value     []byte
+}
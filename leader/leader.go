@@ -0,0 +1,177 @@
+package leader
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// dbNow is the database's time (UnixNano), so that instances need not agree on the time
+const dbNow = "CAST(EXTRACT(EPOCH FROM clock_timestamp()) * 1000000000 AS bigint)"
+
+// Elector campaigns to hold the lease (a row in the leader_lease table) named
+// for a service, so that one of its instances leads at a time. The leader
+// renews its lease every LEADER_RENEW_MS, and a lease not renewed within
+// LEADER_LEASE_MS is taken over by a standby.
+type Elector struct {
+	name     string
+	id       string
+	lease    time.Duration
+	interval time.Duration
+	acquire  *sql.Stmt
+	current  *sql.Stmt
+	release  *sql.Stmt
+	mutex    sync.Mutex
+	leader   string
+	since    time.Time
+	// until is when this instance stops leading, unless it renews its lease
+	until time.Time
+	quit  chan bool
+	done  chan bool
+}
+
+// Status is who leads, as seen by an instance
+type Status struct {
+	Instance string `json:"instance"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"isLeader"`
+	Since    string `json:"since,omitempty"`
+}
+
+// NewElector starts campaigning for the lease of name (e.g. the name of the
+// service), as this instance: LEADER_ID, by default the hostname and pid
+func NewElector(db *sql.DB, name string) (*Elector, error) {
+	leaseMs, err := utils.GetEnvironmentVariableInt("LEADER_LEASE_MS", 10000)
+	if err != nil || leaseMs <= 0 {
+		return nil, fmt.Errorf("Bad value for LEADER_LEASE_MS: %v", err)
+	}
+	renewMs, err := utils.GetEnvironmentVariableInt("LEADER_RENEW_MS", 2000)
+	if err != nil || renewMs <= 0 || renewMs >= leaseMs {
+		return nil, fmt.Errorf("Bad value for LEADER_RENEW_MS, it must be less than LEADER_LEASE_MS: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	e := &Elector{
+		name:     name,
+		id:       utils.GetEnvironmentVariable("LEADER_ID", fmt.Sprintf("%s-%d", hostname, os.Getpid())),
+		lease:    time.Duration(leaseMs) * time.Millisecond,
+		interval: time.Duration(renewMs) * time.Millisecond,
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+	// the lease is taken when it has expired, and renewed when already held
+	if e.acquire, err = db.Prepare("INSERT INTO leader_lease (name, holder, acquired_time, expiry_time) VALUES ($1, $2, " + dbNow + ", " + dbNow + " + $3)" +
+		" ON CONFLICT (name) DO UPDATE SET holder=EXCLUDED.holder, expiry_time=EXCLUDED.expiry_time," +
+		" acquired_time=CASE WHEN leader_lease.holder=EXCLUDED.holder THEN leader_lease.acquired_time ELSE EXCLUDED.acquired_time END" +
+		" WHERE leader_lease.holder=EXCLUDED.holder OR leader_lease.expiry_time < " + dbNow +
+		" RETURNING acquired_time"); err != nil {
+		return nil, err
+	}
+	if e.current, err = db.Prepare("SELECT holder, acquired_time FROM leader_lease WHERE name=$1"); err != nil {
+		e.acquire.Close()
+		return nil, err
+	}
+	if e.release, err = db.Prepare("DELETE FROM leader_lease WHERE name=$1 AND holder=$2"); err != nil {
+		e.acquire.Close()
+		e.current.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			e.campaign()
+			select {
+			case <-ticker.C:
+			case <-e.quit:
+				return
+			}
+		}
+	}()
+	log.Info(fmt.Sprintf("Campaigning to lead %s as %q", name, e.id), log.Data{"leaseMs": leaseMs, "renewMs": renewMs})
+	return e, nil
+}
+
+// campaign takes or renews the lease, or else finds who holds it
+func (e *Elector) campaign() {
+	attempted := time.Now()
+	var acquired sql.NullInt64
+	err := e.acquire.QueryRow(e.name, e.id, int64(e.lease)).Scan(&acquired)
+	if err == nil {
+		e.update(e.id, acquired.Int64, attempted.Add(e.lease))
+		return
+	} else if err != sql.ErrNoRows {
+		// the lease may yet be held, so this instance leads until it expires
+		log.ErrorC("Could not renew leader lease", err, log.Data{"name": e.name, "instance": e.id})
+		return
+	}
+	var holder sql.NullString
+	if err = e.current.QueryRow(e.name).Scan(&holder, &acquired); err != nil && err != sql.ErrNoRows {
+		log.ErrorC("Could not read leader lease", err, log.Data{"name": e.name, "instance": e.id})
+		return
+	}
+	e.update(holder.String, acquired.Int64, time.Time{})
+}
+
+// update records the leader, logging any change
+func (e *Elector) update(leader string, acquired int64, until time.Time) {
+	e.mutex.Lock()
+	wasLeader := e.isLeader()
+	changed := leader != e.leader
+	e.leader = leader
+	e.since = time.Unix(0, acquired)
+	e.until = until
+	isLeader := e.isLeader()
+	e.mutex.Unlock()
+	if isLeader && !wasLeader {
+		log.Info(fmt.Sprintf("%q is now the leader of %s", e.id, e.name), nil)
+	} else if wasLeader && !isLeader {
+		log.Info(fmt.Sprintf("%q is no longer the leader of %s, %q is", e.id, e.name, leader), nil)
+	} else if changed && !isLeader {
+		log.Info(fmt.Sprintf("%q is the leader of %s", leader, e.name), nil)
+	}
+}
+
+// isLeader is IsLeader, with the mutex held
+func (e *Elector) isLeader() bool {
+	return e.leader == e.id && time.Now().Before(e.until)
+}
+
+// IsLeader reports whether this instance holds an unexpired lease. A leader
+// which cannot renew its lease stops leading when the lease would expire.
+func (e *Elector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.isLeader()
+}
+
+// Status reports this instance and the leader
+func (e *Elector) Status() Status {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	status := Status{Instance: e.id, Leader: e.leader, IsLeader: e.isLeader()}
+	if e.leader != "" {
+		status.Since = e.since.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// Close stops campaigning and, if leading, gives up the lease so that a standby takes over at once
+func (e *Elector) Close() error {
+	close(e.quit)
+	<-e.done
+	e.mutex.Lock()
+	e.until = time.Time{}
+	e.mutex.Unlock()
+	_, err := e.release.Exec(e.name, e.id)
+	for _, stmt := range []*sql.Stmt{e.acquire, e.current, e.release} {
+		stmt.Close()
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package leader
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+func TestOneElectorLeads(t *testing.T) {
+	db, err := sql.Open("postgres", "user=dp dbname=dp sslmode=disable")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skip("Local postgres database was not found")
+	}
+	defer db.Close()
+	defer db.Exec("DELETE FROM leader_lease WHERE name=$1", "leader-test")
+
+	var electors []*Elector
+	for _, id := range []string{"first", "second"} {
+		os.Setenv("LEADER_ID", id)
+		elector, err := NewElector(db, "leader-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		electors = append(electors, elector)
+		elector.campaign()
+	}
+	os.Unsetenv("LEADER_ID")
+	if !electors[0].IsLeader() || electors[1].IsLeader() || electors[1].Status().Leader != "first" {
+		t.Errorf("Test failed, expected first to lead, got %+v and %+v", electors[0].Status(), electors[1].Status())
+	}
+
+	electors[0].Close()
+	electors[1].campaign()
+	if !electors[1].IsLeader() {
+		t.Errorf("Test failed, expected second to take over, got %+v", electors[1].Status())
+	}
+	electors[1].Close()
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// Source reports a set of metrics, as a value which can be marshalled to JSON
+type Source func() interface{}
+
+var (
+	sourcesMutex sync.Mutex
+	sources      = make(map[string]Source)
+)
+
+// Register adds (or replaces) the source reported by Handler as name
+func Register(name string, source Source) {
+	sourcesMutex.Lock()
+	defer sourcesMutex.Unlock()
+	sources[name] = source
+}
+
+func Unregister(name string) {
+	sourcesMutex.Lock()
+	defer sourcesMutex.Unlock()
+	delete(sources, name)
+}
+
+// Handler responds with the metrics of every registered source, as a JSON
+// object keyed by the sources' names
+func Handler(w http.ResponseWriter, r *http.Request) {
+	sourcesMutex.Lock()
+	registered := make(map[string]Source, len(sources))
+	for name, source := range sources {
+		registered[name] = source
+	}
+	sourcesMutex.Unlock()
+	// sources are called outside the lock, as they take their own
+	report := make(map[string]interface{}, len(registered))
+	for name, source := range registered {
+		report[name] = source()
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Error(err, nil)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// windowSeconds is the length of the window over which a Window reports
+const windowSeconds = 60
+
+// Window records events (each with a duration, e.g. how long it took) and
+// reports their rate and durations over the last minute
+type Window struct {
+	mutex   sync.Mutex
+	buckets [windowSeconds]bucket
+	total   int64
+}
+
+type bucket struct {
+	second int64 // unix time of the events in the bucket
+	count  int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// WindowReport is the rate and durations of a Window's events in the last
+// minute, and the count of all its events
+type WindowReport struct {
+	Total     int64   `json:"total"`
+	PerSecond float64 `json:"perSecond"`
+	MeanMs    float64 `json:"meanMs"`
+	MaxMs     float64 `json:"maxMs"`
+}
+
+// Record adds an event taking d to the window
+func (w *Window) Record(d time.Duration) {
+	now := time.Now().Unix()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	b := &w.buckets[now%windowSeconds]
+	if b.second != now {
+		*b = bucket{second: now}
+	}
+	b.count++
+	b.sum += d
+	if d > b.max {
+		b.max = d
+	}
+	w.total++
+}
+
+func (w *Window) Report() WindowReport {
+	now := time.Now().Unix()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	report := WindowReport{Total: w.total}
+	var count int64
+	var sum, max time.Duration
+	for _, b := range w.buckets {
+		if now-b.second >= windowSeconds {
+			continue
+		}
+		count += b.count
+		sum += b.sum
+		if b.max > max {
+			max = b.max
+		}
+	}
+	report.PerSecond = float64(count) / windowSeconds
+	if count > 0 {
+		report.MeanMs = float64(sum) / float64(count) / float64(time.Millisecond)
+		report.MaxMs = float64(max) / float64(time.Millisecond)
+	}
+	return report
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWindowReport(t *testing.T) {
+	var window Window
+	window.Record(10 * time.Millisecond)
+	window.Record(30 * time.Millisecond)
+	report := window.Report()
+	if report.Total != 2 || report.MeanMs != 20 || report.MaxMs != 30 || report.PerSecond != 2.0/windowSeconds {
+		t.Errorf("Test failed, got: %+v", report)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Register("test", func() interface{} { return map[string]int{"count": 3} })
+	defer Unregister("test")
+	recorder := httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	var report map[string]map[string]int
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report["test"]["count"] != 3 {
+		t.Errorf("Test failed, got: %s", recorder.Body.String())
+	}
+}
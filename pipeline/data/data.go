@@ -0,0 +1,93 @@
+// Package data copies the files of published collections (other than json,
+// see pipeline/metadata) to the website's bucket, for publish-data
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/dp-publish-pipeline/decrypt"
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/dp-publish-pipeline/s3"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ObjectStore is the part of s3.S3Client which files are uploaded to
+type ObjectStore interface {
+	AddObject(content, s3Location, collectionId string, scheduleId int64)
+}
+
+// UploadFile copies the file to the website's bucket (s3Client, named bucket),
+// or for a dry run, to dryRunPrefix in the bucket (recording the content's
+// checksum). Json files are left to publish-metadata.
+func UploadFile(jsonMessage []byte, s3UpstreamClient s3.S3Client, s3Client ObjectStore, bucket string, completeFileProducer, completeFileFlagProducer kafka.Producer, recorder *rehearsal.Recorder, dryRunPrefix string) error {
+	var message kafka.PublishFileMessage
+	envelope, err := kafka.Decode(jsonMessage, &message)
+	if err != nil {
+		return fmt.Errorf("Invalid JSON: %q: %s", jsonMessage, err)
+	}
+	if message.CollectionId == "" || message.FileLocation == "" || message.Uri == "" {
+		return fmt.Errorf("Malformed JSON: %q", jsonMessage)
+	}
+	if strings.HasSuffix(message.FileLocation, ".json") {
+		return nil
+	}
+	var content []byte
+	var contentErr error
+	if strings.HasPrefix(message.FileLocation, "s3://") {
+		bucketPrefix := "s3://" + s3UpstreamClient.Bucket + "/"
+		if !strings.HasPrefix(message.FileLocation, bucketPrefix) {
+			return fmt.Errorf("Unexpected bucket: wanted %s, for %s", bucketPrefix, message.FileLocation)
+		}
+		if message.EncryptionKey != "" {
+			content, contentErr = decrypt.DecryptS3(s3UpstreamClient, message.FileLocation[len(bucketPrefix):], message.EncryptionKey)
+		} else {
+			content, contentErr = s3UpstreamClient.GetObject(message.FileLocation[len(bucketPrefix):])
+		}
+	} else if strings.HasPrefix(message.FileLocation, "file://") {
+		if message.EncryptionKey != "" {
+			content, contentErr = decrypt.DecryptFile(message.FileLocation[7:], message.EncryptionKey)
+		} else {
+			content, contentErr = ioutil.ReadFile(message.FileLocation[7:])
+		}
+	} else {
+		contentErr = fmt.Errorf("Bad FileLocation")
+	}
+	if contentErr != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to open/decrypt file %d: %s - error %s", message.ScheduleId, message.CollectionId, message.FileId, message.FileLocation, contentErr)
+	}
+	s3Path := filepath.Join(uuid.NewV1().String(), message.CollectionPath, filepath.Base(message.FileLocation))
+	if message.DryRun {
+		s3Path = filepath.Join(dryRunPrefix, strconv.FormatInt(message.ScheduleId, 10), s3Path)
+	}
+	s3Client.AddObject(string(content), s3Path, message.CollectionId, message.ScheduleId)
+	fullS3Path := "s3://" + bucket + "/" + s3Path
+	if message.DryRun {
+		if err := recorder.Record(kafka.RehearsalMessage{ScheduleId: message.ScheduleId, CollectionId: message.CollectionId, Action: "stage", Uri: message.Uri,
+			Location: fullS3Path, Sha256: rehearsal.Checksum(content), Size: int64(len(content)), Detail: "from " + message.FileLocation}, kafka.GetCorrelationId(envelope)); err != nil {
+			return fmt.Errorf("Job %d Collection %q - Failed to record rehearsal of file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+		}
+	}
+	// the flag is only sent once the broker has the file, and the input is only committed once both are sent
+	fileComplete, err := completeFileProducer.Encode(kafka.FileCompleteMessage{FileId: message.FileId, ScheduleId: message.ScheduleId, CollectionId: message.CollectionId, Uri: message.Uri, S3Location: fullS3Path, DryRun: message.DryRun, ScheduleTime: message.ScheduleTime,
+		EmbargoSignature: message.EmbargoSignature}, kafka.GetCorrelationId(envelope))
+	if err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to encode complete file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+	if err := completeFileProducer.Send(fileComplete); err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to send complete file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+	fileComplete, err = completeFileFlagProducer.Encode(kafka.FileCompleteFlagMessage{FileId: message.FileId, ScheduleId: message.ScheduleId, CollectionId: message.CollectionId, Uri: message.Uri}, kafka.GetCorrelationId(envelope))
+	if err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to encode complete flag for file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+	if err := completeFileFlagProducer.Send(fileComplete); err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to send complete flag for file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,7 @@
+// Package pipeline tests the publish pipeline end to end, in process: a job
+// is sent by the scheduler, its files copied or read by publish-data and
+// publish-metadata, stored by publish-receiver and tracked to completion by
+// publish-tracker, over a kafka.MemoryBus. Each service's handling of its
+// messages is in a package of its own (e.g. pipeline/tracker), which its
+// main (e.g. cmd/publish-tracker) connects to kafka.
+package pipeline
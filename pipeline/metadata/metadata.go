@@ -0,0 +1,88 @@
+// Package metadata reads the json files of published collections, and sends
+// their content on to publish-receiver, for publish-metadata
+package metadata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ONSdigital/dp-publish-pipeline/claimcheck"
+	"github.com/ONSdigital/dp-publish-pipeline/decrypt"
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/dp-publish-pipeline/s3"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// SendData sends the content of a json file on to be stored, recording its
+// checksum when it is for a dry run. Other files are left to publish-data.
+func SendData(jsonMessage []byte, fileProducer, flagProducer kafka.Producer, s3UpstreamClient s3.S3Client, claims *claimcheck.Store, recorder *rehearsal.Recorder) error {
+	var message kafka.PublishFileMessage
+	envelope, err := kafka.Decode(jsonMessage, &message)
+	if err != nil {
+		return fmt.Errorf("Failed to parse json message: %s", err)
+	}
+	if message.FileLocation == "" || message.CollectionId == "" || message.Uri == "" {
+		return fmt.Errorf("Json message missing fields: %s", string(jsonMessage))
+	}
+	if !strings.HasSuffix(message.FileLocation, ".json") {
+		return nil // leave non-metadata for other services
+	}
+
+	var content []byte
+	var contentErr error
+	if strings.HasPrefix(message.FileLocation, "file://") {
+		if message.EncryptionKey != "" {
+			content, contentErr = decrypt.DecryptFile(message.FileLocation[7:], message.EncryptionKey)
+		} else {
+			content, contentErr = ioutil.ReadFile(message.FileLocation[7:])
+		}
+	} else if strings.HasPrefix(message.FileLocation, "s3://") {
+		bucketPrefix := "s3://" + s3UpstreamClient.Bucket + "/"
+		if !strings.HasPrefix(message.FileLocation, bucketPrefix) {
+			return fmt.Errorf("Unexpected bucket: wanted %s, for %s", bucketPrefix, message.FileLocation)
+		}
+		if message.EncryptionKey != "" {
+			content, contentErr = decrypt.DecryptS3(s3UpstreamClient, message.FileLocation[len(bucketPrefix):], message.EncryptionKey)
+		} else {
+			content, contentErr = s3UpstreamClient.GetObject(message.FileLocation[len(bucketPrefix):])
+		}
+	} else {
+		contentErr = fmt.Errorf("Bad FileLocation")
+	}
+	if contentErr != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to obtain file %d: %q - %s", message.ScheduleId, message.CollectionId, message.FileId, message.FileLocation, contentErr)
+	}
+
+	if message.DryRun {
+		if err := recorder.Record(kafka.RehearsalMessage{ScheduleId: message.ScheduleId, CollectionId: message.CollectionId, Action: "fetch", Uri: message.Uri,
+			Location: message.FileLocation, Sha256: rehearsal.Checksum(content), Size: int64(len(content))}, kafka.GetCorrelationId(envelope)); err != nil {
+			return fmt.Errorf("Job %d Collection %q - Failed to record rehearsal of file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+		}
+	}
+
+	// the flag is only sent once the broker has the file, and the input is only committed once both are sent
+	fileComplete := kafka.FileCompleteMessage{FileId: message.FileId, ScheduleId: message.ScheduleId, Uri: message.Uri, FileContent: string(content), CollectionId: message.CollectionId, DryRun: message.DryRun, ScheduleTime: message.ScheduleTime,
+		EmbargoSignature: message.EmbargoSignature}
+	if err := claims.Check(&fileComplete); err != nil {
+		return err
+	}
+	data, err := fileProducer.Encode(fileComplete, kafka.GetCorrelationId(envelope))
+	if err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to encode complete file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+	if err := fileProducer.Send(data); err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to send complete file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+	data, err = flagProducer.Encode(kafka.FileCompleteFlagMessage{FileId: message.FileId, ScheduleId: message.ScheduleId, Uri: message.Uri, CollectionId: message.CollectionId}, kafka.GetCorrelationId(envelope))
+	if err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to encode complete flag for file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+	if err := flagProducer.Send(data); err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to send complete flag for file %d: %s", message.ScheduleId, message.CollectionId, message.FileId, err)
+	}
+
+	log.Info(fmt.Sprintf("Job %d Collection %q - uri %s", message.ScheduleId, message.CollectionId, message.FileLocation), nil)
+	return nil
+}
@@ -0,0 +1,104 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/dp-publish-pipeline/s3"
+)
+
+func TestSendDataOverMemoryBus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "data.json")
+	ioutil.WriteFile(location, []byte(`{"type":"taxonomy_landing_page"}`), 0644)
+
+	bus := kafka.NewMemoryBus(2)
+	consumer, _ := bus.NewConsumerGroup("publish-file", "publish-metadata")
+	receiver, _ := bus.NewConsumerGroup("complete-file", "publish-receiver")
+	defer receiver.Close()
+	tracker, _ := bus.NewConsumerGroup("complete-file-flag", "publish-tracker")
+	defer tracker.Close()
+	scheduler := bus.NewProducer("publish-file")
+	data, _ := scheduler.Encode(kafka.PublishFileMessage{ScheduleId: 1, FileId: 2, CollectionId: "test0001", FileLocation: "file://" + location, Uri: "/about/data.json"}, "")
+	scheduler.Output <- data
+	scheduler.Close()
+
+	fileProducer := bus.NewAckProducer("complete-file")
+	flagProducer := bus.NewAckProducer("complete-file-flag")
+	select {
+	case msg := <-consumer.Incoming:
+		if err := consumer.Handle(msg, func(msg kafka.Message) error {
+			return SendData(msg.GetData(), fileProducer, flagProducer, s3.S3Client{}, nil, nil)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, no publish-file message")
+	}
+	consumer.Close()
+	fileProducer.Close()
+	flagProducer.Close()
+	if lag := bus.Lag("publish-file", "publish-metadata"); lag != 0 {
+		t.Errorf("Test failed, publish-file not committed, lag %d", lag)
+	}
+
+	var file kafka.FileCompleteMessage
+	kafka.Decode((<-receiver.Incoming).GetData(), &file)
+	if file.FileId != 2 || file.Uri != "/about/data.json" || file.FileContent != `{"type":"taxonomy_landing_page"}` {
+		t.Errorf("Test failed, got complete-file: %+v", file)
+	}
+
+	var flag kafka.FileCompleteFlagMessage
+	kafka.Decode((<-tracker.Incoming).GetData(), &flag)
+	if flag.FileId != 2 || flag.ScheduleId != 1 || flag.CollectionId != "test0001" {
+		t.Errorf("Test failed, got complete-file-flag: %+v", flag)
+	}
+}
+
+func TestSendDataRecordsDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "data.json")
+	content := []byte(`{"type":"bulletin"}`)
+	ioutil.WriteFile(location, content, 0644)
+
+	bus := kafka.NewMemoryBus(2)
+	scheduler, _ := bus.NewConsumerGroup("rehearsal", "publish-scheduler")
+	defer scheduler.Close()
+	receiver, _ := bus.NewConsumerGroup("complete-file", "publish-receiver")
+	defer receiver.Close()
+	fileProducer := bus.NewAckProducer("complete-file")
+	flagProducer := bus.NewAckProducer("complete-file-flag")
+	recorder := rehearsal.NewRecorder(bus, "publish-metadata", "rehearsal")
+	defer fileProducer.Close()
+	defer flagProducer.Close()
+	defer recorder.Close()
+	data, _ := fileProducer.Encode(kafka.PublishFileMessage{ScheduleId: 1, FileId: 2, CollectionId: "test0001", FileLocation: "file://" + location, Uri: "/gdp/data.json", DryRun: true}, "")
+	if err = SendData(data, fileProducer, flagProducer, s3.S3Client{}, nil, recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	var record kafka.RehearsalMessage
+	kafka.Decode((<-scheduler.Incoming).GetData(), &record)
+	if record.Service != "publish-metadata" || record.Action != "fetch" || record.Sha256 != rehearsal.Checksum(content) || record.Size != int64(len(content)) {
+		t.Errorf("Test failed, got rehearsal record: %+v", record)
+	}
+
+	var file kafka.FileCompleteMessage
+	kafka.Decode((<-receiver.Incoming).GetData(), &file)
+	if !file.DryRun {
+		t.Errorf("Test failed, complete-file not a dry run: %+v", file)
+	}
+}
@@ -0,0 +1,172 @@
+package pipeline_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/data"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/metadata"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/receiver"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/scheduler"
+	"github.com/ONSdigital/dp-publish-pipeline/pipeline/tracker"
+	"github.com/ONSdigital/dp-publish-pipeline/s3"
+
+	_ "github.com/lib/pq"
+)
+
+// bucket is a data.ObjectStore kept in memory
+type bucket struct {
+	mutex   sync.Mutex
+	objects map[string]string
+}
+
+func (b *bucket) AddObject(content, s3Location, collectionId string, scheduleId int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.objects[s3Location] = content
+}
+
+// handle has consumer handle its next message
+func handle(t *testing.T, consumer *kafka.ConsumerGroup, handler kafka.Handler) {
+	select {
+	case msg := <-consumer.Incoming:
+		if err := consumer.Handle(msg, handler); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, no message received")
+	}
+}
+
+func TestPublishOverMemoryBus(t *testing.T) {
+	db, err := sql.Open("postgres", "user=dp dbname=dp sslmode=disable")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skip("Local postgres database was not found")
+	}
+	defer db.Close()
+
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"type":"bulletin"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart.png"), []byte("png"), 0644)
+
+	// the job, as stored and launched by the scheduler
+	collectionId := fmt.Sprintf("pipeline-%d", time.Now().UnixNano())
+	job := scheduler.Job{CollectionId: collectionId, CollectionPath: collectionId, ScheduleTime: time.Now().UnixNano()}
+	if err = db.QueryRow("INSERT INTO schedule(collection_id, collection_path, schedule_time, start_time) VALUES($1, $2, $3, $3) RETURNING schedule_id",
+		job.CollectionId, job.CollectionPath, job.ScheduleTime).Scan(&job.ScheduleId); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Exec("DELETE FROM schedule WHERE schedule_id=$1", job.ScheduleId)
+		db.Exec("DELETE FROM schedule_file WHERE schedule_id=$1", job.ScheduleId)
+		db.Exec("DELETE FROM processed_message WHERE schedule_id=$1", job.ScheduleId)
+		db.Exec("DELETE FROM metadata WHERE collection_id=$1", collectionId)
+		db.Exec("DELETE FROM s3data WHERE collection_id=$1", collectionId)
+	}()
+	for _, name := range []string{"data.json", "chart.png"} {
+		file := kafka.FileResource{Location: "file://" + filepath.Join(dir, name), Uri: "/" + collectionId + "/" + name}
+		if err = db.QueryRow("INSERT INTO schedule_file(schedule_id, uri, file_location) VALUES($1, $2, $3) RETURNING schedule_file_id",
+			job.ScheduleId, file.Uri, file.Location).Scan(&file.Id); err != nil {
+			t.Fatal(err)
+		}
+		job.Files = append(job.Files, file)
+	}
+
+	// every service joins its groups before the job is sent
+	bus := kafka.NewMemoryBus(2)
+	dataConsumer, _ := bus.NewConsumerGroup("publish-file", "publish-data")
+	defer dataConsumer.Close()
+	metadataConsumer, _ := bus.NewConsumerGroup("publish-file", "publish-metadata")
+	defer metadataConsumer.Close()
+	receiverConsumer, _ := bus.NewConsumerGroup("complete-file", "publish-receiver")
+	defer receiverConsumer.Close()
+	trackerConsumer, _ := bus.NewConsumerGroup("complete-file-flag", "publish-tracker")
+	defer trackerConsumer.Close()
+	completeConsumer, _ := bus.NewConsumerGroup("complete", "test")
+	defer completeConsumer.Close()
+
+	fileProducer := bus.NewProducer("publish-file")
+	deleteProducer := bus.NewProducer("publish-delete")
+	scheduler.Publish(job, fileProducer, deleteProducer, nil, nil)
+	fileProducer.Close()
+	deleteProducer.Close()
+
+	completeFileProducer := bus.NewAckProducer("complete-file")
+	defer completeFileProducer.Close()
+	completeFlagProducer := bus.NewAckProducer("complete-file-flag")
+	defer completeFlagProducer.Close()
+	content := &bucket{objects: make(map[string]string)}
+	for range job.Files {
+		handle(t, dataConsumer, func(msg kafka.Message) error {
+			return data.UploadFile(msg.GetData(), s3.S3Client{}, content, "content", completeFileProducer, completeFlagProducer, nil, "dry-run")
+		})
+		handle(t, metadataConsumer, func(msg kafka.Message) error {
+			return metadata.SendData(msg.GetData(), completeFileProducer, completeFlagProducer, s3.S3Client{}, nil, nil)
+		})
+	}
+
+	store, err := receiver.New(db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	completeProducer := bus.NewProducer("complete")
+	defer completeProducer.Close()
+	jobs, err := tracker.New(db, completeProducer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jobs.Close()
+	for range job.Files {
+		handle(t, receiverConsumer, func(msg kafka.Message) error {
+			return store.StoreData(msg.GetData())
+		})
+		handle(t, trackerConsumer, func(msg kafka.Message) error {
+			jobs.MarkFileComplete(msg.GetData())
+			return nil
+		})
+	}
+	jobs.CheckForCompletedJobs()
+
+	// other jobs in the database may have completed too
+	for {
+		var complete kafka.CollectionCompleteMessage
+		handle(t, completeConsumer, func(msg kafka.Message) error {
+			_, err := kafka.Decode(msg.GetData(), &complete)
+			return err
+		})
+		if complete.ScheduleId == job.ScheduleId {
+			if complete.CollectionId != collectionId {
+				t.Errorf("Test failed, got %+v", complete)
+			}
+			break
+		}
+	}
+
+	var metadataContent string
+	if err = db.QueryRow("SELECT content FROM metadata WHERE uri=$1", "/"+collectionId+"?lang=en").Scan(&metadataContent); err != nil || !strings.Contains(metadataContent, "bulletin") {
+		t.Errorf("Test failed, metadata %q: %v", metadataContent, err)
+	}
+	var location string
+	if err = db.QueryRow("SELECT s3 FROM s3data WHERE uri=$1", "/"+collectionId+"/chart.png").Scan(&location); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location, "s3://content/") || content.objects[strings.TrimPrefix(location, "s3://content/")] != "png" {
+		t.Errorf("Test failed, s3data %q not uploaded: %v", location, content.objects)
+	}
+}
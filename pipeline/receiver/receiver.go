@@ -0,0 +1,172 @@
+// Package receiver stores the content of published files in the web
+// database, for publish-receiver
+package receiver
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ONSdigital/dp-publish-pipeline/claimcheck"
+	"github.com/ONSdigital/dp-publish-pipeline/dedupe"
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+const (
+	s3Upsert = "INSERT INTO s3data(collection_id, uri, s3) VALUES($1, $2, $3) " +
+		"ON CONFLICT(uri) DO UPDATE " +
+		"SET (collection_id, s3) = ($1, $3)"
+	metaUpsert = "INSERT INTO metadata(collection_id, uri, content) VALUES($1, $2, $3) " +
+		"ON CONFLICT(uri) DO UPDATE " +
+		"SET (collection_id, content) = ($1, $3)"
+)
+
+// Receiver stores files in the web database: the location of those copied
+// to s3 (s3data), and the content of json files (metadata)
+type Receiver struct {
+	s3        *sql.Stmt
+	meta      *sql.Stmt
+	claims    *claimcheck.Store
+	processed *dedupe.Store
+	recorder  *rehearsal.Recorder
+}
+
+// New prepares a Receiver storing to db, which reads staged content from
+// claims, and records dry runs with recorder
+func New(db *sql.DB, claims *claimcheck.Store, recorder *rehearsal.Recorder) (*Receiver, error) {
+	r := &Receiver{claims: claims, recorder: recorder}
+	var err error
+	if r.s3, err = db.Prepare(s3Upsert); err != nil {
+		return nil, err
+	}
+	if r.meta, err = db.Prepare(metaUpsert); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if r.processed, err = dedupe.NewStore(db, "publish-receiver"); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close closes the receiver's statements and dedupe store, but not its database
+func (r *Receiver) Close() error {
+	r.s3.Close()
+	if r.meta != nil {
+		r.meta.Close()
+	}
+	if r.processed == nil {
+		return nil
+	}
+	return r.processed.Close()
+}
+
+// StoreData stores the content of a completed file, only returning an error
+// when staged content cannot (yet) be read, or the file cannot be stored (e.g.
+// while the database fails over), so that the message can be retried. A file
+// already stored (e.g. when kafka redelivers its message) is skipped. A file of
+// a dry run is only recorded.
+func (r *Receiver) StoreData(jsonMessage []byte) error {
+	var dataSet kafka.FileCompleteMessage
+	envelope, err := kafka.Decode(jsonMessage, &dataSet)
+	if err != nil {
+		log.ErrorC("Failed to parse json message", err, nil)
+		return nil
+	}
+	if dataSet.CollectionId == "" || dataSet.Uri == "" {
+		log.Error(fmt.Errorf("Unknown data from %v", dataSet), nil)
+		return nil
+	}
+	if err = r.claims.Resolve(&dataSet); err != nil {
+		return err
+	}
+	if dataSet.S3Location == "" && dataSet.FileContent == "" {
+		return nil
+	}
+	if dataSet.DryRun {
+		return rehearse(dataSet, r.recorder, kafka.GetCorrelationId(envelope))
+	}
+	key := dedupe.Key{ScheduleId: dataSet.ScheduleId, FileId: dataSet.FileId}
+	if _, err = r.processed.Apply(key, func(tx *sql.Tx) error {
+		if dataSet.S3Location != "" {
+			return addS3Data(dataSet, tx.Stmt(r.s3))
+		}
+		return addMetadata(dataSet, tx.Stmt(r.meta))
+	}); err != nil {
+		// nothing was marked as stored, so the message can be retried
+		return fmt.Errorf("Job %d Collection %q - Failed to store %s: %s", dataSet.ScheduleId, dataSet.CollectionId, dataSet.Uri, err)
+	}
+	return nil
+}
+
+func addS3Data(dataSet kafka.FileCompleteMessage, s3 *sql.Stmt) error {
+	if _, err := s3.Exec(dataSet.CollectionId,
+		resolveURI(dataSet.Uri),
+		dataSet.S3Location); err != nil {
+		return err
+	}
+	log.Trace(fmt.Sprintf("Job %d Collection %q Added S3 : %s", dataSet.ScheduleId, dataSet.CollectionId, dataSet.Uri), nil)
+	return nil
+}
+
+func addMetadata(dataSet kafka.FileCompleteMessage, meta *sql.Stmt) error {
+	lang := getLanguage(dataSet.Uri)
+	if _, err := meta.Exec(dataSet.CollectionId,
+		resolveURI(dataSet.Uri)+"?lang="+lang,
+		dataSet.FileContent); err != nil {
+		return err
+	}
+	log.Trace(fmt.Sprintf("Job %d Collection %q Added metadata : %s", dataSet.ScheduleId, dataSet.CollectionId, dataSet.Uri), nil)
+	return nil
+}
+
+// rehearse records the row that would have been stored for the file
+func rehearse(dataSet kafka.FileCompleteMessage, recorder *rehearsal.Recorder, correlationId string) error {
+	record := kafka.RehearsalMessage{ScheduleId: dataSet.ScheduleId, CollectionId: dataSet.CollectionId, Uri: dataSet.Uri}
+	if dataSet.S3Location != "" {
+		record.Action = "store-s3data"
+		record.Location = dataSet.S3Location
+		record.Detail = "s3data uri " + resolveURI(dataSet.Uri)
+	} else {
+		record.Action = "store-metadata"
+		record.Sha256 = rehearsal.Checksum([]byte(dataSet.FileContent))
+		record.Size = int64(len(dataSet.FileContent))
+		record.Detail = "metadata uri " + resolveURI(dataSet.Uri) + "?lang=" + getLanguage(dataSet.Uri)
+	}
+	if err := recorder.Record(record, correlationId); err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to record rehearsal of %s: %s", dataSet.ScheduleId, dataSet.CollectionId, dataSet.Uri, err)
+	}
+	log.Trace(fmt.Sprintf("Job %d Collection %q Rehearsed %s : %s", dataSet.ScheduleId, dataSet.CollectionId, record.Action, dataSet.Uri), nil)
+	return nil
+}
+
+func getLanguage(uri string) string {
+	if strings.HasSuffix(uri, "data_cy.json") {
+		return "cy"
+	}
+	return "en"
+}
+
+// Within the zebedee reader it builds the uri based of what it is given. Instead
+// of repeating this per HTTP request, postgrese stores the URI the website expects
+// So the content-api does not need to build the uri each time.
+// Examples :
+//
+//	File location                : URI
+//	data.json                    => / (Special case for root file)
+//	about/data.json              => /about
+//	timeseries/mmg/hhh/data.json => /timeseries/mmg/hhh
+//	trade/report/938438.json     => /trade/report/938438 (Special case for charts)
+func resolveURI(uri string) string {
+	if strings.HasSuffix(uri, "/data.json") || strings.HasSuffix(uri, "/data_cy.json") {
+		webURI := filepath.Dir(uri)
+		return webURI
+	} else if strings.HasSuffix(uri, ".json") {
+		return uri[:len(uri)-5]
+	}
+	return uri
+}
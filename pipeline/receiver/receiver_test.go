@@ -0,0 +1,53 @@
+package receiver
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+
+	_ "github.com/lib/pq"
+)
+
+func TestStoreDataLeavesUnstoredFileUncommitted(t *testing.T) {
+	db, err := sql.Open("postgres", "user=dp dbname=dp sslmode=disable")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skip("Local postgres database was not found")
+	}
+	store, err := New(db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	bus := kafka.NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("complete-file", "publish-receiver")
+	consumer.SetRetryPolicy(kafka.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	producer := bus.NewProducer("complete-file")
+	data, _ := producer.Encode(kafka.FileCompleteMessage{ScheduleId: 1, FileId: 2, CollectionId: "receiver-test", Uri: "/about/data.json", FileContent: `{"type":"static_page"}`}, "")
+	producer.Output <- data
+	producer.Close()
+
+	// as if the database had failed over
+	db.Close()
+	select {
+	case msg := <-consumer.Incoming:
+		attempts := 0
+		if err = consumer.Handle(msg, func(msg kafka.Message) error {
+			attempts++
+			return store.StoreData(msg.GetData())
+		}); err == nil || attempts != 2 {
+			t.Errorf("Test failed, expected the file retried then failed, got %d attempts, error %v", attempts, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, no complete-file message")
+	}
+	consumer.Close()
+	if lag := bus.Lag("complete-file", "publish-receiver"); lag != 1 {
+		t.Errorf("Test failed, expected the message left uncommitted, got lag %d", lag)
+	}
+}
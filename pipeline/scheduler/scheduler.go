@@ -0,0 +1,83 @@
+// Package scheduler sends the messages of a job launched by publish-scheduler
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// Job is a collection, scheduled to publish at ScheduleTime
+type Job struct {
+	ScheduleId     int64
+	CollectionId   string
+	CollectionPath string
+	ScheduleTime   int64
+	EncryptionKey  string
+	Files          []kafka.FileResource
+	UrisToDelete   []kafka.FileResource
+	DryRun         bool // rehearse, without changing the website
+}
+
+// Publish sends the job's files and deletes, stopping early if the job is aborted.
+// The embargo of each file is signed by signer (unless nil).
+func Publish(job Job, fileProducer, deleteProducer kafka.Producer, aborted *kafka.AbortedSchedules, signer *kafka.EmbargoSigner) {
+	if job.CollectionId == "" {
+		log.ErrorC("No collectionId", fmt.Errorf("job: %v", job), nil)
+		panic("No collectionId")
+	}
+
+	var data []byte
+	var err error
+	correlationId := kafka.NewCorrelationId()
+
+	// Send published files to the kafka topic
+	for i := 0; i < len(job.Files); i++ {
+		if aborted.Aborted(job.ScheduleId) {
+			log.Info(fmt.Sprintf("Job %d Collection %q aborted after sending %d of %d files", job.ScheduleId, job.CollectionId, i, len(job.Files)), log.Data{"correlationId": correlationId})
+			return
+		}
+		file := kafka.PublishFileMessage{
+			ScheduleId:     job.ScheduleId,
+			FileId:         job.Files[i].Id,
+			CollectionId:   job.CollectionId,
+			CollectionPath: job.CollectionPath,
+			EncryptionKey:  job.EncryptionKey,
+			FileLocation:   job.Files[i].Location,
+			Uri:            job.Files[i].Uri,
+			DryRun:         job.DryRun,
+			ScheduleTime:   job.ScheduleTime,
+		}
+		if file.EmbargoSignature, err = signer.Sign(file); err != nil {
+			log.ErrorC("failed to sign embargo", err, nil)
+			panic("failed to sign embargo")
+		}
+		if data, err = fileProducer.Encode(file, correlationId); err != nil {
+			log.ErrorC("failed to marshal", err, nil)
+			panic("failed to marshal")
+		}
+		fileProducer.Output <- data
+	}
+	log.Info(fmt.Sprintf("Job %d Collection %q sent %d files", job.ScheduleId, job.CollectionId, len(job.Files)), log.Data{"correlationId": correlationId})
+
+	// Send published deletes to the kafka topic
+	for i := 0; i < len(job.UrisToDelete); i++ {
+		if aborted.Aborted(job.ScheduleId) {
+			log.Info(fmt.Sprintf("Job %d Collection %q aborted after sending %d of %d deletes", job.ScheduleId, job.CollectionId, i, len(job.UrisToDelete)), nil)
+			return
+		}
+		if data, err = deleteProducer.Encode(kafka.PublishDeleteMessage{
+			ScheduleId:   job.ScheduleId,
+			DeleteId:     job.UrisToDelete[i].Id,
+			Uri:          job.UrisToDelete[i].Uri,
+			CollectionId: job.CollectionId,
+			DryRun:       job.DryRun,
+		}, correlationId); err != nil {
+			log.ErrorC("cannot marshal", err, nil)
+			panic(err)
+		}
+		deleteProducer.Output <- data
+	}
+	log.Info(fmt.Sprintf("Job %d Collection %q sent %d deletes", job.ScheduleId, job.CollectionId, len(job.UrisToDelete)), nil)
+}
@@ -0,0 +1,207 @@
+// Package tracker records the files and deletes of jobs as they complete (or
+// fail), and completes each job once all of its files and deletes are, for
+// publish-tracker
+package tracker
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/dedupe"
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+	"github.com/ONSdigital/dp-publish-pipeline/rehearsal"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+var statements = map[string]string{
+	"find-completed-jobs":   "SELECT schedule.schedule_id, (SELECT count(*) FROM schedule_delete WHERE schedule.schedule_id = schedule_delete.schedule_id AND schedule_delete.complete_time IS NULL) AS deletes_remaining, (SELECT count(*) FROM schedule_file WHERE schedule.schedule_id = schedule_file.schedule_id AND schedule_file.complete_time IS NULL) AS files_remaining FROM schedule WHERE complete_time is NULL AND abort_time IS NULL GROUP BY schedule.schedule_id",
+	"update-completed-file": "UPDATE schedule_file SET complete_time=$2 WHERE schedule_file_id=$1",
+	"update-failed-file":    "UPDATE schedule_file SET failed_time=$2, attempts=$3, failure=$4 WHERE schedule_file_id=$1 AND complete_time IS NULL",
+	"update-delete-file":    "UPDATE schedule_delete SET complete_time=$2 WHERE schedule_delete_id=$1",
+	"update-complete-job":   "UPDATE schedule SET complete_time=$2 WHERE schedule_id=$1 AND start_time IS NOT NULL AND complete_time IS NULL AND abort_time IS NULL RETURNING collection_id, start_time, dry_run",
+	"notify-change":         "SELECT pg_notify('schedule', $1)", // see publish-scheduler
+}
+
+// Tracker keeps the progress of jobs in the publish database, sending a
+// CollectionCompleteMessage for each job it completes. The completion of a
+// dry run is only recorded for its rehearsal, so nothing downstream acts on it.
+type Tracker struct {
+	db        *sql.DB
+	prepped   map[string]*sql.Stmt
+	processed *dedupe.Store
+	producer  kafka.Producer
+	recorder  *rehearsal.Recorder
+}
+
+// New prepares a Tracker of the jobs in db, which completes them with producer,
+// or (for dry runs) recorder
+func New(db *sql.DB, producer kafka.Producer, recorder *rehearsal.Recorder) (*Tracker, error) {
+	t := &Tracker{db: db, prepped: make(map[string]*sql.Stmt), producer: producer, recorder: recorder}
+	for tag, query := range statements {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("Could not prepare statement %s: %s", tag, err)
+		}
+		t.prepped[tag] = stmt
+	}
+	processed, err := dedupe.NewStore(db, "publish-tracker")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.processed = processed
+	return t, nil
+}
+
+// Close closes the tracker's statements and dedupe store, but not its database
+func (t *Tracker) Close() error {
+	for tag, stmt := range t.prepped {
+		if err := stmt.Close(); err != nil {
+			log.ErrorC("Could not close statement", err, log.Data{"tag": tag})
+		}
+	}
+	if t.processed == nil {
+		return nil
+	}
+	return t.processed.Close()
+}
+
+// CheckForCompletedJobs completes the jobs whose files and deletes have all
+// been completed (an aborted job is never complete)
+func (t *Tracker) CheckForCompletedJobs() {
+	rows, err := t.prepped["find-completed-jobs"].Query()
+	if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	defer rows.Close()
+
+	var scheduleId, deletesRemaining, filesRemaining sql.NullInt64
+	completedTime := time.Now().UnixNano()
+
+	for rows.Next() {
+		if err := rows.Scan(&scheduleId, &deletesRemaining, &filesRemaining); err != nil {
+			log.Error(err, nil)
+			panic(err)
+		}
+		if deletesRemaining.Int64 == 0 && filesRemaining.Int64 == 0 {
+			duration, collectionId, err := t.markJobComplete(scheduleId.Int64, completedTime)
+			if err != nil {
+				log.Error(err, nil)
+			} else {
+				log.Info(fmt.Sprintf("Job %d Collection %q completes in %s", scheduleId.Int64, collectionId, duration), nil)
+			}
+		}
+	}
+}
+
+func (t *Tracker) markJobComplete(scheduleId, completedTime int64) (time.Duration, string, error) {
+	var startTime sql.NullInt64
+	var collectionId sql.NullString
+	var dryRun bool
+	// the job is only left complete once its completion is encoded (or rehearsed),
+	// otherwise it is rolled back to be completed on a later check
+	tx, err := t.db.Begin()
+	if err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	res := tx.Stmt(t.prepped["update-complete-job"]).QueryRow(scheduleId, completedTime)
+	if err := res.Scan(&collectionId, &startTime, &dryRun); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return 0, "", fmt.Errorf("Job %d already complete (or aborted)?", scheduleId)
+		}
+		log.Error(err, nil)
+		panic(err)
+	}
+	// wake the scheduler, as jobs may have been held back for this one (notified on commit)
+	if _, err := tx.Stmt(t.prepped["notify-change"]).Exec(strconv.FormatInt(scheduleId, 10)); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+
+	duration := time.Duration(completedTime-startTime.Int64) * time.Nanosecond
+	var data []byte
+	if dryRun {
+		err = t.rehearseComplete(scheduleId, collectionId.String, duration)
+	} else if data, err = t.producer.Encode(kafka.CollectionCompleteMessage{ScheduleId: scheduleId, CollectionId: collectionId.String}, ""); err != nil {
+		err = fmt.Errorf("Job %d Collection %q - Failed to encode complete collection: %s", scheduleId, collectionId.String, err)
+	}
+	if err != nil {
+		tx.Rollback()
+		return duration, collectionId.String, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error(err, nil)
+		panic(err)
+	}
+	if data != nil {
+		t.producer.Output <- data
+	}
+
+	return duration, collectionId.String, nil
+}
+
+// rehearseComplete records the completion of a dry run, in place of its CollectionCompleteMessage
+func (t *Tracker) rehearseComplete(scheduleId int64, collectionId string, duration time.Duration) error {
+	if t.recorder == nil {
+		return fmt.Errorf("Job %d Collection %q - dry run complete, with no rehearsal to record it in", scheduleId, collectionId)
+	}
+	if err := t.recorder.Record(kafka.RehearsalMessage{ScheduleId: scheduleId, CollectionId: collectionId, Action: "complete",
+		Detail: fmt.Sprintf("in %s", duration)}, ""); err != nil {
+		return fmt.Errorf("Job %d Collection %q - Failed to record rehearsal of its completion: %s", scheduleId, collectionId, err)
+	}
+	return nil
+}
+
+// MarkFileComplete records a file (or delete) complete, skipping one already
+// marked complete, e.g. when kafka redelivers its message
+func (t *Tracker) MarkFileComplete(jsonMessage []byte) {
+	var file kafka.FileCompleteFlagMessage
+	if _, err := kafka.Decode(jsonMessage, &file); err != nil {
+		log.ErrorC("Failed to parse json message", err, log.Data{"json": jsonMessage})
+		return
+	}
+	if file.ScheduleId == 0 || (file.FileId == 0 && file.DeleteId == 0) {
+		log.Error(errors.New("Json message is missing fields"), log.Data{"json": string(jsonMessage)})
+		return
+	}
+
+	key := dedupe.Key{ScheduleId: file.ScheduleId, FileId: file.FileId, DeleteId: file.DeleteId}
+	if _, err := t.processed.Apply(key, func(tx *sql.Tx) error {
+		if file.FileId != 0 {
+			_, err := tx.Stmt(t.prepped["update-completed-file"]).Exec(file.FileId, time.Now().UnixNano())
+			return err
+		}
+		_, err := tx.Stmt(t.prepped["update-delete-file"]).Exec(file.DeleteId, time.Now().UnixNano())
+		return err
+	}); err != nil {
+		log.ErrorC("Could not update file", err, log.Data{"fileId": file.FileId, "deleteId": file.DeleteId})
+		panic(err)
+	}
+}
+
+// MarkFileFailed records a file which publish-data/publish-metadata gave up
+// on, leaving its job incomplete
+func (t *Tracker) MarkFileFailed(jsonMessage []byte) {
+	var file kafka.FileFailedMessage
+	if _, err := kafka.Decode(jsonMessage, &file); err != nil {
+		log.ErrorC("Failed to parse json message", err, log.Data{"json": jsonMessage})
+		return
+	}
+	if file.ScheduleId == 0 || file.FileId == 0 {
+		log.Error(errors.New("Json message is missing fields"), log.Data{"json": string(jsonMessage)})
+		return
+	}
+
+	if _, err := t.prepped["update-failed-file"].Exec(file.FileId, time.Now().UnixNano(), file.Attempts, file.Error); err != nil {
+		log.ErrorC("Could not update failed file", err, log.Data{"fileId": file.FileId})
+		panic(err)
+	}
+	log.Error(fmt.Errorf("Job %d Collection %q file %d failed after %d attempts: %s", file.ScheduleId, file.CollectionId, file.FileId, file.Attempts, file.Error), log.Data{"uri": file.Uri})
+}
@@ -0,0 +1,49 @@
+package tracker
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+
+	_ "github.com/lib/pq"
+)
+
+func TestUnrehearsedDryRunIsLeftIncomplete(t *testing.T) {
+	db, err := sql.Open("postgres", "user=dp dbname=dp sslmode=disable")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skip("Local postgres database was not found")
+	}
+	defer db.Close()
+
+	// no recorder, so the completion of the dry run cannot be rehearsed
+	jobs, err := New(db, kafka.NewMemoryBus(1).NewProducer("complete"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jobs.Close()
+
+	var scheduleId int64
+	collectionId := fmt.Sprintf("tracker-%d", time.Now().UnixNano())
+	if err = db.QueryRow("INSERT INTO schedule(collection_id, collection_path, schedule_time, start_time, dry_run) VALUES($1, $1, $2, $2, true) RETURNING schedule_id",
+		collectionId, time.Now().UnixNano()).Scan(&scheduleId); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM schedule WHERE schedule_id=$1", scheduleId)
+
+	if _, _, err = jobs.markJobComplete(scheduleId, time.Now().UnixNano()); err == nil {
+		t.Error("Test failed, expected the unrehearsed completion to fail")
+	}
+	var completeTime sql.NullInt64
+	if err = db.QueryRow("SELECT complete_time FROM schedule WHERE schedule_id=$1", scheduleId).Scan(&completeTime); err != nil {
+		t.Fatal(err)
+	}
+	if completeTime.Valid {
+		t.Errorf("Test failed, expected the job left incomplete, got complete_time %d", completeTime.Int64)
+	}
+}
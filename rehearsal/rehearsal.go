@@ -0,0 +1,42 @@
+// Package rehearsal records what the publishing services do, or would have
+// done, for the files and deletes of a dry run, so that a publish can be
+// rehearsed without changing the website. The records are sent to the
+// rehearsal topic, from which publish-scheduler stores them for its report.
+package rehearsal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+)
+
+// Recorder sends the records of a service
+type Recorder struct {
+	service  string
+	producer kafka.Producer
+}
+
+func NewRecorder(bus kafka.Bus, service, topic string) *Recorder {
+	return &Recorder{service: service, producer: bus.NewAckProducer(topic)}
+}
+
+// Record sends the record, once the broker has it, as from this service
+func (r *Recorder) Record(record kafka.RehearsalMessage, correlationId string) error {
+	record.Service = r.service
+	data, err := r.producer.Encode(record, correlationId)
+	if err != nil {
+		return err
+	}
+	return r.producer.Send(data)
+}
+
+func (r *Recorder) Close() error {
+	return r.producer.Close()
+}
+
+// Checksum is the hex sha256 of content, as recorded
+func Checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,32 @@
+package rehearsal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/kafka"
+)
+
+func TestRecordIsFromService(t *testing.T) {
+	bus := kafka.NewMemoryBus(1)
+	consumer, _ := bus.NewConsumerGroup("rehearsal", "test")
+	defer consumer.Close()
+	recorder := NewRecorder(bus, "publish-data", "rehearsal")
+	defer recorder.Close()
+	if err := recorder.Record(kafka.RehearsalMessage{ScheduleId: 1, CollectionId: "test0001", Action: "stage", Uri: "/gdp/chart.png", Sha256: Checksum([]byte("png"))}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-consumer.Incoming:
+		var record kafka.RehearsalMessage
+		if _, err := kafka.Decode(msg.GetData(), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Service != "publish-data" || record.Action != "stage" || len(record.Sha256) != 64 {
+			t.Errorf("Test failed, got %+v", record)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Test failed, no record sent")
+	}
+}
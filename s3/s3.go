@@ -1,6 +1,7 @@
 package s3
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"strings"
@@ -67,3 +68,18 @@ func (s3 *S3Client) AddObject(content, s3Location, collectionId string, schedule
 	s3.client.PutObject(s3.Bucket, s3Location, file, "application/octet-stream")
 	log.Trace(fmt.Sprintf("Job %d Collection %q filed %q to s3:%s", scheduleId, collectionId, s3Location, s3.Bucket), nil)
 }
+
+// PutObject stores content at location, returning any error
+func (s3 *S3Client) PutObject(location string, content []byte) error {
+	_, err := s3.client.PutObject(s3.Bucket, location, bytes.NewReader(content), "application/octet-stream")
+	return err
+}
+
+// StatObject returns the size of the object at location, or an error if it cannot be found
+func (s3 *S3Client) StatObject(location string) (int64, error) {
+	info, err := s3.client.StatObject(s3.Bucket, location)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
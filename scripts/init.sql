@@ -1,8 +1,13 @@
 DROP TABLE IF EXISTS schedule;
 DROP TABLE IF EXISTS schedule_file;
 DROP TABLE IF EXISTS schedule_delete;
+DROP TABLE IF EXISTS schedule_audit;
+DROP TABLE IF EXISTS schedule_dependency;
 DROP TABLE IF EXISTS metadata;
 DROP TABLE IF EXISTS s3data;
+DROP TABLE IF EXISTS processed_message;
+DROP TABLE IF EXISTS leader_lease;
+DROP TABLE IF EXISTS rehearsal;
 
 CREATE TABLE schedule (
     schedule_id         SERIAL PRIMARY KEY,
@@ -10,7 +15,16 @@ CREATE TABLE schedule (
     collection_path     varchar(128) NOT NULL,
     schedule_time       bigint NOT NULL,
     start_time          bigint,
-    complete_time       bigint
+    complete_time       bigint,
+    abort_time          bigint, -- set when aborted while publishing, it then never completes
+    held_time           bigint, -- set when first held back (when due) by an unmet dependency
+    flagged_time        bigint, -- set when held back for longer than the dependency timeout
+    calendar_uid        varchar(255), -- of the release calendar entry it was imported from, if any
+    awaiting_content    boolean NOT NULL DEFAULT false, -- imported, and yet to be given its files and deletes
+    validation_status   varchar(16), -- validated or invalid, once checked when scheduled
+    validation_time     bigint, -- when checked or, while pending, when claimed to be checked
+    validation_issues   text, -- why it is invalid, a line each
+    dry_run             boolean NOT NULL DEFAULT false -- only rehearse the publish, see rehearsal
 );
 
 CREATE TABLE schedule_file (
@@ -18,7 +32,10 @@ CREATE TABLE schedule_file (
     schedule_id         int,
     uri                 varchar(2048) NOT NULL,
     file_location       varchar(2048) NOT NULL,
-    complete_time       bigint
+    complete_time       bigint,
+    failed_time         bigint,
+    attempts            int,
+    failure             text
 );
 
 CREATE TABLE schedule_delete (
@@ -28,6 +45,27 @@ CREATE TABLE schedule_delete (
     complete_time       bigint
 );
 
+-- The collections which must have published before a schedule may start
+CREATE TABLE schedule_dependency (
+    schedule_id         int NOT NULL,
+    collection_id       varchar(128) NOT NULL,
+    PRIMARY KEY (schedule_id, collection_id)
+);
+
+-- A record of each change made to a schedule after it was stored: a
+-- reschedule, cancel, trigger or abort (old/new_schedule_time are NULL when not
+-- applicable). The schedule row itself is gone once cancelled.
+CREATE TABLE schedule_audit (
+    schedule_audit_id   SERIAL PRIMARY KEY,
+    schedule_id         int NOT NULL,
+    collection_id       varchar(128) NOT NULL,
+    action              varchar(32) NOT NULL,
+    source              varchar(32) NOT NULL,
+    old_schedule_time   bigint,
+    new_schedule_time   bigint,
+    audit_time          bigint NOT NULL
+);
+
 -- The following table is used to store metadata which contains all uris from
 -- the ONS website with links to the content location on the S3 bucket.
 --
@@ -43,3 +81,38 @@ CREATE TABLE metadata(id SERIAL PRIMARY KEY,
                       collection_id varchar(128) NOT NULL,
                       uri varchar(2048) NOT NULL UNIQUE,
                       content json NOT NULL);
+
+-- The keys of the messages each consumer (publish-tracker, publish-receiver)
+-- has applied, so that redelivered messages are skipped. A key has either a
+-- file_id or a delete_id (the other being 0). Rows are purged after the
+-- consumer's DEDUPE_RETENTION_HOURS.
+CREATE TABLE processed_message(consumer varchar(128) NOT NULL,
+                      schedule_id bigint NOT NULL,
+                      file_id bigint NOT NULL DEFAULT 0,
+                      delete_id bigint NOT NULL DEFAULT 0,
+                      applied_time bigint NOT NULL,
+                      PRIMARY KEY(consumer, schedule_id, file_id, delete_id));
+
+-- The lease by which one instance of a service (publish-scheduler) leads.
+-- The holder renews it before expiry_time (UnixNano, database time), after
+-- which another instance may take it.
+CREATE TABLE leader_lease(name varchar(64) PRIMARY KEY,
+                      holder varchar(255) NOT NULL,
+                      acquired_time bigint NOT NULL,
+                      expiry_time bigint NOT NULL);
+
+-- What each service did, or would have done, for the files and deletes of a
+-- dry run job (schedule.dry_run), as stored by publish-scheduler from the
+-- rehearsal topic. Actions are e.g. stage (publish-data), store-metadata
+-- (publish-receiver), delete (publish-deleter) and complete (publish-tracker).
+CREATE TABLE rehearsal(schedule_id bigint NOT NULL,
+                      collection_id varchar(128) NOT NULL,
+                      service varchar(64) NOT NULL,
+                      action varchar(64) NOT NULL,
+                      uri varchar(2048) NOT NULL,
+                      location text NOT NULL DEFAULT '',
+                      sha256 varchar(64) NOT NULL DEFAULT '',
+                      size bigint NOT NULL DEFAULT 0,
+                      detail text NOT NULL DEFAULT '',
+                      record_time bigint NOT NULL,
+                      PRIMARY KEY(schedule_id, service, action, uri));
@@ -0,0 +1,106 @@
+package shutdown
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ONSdigital/dp-publish-pipeline/utils"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// Graceful holds the steps a service takes to stop cleanly. A service should
+// select on Signals and, on receipt, call Shutdown.
+type Graceful struct {
+	Signals    chan os.Signal
+	service    string
+	timeout    time.Duration
+	steps      []step
+	mutex      sync.Mutex
+	interrupts []func()
+	// exit ends the service when it has not stopped by the deadline
+	exit func(code int)
+}
+
+type step struct {
+	name string
+	run  func() error
+}
+
+// New registers for SIGINT and SIGTERM, and reads the deadline for shutting
+// down from SHUTDOWN_TIMEOUT (in seconds, default 10)
+func New(service string) (*Graceful, error) {
+	timeout, err := utils.GetEnvironmentVariableInt("SHUTDOWN_TIMEOUT", 10)
+	if err != nil {
+		return nil, fmt.Errorf("Bad value for SHUTDOWN_TIMEOUT: %s", err)
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, syscall.SIGINT, syscall.SIGTERM)
+	g := &Graceful{
+		Signals: make(chan os.Signal, 1),
+		service: service,
+		timeout: time.Duration(timeout) * time.Second,
+		exit:    os.Exit,
+	}
+	go g.relay(received)
+	return g, nil
+}
+
+// OnSignal adds a function called as soon as a signal arrives, before it is
+// passed to Signals, to interrupt work (e.g. retries) which would keep the
+// service from reading Signals. It should not block.
+func (g *Graceful) OnSignal(interrupt func()) {
+	g.mutex.Lock()
+	g.interrupts = append(g.interrupts, interrupt)
+	g.mutex.Unlock()
+}
+
+// relay calls the OnSignal functions for each signal received, then passes it to Signals
+func (g *Graceful) relay(received <-chan os.Signal) {
+	for sig := range received {
+		g.mutex.Lock()
+		interrupts := g.interrupts
+		g.mutex.Unlock()
+		for _, interrupt := range interrupts {
+			interrupt()
+		}
+		select {
+		case g.Signals <- sig:
+		default:
+			// a signal is already waiting
+		}
+	}
+}
+
+// Add appends a step to those run (in the order added) by Shutdown
+func (g *Graceful) Add(name string, run func() error) {
+	g.steps = append(g.steps, step{name, run})
+}
+
+// Shutdown runs each step in turn. A failing step is logged and the next one
+// run. If the steps have not all completed by the deadline, the service exits.
+func (g *Graceful) Shutdown() {
+	log.Info(fmt.Sprintf("Stopping %s", g.service), log.Data{"timeout": g.timeout.String()})
+	done := make(chan bool)
+	go func() {
+		for _, s := range g.steps {
+			if err := s.run(); err != nil {
+				log.ErrorC("Shutdown step failed", err, log.Data{"step": s.name})
+				continue
+			}
+			log.Trace("Shutdown step complete", log.Data{"step": s.name})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info(fmt.Sprintf("Service %s stopped", g.service), nil)
+	case <-time.After(g.timeout):
+		log.Error(fmt.Errorf("Service %s did not stop within %s", g.service, g.timeout), nil)
+		g.exit(1)
+	}
+}
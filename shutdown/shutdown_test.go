@@ -0,0 +1,74 @@
+package shutdown
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownRunsStepsInOrder(t *testing.T) {
+	g, err := New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := false
+	g.exit = func(int) { exited = true }
+	var ran []string
+	g.Add("first", func() error { ran = append(ran, "first"); return nil })
+	g.Add("failing", func() error { ran = append(ran, "failing"); return errors.New("failed") })
+	g.Add("last", func() error { ran = append(ran, "last"); return nil })
+	g.Shutdown()
+	if !reflect.DeepEqual(ran, []string{"first", "failing", "last"}) || exited {
+		t.Errorf("Test failed, expected every step run in order without exiting, got %v (exited %v)", ran, exited)
+	}
+}
+
+func TestShutdownExitsAfterTimeout(t *testing.T) {
+	os.Setenv("SHUTDOWN_TIMEOUT", "0")
+	defer os.Unsetenv("SHUTDOWN_TIMEOUT")
+	g, err := New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitCode := -1
+	g.exit = func(code int) { exitCode = code }
+	stuck := make(chan bool)
+	defer close(stuck)
+	g.Add("stuck", func() error { <-stuck; return nil })
+	g.Shutdown()
+	if exitCode != 1 {
+		t.Errorf("Test failed, expected exit 1 at the deadline, got %d", exitCode)
+	}
+}
+
+func TestNewRejectsBadTimeout(t *testing.T) {
+	os.Setenv("SHUTDOWN_TIMEOUT", "soon")
+	defer os.Unsetenv("SHUTDOWN_TIMEOUT")
+	if _, err := New("test"); err == nil {
+		t.Error("Test failed, expected an error for a bad SHUTDOWN_TIMEOUT")
+	}
+}
+
+func TestOnSignalInterruptsBeforeSignalling(t *testing.T) {
+	g, err := New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted := make(chan bool, 1)
+	g.OnSignal(func() { interrupted <- true })
+	received := make(chan os.Signal)
+	go g.relay(received)
+	received <- syscall.SIGTERM
+	close(received)
+	select {
+	case sig := <-g.Signals:
+		if sig != syscall.SIGTERM || len(interrupted) != 1 {
+			t.Errorf("Test failed, expected an interrupt, then SIGTERM, got %v (interrupts %d)", sig, len(interrupted))
+		}
+	case <-time.After(time.Second):
+		t.Error("Test failed, signal not passed on")
+	}
+}